@@ -1,17 +1,28 @@
 package rafted
 
 import (
+    "context"
+    hsm "github.com/hhkbp2/go-hsm"
     cm "github.com/hhkbp2/rafted/comm"
     ev "github.com/hhkbp2/rafted/event"
     logging "github.com/hhkbp2/rafted/logging"
     ps "github.com/hhkbp2/rafted/persist"
     "io"
+    "sync/atomic"
+    "time"
 )
 
 type Notifiable interface {
     GetNotifyChan() <-chan ev.NotifyEvent
 }
 
+// Subscribable allows multiple consumers to receive notifies independently,
+// each with its own filter and buffer.
+type Subscribable interface {
+    Subscribe(capacity int, types ...hsm.EventType) *Subscription
+    Unsubscribe(subscription *Subscription)
+}
+
 type Backend interface {
     Send(event ev.RequestEvent)
     io.Closer
@@ -19,12 +30,37 @@ type Backend interface {
 }
 
 type HSMBackend struct {
+    config *Configuration
     local  Local
     peers  Peers
     server cm.Server
+    // set once the backend starts draining
+    draining int32
 }
 
+// Send passes event to local. The client requests are refused once
+// the backend starts draining. They're redirected to the leader if it's
+// another node, or responded with LeaderUnknownResponseEvent otherwise.
+// The subscriptions are served by the backend itself.
 func (self *HSMBackend) Send(event ev.RequestEvent) {
+    if event.Type() == ev.EventSubscribeRequest {
+        self.subscribe(event)
+        return
+    }
+    if (atomic.LoadInt32(&self.draining) == 1) &&
+        ev.IsClientRequestEvent(event.Type()) {
+
+        leader := self.local.GetLeader()
+        if ps.MultiAddrEqual(leader, nil) ||
+            ps.MultiAddrEqual(leader, self.local.GetLocalAddr()) {
+
+            event.SendResponse(ev.NewLeaderUnknownResponseEvent())
+        } else {
+            response := &ev.LeaderRedirectResponse{leader}
+            event.SendResponse(ev.NewLeaderRedirectResponseEvent(response))
+        }
+        return
+    }
     self.local.Send(event)
 }
 
@@ -32,13 +68,184 @@ func (self *HSMBackend) GetNotifyChan() <-chan ev.NotifyEvent {
     return self.local.Notifier().GetNotifyChan()
 }
 
+func (self *HSMBackend) Subscribe(
+    capacity int, types ...hsm.EventType) *Subscription {
+
+    return self.local.Notifier().Subscribe(capacity, types...)
+}
+
+func (self *HSMBackend) Unsubscribe(subscription *Subscription) {
+    self.local.Notifier().Unsubscribe(subscription)
+}
+
+// subscribe makes a subscription to the notifies for a remote subscriber,
+// which lasts until the subscriber cancels it or the backend is closed.
+func (self *HSMBackend) subscribe(event ev.RequestEvent) {
+    e, ok := event.(*ev.SubscribeRequestEvent)
+    hsm.AssertTrue(ok)
+    request := e.Request
+    notifier := self.local.Notifier()
+    subscription, response := notifier.SubscribeFrom(
+        request.Epoch, request.After, request.Capacity, request.Types...)
+    cancel := func() {
+        notifier.Unsubscribe(subscription)
+    }
+    event.SendResponse(ev.NewSubscribeResponseEvent(
+        response, subscription.GetMessageChan(), cancel))
+}
+
+// Close shuts down the backend. The components are closed one by one:
+// peers keep writing to servers and notifying through local until
+// they're closed. The log and config manager are synced at last,
+// after nothing writes to them any more, if they implement ps.Syncer.
 func (self *HSMBackend) Close() error {
-    toClose := make([]io.Closer, 0, 3)
-    toClose = append(toClose, self.server, self.peers, self.local)
-    ParallelClose(toClose)
-    return nil
+    self.peers.Close()
+    self.server.Close()
+    self.local.Close()
+    return self.sync()
+}
+
+func (self *HSMBackend) sync() error {
+    var err error
+    if syncer, ok := self.local.Log().(ps.Syncer); ok {
+        err = syncer.Sync()
+    }
+    if syncer, ok := self.local.ConfigManager().(ps.Syncer); ok {
+        if e := syncer.Sync(); e != nil && err == nil {
+            err = e
+        }
+    }
+    return err
+}
+
+// Drain stops the backend from accepting client requests, and waits for
+// the ones accepted to finish. A leader waits for all the log entries it
+// has started to be committed and applied, then transfers the leadership
+// and waits for another node to take over. Others wait for the committed
+// entries to be applied. It returns ctx.Err() if ctx is done before that.
+// The status is queried behind the requests queued already, so that
+// they're counted in.
+func (self *HSMBackend) Drain(ctx context.Context) error {
+    atomic.StoreInt32(&self.draining, 1)
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    status := self.local.QueryStatus()
+    if status == nil {
+        // fail to read the log, nothing would be applied
+        return nil
+    }
+    isLeader := (status.State == ev.RaftStateLeader)
+    toApply := status.CommittedIndex
+    if isLeader {
+        toApply = status.StartedIndex
+    }
+    applied := func() bool {
+        status := self.local.QueryStatus()
+        // a leader stepping down fails all its requests not committed
+        return (status == nil) || (status.LastAppliedIndex >= toApply) ||
+            (isLeader && (status.State != ev.RaftStateLeader))
+    }
+    if _, err := self.waitFor(ctx, applied, 0); err != nil {
+        return err
+    }
+    if !isLeader {
+        return nil
+    }
+    takenOver := func() bool {
+        leader := self.local.GetLeader()
+        return !ps.MultiAddrEqual(leader, nil) &&
+            ps.MultiAddrNotEqual(leader, self.local.GetLocalAddr())
+    }
+    // retry for every election timeout, in case the peer chosen fails
+    // to win the election
+    for {
+        reqEvent := ev.NewTransferLeadershipRequestEvent(
+            &ev.TransferLeadershipRequest{})
+        self.local.Send(reqEvent)
+        var event ev.Event
+        select {
+        case event = <-reqEvent.GetResponseChan():
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+        e, ok := event.(*ev.ClientResponseEvent)
+        if !ok || !e.Response.Success {
+            // not leader any more, or no peer to transfer to
+            return nil
+        }
+        ok, err := self.waitFor(ctx, takenOver, self.config.ElectionTimeout)
+        if ok || (err != nil) {
+            return err
+        }
+    }
+}
+
+// waitFor checks cond every DrainPollInterval until it's true, and returns
+// whether it is. It gives up once timeout passes, or ctx is done with
+// ctx.Err(). A zero timeout never passes.
+func (self *HSMBackend) waitFor(
+    ctx context.Context,
+    cond func() bool,
+    timeout time.Duration) (bool, error) {
+
+    clock := self.config.Clock
+    start := clock.Now()
+    for !cond() {
+        if (timeout > 0) && TimeExpire(clock, start, timeout) {
+            return false, nil
+        }
+        select {
+        case <-clock.After(self.config.DrainPollInterval):
+        case <-ctx.Done():
+            return false, ctx.Err()
+        }
+    }
+    return true, nil
+}
+
+// State returns the raft state and the current term of the backend.
+// It only queries the local hsm, so it never waits on the peers
+// of a leader.
+func (self *HSMBackend) State() (ev.RaftStateType, uint64) {
+    return RaftStateOf(self.local.QueryState()), self.local.GetCurrentTerm()
+}
+
+// StateID returns the id of the hsm state the local node is in,
+// e.g. StatePersistErrorID.
+func (self *HSMBackend) StateID() string {
+    return self.local.QueryState()
 }
 
+// CloseHSMBackends shuts down the backends running in the same process
+// together. Each kind of components is closed for all of them at a time,
+// since the peers of one backend keep writing to the servers of
+// the others until they're closed.
+func CloseHSMBackends(backends ...*HSMBackend) error {
+    closeAll := func(get func(backend *HSMBackend) io.Closer) {
+        toClose := make([]io.Closer, 0, len(backends))
+        for _, backend := range backends {
+            toClose = append(toClose, get(backend))
+        }
+        ParallelClose(toClose)
+    }
+    closeAll(func(backend *HSMBackend) io.Closer { return backend.peers })
+    closeAll(func(backend *HSMBackend) io.Closer { return backend.server })
+    closeAll(func(backend *HSMBackend) io.Closer { return backend.local })
+    var err error
+    for _, backend := range backends {
+        if e := backend.sync(); e != nil && err == nil {
+            err = e
+        }
+    }
+    return err
+}
+
+// GenServerFunc creates the server of a backend, which passes all
+// the requests it receives to handler.
+type GenServerFunc func(
+    handler cm.RequestEventHandler, logger logging.Logger) (cm.Server, error)
+
 func NewHSMBackend(
     config *Configuration,
     localAddr *ps.ServerAddress,
@@ -48,6 +255,38 @@ func NewHSMBackend(
     log ps.Log,
     logger logging.Logger) (*HSMBackend, error) {
 
+    client := cm.NewSocketClient(config.CommPoolSize, config.CommClientTimeout)
+    genServer := func(
+        handler cm.RequestEventHandler,
+        logger logging.Logger) (cm.Server, error) {
+
+        return cm.NewSocketServer(
+            cm.FirstAddr(bindAddr), config.CommServerTimeout, handler, logger)
+    }
+    return NewHSMBackendWith(
+        config,
+        localAddr,
+        configManager,
+        stateMachine,
+        log,
+        client,
+        genServer,
+        logger)
+}
+
+// NewHSMBackendWith creates a backend which talks to its peers
+// with client and serves them with the server created by genServer,
+// so that it could run on any transport.
+func NewHSMBackendWith(
+    config *Configuration,
+    localAddr *ps.ServerAddress,
+    configManager ps.ConfigManager,
+    stateMachine ps.StateMachine,
+    log ps.Log,
+    client cm.Client,
+    genServer GenServerFunc,
+    logger logging.Logger) (*HSMBackend, error) {
+
     local, err := NewLocalManager(
         config,
         localAddr,
@@ -58,7 +297,6 @@ func NewHSMBackend(
     if err != nil {
         return nil, err
     }
-    client := cm.NewSocketClient(config.CommPoolSize, config.CommClientTimeout)
     getLoggerForPeer := func(_ ps.MultiAddr) logging.Logger {
         return logger
     }
@@ -68,19 +306,21 @@ func NewHSMBackend(
         local,
         getLoggerForPeer,
         logger)
+    object := &HSMBackend{
+        config: config,
+        local:  local,
+        peers:  peerManager,
+    }
     eventHandler := func(event ev.RequestEvent) {
-        local.Send(event)
+        object.Send(event)
     }
-    server, err := cm.NewSocketServer(
-        cm.FirstAddr(bindAddr), config.CommServerTimeout, eventHandler, logger)
+    server, err := genServer(eventHandler, logger)
     if err != nil {
-        // TODO add cleanup
+        peerManager.Close()
+        local.Close()
         return nil, err
     }
     server.Serve()
-    return &HSMBackend{
-        local:  local,
-        peers:  peerManager,
-        server: server,
-    }, nil
+    object.server = server
+    return object, nil
 }
@@ -14,9 +14,6 @@ import (
 type GenHSMBackendFunc func(
     addr *ps.ServerAddress, slice *ps.ServerAddressSlice) (*HSMBackend, error)
 
-type GenServerFunc func(
-    handler cm.RequestEventHandler, logger logging.Logger) (cm.Server, error)
-
 func NewTestBackendWith(
     localAddr *ps.ServerAddress,
     addrSlice *ps.ServerAddressSlice,
@@ -59,8 +56,13 @@ func NewTestBackendWith(
         getLoggerForPeer,
         peerManagerLogger)
 
+    object := &HSMBackend{
+        config: testConfig,
+        local:  local,
+        peers:  peerManager,
+    }
     eventHandler := func(event ev.RequestEvent) {
-        local.Send(event)
+        object.Send(event)
     }
     serverLogger := logging.GetLogger("Server" + "#" + localAddr.String())
     server, err := genServer(eventHandler, serverLogger)
@@ -68,11 +70,7 @@ func NewTestBackendWith(
         return nil, err
     }
     server.Serve()
-    object := &HSMBackend{
-        local:  local,
-        peers:  peerManager,
-        server: server,
-    }
+    object.server = server
     return object, nil
 }
 
@@ -217,5 +215,6 @@ func TestRPCBackendContruction(t *testing.T) {
 func TestXXX(t *testing.T) {
     assert.Equal(t, hsm.EventType(100+4), ev.EventTerm)
     assert.Equal(t, hsm.EventType(1049), ev.EventClientUser)
+    assert.Equal(t, hsm.EventType(149), ev.EventQueryNodeStatusRequest)
     assert.Equal(t, hsm.EventType(1060), ev.EventNotifyPersistError)
 }
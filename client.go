@@ -1,7 +1,9 @@
 package rafted
 
 import (
+    "context"
     "errors"
+    "fmt"
     hsm "github.com/hhkbp2/go-hsm"
     cm "github.com/hhkbp2/rafted/comm"
     ev "github.com/hhkbp2/rafted/event"
@@ -9,6 +11,8 @@ import (
     ps "github.com/hhkbp2/rafted/persist"
     rt "github.com/hhkbp2/rafted/retry"
     "io"
+    "sync"
+    "sync/atomic"
     "time"
 )
 
@@ -21,20 +25,51 @@ var (
     InMemberChange            = errors.New("in member change")
     PersistError              = errors.New("persist error")
     InvalidResponseType       = errors.New("invalid response type")
+    InvalidConfig             = errors.New("invalid config")
+    NodeNotFresh              = errors.New("node not fresh")
+    Closed                    = errors.New("closed")
+    Overloaded                = errors.New("overloaded")
 )
 
+// LeaderChangedError is returned when the leader steps down before
+// the request is committed, so whether the request takes effect is
+// unknown. Leader is the hint of the new leader, nil if it's unknown.
+type LeaderChangedError struct {
+    Leader *ps.ServerAddress
+}
+
+func (self *LeaderChangedError) Error() string {
+    if self.Leader == nil {
+        return "leader changed, new leader unknown"
+    }
+    return fmt.Sprintf("leader changed, new leader: %s", self.Leader)
+}
+
+// Client is the interface to operate a raft cluster. The methods with
+// a Context suffix are the same as the ones without, except that they
+// return the error of ctx once ctx is done, and the deadline of ctx
+// travels in the data requests for the leader to drop them after it.
 type Client interface {
     Append(data []byte) (result []byte, err error)
     ReadOnly(data []byte) (result []byte, err error)
     GetConfig() (conf *ps.Config, err error)
     ChangeConfig(conf *ps.Config) error
+    QueryNodeStatus() (*ev.QueryNodeStatusResponse, error)
+    AppendContext(ctx context.Context, data []byte) (result []byte, err error)
+    ReadOnlyContext(
+        ctx context.Context, data []byte) (result []byte, err error)
+    GetConfigContext(ctx context.Context) (conf *ps.Config, err error)
+    ChangeConfigContext(ctx context.Context, conf *ps.Config) error
+    QueryNodeStatusContext(
+        ctx context.Context) (*ev.QueryNodeStatusResponse, error)
     io.Closer
 }
 
 type SimpleClient struct {
-    backend Backend
-    timeout time.Duration
-    retry   rt.Retry
+    backend  Backend
+    timeout  time.Duration
+    retry    rt.Retry
+    pipeline *pipeline
 }
 
 func NewSimpleClient(
@@ -44,46 +79,113 @@ func NewSimpleClient(
         backend: backend,
         timeout: timeout,
         retry:   retry,
+        pipeline: newPipeline(
+            backend, timeout, retry, retry, dummyRedirectHandler, nil),
     }
 }
 
 func (self *SimpleClient) Append(data []byte) (result []byte, err error) {
+    return self.AppendContext(context.Background(), data)
+}
+
+func (self *SimpleClient) AppendContext(
+    ctx context.Context, data []byte) (result []byte, err error) {
+
     request := &ev.ClientAppendRequest{
-        Data: data,
+        Data:    data,
+        Timeout: TimeoutOf(ctx),
     }
     reqEvent := ev.NewClientAppendRequestEvent(request)
-    return doRequest(self.backend, reqEvent, self.timeout, self.retry,
+    return doRequest(ctx, self.backend, reqEvent, self.timeout, self.retry,
         self.retry, dummyRedirectHandler)
 }
 
 func (self *SimpleClient) ReadOnly(data []byte) (result []byte, err error) {
+    return self.ReadOnlyContext(context.Background(), data)
+}
+
+func (self *SimpleClient) ReadOnlyContext(
+    ctx context.Context, data []byte) (result []byte, err error) {
+
     request := &ev.ClientReadOnlyRequest{
-        Data: data,
+        Data:    data,
+        Timeout: TimeoutOf(ctx),
     }
     reqEvent := ev.NewClientReadOnlyRequestEvent(request)
-    return doRequest(self.backend, reqEvent, self.timeout, self.retry,
+    return doRequest(ctx, self.backend, reqEvent, self.timeout, self.retry,
         self.retry, dummyRedirectHandler)
+}
 
+func (self *SimpleClient) AppendAsync(data []byte) *Future {
+    return self.AppendAsyncContext(context.Background(), data)
+}
+
+func (self *SimpleClient) AppendAsyncContext(
+    ctx context.Context, data []byte) *Future {
+
+    request := &ev.ClientAppendRequest{
+        Data:    data,
+        Timeout: TimeoutOf(ctx),
+    }
+    return self.pipeline.Submit(ctx, ev.NewClientAppendRequestEvent(request))
+}
+
+func (self *SimpleClient) ReadOnlyAsync(data []byte) *Future {
+    return self.ReadOnlyAsyncContext(context.Background(), data)
+}
+
+func (self *SimpleClient) ReadOnlyAsyncContext(
+    ctx context.Context, data []byte) *Future {
+
+    request := &ev.ClientReadOnlyRequest{
+        Data:    data,
+        Timeout: TimeoutOf(ctx),
+    }
+    return self.pipeline.Submit(
+        ctx, ev.NewClientReadOnlyRequestEvent(request))
 }
 
 func (self *SimpleClient) GetConfig() (conf *ps.Config, err error) {
+    return self.GetConfigContext(context.Background())
+}
+
+func (self *SimpleClient) GetConfigContext(
+    ctx context.Context) (conf *ps.Config, err error) {
+
     // TODO add impl
     return nil, nil
 }
 
 func (self *SimpleClient) ChangeConfig(conf *ps.Config) error {
+    return self.ChangeConfigContext(context.Background(), conf)
+}
+
+func (self *SimpleClient) ChangeConfigContext(
+    ctx context.Context, conf *ps.Config) error {
+
     request := &ev.ClientChangeConfigRequest{
         Conf: conf,
     }
     reqEvent := ev.NewClientChangeConfigRequestEvent(request)
-    _, err := doRequest(self.backend, reqEvent, self.timeout, self.retry,
-        self.retry, dummyRedirectHandler)
+    _, err := doRequest(ctx, self.backend, reqEvent, self.timeout,
+        self.retry, self.retry, dummyRedirectHandler)
     return err
 }
 
+func (self *SimpleClient) QueryNodeStatus() (
+    *ev.QueryNodeStatusResponse, error) {
+
+    return self.QueryNodeStatusContext(context.Background())
+}
+
+func (self *SimpleClient) QueryNodeStatusContext(
+    ctx context.Context) (*ev.QueryNodeStatusResponse, error) {
+
+    return queryNodeStatus(ctx, self.backend, self.timeout, self.retry)
+}
+
 func (self *SimpleClient) Close() error {
-    // empty body
-    return nil
+    return self.pipeline.Close()
 }
 
 type RedirectClient struct {
@@ -91,10 +193,11 @@ type RedirectClient struct {
     retry         rt.Retry
     redirectRetry rt.Retry
 
-    backend Backend
-    client  cm.Client
-    server  cm.Server
-    logger  logging.Logger
+    backend  Backend
+    client   cm.Client
+    server   cm.Server
+    pipeline *pipeline
+    logger   logging.Logger
 }
 
 func NewRedirectClient(
@@ -106,7 +209,7 @@ func NewRedirectClient(
     server cm.Server,
     logger logging.Logger) *RedirectClient {
 
-    return &RedirectClient{
+    object := &RedirectClient{
         timeout:       timeout,
         retry:         retry,
         redirectRetry: redirectRetry,
@@ -115,6 +218,12 @@ func NewRedirectClient(
         server:        server,
         logger:        logger,
     }
+    // forward the redirected async requests on pipelined connections
+    // if client supports
+    pipeliner, _ := client.(cm.Pipeliner)
+    object.pipeline = newPipeline(backend, timeout, retry, redirectRetry,
+        object.genRedirectHandler(), pipeliner)
+    return object
 }
 
 func (self *RedirectClient) Start() error {
@@ -123,73 +232,301 @@ func (self *RedirectClient) Start() error {
 }
 
 func (self *RedirectClient) Close() error {
+    self.pipeline.Close()
     return self.server.Close()
 }
 
 func (self *RedirectClient) genRedirectHandler() RedirectResponseHandler {
     return func(
+        ctx context.Context,
         respEvent *ev.LeaderRedirectResponseEvent,
         reqEvent ev.RequestEvent) (ev.Event, error) {
 
         self.logger.Debug("redirect to leader: %s", respEvent.Response.Leader)
-        return self.client.CallRPCTo(respEvent.Response.Leader, reqEvent)
+        return self.client.CallRPCToContext(
+            ctx, respEvent.Response.Leader, reqEvent)
     }
 }
 
 func (self *RedirectClient) Append(data []byte) (result []byte, err error) {
+    return self.AppendContext(context.Background(), data)
+}
+
+func (self *RedirectClient) AppendContext(
+    ctx context.Context, data []byte) (result []byte, err error) {
+
     request := &ev.ClientAppendRequest{
-        Data: data,
+        Data:    data,
+        Timeout: TimeoutOf(ctx),
     }
     reqEvent := ev.NewClientAppendRequestEvent(request)
-    return doRequest(self.backend, reqEvent, self.timeout, self.retry,
+    return doRequest(ctx, self.backend, reqEvent, self.timeout, self.retry,
         self.redirectRetry, self.genRedirectHandler())
 }
 
 func (self *RedirectClient) ReadOnly(data []byte) (result []byte, err error) {
+    return self.ReadOnlyContext(context.Background(), data)
+}
+
+func (self *RedirectClient) ReadOnlyContext(
+    ctx context.Context, data []byte) (result []byte, err error) {
+
     request := &ev.ClientReadOnlyRequest{
-        Data: data,
+        Data:    data,
+        Timeout: TimeoutOf(ctx),
     }
     reqEvent := ev.NewClientReadOnlyRequestEvent(request)
-    return doRequest(self.backend, reqEvent, self.timeout, self.retry,
+    return doRequest(ctx, self.backend, reqEvent, self.timeout, self.retry,
         self.redirectRetry, self.genRedirectHandler())
 }
 
+func (self *RedirectClient) AppendAsync(data []byte) *Future {
+    return self.AppendAsyncContext(context.Background(), data)
+}
+
+func (self *RedirectClient) AppendAsyncContext(
+    ctx context.Context, data []byte) *Future {
+
+    request := &ev.ClientAppendRequest{
+        Data:    data,
+        Timeout: TimeoutOf(ctx),
+    }
+    return self.pipeline.Submit(ctx, ev.NewClientAppendRequestEvent(request))
+}
+
+func (self *RedirectClient) ReadOnlyAsync(data []byte) *Future {
+    return self.ReadOnlyAsyncContext(context.Background(), data)
+}
+
+func (self *RedirectClient) ReadOnlyAsyncContext(
+    ctx context.Context, data []byte) *Future {
+
+    request := &ev.ClientReadOnlyRequest{
+        Data:    data,
+        Timeout: TimeoutOf(ctx),
+    }
+    return self.pipeline.Submit(
+        ctx, ev.NewClientReadOnlyRequestEvent(request))
+}
+
 func (self *RedirectClient) GetConfig() (conf *ps.Config, err error) {
+    return self.GetConfigContext(context.Background())
+}
+
+func (self *RedirectClient) GetConfigContext(
+    ctx context.Context) (conf *ps.Config, err error) {
+
     // TODO add impl
     return nil, nil
 }
 
 func (self *RedirectClient) ChangeConfig(conf *ps.Config) error {
+    return self.ChangeConfigContext(context.Background(), conf)
+}
+
+func (self *RedirectClient) ChangeConfigContext(
+    ctx context.Context, conf *ps.Config) error {
+
     request := &ev.ClientChangeConfigRequest{
         Conf: conf,
     }
     reqEvent := ev.NewClientChangeConfigRequestEvent(request)
-    _, err := doRequest(self.backend, reqEvent, self.timeout, self.retry,
-        self.redirectRetry, self.genRedirectHandler())
+    _, err := doRequest(ctx, self.backend, reqEvent, self.timeout,
+        self.retry, self.redirectRetry, self.genRedirectHandler())
     return err
 }
 
+// QueryNodeStatus returns the status of the local node, which is
+// never redirected to leader.
+func (self *RedirectClient) QueryNodeStatus() (
+    *ev.QueryNodeStatusResponse, error) {
+
+    return self.QueryNodeStatusContext(context.Background())
+}
+
+func (self *RedirectClient) QueryNodeStatusContext(
+    ctx context.Context) (*ev.QueryNodeStatusResponse, error) {
+
+    return queryNodeStatus(ctx, self.backend, self.timeout, self.retry)
+}
+
+// RemoteSubscription receives the notifies of a remote node through
+// subscriber. Once the notify stream breaks, it subscribes again with
+// the backoff of retry, and resumes right after the last notify received,
+// so that the notifies in the meantime are still received as long as
+// the node keeps them in history. It ends once retry gives up.
+type RemoteSubscription struct {
+    subscriber cm.Subscriber
+    target     ps.MultiAddr
+    retry      rt.Retry
+    request    ev.SubscribeRequest
+    outChan    chan ev.NotifyEvent
+    missed     uint64
+    err        error
+    ctx        context.Context
+    cancel     context.CancelFunc
+    group      *sync.WaitGroup
+    logger     logging.Logger
+}
+
+// NewRemoteSubscription subscribes to the notifies of types of target,
+// or all the notifies if no type is specified. Target keeps at most
+// capacity notifies not sent yet, zero for its default capacity.
+func NewRemoteSubscription(
+    subscriber cm.Subscriber,
+    target ps.MultiAddr,
+    retry rt.Retry,
+    logger logging.Logger,
+    capacity int,
+    types ...hsm.EventType) *RemoteSubscription {
+
+    ctx, cancel := context.WithCancel(context.Background())
+    object := &RemoteSubscription{
+        subscriber: subscriber,
+        target:     target,
+        retry:      retry,
+        request: ev.SubscribeRequest{
+            Types:    types,
+            Capacity: capacity,
+        },
+        outChan: make(chan ev.NotifyEvent, 0),
+        ctx:     ctx,
+        cancel:  cancel,
+        group:   &sync.WaitGroup{},
+        logger:  logger,
+    }
+    object.Start()
+    return object
+}
+
+func (self *RemoteSubscription) Start() {
+    self.group.Add(1)
+    go func() {
+        defer self.group.Done()
+        defer close(self.outChan)
+        for {
+            var stream cm.NotifyStream
+            subscribe := func() error {
+                response, s, err := self.subscriber.Subscribe(
+                    self.ctx, self.target, &self.request)
+                if err != nil {
+                    self.logger.Warning("fail to subscribe to: %s, error: %s",
+                        self.target, err)
+                    return err
+                }
+                if response.Missed {
+                    atomic.AddUint64(&self.missed, 1)
+                }
+                self.request.Follow(response)
+                stream = s
+                return nil
+            }
+            if err := self.retry.DoContext(self.ctx, subscribe); err != nil {
+                if self.ctx.Err() == nil {
+                    self.err = err
+                }
+                return
+            }
+            if !self.receive(stream) {
+                return
+            }
+        }
+    }()
+}
+
+// receive passes the notifies from stream until it breaks. It returns
+// false if the subscription is closed.
+func (self *RemoteSubscription) receive(stream cm.NotifyStream) bool {
+    defer stream.Close()
+    for {
+        message, err := stream.Recv()
+        if err == cm.ErrorNotifyMissed {
+            atomic.AddUint64(&self.missed, 1)
+            continue
+        } else if err != nil {
+            if self.ctx.Err() != nil {
+                return false
+            }
+            self.logger.Warning("notify stream from: %s breaks, error: %s",
+                self.target, err)
+            return true
+        }
+        self.request.Receive(message)
+        event := message.Event()
+        if event == nil {
+            // unknown to this version
+            continue
+        }
+        select {
+        case self.outChan <- event:
+        case <-self.ctx.Done():
+            return false
+        }
+    }
+}
+
+// GetNotifyChan returns the channel of the notifies, which is closed
+// once the subscription ends.
+func (self *RemoteSubscription) GetNotifyChan() <-chan ev.NotifyEvent {
+    return self.outChan
+}
+
+// Missed returns how many times some notifies are found lost, for
+// the remote node doesn't keep them in history any more, or it restarts.
+func (self *RemoteSubscription) Missed() uint64 {
+    return atomic.LoadUint64(&self.missed)
+}
+
+// Err returns the error that retry gives up with, once the notify
+// channel is closed. It's nil if the subscription is closed.
+func (self *RemoteSubscription) Err() error {
+    return self.err
+}
+
+func (self *RemoteSubscription) Close() error {
+    self.cancel()
+    self.group.Wait()
+    return nil
+}
+
 func sendToBackend(
+    ctx context.Context,
     backend Backend,
     reqEvent ev.RequestEvent,
     timeout time.Duration) (event ev.Event, err error) {
 
     backend.Send(reqEvent)
-    timeChan := time.After(timeout)
+    return recvFromBackend(ctx, reqEvent, timeout)
+}
+
+// recvFromBackend waits for the response of reqEvent which is
+// sent already.
+func recvFromBackend(
+    ctx context.Context,
+    reqEvent ev.RequestEvent,
+    timeout time.Duration) (event ev.Event, err error) {
+
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
     select {
     case event := <-reqEvent.GetResponseChan():
         return event, nil
-    case <-timeChan:
+    case <-timer.C:
         return nil, Timeout
+    case <-ctx.Done():
+        return nil, ctx.Err()
     }
 }
 
 type RedirectResponseHandler func(
-    *ev.LeaderRedirectResponseEvent, ev.RequestEvent) (ev.Event, error)
+    context.Context,
+    *ev.LeaderRedirectResponseEvent,
+    ev.RequestEvent) (ev.Event, error)
 
 type InavaliableResponseHandler func(ev.Event, ev.RequestEvent) ([]byte, error)
 
 func doRequest(
+    ctx context.Context,
     backend Backend,
     reqEvent ev.RequestEvent,
     timeout time.Duration,
@@ -197,9 +534,26 @@ func doRequest(
     redirectRetry rt.Retry,
     redirectHandler RedirectResponseHandler) ([]byte, error) {
 
+    send := func() (ev.Event, error) {
+        return sendToBackend(ctx, backend, reqEvent, timeout)
+    }
+    return doRequestWith(
+        ctx, send, reqEvent, retry, redirectRetry, redirectHandler)
+}
+
+// doRequestWith is the same as doRequest except that the request is
+// sent by send, so that it could go to any node besides the local one.
+func doRequestWith(
+    ctx context.Context,
+    send func() (ev.Event, error),
+    reqEvent ev.RequestEvent,
+    retry rt.Retry,
+    redirectRetry rt.Retry,
+    redirectHandler RedirectResponseHandler) ([]byte, error) {
+
     resultChan := make(chan []byte, 1)
     fn := func() error {
-        respEvent, err := sendToBackend(backend, reqEvent, timeout)
+        respEvent, err := send()
         if err != nil {
             return err
         }
@@ -207,29 +561,83 @@ func doRequest(
             redirect := func() error {
                 e, ok := respEvent.(*ev.LeaderRedirectResponseEvent)
                 hsm.AssertTrue(ok)
-                respEvent, err = redirectHandler(e, reqEvent)
+                respEvent, err = redirectHandler(ctx, e, reqEvent)
                 return err
             }
-            err = redirectRetry.Do(redirect)
+            err = redirectRetry.DoContext(ctx, redirect)
             if err != nil {
                 return err
             }
         }
+        result, err := resultOf(respEvent)
+        if err != nil {
+            return err
+        }
+        resultChan <- result
+        return nil
+    }
+
+    err := retry.DoContext(ctx, fn)
+    if err != nil {
+        return nil, err
+    }
+    result := <-resultChan
+    return result, nil
+}
+
+// resultOf maps the response of a data request to its result.
+func resultOf(respEvent ev.Event) ([]byte, error) {
+    switch respEvent.Type() {
+    case ev.EventClientResponse:
+        e, ok := respEvent.(*ev.ClientResponseEvent)
+        hsm.AssertTrue(ok)
+        if e.Response.Success {
+            return e.Response.Data, nil
+        }
+        return nil, Failure
+    case ev.EventLeaderUnknownResponse:
+        return nil, LeaderUnknown
+    case ev.EventLeaderUnsyncResponse:
+        return nil, LeaderUnsync
+    case ev.EventLeaderInMemberChangeResponse:
+        return nil, InMemberChange
+    case ev.EventLeaderChangedResponse:
+        e, ok := respEvent.(*ev.LeaderChangedResponseEvent)
+        hsm.AssertTrue(ok)
+        return nil, &LeaderChangedError{
+            Leader: e.Response.Leader,
+        }
+    case ev.EventOverloadedResponse:
+        return nil, Overloaded
+    case ev.EventDeadlineExceededResponse:
+        return nil, context.DeadlineExceeded
+    case ev.EventPersistErrorResponse:
+        return nil, PersistError
+    default:
+        return nil, InvalidResponseType
+    }
+}
+
+func queryNodeStatus(
+    ctx context.Context,
+    backend Backend,
+    timeout time.Duration,
+    retry rt.Retry) (*ev.QueryNodeStatusResponse, error) {
+
+    resultChan := make(chan *ev.QueryNodeStatusResponse, 1)
+    fn := func() error {
+        request := &ev.QueryNodeStatusRequest{}
+        reqEvent := ev.NewQueryNodeStatusRequestEvent(request)
+        respEvent, err := sendToBackend(ctx, backend, reqEvent, timeout)
+        if err != nil {
+            return err
+        }
         switch respEvent.Type() {
-        case ev.EventClientResponse:
-            e, ok := respEvent.(*ev.ClientResponseEvent)
+        case ev.EventQueryNodeStatusResponse:
+            e, ok := respEvent.(*ev.QueryNodeStatusResponseEvent)
             hsm.AssertTrue(ok)
-            if e.Response.Success {
-                resultChan <- e.Response.Data
-                return nil
-            }
-            return Failure
-        case ev.EventLeaderUnknownResponse:
-            return LeaderUnknown
-        case ev.EventLeaderUnsyncResponse:
-            return LeaderUnsync
-        case ev.EventLeaderInMemberChangeResponse:
-            return InMemberChange
+            resultChan <- e.Response
+            return nil
         case ev.EventPersistErrorResponse:
             return PersistError
         default:
@@ -237,7 +645,7 @@ func doRequest(
         }
     }
 
-    err := retry.Do(fn)
+    err := retry.DoContext(ctx, fn)
     if err != nil {
         return nil, err
     }
@@ -246,6 +654,7 @@ func doRequest(
 }
 
 func dummyRedirectHandler(
+    _ context.Context,
     respEvent *ev.LeaderRedirectResponseEvent,
     _ ev.RequestEvent) (ev.Event, error) {
 
@@ -1,7 +1,9 @@
 package rafted
 
 import (
+    "context"
     "errors"
+    "fmt"
     hsm "github.com/hhkbp2/go-hsm"
     cm "github.com/hhkbp2/rafted/comm"
     ev "github.com/hhkbp2/rafted/event"
@@ -9,6 +11,8 @@ import (
     ps "github.com/hhkbp2/rafted/persist"
     rt "github.com/hhkbp2/rafted/retry"
     "github.com/hhkbp2/testify/assert"
+    "github.com/hhkbp2/testify/require"
+    "sync"
     "testing"
     "time"
 )
@@ -261,3 +265,575 @@ func TestRedirectClientRedirection(t *testing.T) {
     assert.Equal(t, 1, invokedCount1)
     assert.Equal(t, 1, invokedCount2)
 }
+
+// MockHoldBackend holds the requests it receives, for the test to
+// response them later.
+type MockHoldBackend struct {
+    events chan ev.RequestEvent
+}
+
+func NewMockHoldBackend(size int) *MockHoldBackend {
+    return &MockHoldBackend{
+        events: make(chan ev.RequestEvent, size),
+    }
+}
+
+func (self *MockHoldBackend) Send(event ev.RequestEvent) {
+    self.events <- event
+}
+
+func (self *MockHoldBackend) Close() error {
+    // empty body
+    return nil
+}
+
+func (self *MockHoldBackend) GetNotifyChan() <-chan ev.NotifyEvent {
+    // dummy implementation
+    return make(<-chan ev.NotifyEvent)
+}
+
+func getTestAsyncData(size int) [][]byte {
+    data := make([][]byte, 0, size)
+    for i := 0; i < size; i++ {
+        data = append(data, []byte(fmt.Sprintf("data%d", i)))
+    }
+    return data
+}
+
+func TestSimpleClientAsync(t *testing.T) {
+    backend := NewMockBackend()
+    timeout := testConfig.ClientTimeout
+    retry := rt.NewOnceRetry(time.Sleep, time.Second*1)
+    client := NewSimpleClient(backend, timeout, retry)
+
+    future := client.AppendAsync(testData)
+    result, err := future.Wait()
+    assert.Nil(t, err)
+    assert.Equal(t, testData, result)
+    select {
+    case <-future.Done():
+    default:
+        assert.True(t, false, "future should be done")
+    }
+    future = client.ReadOnlyAsync(testData)
+    r := <-future.ResultChan()
+    assert.Nil(t, r.Error)
+    assert.Equal(t, testData, r.Result)
+    // callbacks registered after completion are called right away
+    called := false
+    future.OnComplete(func(result []byte, err error) {
+        called = true
+        assert.Equal(t, testData, result)
+    })
+    assert.True(t, called)
+
+    assert.Nil(t, client.Close())
+    _, err = client.AppendAsync(testData).Wait()
+    assert.Equal(t, Closed, err)
+}
+
+func TestSimpleClientAsyncPipelining(t *testing.T) {
+    size := 100
+    backend := NewMockHoldBackend(size)
+    timeout := testConfig.ClientTimeout
+    retry := rt.NewOnceRetry(time.Sleep, time.Second*1)
+    client := NewSimpleClient(backend, timeout, retry)
+    defer client.Close()
+
+    data := getTestAsyncData(size)
+    var lock sync.Mutex
+    completed := make([]int, 0, size)
+    futures := make([]*Future, 0, size)
+    for i := 0; i < size; i++ {
+        future := client.AppendAsync(data[i])
+        index := i
+        future.OnComplete(func(result []byte, err error) {
+            lock.Lock()
+            defer lock.Unlock()
+            assert.Nil(t, err)
+            assert.Equal(t, data[index], result)
+            completed = append(completed, index)
+        })
+        futures = append(futures, future)
+    }
+    // all the requests are sent before any response, in submission order,
+    // and responsed in the reverse order
+    events := make([]ev.RequestEvent, 0, size)
+    for i := 0; i < size; i++ {
+        event := <-backend.events
+        e, ok := event.(*ev.ClientAppendRequestEvent)
+        require.True(t, ok)
+        assert.Equal(t, data[i], e.Request.Data)
+        events = append(events, event)
+    }
+    for i := size - 1; i >= 0; i-- {
+        e, _ := events[i].(*ev.ClientAppendRequestEvent)
+        response := &ev.ClientResponse{
+            Success: true,
+            Data:    e.Request.Data,
+        }
+        events[i].SendResponse(ev.NewClientResponseEvent(response))
+    }
+    for _, future := range futures {
+        _, err := future.Wait()
+        assert.Nil(t, err)
+    }
+    // the futures complete in submission order
+    lock.Lock()
+    defer lock.Unlock()
+    require.Equal(t, size, len(completed))
+    for i := 0; i < size; i++ {
+        assert.Equal(t, i, completed[i])
+    }
+}
+
+func TestRedirectClientAsyncRedirection(t *testing.T) {
+    testRegister.Reset()
+    addrSlice := ps.SetupMemoryMultiAddrSlice(2)
+    backend1 := NewMockBackend2(
+        func(event ev.RequestEvent) ev.Event {
+            response := &ev.LeaderRedirectResponse{
+                Leader: addrSlice.Addresses[1],
+            }
+            return ev.NewLeaderRedirectResponseEvent(response)
+        })
+    redirectClient1, err := setupTestMemoryRedirectClient(
+        addrSlice.Addresses[0], backend1)
+    require.Nil(t, err)
+    defer redirectClient1.Close()
+
+    received := make([][]byte, 0)
+    backend2 := NewMockBackend2(
+        func(event ev.RequestEvent) ev.Event {
+            e, ok := event.(*ev.ClientAppendRequestEvent)
+            hsm.AssertTrue(ok)
+            received = append(received, e.Request.Data)
+            response := &ev.ClientResponse{
+                Success: true,
+                Data:    e.Request.Data,
+            }
+            return ev.NewClientResponseEvent(response)
+        })
+    redirectClient2, err := setupTestMemoryRedirectClient(
+        addrSlice.Addresses[1], backend2)
+    require.Nil(t, err)
+    defer redirectClient2.Close()
+
+    size := 20
+    data := getTestAsyncData(size)
+    futures := make([]*Future, 0, size)
+    for i := 0; i < size; i++ {
+        futures = append(futures, redirectClient1.AppendAsync(data[i]))
+    }
+    for i, future := range futures {
+        result, err := future.Wait()
+        assert.Nil(t, err)
+        assert.Equal(t, data[i], result)
+    }
+    // the leader sees the redirected requests in submission order
+    assert.Equal(t, data, received)
+}
+
+func testRedirectClientAsyncPipelinedForwarding(
+    t *testing.T,
+    addrSlice *ps.ServerAddressSlice,
+    genRedirectClient GenRedirectClientFunc) {
+
+    backend1 := NewMockBackend2(
+        func(event ev.RequestEvent) ev.Event {
+            response := &ev.LeaderRedirectResponse{
+                Leader: addrSlice.Addresses[1],
+            }
+            return ev.NewLeaderRedirectResponseEvent(response)
+        })
+    redirectClient1, err := genRedirectClient(
+        addrSlice.Addresses[0], backend1)
+    require.Nil(t, err)
+    defer redirectClient1.Close()
+
+    size := cm.MaxPipelinedRequests + 10
+    backend2 := NewMockHoldBackend(size)
+    redirectClient2, err := genRedirectClient(
+        addrSlice.Addresses[1], backend2)
+    require.Nil(t, err)
+    defer redirectClient2.Close()
+
+    data := getTestAsyncData(size)
+    futures := make([]*Future, 0, size)
+    for i := 0; i < size; i++ {
+        futures = append(futures, redirectClient1.AppendAsync(data[i]))
+    }
+    respond := func(event ev.RequestEvent) {
+        e, ok := event.(*ev.ClientAppendRequestEvent)
+        require.True(t, ok)
+        response := &ev.ClientResponse{
+            Success: true,
+            Data:    e.Request.Data,
+        }
+        event.SendResponse(ev.NewClientResponseEvent(response))
+    }
+    // a full window of requests are forwarded before any response,
+    // in submission order, but no more
+    events := make([]ev.RequestEvent, 0, size)
+    for i := 0; i < cm.MaxPipelinedRequests; i++ {
+        select {
+        case event := <-backend2.events:
+            e, ok := event.(*ev.ClientAppendRequestEvent)
+            require.True(t, ok)
+            assert.Equal(t, data[i], e.Request.Data)
+            events = append(events, event)
+        case <-time.After(testConfig.ClientTimeout):
+            require.True(t, false, "requests not pipelined")
+        }
+    }
+    select {
+    case <-backend2.events:
+        assert.True(t, false, "too many requests in flight")
+    case <-time.After(testConfig.ClientTimeout / 10):
+    }
+    for _, event := range events {
+        respond(event)
+    }
+    for i := cm.MaxPipelinedRequests; i < size; i++ {
+        event := <-backend2.events
+        e, ok := event.(*ev.ClientAppendRequestEvent)
+        require.True(t, ok)
+        assert.Equal(t, data[i], e.Request.Data)
+        respond(event)
+    }
+    for i, future := range futures {
+        result, err := future.Wait()
+        assert.Nil(t, err)
+        assert.Equal(t, data[i], result)
+    }
+}
+
+func TestRedirectClientAsyncPipelinedForwarding(t *testing.T) {
+    testRegister.Reset()
+    testRedirectClientAsyncPipelinedForwarding(
+        t, ps.SetupMemoryMultiAddrSlice(2), setupTestMemoryRedirectClient)
+    testRedirectClientAsyncPipelinedForwarding(
+        t, ps.SetupSocketMultiAddrSlice(2), setupTestSocketRedirectClient)
+}
+
+func TestRedirectClientAsyncPipelineRetry(t *testing.T) {
+    testRegister.Reset()
+    addrSlice := ps.SetupMemoryMultiAddrSlice(2)
+    backend1 := NewMockBackend2(
+        func(event ev.RequestEvent) ev.Event {
+            response := &ev.LeaderRedirectResponse{
+                Leader: addrSlice.Addresses[1],
+            }
+            return ev.NewLeaderRedirectResponseEvent(response)
+        })
+    redirectClient1, err := setupTestMemoryRedirectClient(
+        addrSlice.Addresses[0], backend1)
+    require.Nil(t, err)
+    defer redirectClient1.Close()
+
+    size := 8
+    backend2 := NewMockHoldBackend(size)
+    redirectClient2, err := setupTestMemoryRedirectClient(
+        addrSlice.Addresses[1], backend2)
+    require.Nil(t, err)
+    defer redirectClient2.Close()
+
+    data := getTestAsyncData(size)
+    var lock sync.Mutex
+    completed := make([]int, 0, size)
+    futures := make([]*Future, 0, size)
+    for i := 0; i < size; i++ {
+        future := redirectClient1.AppendAsync(data[i])
+        index := i
+        future.OnComplete(func(result []byte, err error) {
+            lock.Lock()
+            defer lock.Unlock()
+            completed = append(completed, index)
+        })
+        futures = append(futures, future)
+    }
+    received := make([][]byte, 0)
+    next := func() ev.RequestEvent {
+        event := <-backend2.events
+        e, ok := event.(*ev.ClientAppendRequestEvent)
+        require.True(t, ok)
+        received = append(received, e.Request.Data)
+        return event
+    }
+    respond := func(event ev.RequestEvent) {
+        e, _ := event.(*ev.ClientAppendRequestEvent)
+        response := &ev.ClientResponse{
+            Success: true,
+            Data:    e.Request.Data,
+        }
+        event.SendResponse(ev.NewClientResponseEvent(response))
+    }
+    // the request in the middle fails, after the ones behind it
+    // are forwarded already
+    failedIndex := 3
+    events := make([]ev.RequestEvent, 0, size)
+    for i := 0; i < size; i++ {
+        events = append(events, next())
+    }
+    for i, event := range events {
+        if i == failedIndex {
+            event.SendResponse(ev.NewOverloadedResponseEvent())
+            continue
+        }
+        respond(event)
+    }
+    // the failed one and all the ones after it are retried one by one
+    for i := failedIndex; i < size; i++ {
+        respond(next())
+    }
+    for i, future := range futures {
+        result, err := future.Wait()
+        assert.Nil(t, err)
+        assert.Equal(t, data[i], result)
+    }
+    expected := append(append([][]byte{}, data...), data[failedIndex:]...)
+    assert.Equal(t, expected, received)
+    lock.Lock()
+    defer lock.Unlock()
+    require.Equal(t, size, len(completed))
+    for i := 0; i < size; i++ {
+        assert.Equal(t, i, completed[i])
+    }
+}
+
+func TestSimpleClientAsyncContext(t *testing.T) {
+    backend := NewMockHoldBackend(10)
+    timeout := testConfig.ClientTimeout
+    retry := rt.NewOnceRetry(time.Sleep, time.Second*1)
+    client := NewSimpleClient(backend, timeout, retry)
+    defer client.Close()
+
+    // a request with ctx done already isn't sent at all
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    _, err := client.AppendAsyncContext(ctx, testData).Wait()
+    assert.Equal(t, context.Canceled, err)
+    assert.Equal(t, 0, len(backend.events))
+    // the time left before the deadline of ctx travels in the request,
+    // which fails once ctx is done
+    ctx, cancel = context.WithTimeout(context.Background(), timeout/10)
+    defer cancel()
+    future := client.ReadOnlyAsyncContext(ctx, testData)
+    event := <-backend.events
+    e, ok := event.(*ev.ClientReadOnlyRequestEvent)
+    require.True(t, ok)
+    assert.True(t, e.Request.Timeout > 0)
+    assert.True(t, e.Request.Timeout <= timeout/10)
+    _, err = future.Wait()
+    assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestSimpleClientContext(t *testing.T) {
+    backend := NewMockHoldBackend(10)
+    timeout := testConfig.ClientTimeout
+    retry := rt.NewOnceRetry(time.Sleep, time.Second*1)
+    client := NewSimpleClient(backend, timeout, retry)
+    defer client.Close()
+
+    // the time left before the deadline of ctx travels in the request
+    ctx, cancel := context.WithTimeout(context.Background(), timeout/10)
+    defer cancel()
+    start := time.Now()
+    _, err := client.AppendContext(ctx, testData)
+    assert.Equal(t, context.DeadlineExceeded, err)
+    assert.True(t, time.Since(start) < timeout)
+    event := <-backend.events
+    e, ok := event.(*ev.ClientAppendRequestEvent)
+    require.True(t, ok)
+    assert.True(t, e.Request.Timeout > 0)
+    assert.True(t, e.Request.Timeout <= timeout/10)
+    // a canceled ctx aborts the pending wait
+    ctx, cancel = context.WithCancel(context.Background())
+    go func() {
+        <-backend.events
+        cancel()
+    }()
+    _, err = client.ReadOnlyContext(ctx, testData)
+    assert.Equal(t, context.Canceled, err)
+    // requests without deadline never expire
+    go func() {
+        event := <-backend.events
+        e, ok := event.(*ev.ClientAppendRequestEvent)
+        hsm.AssertTrue(ok)
+        assert.Equal(t, time.Duration(0), e.Request.Timeout)
+        response := &ev.ClientResponse{
+            Success: true,
+            Data:    e.Request.Data,
+        }
+        event.SendResponse(ev.NewClientResponseEvent(response))
+    }()
+    result, err := client.Append(testData)
+    assert.Nil(t, err)
+    assert.Equal(t, testData, result)
+}
+
+func TestFutureWaitContext(t *testing.T) {
+    backend := NewMockHoldBackend(10)
+    timeout := testConfig.ClientTimeout
+    retry := rt.NewOnceRetry(time.Sleep, time.Second*1)
+    client := NewSimpleClient(backend, timeout, retry)
+    defer client.Close()
+
+    future := client.AppendAsync(testData)
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    _, err := future.WaitContext(ctx)
+    assert.Equal(t, context.Canceled, err)
+    // the request goes on after the wait is canceled
+    event := <-backend.events
+    response := &ev.ClientResponse{
+        Success: true,
+        Data:    testData,
+    }
+    event.SendResponse(ev.NewClientResponseEvent(response))
+    result, err := future.WaitContext(context.Background())
+    assert.Nil(t, err)
+    assert.Equal(t, testData, result)
+}
+
+func TestSimpleClientLeaderChanged(t *testing.T) {
+    leader := ps.RandomMemoryMultiAddr()
+    backend := NewMockBackend2(
+        func(event ev.RequestEvent) ev.Event {
+            response := &ev.LeaderChangedResponse{
+                Leader: leader,
+            }
+            return ev.NewLeaderChangedResponseEvent(response)
+        })
+    timeout := testConfig.ClientTimeout
+    retry := rt.NewOnceRetry(time.Sleep, time.Second*1)
+    client := NewSimpleClient(backend, timeout, retry)
+    defer client.Close()
+
+    _, err := client.Append(testData)
+    e, ok := err.(*LeaderChangedError)
+    require.True(t, ok)
+    assert.Equal(t, leader, e.Leader)
+}
+
+// mockNotifyStream passes messages, and breaks after them. It waits for
+// ctx to be done if it has no message at all.
+type mockNotifyStream struct {
+    ctx      context.Context
+    messages []*ev.NotifyMessage
+    broken   bool
+}
+
+func (self *mockNotifyStream) Recv() (*ev.NotifyMessage, error) {
+    if len(self.messages) > 0 {
+        message := self.messages[0]
+        self.messages = self.messages[1:]
+        return message, nil
+    }
+    if self.broken {
+        return nil, errors.New("stream broken")
+    }
+    <-self.ctx.Done()
+    return nil, self.ctx.Err()
+}
+
+func (self *mockNotifyStream) Close() error {
+    return nil
+}
+
+// mockSubscriber serves the subscriptions from a history of commit
+// notifies, as if they are all made after the subscription, and breaks
+// every stream after a batch of notifies.
+type mockSubscriber struct {
+    epoch    uint64
+    size     uint64
+    batch    uint64
+    requests []ev.SubscribeRequest
+    lock     sync.Mutex
+}
+
+func (self *mockSubscriber) Subscribe(
+    ctx context.Context,
+    target ps.MultiAddr,
+    request *ev.SubscribeRequest) (
+    *ev.SubscribeResponse, cm.NotifyStream, error) {
+
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.requests = append(self.requests, *request)
+    stream := &mockNotifyStream{ctx: ctx}
+    for seq := request.After + 1; seq <= self.size; seq++ {
+        if uint64(len(stream.messages)) == self.batch {
+            break
+        }
+        event := ev.NewNotifyCommitEvent(1, seq)
+        stream.messages = append(
+            stream.messages, ev.NewNotifyMessage(seq, event))
+    }
+    stream.broken = len(stream.messages) > 0
+    response := &ev.SubscribeResponse{
+        Epoch: self.epoch,
+    }
+    return response, stream, nil
+}
+
+func (self *mockSubscriber) Requests() []ev.SubscribeRequest {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return append(make([]ev.SubscribeRequest, 0), self.requests...)
+}
+
+func TestRemoteSubscriptionResume(t *testing.T) {
+    subscriber := &mockSubscriber{
+        epoch: 7,
+        size:  5,
+        batch: 2,
+    }
+    retry := rt.NewNTimesRetry(time.Sleep, 3, 0)
+    logger := logging.GetLogger("test remote subscription")
+    subscription := NewRemoteSubscription(
+        subscriber, ps.RandomMemoryMultiAddr(), retry, logger, 0,
+        ev.EventNotifyCommit)
+    // the stream breaks after every batch, and nothing is skipped
+    // when it's subscribed again
+    for i := uint64(1); i <= subscriber.size; i++ {
+        select {
+        case event := <-subscription.GetNotifyChan():
+            e, ok := event.(*ev.NotifyCommitEvent)
+            require.True(t, ok)
+            assert.Equal(t, i, e.LogIndex)
+        case <-time.After(time.Second):
+            require.True(t, false, "notify not received")
+        }
+    }
+    assert.Nil(t, subscription.Close())
+    assert.Nil(t, subscription.Err())
+    assert.Equal(t, uint64(0), subscription.Missed())
+
+    requests := subscriber.Requests()
+    require.True(t, len(requests) >= 3)
+    for i, request := range requests[:3] {
+        assert.Equal(t, []hsm.EventType{ev.EventNotifyCommit}, request.Types)
+        if i == 0 {
+            assert.Equal(t, uint64(0), request.Epoch)
+            assert.Equal(t, uint64(0), request.After)
+            continue
+        }
+        assert.Equal(t, subscriber.epoch, request.Epoch)
+        assert.Equal(t, uint64(i)*subscriber.batch, request.After)
+    }
+}
+
+func TestSimpleClientDeadlineExceeded(t *testing.T) {
+    backend := NewMockBackend2(
+        func(event ev.RequestEvent) ev.Event {
+            return ev.NewDeadlineExceededResponseEvent()
+        })
+    timeout := testConfig.ClientTimeout
+    retry := rt.NewOnceRetry(time.Sleep, time.Second*1)
+    client := NewSimpleClient(backend, timeout, retry)
+    defer client.Close()
+
+    _, err := client.Append(testData)
+    assert.Equal(t, context.DeadlineExceeded, err)
+}
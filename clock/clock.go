@@ -0,0 +1,66 @@
+package clock
+
+import (
+    "time"
+)
+
+// Timer is a single shot timer created by a Clock.
+type Timer interface {
+    // Chan returns the channel on which the fire time is delivered.
+    Chan() <-chan time.Time
+    // Stop prevents the timer from firing. It returns false if the timer
+    // has already fired or been stopped.
+    Stop() bool
+}
+
+// Clock is the source of time for all tickers and timeout checks
+// in this module. It could be replaced by a virtual clock to drive
+// a cluster in simulated time.
+type Clock interface {
+    Now() time.Time
+    After(d time.Duration) <-chan time.Time
+    NewTimer(d time.Duration) Timer
+    // Fork returns a clock with the same time source, whose timers are
+    // labeled with the specified name. The name is used to order
+    // simultaneous timers in a deterministic way.
+    Fork(name string) Clock
+}
+
+// SystemClock is a Clock backed by the wall clock of the OS.
+type SystemClock struct{}
+
+func NewSystemClock() *SystemClock {
+    return &SystemClock{}
+}
+
+func (self *SystemClock) Now() time.Time {
+    return time.Now()
+}
+
+func (self *SystemClock) After(d time.Duration) <-chan time.Time {
+    return time.After(d)
+}
+
+func (self *SystemClock) NewTimer(d time.Duration) Timer {
+    return &systemTimer{time.NewTimer(d)}
+}
+
+func (self *SystemClock) Fork(_ string) Clock {
+    return self
+}
+
+type systemTimer struct {
+    timer *time.Timer
+}
+
+func (self *systemTimer) Chan() <-chan time.Time {
+    return self.timer.C
+}
+
+func (self *systemTimer) Stop() bool {
+    return self.timer.Stop()
+}
+
+var (
+    DefaultClock Clock = NewSystemClock()
+)
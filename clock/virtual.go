@@ -0,0 +1,224 @@
+package clock
+
+import (
+    "container/heap"
+    "sync"
+    "time"
+)
+
+// VirtualClock is a Clock whose time only moves when it's advanced
+// explicitly. Timers fire one at a time in the order of
+// (deadline, name, creation), so that a run driven by a virtual clock
+// could be replayed exactly.
+type VirtualClock struct {
+    now      time.Time
+    seq      uint64
+    activity uint64
+    timers   virtualTimerHeap
+    lock     sync.Mutex
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+    return &VirtualClock{
+        now:    start,
+        timers: make(virtualTimerHeap, 0),
+    }
+}
+
+func (self *VirtualClock) Now() time.Time {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.activity++
+    return self.now
+}
+
+func (self *VirtualClock) After(d time.Duration) <-chan time.Time {
+    return self.newTimer("", d).ch
+}
+
+func (self *VirtualClock) NewTimer(d time.Duration) Timer {
+    return self.newTimer("", d)
+}
+
+func (self *VirtualClock) Fork(name string) Clock {
+    return &virtualClockView{
+        clock: self,
+        name:  name,
+    }
+}
+
+func (self *VirtualClock) newTimer(name string, d time.Duration) *virtualTimer {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.activity++
+    self.seq++
+    timer := &virtualTimer{
+        clock:    self,
+        name:     name,
+        deadline: self.now.Add(d),
+        seq:      self.seq,
+        ch:       make(chan time.Time, 1),
+        index:    -1,
+    }
+    if d <= 0 {
+        // fire immediately as the system clock does
+        timer.ch <- self.now
+        return timer
+    }
+    heap.Push(&self.timers, timer)
+    return timer
+}
+
+func (self *VirtualClock) stopTimer(timer *virtualTimer) bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.activity++
+    if timer.index < 0 {
+        return false
+    }
+    heap.Remove(&self.timers, timer.index)
+    return true
+}
+
+// Activity returns a counter which increases on every call to this clock.
+// It could be used to detect whether the users of this clock are idle.
+func (self *VirtualClock) Activity() uint64 {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.activity
+}
+
+// Pending returns the number of timers which haven't fired yet.
+func (self *VirtualClock) Pending() int {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return len(self.timers)
+}
+
+// Next returns the deadline and name of the next timer to fire.
+func (self *VirtualClock) Next() (time.Time, string, bool) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if len(self.timers) == 0 {
+        return time.Time{}, "", false
+    }
+    timer := self.timers[0]
+    return timer.deadline, timer.name, true
+}
+
+// Step moves the time forward to the deadline of the next timer and fires it.
+// It returns the name of the fired timer, or false if there is no timer.
+func (self *VirtualClock) Step() (string, bool) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if len(self.timers) == 0 {
+        return "", false
+    }
+    timer := heap.Pop(&self.timers).(*virtualTimer)
+    self.fire(timer)
+    return timer.name, true
+}
+
+// Advance moves the time forward by d, firing all the timers
+// whose deadlines are passed in order. It returns the number of fired timers.
+func (self *VirtualClock) Advance(d time.Duration) int {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    end := self.now.Add(d)
+    count := 0
+    for len(self.timers) > 0 && !self.timers[0].deadline.After(end) {
+        timer := heap.Pop(&self.timers).(*virtualTimer)
+        self.fire(timer)
+        count++
+    }
+    self.now = end
+    return count
+}
+
+func (self *VirtualClock) fire(timer *virtualTimer) {
+    if timer.deadline.After(self.now) {
+        self.now = timer.deadline
+    }
+    self.activity++
+    timer.ch <- self.now
+}
+
+type virtualClockView struct {
+    clock *VirtualClock
+    name  string
+}
+
+func (self *virtualClockView) Now() time.Time {
+    return self.clock.Now()
+}
+
+func (self *virtualClockView) After(d time.Duration) <-chan time.Time {
+    return self.clock.newTimer(self.name, d).ch
+}
+
+func (self *virtualClockView) NewTimer(d time.Duration) Timer {
+    return self.clock.newTimer(self.name, d)
+}
+
+func (self *virtualClockView) Fork(name string) Clock {
+    return &virtualClockView{
+        clock: self.clock,
+        name:  self.name + "/" + name,
+    }
+}
+
+type virtualTimer struct {
+    clock    *VirtualClock
+    name     string
+    deadline time.Time
+    seq      uint64
+    ch       chan time.Time
+    index    int
+}
+
+func (self *virtualTimer) Chan() <-chan time.Time {
+    return self.ch
+}
+
+func (self *virtualTimer) Stop() bool {
+    return self.clock.stopTimer(self)
+}
+
+type virtualTimerHeap []*virtualTimer
+
+func (self virtualTimerHeap) Len() int {
+    return len(self)
+}
+
+func (self virtualTimerHeap) Less(i, j int) bool {
+    a, b := self[i], self[j]
+    if !a.deadline.Equal(b.deadline) {
+        return a.deadline.Before(b.deadline)
+    }
+    if a.name != b.name {
+        return a.name < b.name
+    }
+    return a.seq < b.seq
+}
+
+func (self virtualTimerHeap) Swap(i, j int) {
+    self[i], self[j] = self[j], self[i]
+    self[i].index = i
+    self[j].index = j
+}
+
+func (self *virtualTimerHeap) Push(x interface{}) {
+    timer := x.(*virtualTimer)
+    timer.index = len(*self)
+    *self = append(*self, timer)
+}
+
+func (self *virtualTimerHeap) Pop() interface{} {
+    old := *self
+    n := len(old)
+    timer := old[n-1]
+    old[n-1] = nil
+    timer.index = -1
+    *self = old[:n-1]
+    return timer
+}
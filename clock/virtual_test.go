@@ -0,0 +1,56 @@
+package clock
+
+import (
+    "github.com/hhkbp2/testify/assert"
+    "testing"
+    "time"
+)
+
+func TestVirtualClockStep(t *testing.T) {
+    start := time.Unix(0, 0)
+    clock := NewVirtualClock(start)
+    assert.Equal(t, start, clock.Now())
+    c1 := clock.Fork("b").After(time.Second)
+    c2 := clock.Fork("a").After(time.Second)
+    c3 := clock.After(time.Millisecond)
+    assert.Equal(t, 3, clock.Pending())
+    // the earliest timer fires first
+    name, ok := clock.Step()
+    assert.True(t, ok)
+    assert.Equal(t, "", name)
+    assert.Equal(t, start.Add(time.Millisecond), <-c3)
+    // simultaneous timers fire in the order of their names
+    name, ok = clock.Step()
+    assert.True(t, ok)
+    assert.Equal(t, "a", name)
+    assert.Equal(t, start.Add(time.Second), <-c2)
+    name, ok = clock.Step()
+    assert.True(t, ok)
+    assert.Equal(t, "b", name)
+    assert.Equal(t, start.Add(time.Second), <-c1)
+    _, ok = clock.Step()
+    assert.False(t, ok)
+    assert.Equal(t, start.Add(time.Second), clock.Now())
+}
+
+func TestVirtualClockAdvance(t *testing.T) {
+    start := time.Unix(0, 0)
+    clock := NewVirtualClock(start)
+    timer1 := clock.NewTimer(time.Millisecond * 10)
+    timer2 := clock.NewTimer(time.Millisecond * 20)
+    timer3 := clock.NewTimer(time.Millisecond * 30)
+    assert.True(t, timer2.Stop())
+    assert.False(t, timer2.Stop())
+    assert.Equal(t, 1, clock.Advance(time.Millisecond*25))
+    assert.Equal(t, start.Add(time.Millisecond*25), clock.Now())
+    assert.Equal(t, start.Add(time.Millisecond*10), <-timer1.Chan())
+    assert.Equal(t, 0, len(timer2.Chan()))
+    deadline, _, ok := clock.Next()
+    assert.True(t, ok)
+    assert.Equal(t, start.Add(time.Millisecond*30), deadline)
+    assert.False(t, timer1.Stop())
+    assert.True(t, timer3.Stop())
+    assert.Equal(t, 0, clock.Pending())
+    // timer with no timeout fires immediately
+    assert.Equal(t, clock.Now(), <-clock.After(0))
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/hhkbp2/rafted"
+    cm "github.com/hhkbp2/rafted/comm"
+    ev "github.com/hhkbp2/rafted/event"
+    logging "github.com/hhkbp2/rafted/logging"
+    ps "github.com/hhkbp2/rafted/persist"
+    rt "github.com/hhkbp2/rafted/retry"
+    "io"
+    "strings"
+    "text/tabwriter"
+    "time"
+)
+
+var (
+    ErrorUsage         = errors.New("invalid usage")
+    ErrorNoServer      = errors.New("no server available")
+    ErrorLeaderUnsync  = errors.New("leader unsync")
+    ErrorLeaderUnknown = errors.New("leader unknown")
+    ErrorMemberChange  = errors.New("cluster in member change")
+    ErrorPersist       = errors.New("persist error on server")
+    ErrorOverloaded    = errors.New("server overloaded")
+    ErrorFailure       = errors.New("request fails")
+    ErrorNotSupported  = errors.New(
+        "not supported by the client protocol of the servers")
+)
+
+// Ctl runs the admin commands against a cluster. It talks to the members
+// with client directly, and follows the leader redirections itself.
+type Ctl struct {
+    client  cm.Client
+    servers []*ps.ServerAddress
+    tries   int
+    delay   time.Duration
+    json    bool
+    out     io.Writer
+}
+
+func NewCtl(
+    client cm.Client,
+    servers []*ps.ServerAddress,
+    tries int,
+    delay time.Duration,
+    jsonOutput bool,
+    out io.Writer) *Ctl {
+
+    return &Ctl{
+        client:  client,
+        servers: servers,
+        tries:   tries,
+        delay:   delay,
+        json:    jsonOutput,
+        out:     out,
+    }
+}
+
+// Run runs the command in args.
+func (self *Ctl) Run(args []string) error {
+    if len(args) == 0 {
+        return ErrorUsage
+    }
+    command, args := args[0], args[1:]
+    switch command {
+    case "status":
+        return self.Status()
+    case "members":
+        return self.runMembers(args)
+    case "append":
+        if len(args) != 1 {
+            return ErrorUsage
+        }
+        return self.Append([]byte(args[0]))
+    case "read":
+        if len(args) != 1 {
+            return ErrorUsage
+        }
+        return self.Read([]byte(args[0]))
+    case "transfer":
+        addr, err := parseOptionalAddr(args)
+        if err != nil {
+            return err
+        }
+        return self.Transfer(addr)
+    case "resume":
+        if len(args) != 1 {
+            return ErrorUsage
+        }
+        addr, err := ps.ParseServerAddress(args[0])
+        if err != nil {
+            return err
+        }
+        return self.Resume(addr)
+    case "snapshot":
+        addr, err := parseOptionalAddr(args)
+        if err != nil {
+            return err
+        }
+        if addr == nil {
+            addr = self.servers[0]
+        }
+        return self.printResult(self.Snapshot(addr))
+    case "tail":
+        addr, err := parseOptionalAddr(args)
+        if err != nil {
+            return err
+        }
+        if addr == nil {
+            addr = self.servers[0]
+        }
+        return self.Tail(context.Background(), addr)
+    }
+    return ErrorUsage
+}
+
+// parseOptionalAddr parses the only address in args, if any.
+func parseOptionalAddr(args []string) (*ps.ServerAddress, error) {
+    switch len(args) {
+    case 0:
+        return nil, nil
+    case 1:
+        return ps.ParseServerAddress(args[0])
+    }
+    return nil, ErrorUsage
+}
+
+func (self *Ctl) runMembers(args []string) error {
+    if len(args) == 0 || args[0] == "list" {
+        return self.Members()
+    }
+    if len(args) < 2 {
+        return ErrorUsage
+    }
+    addrs := make([]*ps.ServerAddress, 0, len(args)-1)
+    for _, arg := range args[1:] {
+        addr, err := ps.ParseServerAddress(arg)
+        if err != nil {
+            return err
+        }
+        addrs = append(addrs, addr)
+    }
+    switch args[0] {
+    case "add":
+        return self.AddMembers(addrs)
+    case "remove":
+        return self.RemoveMembers(addrs)
+    }
+    return ErrorUsage
+}
+
+// nodeStatus is the status of a member, or the error querying it.
+type nodeStatus struct {
+    Addr   string
+    Status *ev.QueryNodeStatusResponse `json:",omitempty"`
+    Error  string                      `json:",omitempty"`
+}
+
+func (self *Ctl) queryStatus(
+    addr *ps.ServerAddress) (*ev.QueryNodeStatusResponse, error) {
+
+    reqEvent := ev.NewQueryNodeStatusRequestEvent(
+        &ev.QueryNodeStatusRequest{})
+    event, err := self.client.CallRPCTo(addr, reqEvent)
+    if err != nil {
+        return nil, err
+    }
+    e, ok := event.(*ev.QueryNodeStatusResponseEvent)
+    if !ok {
+        return nil, errors.New(fmt.Sprintf(
+            "unexpected response: %s", ev.EventTypeString(event.Type())))
+    }
+    return e.Response, nil
+}
+
+// Status prints the status of every member.
+func (self *Ctl) Status() error {
+    statuses := make([]*nodeStatus, 0, len(self.servers))
+    for _, addr := range self.servers {
+        status := &nodeStatus{Addr: ps.FormatServerAddress(addr)}
+        response, err := self.queryStatus(addr)
+        if err != nil {
+            status.Error = err.Error()
+        } else {
+            status.Status = response
+        }
+        statuses = append(statuses, status)
+    }
+    if self.json {
+        return self.printJSON(statuses)
+    }
+    writer := tabwriter.NewWriter(self.out, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(writer, "ADDR\tSTATE\tTERM\tLEADER\tCOMMITTED\tAPPLIED\tLAST")
+    for _, status := range statuses {
+        if status.Status == nil {
+            fmt.Fprintf(writer, "%s\terror: %s\n", status.Addr, status.Error)
+            continue
+        }
+        s := status.Status
+        leader := "-"
+        if s.Leader != nil {
+            leader = ps.FormatServerAddress(s.Leader)
+        }
+        fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%d\t%d\t%d\n",
+            status.Addr, stateString(s.State), s.Term, leader,
+            s.CommittedIndex, s.LastAppliedIndex, s.LastLogIndex)
+    }
+    return writer.Flush()
+}
+
+func stateString(state ev.RaftStateType) string {
+    return strings.ToLower(strings.TrimPrefix(state.String(), "RaftState"))
+}
+
+// leaderStatus returns the status of the leader, which knows
+// the latest configuration of the cluster.
+func (self *Ctl) leaderStatus() (*ev.QueryNodeStatusResponse, error) {
+    var lastErr error = ErrorNoServer
+    for i := 0; i < self.tries; i++ {
+        for _, addr := range self.servers {
+            status, err := self.queryStatus(addr)
+            if err != nil {
+                lastErr = err
+                continue
+            }
+            if status.State == ev.RaftStateLeader {
+                return status, nil
+            }
+            if status.Leader == nil {
+                lastErr = ErrorLeaderUnknown
+                continue
+            }
+            status, err = self.queryStatus(status.Leader)
+            if err != nil {
+                lastErr = err
+                continue
+            }
+            if status.State == ev.RaftStateLeader {
+                return status, nil
+            }
+        }
+        time.Sleep(self.delay)
+    }
+    return nil, lastErr
+}
+
+// Members prints the members of the cluster.
+func (self *Ctl) Members() error {
+    status, err := self.leaderStatus()
+    if err != nil {
+        return err
+    }
+    conf := status.Conf
+    if status.PendingConf != nil {
+        conf = status.PendingConf
+    }
+    if self.json {
+        return self.printJSON(conf)
+    }
+    printSlice := func(name string, slice *ps.ServerAddressSlice) {
+        if slice == nil {
+            return
+        }
+        fmt.Fprintf(self.out, "%s:\n", name)
+        for _, addr := range slice.Addresses {
+            fmt.Fprintf(self.out, "    %s\n", ps.FormatServerAddress(addr))
+        }
+    }
+    printSlice("servers", conf.Servers)
+    printSlice("new servers", conf.NewServers)
+    return nil
+}
+
+func (self *Ctl) changeMembers(
+    change func(servers []*ps.ServerAddress) []*ps.ServerAddress) error {
+
+    status, err := self.leaderStatus()
+    if err != nil {
+        return err
+    }
+    if status.PendingConf != nil || !status.Conf.IsNormalConfig() {
+        return ErrorMemberChange
+    }
+    servers := status.Conf.Servers
+    conf := &ps.Config{
+        Servers: servers,
+        NewServers: &ps.ServerAddressSlice{
+            Addresses: change(servers.Addresses),
+        },
+        Priorities: status.Conf.Priorities,
+    }
+    reqEvent := ev.NewClientChangeConfigRequestEvent(
+        &ev.ClientChangeConfigRequest{Conf: conf})
+    if _, err := self.request(status.LocalAddr, reqEvent); err != nil {
+        return err
+    }
+    return self.Members()
+}
+
+// AddMembers adds addrs into the cluster.
+func (self *Ctl) AddMembers(addrs []*ps.ServerAddress) error {
+    return self.changeMembers(func(
+        servers []*ps.ServerAddress) []*ps.ServerAddress {
+
+        result := append(make([]*ps.ServerAddress, 0), servers...)
+        for _, addr := range addrs {
+            if indexOf(result, addr) < 0 {
+                result = append(result, addr)
+            }
+        }
+        return result
+    })
+}
+
+// RemoveMembers removes addrs from the cluster.
+func (self *Ctl) RemoveMembers(addrs []*ps.ServerAddress) error {
+    return self.changeMembers(func(
+        servers []*ps.ServerAddress) []*ps.ServerAddress {
+
+        result := make([]*ps.ServerAddress, 0, len(servers))
+        for _, server := range servers {
+            if indexOf(addrs, server) < 0 {
+                result = append(result, server)
+            }
+        }
+        return result
+    })
+}
+
+func indexOf(addrs []*ps.ServerAddress, addr *ps.ServerAddress) int {
+    for i, a := range addrs {
+        if ps.MultiAddrEqual(a, addr) {
+            return i
+        }
+    }
+    return -1
+}
+
+// Append appends data to the log of the cluster, and prints the result.
+func (self *Ctl) Append(data []byte) error {
+    reqEvent := ev.NewClientAppendRequestEvent(
+        &ev.ClientAppendRequest{Data: data})
+    return self.printResult(self.request(nil, reqEvent))
+}
+
+// Read sends the read only request with data, and prints the result.
+func (self *Ctl) Read(data []byte) error {
+    reqEvent := ev.NewClientReadOnlyRequestEvent(
+        &ev.ClientReadOnlyRequest{Data: data})
+    return self.printResult(self.request(nil, reqEvent))
+}
+
+// Transfer transfers the leadership to the member at addr, or the member
+// with the most log replicated if addr is nil. It returns once the leader
+// starts the transfer, which could still fail if the member doesn't win
+// the election.
+func (self *Ctl) Transfer(addr *ps.ServerAddress) error {
+    status, err := self.leaderStatus()
+    if err != nil {
+        return err
+    }
+    reqEvent := ev.NewTransferLeadershipRequestEvent(
+        &ev.TransferLeadershipRequest{Target: addr})
+    _, err = self.request(status.LocalAddr, reqEvent)
+    return err
+}
+
+// Resume brings the member at addr back to serve after the persist error
+// on it is fixed. The request is served by that member only.
+func (self *Ctl) Resume(addr *ps.ServerAddress) error {
+    reqEvent := ev.NewResumeRequestEvent(&ev.ResumeRequest{})
+    event, err := self.client.CallRPCTo(addr, reqEvent)
+    if err != nil {
+        return err
+    }
+    switch e := event.(type) {
+    case *ev.ClientResponseEvent:
+        if !e.Response.Success {
+            return ErrorFailure
+        }
+        return nil
+    case *ev.PersistErrorResponseEvent:
+        return ErrorPersist
+    }
+    return errors.New(fmt.Sprintf(
+        "unexpected response: %s", ev.EventTypeString(event.Type())))
+}
+
+// Snapshot takes a snapshot of the state machine on the member at addr,
+// and returns the id of the snapshot. The request is served by that
+// member only.
+func (self *Ctl) Snapshot(addr *ps.ServerAddress) ([]byte, error) {
+    reqEvent := ev.NewSnapshotRequestEvent(&ev.SnapshotRequest{})
+    event, err := self.client.CallRPCTo(addr, reqEvent)
+    if err != nil {
+        return nil, err
+    }
+    switch e := event.(type) {
+    case *ev.ClientResponseEvent:
+        if !e.Response.Success {
+            return nil, ErrorFailure
+        }
+        return e.Response.Data, nil
+    case *ev.PersistErrorResponseEvent:
+        return nil, ErrorPersist
+    }
+    return nil, errors.New(fmt.Sprintf(
+        "unexpected response: %s", ev.EventTypeString(event.Type())))
+}
+
+// Tail prints the notifications of the member at addr as they arrive,
+// until ctx is done. It subscribes again after the connection breaks,
+// and tells when some notifications are missed in the meantime.
+func (self *Ctl) Tail(ctx context.Context, addr *ps.ServerAddress) error {
+    subscriber, ok := self.client.(cm.Subscriber)
+    if !ok {
+        return ErrorNotSupported
+    }
+    retry := rt.NewNTimesRetry(time.Sleep, uint32(self.tries), self.delay)
+    subscription := rafted.NewRemoteSubscription(
+        subscriber, addr, retry, logging.GetLogger("raftctl"), 0)
+    defer subscription.Close()
+    var missed uint64
+    for {
+        select {
+        case event, ok := <-subscription.GetNotifyChan():
+            if !ok {
+                return subscription.Err()
+            }
+            if m := subscription.Missed(); m != missed {
+                fmt.Fprintln(self.out, "some notifications missed")
+                missed = m
+            }
+            message := ev.NewNotifyMessage(0, event)
+            if err := self.printNotify(message); err != nil {
+                return err
+            }
+        case <-ctx.Done():
+            return nil
+        }
+    }
+}
+
+func (self *Ctl) printNotify(message *ev.NotifyMessage) error {
+    if self.json {
+        data, err := json.Marshal(message)
+        if err != nil {
+            return err
+        }
+        fmt.Fprintln(self.out, string(data))
+        return nil
+    }
+    fmt.Fprintln(self.out, notifyString(message))
+    return nil
+}
+
+// notifyString formats message as its type followed by the fields
+// it carries.
+func notifyString(message *ev.NotifyMessage) string {
+    name := ev.NotifyTypeString(message.Type)
+    switch message.Type {
+    case ev.EventNotifyHeartbeatTimeout,
+        ev.EventNotifyElectionTimeout,
+        ev.EventNotifyElectionTimeoutThreshold:
+        return fmt.Sprintf("%s last: %s, timeout: %s", name,
+            message.Time.Format(time.RFC3339Nano), message.Timeout)
+    case ev.EventNotifyStateChange:
+        return fmt.Sprintf("%s %s -> %s", name,
+            stateString(message.OldState), stateString(message.NewState))
+    case ev.EventNotifyLeaderChange:
+        leader := "-"
+        if message.Leader != nil {
+            leader = ps.FormatServerAddress(message.Leader)
+        }
+        return fmt.Sprintf("%s leader: %s", name, leader)
+    case ev.EventNotifyTermChange:
+        return fmt.Sprintf("%s %d -> %d", name,
+            message.OldTerm, message.NewTerm)
+    case ev.EventNotifyCommit, ev.EventNotifyApply:
+        return fmt.Sprintf("%s term: %d, index: %d", name,
+            message.Term, message.LogIndex)
+    case ev.EventNotifyMemberChange:
+        return fmt.Sprintf("%s %s -> %s", name,
+            slicePrintString(message.OldServers),
+            slicePrintString(message.NewServers))
+    case ev.EventNotifyPersistError:
+        return fmt.Sprintf("%s error: %s", name, message.Error)
+    }
+    return name
+}
+
+func slicePrintString(slice *ps.ServerAddressSlice) string {
+    if slice == nil {
+        return "-"
+    }
+    addrs := make([]string, 0, len(slice.Addresses))
+    for _, addr := range slice.Addresses {
+        addrs = append(addrs, ps.FormatServerAddress(addr))
+    }
+    return "[" + strings.Join(addrs, ", ") + "]"
+}
+
+// request sends the request to target, or the first server if target
+// is nil, and follows the leader redirections until it's responded.
+func (self *Ctl) request(
+    target *ps.ServerAddress, reqEvent ev.RequestEvent) ([]byte, error) {
+
+    next := 0
+    if target == nil {
+        target = self.servers[next]
+    }
+    var lastErr error = ErrorNoServer
+    for i := 0; i < self.tries*len(self.servers); i++ {
+        event, err := self.client.CallRPCTo(target, reqEvent)
+        if err != nil {
+            lastErr = err
+            next = (next + 1) % len(self.servers)
+            target = self.servers[next]
+            continue
+        }
+        switch e := event.(type) {
+        case *ev.ClientResponseEvent:
+            if !e.Response.Success {
+                return nil, ErrorFailure
+            }
+            return e.Response.Data, nil
+        case *ev.LeaderRedirectResponseEvent:
+            target = e.Response.Leader
+            continue
+        case *ev.LeaderInMemberChangeResponseEvent:
+            return nil, ErrorMemberChange
+        case *ev.PersistErrorResponseEvent:
+            return nil, ErrorPersist
+        case *ev.LeaderUnsyncResponseEvent:
+            lastErr = ErrorLeaderUnsync
+        case *ev.OverloadedResponseEvent:
+            // back off for the delay before trying again
+            lastErr = ErrorOverloaded
+        case *ev.LeaderUnknownResponseEvent:
+            lastErr = ErrorLeaderUnknown
+            next = (next + 1) % len(self.servers)
+            target = self.servers[next]
+        default:
+            lastErr = errors.New(fmt.Sprintf(
+                "unexpected response: %s", ev.EventTypeString(event.Type())))
+            next = (next + 1) % len(self.servers)
+            target = self.servers[next]
+        }
+        time.Sleep(self.delay)
+    }
+    return nil, lastErr
+}
+
+func (self *Ctl) printResult(result []byte, err error) error {
+    if err != nil {
+        return err
+    }
+    if self.json {
+        return self.printJSON(map[string]string{"Result": string(result)})
+    }
+    fmt.Fprintln(self.out, string(result))
+    return nil
+}
+
+func (self *Ctl) printJSON(v interface{}) error {
+    data, err := json.MarshalIndent(v, "", "    ")
+    if err != nil {
+        return err
+    }
+    fmt.Fprintln(self.out, string(data))
+    return nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "github.com/hhkbp2/rafted"
+    ev "github.com/hhkbp2/rafted/event"
+    ps "github.com/hhkbp2/rafted/persist"
+    "github.com/hhkbp2/rafted/rafttest"
+    "github.com/hhkbp2/testify/assert"
+    "github.com/hhkbp2/testify/require"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestRunUsage(t *testing.T) {
+    stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+    assert.Equal(t, 2, run([]string{}, stdout, stderr))
+    assert.Contains(t, stderr.String(), "usage: raftctl")
+    stderr.Reset()
+    assert.Equal(t, 2, run([]string{"-transport", "http", "status"},
+        stdout, stderr))
+    assert.Contains(t, stderr.String(), "invalid transport")
+}
+
+// fakeLeader answers the status queries as the leader of a cluster
+// with conf, and records the config change requests.
+type fakeLeader struct {
+    addr    *ps.ServerAddress
+    conf    *ps.Config
+    changes []*ps.Config
+}
+
+func (self *fakeLeader) CallRPCTo(
+    target ps.MultiAddr, request ev.Event) (ev.Event, error) {
+
+    switch e := request.(type) {
+    case *ev.QueryNodeStatusRequestEvent:
+        return ev.NewQueryNodeStatusResponseEvent(
+            &ev.QueryNodeStatusResponse{
+                State:     ev.RaftStateLeader,
+                LocalAddr: self.addr,
+                Leader:    self.addr,
+                Conf:      self.conf,
+            }), nil
+    case *ev.ClientChangeConfigRequestEvent:
+        self.changes = append(self.changes, e.Request.Conf)
+        self.conf = &ps.Config{Servers: e.Request.Conf.NewServers}
+        return ev.NewClientResponseEvent(
+            &ev.ClientResponse{Success: true}), nil
+    }
+    return nil, ErrorFailure
+}
+
+func (self *fakeLeader) CallRPCToContext(
+    _ context.Context,
+    target ps.MultiAddr,
+    request ev.Event) (ev.Event, error) {
+
+    return self.CallRPCTo(target, request)
+}
+
+func (self *fakeLeader) Close() error {
+    return nil
+}
+
+func TestCtlChangeMembers(t *testing.T) {
+    addrs := ps.SetupSocketMultiAddrSlice(4).Addresses
+    leader := &fakeLeader{
+        addr: addrs[0],
+        conf: &ps.Config{
+            Servers: &ps.ServerAddressSlice{Addresses: addrs[:3]},
+        },
+    }
+    out := &bytes.Buffer{}
+    ctl := NewCtl(leader, addrs[:1], 1, 0, false, out)
+    require.Nil(t, ctl.Run([]string{"members", "add", addrs[3].String()}))
+    require.Equal(t, 1, len(leader.changes))
+    assert.Equal(t, addrs[:3], leader.changes[0].Servers.Addresses)
+    assert.Equal(t, addrs, leader.changes[0].NewServers.Addresses)
+    assert.Contains(t, out.String(), addrs[3].String())
+
+    require.Nil(t, ctl.Run([]string{"members", "remove", addrs[1].String()}))
+    require.Equal(t, 2, len(leader.changes))
+    assert.Equal(t, addrs, leader.changes[1].Servers.Addresses)
+    expected := []*ps.ServerAddress{addrs[0], addrs[2], addrs[3]}
+    assert.Equal(t, expected, leader.changes[1].NewServers.Addresses)
+}
+
+func TestCtlChangeMembersWithID(t *testing.T) {
+    addrs := ps.SetupSocketMultiAddrSlice(4).Addresses
+    leader := &fakeLeader{
+        addr: addrs[0],
+        conf: &ps.Config{
+            Servers: &ps.ServerAddressSlice{Addresses: addrs[:3]},
+        },
+    }
+    out := &bytes.Buffer{}
+    ctl := NewCtl(leader, addrs[:1], 1, 0, false, out)
+    member := "node3@" + addrs[3].String()
+    require.Nil(t, ctl.Run([]string{"members", "add", member}))
+    require.Equal(t, 1, len(leader.changes))
+    added := leader.changes[0].NewServers.Addresses[3]
+    assert.Equal(t, "node3", added.ID)
+    assert.Equal(t, addrs[3].String(), added.String())
+    // the members are printed with their IDs
+    assert.Contains(t, out.String(), member)
+    // the member is removed by its ID, even on another address
+    require.Nil(t, ctl.Run([]string{"members", "remove", "node3@127.0.0.1:1"}))
+    require.Equal(t, 2, len(leader.changes))
+    assert.Equal(t, addrs[:3], leader.changes[1].NewServers.Addresses)
+}
+
+func TestCtl(t *testing.T) {
+    config := rafted.DefaultConfiguration()
+    cluster, err := rafttest.NewCluster(config, 3, rafttest.TransportMemory)
+    require.Nil(t, err)
+    defer cluster.Close()
+    leader, err := cluster.WaitLeader(config.ElectionTimeout * 10)
+    require.Nil(t, err)
+    client := cluster.NewClient()
+    defer client.Close()
+    out := &bytes.Buffer{}
+    addrs := cluster.Addrs().Addresses
+    ctl := NewCtl(client, addrs, 3, config.HeartbeatTimeout, false, out)
+
+    // status in text
+    require.Nil(t, ctl.Run([]string{"status"}))
+    lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+    require.Equal(t, 4, len(lines))
+    assert.True(t, strings.HasPrefix(lines[0], "ADDR"))
+    assert.Contains(t, lines[1+leader], "leader")
+    // status in json
+    out.Reset()
+    ctl.json = true
+    require.Nil(t, ctl.Status())
+    statuses := make([]*nodeStatus, 0)
+    require.Nil(t, json.Unmarshal(out.Bytes(), &statuses))
+    require.Equal(t, 3, len(statuses))
+    leaders := 0
+    for _, status := range statuses {
+        require.NotNil(t, status.Status)
+        if status.Status.State == ev.RaftStateLeader {
+            leaders++
+        }
+    }
+    assert.Equal(t, 1, leaders)
+    ctl.json = false
+
+    // append and read through a follower, which redirects to the leader
+    follower := (leader + 1) % cluster.Size()
+    ctl.servers = []*ps.ServerAddress{addrs[follower]}
+    out.Reset()
+    require.Nil(t, ctl.Run([]string{"append", "hello"}))
+    assert.Equal(t, "hello\n", out.String())
+    out.Reset()
+    require.Nil(t, ctl.Run([]string{"read", "world"}))
+    assert.Equal(t, "world\n", out.String())
+    ctl.servers = addrs
+
+    // take a snapshot on the leader, which covers the append applied
+    out.Reset()
+    require.Nil(t, ctl.Run([]string{"snapshot", addrs[leader].String()}))
+    meta, err := cluster.StateMachine(leader).LastSnapshotInfo()
+    require.Nil(t, err)
+    assert.Equal(t, meta.ID+"\n", out.String())
+    lastAppliedIndex, err := cluster.Log(leader).LastAppliedIndex()
+    require.Nil(t, err)
+    assert.Equal(t, lastAppliedIndex, meta.LastIncludedIndex)
+
+    // members
+    out.Reset()
+    require.Nil(t, ctl.Run([]string{"members"}))
+    for _, addr := range addrs {
+        assert.Contains(t, out.String(), addr.String())
+    }
+
+    // resuming a member not in persist error state is a no-op
+    require.Nil(t, ctl.Run([]string{"resume", addrs[follower].String()}))
+    assert.Equal(t, ErrorUsage, ctl.Run([]string{"resume"}))
+
+    // transfer the leadership to a follower
+    require.Nil(t, ctl.Run([]string{"transfer", addrs[follower].String()}))
+    deadline := time.Now().Add(config.ElectionTimeout * 10)
+    for {
+        index, _, ok := cluster.Leader()
+        if ok && index == follower {
+            break
+        }
+        require.True(t, time.Now().Before(deadline))
+        time.Sleep(config.HeartbeatTimeout)
+    }
+    // a non-member is never transferred to
+    nonMember := ps.SetupSocketMultiAddrSlice(1).Addresses[0]
+    assert.Equal(t, ErrorFailure,
+        ctl.Run([]string{"transfer", nonMember.String()}))
+    assert.Equal(t, ErrorUsage,
+        ctl.Run([]string{"transfer", addrs[0].String(), addrs[1].String()}))
+
+    // the memory transport doesn't support subscription
+    assert.Equal(t, ErrorNotSupported, ctl.Run([]string{"tail"}))
+    assert.Equal(t, ErrorUsage,
+        ctl.Run([]string{"snapshot", addrs[0].String(), addrs[1].String()}))
+    assert.Equal(t, ErrorUsage, ctl.Run([]string{"append"}))
+    assert.Equal(t, ErrorUsage, ctl.Run([]string{"unknown"}))
+}
+
+// syncBuffer is a buffer safe to write and read concurrently.
+type syncBuffer struct {
+    buffer bytes.Buffer
+    lock   sync.Mutex
+}
+
+func (self *syncBuffer) Write(p []byte) (int, error) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.buffer.Write(p)
+}
+
+func (self *syncBuffer) String() string {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.buffer.String()
+}
+
+func TestCtlTail(t *testing.T) {
+    config := rafted.DefaultConfiguration()
+    cluster, err := rafttest.NewCluster(config, 3, rafttest.TransportSocket)
+    require.Nil(t, err)
+    defer cluster.Close()
+    leader, err := cluster.WaitLeader(config.ElectionTimeout * 10)
+    require.Nil(t, err)
+    client := cluster.NewClient()
+    defer client.Close()
+    addrs := cluster.Addrs().Addresses
+    out := &syncBuffer{}
+    ctl := NewCtl(client, addrs, 3, config.HeartbeatTimeout, false, out)
+    appender := NewCtl(
+        client, addrs, 3, config.HeartbeatTimeout, false, &bytes.Buffer{})
+
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan error, 1)
+    go func() {
+        done <- ctl.Tail(ctx, addrs[leader])
+    }()
+    // the notifies before the subscription is made are not received,
+    // so keep appending until one is printed
+    deadline := time.Now().Add(config.ElectionTimeout * 10)
+    for !strings.Contains(out.String(), "ApplyNotify") {
+        require.True(t, time.Now().Before(deadline))
+        require.Nil(t, appender.Run([]string{"append", "hello"}))
+        time.Sleep(config.HeartbeatTimeout)
+    }
+    cancel()
+    require.Nil(t, <-done)
+    assert.Contains(t, out.String(), "CommitNotify")
+}
@@ -0,0 +1,98 @@
+// raftctl is the admin tool to inspect and operate a rafted cluster.
+// It speaks the client protocol to the members over socket or rpc.
+package main
+
+import (
+    "flag"
+    "fmt"
+    "github.com/hhkbp2/rafted"
+    cm "github.com/hhkbp2/rafted/comm"
+    ps "github.com/hhkbp2/rafted/persist"
+    "io"
+    "os"
+)
+
+const usage = `usage: raftctl [flags] <command> [arguments]
+
+commands:
+    status                      status of every member
+    members [list]              members of the cluster
+    members add <addr>...       add members into the cluster
+    members remove <addr>...    remove members from the cluster
+    append <payload>            append payload to the log
+    read <payload>              send a read only request with payload
+    transfer [addr]             transfer the leadership to a member
+    resume <addr>               resume a member after its persist error
+    snapshot [addr]             take a snapshot of the state machine on a member
+    tail [addr]                 print the notifications of a member
+
+addresses are in the form of host:port, or id@host:port to give
+the member an ID.
+
+flags:
+`
+
+func main() {
+    os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+    config := rafted.DefaultConfiguration()
+    flags := flag.NewFlagSet("raftctl", flag.ContinueOnError)
+    flags.SetOutput(stderr)
+    flags.Usage = func() {
+        fmt.Fprint(stderr, usage)
+        flags.PrintDefaults()
+    }
+    transport := flags.String(
+        "transport", "socket", "transport to the members: socket or rpc")
+    servers := flags.String(
+        "servers", "127.0.0.1:6152", "comma separated members to talk to")
+    timeout := flags.Duration(
+        "timeout", config.CommClientTimeout, "timeout of every request")
+    tries := flags.Int(
+        "tries", 3, "how many rounds to try all the members")
+    delay := flags.Duration(
+        "delay", config.HeartbeatTimeout, "delay between the tries")
+    jsonOutput := flags.Bool("json", false, "print the output in json")
+    user := flags.String(
+        "user", config.RPCClientAuth.User, "user of the rpc transport")
+    password := flags.String(
+        "password", config.RPCClientAuth.Password,
+        "password of the rpc transport")
+    if err := flags.Parse(args); err != nil {
+        return 2
+    }
+
+    addrs, err := ps.ParseServerAddresses(*servers)
+    if err != nil || len(addrs) == 0 {
+        fmt.Fprintf(stderr, "invalid servers: %s\n", *servers)
+        return 2
+    }
+    var client cm.Client
+    switch *transport {
+    case "socket":
+        client = cm.NewSocketClient(config.CommPoolSize, *timeout)
+    case "rpc":
+        auth := &cm.RPCAuth{
+            User:     *user,
+            Password: *password,
+        }
+        client = cm.NewRPCClient(*timeout, auth)
+    default:
+        fmt.Fprintf(stderr, "invalid transport: %s\n", *transport)
+        return 2
+    }
+    defer client.Close()
+
+    ctl := NewCtl(client, addrs, *tries, *delay, *jsonOutput, stdout)
+    if err := ctl.Run(flags.Args()); err != nil {
+        if err == ErrorUsage {
+            flags.Usage()
+            return 2
+        }
+        fmt.Fprintf(stderr, "raftctl: %s\n", err)
+        return 1
+    }
+    return 0
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/hhkbp2/rafted"
+    cm "github.com/hhkbp2/rafted/comm"
+    ps "github.com/hhkbp2/rafted/persist"
+    "io/ioutil"
+    "time"
+)
+
+// ClusterConfig is the config of a kv cluster, shared by all
+// the members. It's loaded from a json file like:
+//
+//     {
+//         "transport": "socket",
+//         "heartbeat_timeout": "50ms",
+//         "election_timeout": "200ms",
+//         "members": [
+//             {
+//                 "name": "kv1",
+//                 "raft": "kv1@127.0.0.1:6152",
+//                 "client": "127.0.0.1:6252",
+//                 "http": "127.0.0.1:8080"
+//             }
+//         ]
+//     }
+//
+// The timeouts are optional, and default to the ones in
+// rafted.DefaultConfiguration(). The raft address could be given an ID in
+// the form of id@host:port, which keeps identifying the member after its
+// address changes.
+type ClusterConfig struct {
+    Transport        string          `json:"transport"`
+    HeartbeatTimeout string          `json:"heartbeat_timeout"`
+    ElectionTimeout  string          `json:"election_timeout"`
+    ClientTimeout    string          `json:"client_timeout"`
+    User             string          `json:"user"`
+    Password         string          `json:"password"`
+    Members          []*MemberConfig `json:"members"`
+}
+
+// MemberConfig is the addresses of a member. Raft is the address which
+// the other members and raftctl talk to, Client is the address of
+// the redirect client, and HTTP is the address of the kv front end.
+type MemberConfig struct {
+    Name   string `json:"name"`
+    Raft   string `json:"raft"`
+    Client string `json:"client"`
+    HTTP   string `json:"http"`
+}
+
+// LoadConfig reads the cluster config from the json file in path.
+func LoadConfig(path string) (*ClusterConfig, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    return ParseConfig(data)
+}
+
+// ParseConfig parses and validates the cluster config in json.
+func ParseConfig(data []byte) (*ClusterConfig, error) {
+    config := &ClusterConfig{}
+    if err := json.Unmarshal(data, config); err != nil {
+        return nil, err
+    }
+    if err := config.Validate(); err != nil {
+        return nil, err
+    }
+    return config, nil
+}
+
+// Validate checks the transport, the timeouts and the members.
+func (self *ClusterConfig) Validate() error {
+    switch self.Transport {
+    case "":
+        self.Transport = "socket"
+    case "socket", "rpc":
+    default:
+        return errors.New(fmt.Sprintf(
+            "invalid transport: %s", self.Transport))
+    }
+    if _, err := self.Configuration(); err != nil {
+        return err
+    }
+    if len(self.Members) == 0 {
+        return errors.New("no member in cluster")
+    }
+    names := make(map[string]bool)
+    ids := make(map[string]bool)
+    for _, member := range self.Members {
+        if member.Name == "" {
+            return errors.New("member without name")
+        }
+        if names[member.Name] {
+            return errors.New(fmt.Sprintf(
+                "duplicate member: %s", member.Name))
+        }
+        names[member.Name] = true
+        for _, addr := range []string{member.Raft, member.Client} {
+            if _, err := ps.ParseServerAddress(addr); err != nil {
+                return errors.New(fmt.Sprintf(
+                    "invalid address of member %s: %s", member.Name, addr))
+            }
+        }
+        raft, _ := ps.ParseServerAddress(member.Raft)
+        if raft.ID != "" {
+            if ids[raft.ID] {
+                return errors.New(fmt.Sprintf(
+                    "duplicate member id: %s", raft.ID))
+            }
+            ids[raft.ID] = true
+        }
+        if member.HTTP == "" {
+            return errors.New(fmt.Sprintf(
+                "no http address of member: %s", member.Name))
+        }
+    }
+    return nil
+}
+
+// Configuration returns the raft configuration of the members.
+func (self *ClusterConfig) Configuration() (*rafted.Configuration, error) {
+    config := rafted.DefaultConfiguration()
+    timeouts := []struct {
+        name  string
+        value string
+        to    *time.Duration
+    }{
+        {"heartbeat_timeout", self.HeartbeatTimeout, &config.HeartbeatTimeout},
+        {"election_timeout", self.ElectionTimeout, &config.ElectionTimeout},
+        {"client_timeout", self.ClientTimeout, &config.ClientTimeout},
+    }
+    for _, timeout := range timeouts {
+        if timeout.value == "" {
+            continue
+        }
+        d, err := time.ParseDuration(timeout.value)
+        if err != nil || d <= 0 {
+            return nil, errors.New(fmt.Sprintf(
+                "invalid %s: %s", timeout.name, timeout.value))
+        }
+        *timeout.to = d
+    }
+    if config.HeartbeatTimeout >= config.ElectionTimeout {
+        return nil, errors.New(
+            "heartbeat_timeout should be less than election_timeout")
+    }
+    if self.User != "" || self.Password != "" {
+        auth := &cm.RPCAuth{
+            User:     self.User,
+            Password: self.Password,
+        }
+        config.RPCServerAuth = auth
+        config.RPCClientAuth = auth
+    }
+    return config, nil
+}
+
+// Member returns the config of the member with name.
+func (self *ClusterConfig) Member(name string) (*MemberConfig, error) {
+    for _, member := range self.Members {
+        if member.Name == name {
+            return member, nil
+        }
+    }
+    return nil, errors.New(fmt.Sprintf("no such member: %s", name))
+}
+
+// Servers returns the raft addresses of all the members.
+func (self *ClusterConfig) Servers() *ps.ServerAddressSlice {
+    servers := &ps.ServerAddressSlice{
+        Addresses: make([]*ps.ServerAddress, 0, len(self.Members)),
+    }
+    for _, member := range self.Members {
+        addr, _ := ps.ParseServerAddress(member.Raft)
+        servers.Addresses = append(servers.Addresses, addr)
+    }
+    return servers
+}
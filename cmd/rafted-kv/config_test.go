@@ -0,0 +1,57 @@
+package main
+
+import (
+    "github.com/hhkbp2/testify/assert"
+    "github.com/hhkbp2/testify/require"
+    "testing"
+    "time"
+)
+
+func TestLoadConfig(t *testing.T) {
+    config, err := LoadConfig("cluster.json")
+    require.Nil(t, err)
+    assert.Equal(t, "socket", config.Transport)
+    require.Equal(t, 3, len(config.Members))
+    member, err := config.Member("kv2")
+    require.Nil(t, err)
+    assert.Equal(t, "127.0.0.1:8081", member.HTTP)
+    _, err = config.Member("kv4")
+    assert.NotNil(t, err)
+    servers := config.Servers()
+    require.Equal(t, 3, servers.Len())
+    assert.Equal(t, "127.0.0.1:6152", servers.Addresses[0].String())
+    assert.Equal(t, "kv1", servers.Addresses[0].ID)
+    raftConfig, err := config.Configuration()
+    require.Nil(t, err)
+    assert.Equal(t, time.Millisecond*500, raftConfig.ClientTimeout)
+}
+
+func TestParseConfig(t *testing.T) {
+    member := `{"name": "kv1", "raft": "127.0.0.1:6152",
+        "client": "127.0.0.1:6252", "http": "127.0.0.1:8080"}`
+    config, err := ParseConfig([]byte(`{"members": [` + member + `]}`))
+    require.Nil(t, err)
+    assert.Equal(t, "socket", config.Transport)
+
+    invalids := []string{
+        `{"members": [` + member + `], "transport": "http"}`,
+        `{"members": [` + member + `], "election_timeout": "soon"}`,
+        `{"members": [` + member + `], "heartbeat_timeout": "1s"}`,
+        `{"members": []}`,
+        `{"members": [` + member + `, ` + member + `]}`,
+        `{"members": [{"name": "kv1", "raft": "127.0.0.1"}]}`,
+        `{"members": [{"name": "kv1", "raft": "127.0.0.1:6152",
+            "client": "127.0.0.1:6252"}]}`,
+        `{"members": [{"name": "kv1", "raft": "@127.0.0.1:6152",
+            "client": "127.0.0.1:6252", "http": "127.0.0.1:8080"}]}`,
+        `{"members": [{"name": "kv1", "raft": "kv@127.0.0.1:6152",
+            "client": "127.0.0.1:6252", "http": "127.0.0.1:8080"},
+            {"name": "kv2", "raft": "kv@127.0.0.1:6153",
+            "client": "127.0.0.1:6253", "http": "127.0.0.1:8081"}]}`,
+        `not json`,
+    }
+    for _, invalid := range invalids {
+        _, err := ParseConfig([]byte(invalid))
+        assert.NotNil(t, err, invalid)
+    }
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/hhkbp2/rafted/kv"
+    ps "github.com/hhkbp2/rafted/persist"
+    "io"
+    "sync"
+)
+
+var (
+    ErrorSnapshotClosed = errors.New("snapshot writer closed")
+)
+
+// KVStateMachine is a key value store replicated by raft. It applies
+// the commands encoded by kv.EncodeInput. Every snapshot of it
+// is the whole store encoded in json, and is kept in memory.
+type KVStateMachine struct {
+    data         map[string]string
+    dataLock     sync.RWMutex
+    snapshots    []*kvSnapshot
+    snapshotLock sync.RWMutex
+}
+
+type kvSnapshot struct {
+    meta *ps.SnapshotMeta
+    data []byte
+}
+
+func NewKVStateMachine() *KVStateMachine {
+    return &KVStateMachine{
+        data:      make(map[string]string),
+        snapshots: make([]*kvSnapshot, 0),
+    }
+}
+
+func (self *KVStateMachine) Apply(p []byte) []byte {
+    input, err := kv.DecodeInput(p)
+    if err != nil {
+        return kv.EncodeOutput(&kv.Output{})
+    }
+    self.dataLock.Lock()
+    defer self.dataLock.Unlock()
+    value, found := self.data[input.Key]
+    output := &kv.Output{Found: found}
+    switch input.Op {
+    case kv.Get:
+        output.Value = value
+    case kv.Put:
+        self.data[input.Key] = input.Value
+    case kv.Delete:
+        delete(self.data, input.Key)
+    case kv.Cas:
+        if found && value == input.Expect {
+            self.data[input.Key] = input.Value
+            output.Ok = true
+        }
+    }
+    return kv.EncodeOutput(output)
+}
+
+// Get returns the value of key in the local store, which may be stale.
+func (self *KVStateMachine) Get(key string) (string, bool) {
+    self.dataLock.RLock()
+    defer self.dataLock.RUnlock()
+    value, ok := self.data[key]
+    return value, ok
+}
+
+// Len returns the number of keys in the local store.
+func (self *KVStateMachine) Len() int {
+    self.dataLock.RLock()
+    defer self.dataLock.RUnlock()
+    return len(self.data)
+}
+
+func (self *KVStateMachine) getID(term, index uint64) string {
+    return fmt.Sprintf("%d-%d", term, index)
+}
+
+func (self *KVStateMachine) MakeSnapshot(
+    lastIncludedTerm uint64,
+    lastIncludedIndex uint64,
+    conf *ps.Config) (id string, err error) {
+
+    self.dataLock.RLock()
+    data, err := json.Marshal(self.data)
+    self.dataLock.RUnlock()
+    if err != nil {
+        return "", err
+    }
+    id = self.getID(lastIncludedTerm, lastIncludedIndex)
+    snapshot := &kvSnapshot{
+        meta: &ps.SnapshotMeta{
+            ID:                id,
+            LastIncludedTerm:  lastIncludedTerm,
+            LastIncludedIndex: lastIncludedIndex,
+            Size:              uint64(len(data)),
+            Conf:              conf,
+        },
+        data: data,
+    }
+    self.addSnapshot(snapshot)
+    return id, nil
+}
+
+func (self *KVStateMachine) MakeEmptySnapshot(
+    lastIncludedTerm uint64,
+    lastIncludedIndex uint64,
+    conf *ps.Config) (ps.SnapshotWriter, error) {
+
+    snapshot := &kvSnapshot{
+        meta: &ps.SnapshotMeta{
+            ID:                self.getID(lastIncludedTerm, lastIncludedIndex),
+            LastIncludedTerm:  lastIncludedTerm,
+            LastIncludedIndex: lastIncludedIndex,
+            Size:              0,
+            Conf:              conf,
+        },
+    }
+    return &kvSnapshotWriter{
+        stateMachine: self,
+        snapshot:     snapshot,
+    }, nil
+}
+
+// addSnapshot keeps the snapshots in ascending order of index.
+// A snapshot replaces the one with the same id.
+func (self *KVStateMachine) addSnapshot(snapshot *kvSnapshot) {
+    self.snapshotLock.Lock()
+    defer self.snapshotLock.Unlock()
+    for i, s := range self.snapshots {
+        if s.meta.ID == snapshot.meta.ID {
+            self.snapshots[i] = snapshot
+            return
+        }
+    }
+    i := len(self.snapshots)
+    for i > 0 && self.snapshots[i-1].meta.LastIncludedIndex >
+        snapshot.meta.LastIncludedIndex {
+
+        i--
+    }
+    self.snapshots = append(self.snapshots, nil)
+    copy(self.snapshots[i+1:], self.snapshots[i:])
+    self.snapshots[i] = snapshot
+}
+
+func (self *KVStateMachine) getSnapshot(id string) (*kvSnapshot, int) {
+    for i, snapshot := range self.snapshots {
+        if snapshot.meta.ID == id {
+            return snapshot, i
+        }
+    }
+    return nil, -1
+}
+
+func (self *KVStateMachine) RestoreFromSnapshot(id string) error {
+    self.snapshotLock.RLock()
+    snapshot, _ := self.getSnapshot(id)
+    self.snapshotLock.RUnlock()
+    if snapshot == nil {
+        return ps.ErrorSnapshotNotFound
+    }
+    data := make(map[string]string)
+    if err := json.Unmarshal(snapshot.data, &data); err != nil {
+        return err
+    }
+    self.dataLock.Lock()
+    defer self.dataLock.Unlock()
+    self.data = data
+    return nil
+}
+
+func (self *KVStateMachine) LastSnapshotInfo() (*ps.SnapshotMeta, error) {
+    self.snapshotLock.RLock()
+    defer self.snapshotLock.RUnlock()
+    if len(self.snapshots) == 0 {
+        return nil, ps.ErrorNoSnapshot
+    }
+    return self.snapshots[len(self.snapshots)-1].meta, nil
+}
+
+func (self *KVStateMachine) AllSnapshotInfo() ([]*ps.SnapshotMeta, error) {
+    self.snapshotLock.RLock()
+    defer self.snapshotLock.RUnlock()
+    if len(self.snapshots) == 0 {
+        return nil, ps.ErrorNoSnapshot
+    }
+    result := make([]*ps.SnapshotMeta, 0, len(self.snapshots))
+    for i := len(self.snapshots) - 1; i >= 0; i-- {
+        result = append(result, self.snapshots[i].meta)
+    }
+    return result, nil
+}
+
+func (self *KVStateMachine) OpenSnapshot(
+    id string) (*ps.SnapshotMeta, io.ReadCloser, error) {
+
+    self.snapshotLock.RLock()
+    defer self.snapshotLock.RUnlock()
+    snapshot, _ := self.getSnapshot(id)
+    if snapshot == nil {
+        return nil, nil, ps.ErrorSnapshotNotFound
+    }
+    reader := ps.NewReaderCloserWrapper(bytes.NewReader(snapshot.data))
+    return snapshot.meta, reader, nil
+}
+
+func (self *KVStateMachine) DeleteSnapshot(id string) error {
+    self.snapshotLock.Lock()
+    defer self.snapshotLock.Unlock()
+    _, i := self.getSnapshot(id)
+    if i < 0 {
+        return ps.ErrorSnapshotNotFound
+    }
+    self.snapshots = append(self.snapshots[:i], self.snapshots[i+1:]...)
+    return nil
+}
+
+// kvSnapshotWriter receives a snapshot from the leader. The snapshot
+// becomes visible only after the writer is closed.
+type kvSnapshotWriter struct {
+    stateMachine *KVStateMachine
+    snapshot     *kvSnapshot
+    buffer       bytes.Buffer
+    closed       bool
+    lock         sync.Mutex
+}
+
+func (self *kvSnapshotWriter) Write(p []byte) (int, error) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if self.closed {
+        return 0, ErrorSnapshotClosed
+    }
+    return self.buffer.Write(p)
+}
+
+func (self *kvSnapshotWriter) Close() error {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if self.closed {
+        return ErrorSnapshotClosed
+    }
+    self.closed = true
+    self.snapshot.data = self.buffer.Bytes()
+    self.snapshot.meta.Size = uint64(len(self.snapshot.data))
+    self.stateMachine.addSnapshot(self.snapshot)
+    return nil
+}
+
+func (self *kvSnapshotWriter) ID() string {
+    return self.snapshot.meta.ID
+}
+
+func (self *kvSnapshotWriter) Cancel() error {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.closed = true
+    self.buffer.Reset()
+    return nil
+}
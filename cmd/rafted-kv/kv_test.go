@@ -0,0 +1,107 @@
+package main
+
+import (
+    "github.com/hhkbp2/rafted/kv"
+    ps "github.com/hhkbp2/rafted/persist"
+    "github.com/hhkbp2/testify/assert"
+    "github.com/hhkbp2/testify/require"
+    "io/ioutil"
+    "testing"
+)
+
+func applyKV(
+    stateMachine *KVStateMachine,
+    input *kv.Input) *kv.Output {
+
+    output, err := kv.DecodeOutput(
+        stateMachine.Apply(kv.EncodeInput(input)))
+    if err != nil {
+        panic(err)
+    }
+    return output
+}
+
+func TestKVStateMachineApply(t *testing.T) {
+    sm := NewKVStateMachine()
+    output := applyKV(sm, &kv.Input{Op: kv.Get, Key: "a"})
+    assert.False(t, output.Found)
+    output = applyKV(sm,
+        &kv.Input{Op: kv.Put, Key: "a", Value: "1"})
+    assert.False(t, output.Found)
+    output = applyKV(sm, &kv.Input{Op: kv.Get, Key: "a"})
+    assert.Equal(t, &kv.Output{Value: "1", Found: true}, output)
+    output = applyKV(sm, &kv.Input{
+        Op: kv.Cas, Key: "a", Value: "2", Expect: "0"})
+    assert.False(t, output.Ok)
+    output = applyKV(sm, &kv.Input{
+        Op: kv.Cas, Key: "a", Value: "2", Expect: "1"})
+    assert.True(t, output.Ok)
+    value, ok := sm.Get("a")
+    assert.True(t, ok)
+    assert.Equal(t, "2", value)
+    output = applyKV(sm, &kv.Input{Op: kv.Delete, Key: "a"})
+    assert.True(t, output.Found)
+    assert.Equal(t, 0, sm.Len())
+    // garbage is applied as a no-op
+    output, err := kv.DecodeOutput(sm.Apply([]byte("garbage")))
+    require.Nil(t, err)
+    assert.Equal(t, &kv.Output{}, output)
+}
+
+func TestKVStateMachineSnapshot(t *testing.T) {
+    sm := NewKVStateMachine()
+    _, err := sm.LastSnapshotInfo()
+    assert.Equal(t, ps.ErrorNoSnapshot, err)
+    applyKV(sm, &kv.Input{Op: kv.Put, Key: "a", Value: "1"})
+    applyKV(sm, &kv.Input{Op: kv.Put, Key: "b", Value: "2"})
+    conf := &ps.Config{Servers: ps.SetupSocketMultiAddrSlice(3)}
+    id, err := sm.MakeSnapshot(1, 2, conf)
+    require.Nil(t, err)
+    applyKV(sm, &kv.Input{Op: kv.Put, Key: "c", Value: "3"})
+    id2, err := sm.MakeSnapshot(1, 3, conf)
+    require.Nil(t, err)
+    metas, err := sm.AllSnapshotInfo()
+    require.Nil(t, err)
+    require.Equal(t, 2, len(metas))
+    assert.Equal(t, id2, metas[0].ID)
+    assert.Equal(t, id, metas[1].ID)
+
+    // send the first snapshot to another state machine
+    meta, reader, err := sm.OpenSnapshot(id)
+    require.Nil(t, err)
+    data, err := ioutil.ReadAll(reader)
+    require.Nil(t, err)
+    require.Nil(t, reader.Close())
+    assert.Equal(t, uint64(len(data)), meta.Size)
+    other := NewKVStateMachine()
+    writer, err := other.MakeEmptySnapshot(
+        meta.LastIncludedTerm, meta.LastIncludedIndex, meta.Conf)
+    require.Nil(t, err)
+    assert.Equal(t, id, writer.ID())
+    _, err = other.LastSnapshotInfo()
+    assert.Equal(t, ps.ErrorNoSnapshot, err)
+    _, err = writer.Write(data)
+    require.Nil(t, err)
+    require.Nil(t, writer.Close())
+    require.Nil(t, other.RestoreFromSnapshot(id))
+    assert.Equal(t, 2, other.Len())
+    value, ok := other.Get("b")
+    assert.True(t, ok)
+    assert.Equal(t, "2", value)
+
+    // a cancelled snapshot is dropped
+    writer, err = other.MakeEmptySnapshot(2, 5, conf)
+    require.Nil(t, err)
+    require.Nil(t, writer.Cancel())
+    assert.Equal(t, ErrorSnapshotClosed, writer.Close())
+    assert.Equal(t, ps.ErrorSnapshotNotFound,
+        other.RestoreFromSnapshot(writer.ID()))
+
+    require.Nil(t, sm.DeleteSnapshot(id2))
+    meta, err = sm.LastSnapshotInfo()
+    require.Nil(t, err)
+    assert.Equal(t, id, meta.ID)
+    assert.Equal(t, ps.ErrorSnapshotNotFound, sm.DeleteSnapshot(id2))
+    _, _, err = sm.OpenSnapshot(id2)
+    assert.Equal(t, ps.ErrorSnapshotNotFound, err)
+}
@@ -0,0 +1,85 @@
+// rafted-kv is a replicated key value server built on rafted. All
+// the members of a cluster are started with the same config file, see
+// ClusterConfig for its format and cluster.json for an example:
+//
+//     rafted-kv -config cluster.json -name kv1 &
+//     rafted-kv -config cluster.json -name kv2 &
+//     rafted-kv -config cluster.json -name kv3 &
+//
+// and then the store is served over http on any member:
+//
+//     curl -X PUT -d world http://127.0.0.1:8080/kv/hello
+//     curl http://127.0.0.1:8081/kv/hello
+//     curl -X POST -d again http://127.0.0.1:8082/kv/hello?expect=world
+//     curl -X DELETE http://127.0.0.1:8080/kv/hello
+//
+// The members could be inspected by raftctl on their raft addresses.
+package main
+
+import (
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "os/signal"
+    "syscall"
+)
+
+func main() {
+    os.Exit(run(os.Args[1:], os.Stdout, os.Stderr, interrupted()))
+}
+
+// interrupted returns a channel which is closed on SIGINT or SIGTERM.
+func interrupted() <-chan struct{} {
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+    done := make(chan struct{})
+    go func() {
+        <-signals
+        close(done)
+    }()
+    return done
+}
+
+// run serves as the member in args until stop is closed.
+func run(args []string, stdout, stderr io.Writer, stop <-chan struct{}) int {
+    flags := flag.NewFlagSet("rafted-kv", flag.ContinueOnError)
+    flags.SetOutput(stderr)
+    configPath := flags.String("config", "cluster.json", "cluster config file")
+    name := flags.String("name", "", "name of this member in config")
+    if err := flags.Parse(args); err != nil {
+        return 2
+    }
+    if *name == "" || flags.NArg() > 0 {
+        flags.Usage()
+        return 2
+    }
+
+    config, err := LoadConfig(*configPath)
+    if err != nil {
+        fmt.Fprintf(stderr, "rafted-kv: invalid config: %s\n", err)
+        return 1
+    }
+    server, err := NewServer(config, *name)
+    if err != nil {
+        fmt.Fprintf(stderr, "rafted-kv: fail to start: %s\n", err)
+        return 1
+    }
+    fmt.Fprintf(stdout, "rafted-kv: %s serving on %s\n", *name, server.Addr())
+    errChan := make(chan error, 1)
+    go func() {
+        errChan <- server.Serve()
+    }()
+    select {
+    case <-stop:
+        server.Close()
+        <-errChan
+    case err := <-errChan:
+        server.Close()
+        if err != nil {
+            fmt.Fprintf(stderr, "rafted-kv: %s\n", err)
+            return 1
+        }
+    }
+    return 0
+}
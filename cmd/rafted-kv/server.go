@@ -0,0 +1,339 @@
+package main
+
+import (
+    "encoding/json"
+    "github.com/hhkbp2/rafted"
+    cm "github.com/hhkbp2/rafted/comm"
+    ev "github.com/hhkbp2/rafted/event"
+    "github.com/hhkbp2/rafted/kv"
+    logging "github.com/hhkbp2/rafted/logging"
+    ps "github.com/hhkbp2/rafted/persist"
+    rt "github.com/hhkbp2/rafted/retry"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "strings"
+    "sync"
+)
+
+// KVResult is the json body of the responses to the kv requests.
+// Found tells whether the key exists before the request, and Ok tells
+// whether a cas succeeds.
+type KVResult struct {
+    Key   string `json:"key"`
+    Value string `json:"value,omitempty"`
+    Found bool   `json:"found"`
+    Ok    bool   `json:"ok,omitempty"`
+}
+
+// Handler is the http front end of the kv store:
+//
+//     GET    /kv/<key>                  get the value of key
+//     PUT    /kv/<key>                  put the request body as value
+//     DELETE /kv/<key>                  delete key
+//     POST   /kv/<key>?expect=<value>   cas the request body as value
+//     GET    /status                    status of the member
+//
+// The kv requests go through the log of the cluster by the client,
+// which redirects them to the leader. So the reads are linearizable.
+type Handler struct {
+    client rafted.Client
+    mux    *http.ServeMux
+}
+
+func NewHandler(client rafted.Client) *Handler {
+    object := &Handler{
+        client: client,
+        mux:    http.NewServeMux(),
+    }
+    object.mux.HandleFunc("/kv/", object.handleKV)
+    object.mux.HandleFunc("/status", object.handleStatus)
+    return object
+}
+
+func (self *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    self.mux.ServeHTTP(w, r)
+}
+
+func (self *Handler) handleKV(w http.ResponseWriter, r *http.Request) {
+    key := strings.TrimPrefix(r.URL.Path, "/kv/")
+    if key == "" {
+        http.Error(w, "no key", http.StatusBadRequest)
+        return
+    }
+    input := &kv.Input{Key: key}
+    switch r.Method {
+    case "GET":
+        input.Op = kv.Get
+    case "DELETE":
+        input.Op = kv.Delete
+    case "PUT", "POST":
+        value, err := ioutil.ReadAll(r.Body)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        input.Op, input.Value = kv.Put, string(value)
+        if r.Method == "POST" {
+            expect, ok := r.URL.Query()["expect"]
+            if !ok {
+                http.Error(w, "no expect for cas", http.StatusBadRequest)
+                return
+            }
+            input.Op, input.Expect = kv.Cas, expect[0]
+        }
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var data []byte
+    var err error
+    if input.Op == kv.Get {
+        data, err = self.client.ReadOnly(kv.EncodeInput(input))
+    } else {
+        data, err = self.client.Append(kv.EncodeInput(input))
+    }
+    if err != nil {
+        http.Error(w, err.Error(), statusOf(err))
+        return
+    }
+    output, err := kv.DecodeOutput(data)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    result := &KVResult{
+        Key:   key,
+        Value: output.Value,
+        Found: output.Found,
+        Ok:    output.Ok,
+    }
+    status := http.StatusOK
+    switch {
+    case input.Op == kv.Put:
+        result.Value = input.Value
+    case input.Op == kv.Cas && !output.Ok:
+        status = http.StatusConflict
+    case !output.Found:
+        status = http.StatusNotFound
+    }
+    writeJSON(w, status, result)
+}
+
+func (self *Handler) handleStatus(w http.ResponseWriter, r *http.Request) {
+    status, err := self.client.QueryNodeStatus()
+    if err != nil {
+        http.Error(w, err.Error(), statusOf(err))
+        return
+    }
+    writeJSON(w, http.StatusOK, status)
+}
+
+// statusOf returns the http status for err. The errors which go away
+// after the cluster elects a leader are reported as unavailable.
+func statusOf(err error) int {
+    switch err {
+    case rafted.Timeout, rafted.LeaderUnknown, rafted.LeaderUnsync,
+        rafted.InMemberChange:
+        return http.StatusServiceUnavailable
+    }
+    return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+    data, err := json.Marshal(v)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    w.Write(data)
+}
+
+// Server is a member of the kv cluster, which runs a raft node with
+// the kv store as its state machine, and serves the store over http.
+type Server struct {
+    name         string
+    node         *rafted.RaftNode
+    stateMachine *KVStateMachine
+    listener     net.Listener
+    httpServer   *http.Server
+    closeChan    chan interface{}
+    group        *sync.WaitGroup
+    logger       logging.Logger
+}
+
+// NewServer starts the raft node of the member with name in config,
+// and listens on its http address. Call Serve() to serve the requests.
+func NewServer(config *ClusterConfig, name string) (*Server, error) {
+    raftConfig, err := config.Configuration()
+    if err != nil {
+        return nil, err
+    }
+    member, err := config.Member(name)
+    if err != nil {
+        return nil, err
+    }
+    localAddr, err := ps.ParseServerAddress(member.Raft)
+    if err != nil {
+        return nil, err
+    }
+    clientAddr, err := ps.ParseServerAddress(member.Client)
+    if err != nil {
+        return nil, err
+    }
+    log := ps.NewMemoryLog()
+    firstLogIndex, err := log.FirstIndex()
+    if err != nil {
+        return nil, err
+    }
+    conf := &ps.Config{
+        Servers:    config.Servers(),
+        NewServers: nil,
+    }
+    configManager := ps.NewMemoryConfigManager(firstLogIndex, conf)
+    stateMachine := NewKVStateMachine()
+
+    newClient := func() cm.Client {
+        if config.Transport == "rpc" {
+            return cm.NewRPCClient(
+                raftConfig.CommClientTimeout, raftConfig.RPCClientAuth)
+        }
+        return cm.NewSocketClient(
+            raftConfig.CommPoolSize, raftConfig.CommClientTimeout)
+    }
+    genServer := func(addr *ps.ServerAddress) rafted.GenServerFunc {
+        return func(
+            handler cm.RequestEventHandler,
+            logger logging.Logger) (cm.Server, error) {
+
+            if config.Transport == "rpc" {
+                return cm.NewRPCServer(
+                    addr, raftConfig.CommServerTimeout,
+                    raftConfig.RPCServerAuth, handler, logger)
+            }
+            return cm.NewSocketServer(
+                cm.FirstAddr(addr), raftConfig.CommServerTimeout, handler,
+                logger)
+        }
+    }
+
+    backend, err := rafted.NewHSMBackendWith(
+        raftConfig,
+        localAddr,
+        configManager,
+        stateMachine,
+        log,
+        newClient(),
+        genServer(localAddr),
+        logging.GetLogger("backend#"+name))
+    if err != nil {
+        return nil, err
+    }
+    logger := logging.GetLogger("kv#" + name)
+    clientServer, err := genServer(clientAddr)(
+        func(event ev.RequestEvent) {
+            backend.Send(event)
+        },
+        logger)
+    if err != nil {
+        backend.Close()
+        return nil, err
+    }
+    redirectRetry := rt.NewErrorRetry().
+        MaxTries(3).
+        Delay(raftConfig.HeartbeatTimeout)
+    retry := redirectRetry.Copy().
+        OnError(rafted.LeaderUnknown).
+        OnError(rafted.LeaderUnsync)
+    client := rafted.NewRedirectClient(
+        raftConfig.ClientTimeout,
+        retry,
+        redirectRetry,
+        backend,
+        newClient(),
+        clientServer,
+        logger)
+    client.Start()
+    node := rafted.NewRaftNode(backend, client)
+
+    listener, err := net.Listen("tcp", member.HTTP)
+    if err != nil {
+        node.Close()
+        return nil, err
+    }
+    object := &Server{
+        name:         name,
+        node:         node,
+        stateMachine: stateMachine,
+        listener:     listener,
+        httpServer:   &http.Server{Handler: NewHandler(node)},
+        closeChan:    make(chan interface{}),
+        group:        &sync.WaitGroup{},
+        logger:       logger,
+    }
+    object.group.Add(1)
+    go object.watch()
+    return object, nil
+}
+
+// Addr returns the address the http front end listens on.
+func (self *Server) Addr() string {
+    return self.listener.Addr().String()
+}
+
+func (self *Server) Node() *rafted.RaftNode {
+    return self.node
+}
+
+func (self *Server) StateMachine() *KVStateMachine {
+    return self.stateMachine
+}
+
+// Serve serves the http requests until the server is closed.
+func (self *Server) Serve() error {
+    err := self.httpServer.Serve(self.listener)
+    if err == http.ErrServerClosed {
+        return nil
+    }
+    return err
+}
+
+func (self *Server) Close() error {
+    err := self.httpServer.Close()
+    close(self.closeChan)
+    self.group.Wait()
+    self.node.Close()
+    return err
+}
+
+// watch logs the changes of the node, and keeps its notifications
+// from piling up.
+func (self *Server) watch() {
+    defer self.group.Done()
+    notifyChan := self.node.GetNotifyChan()
+    for {
+        select {
+        case <-self.closeChan:
+            return
+        case event := <-notifyChan:
+            switch e := event.(type) {
+            case *ev.NotifyStateChangeEvent:
+                self.logger.Info("state change from %s to %s",
+                    e.OldState.String(), e.NewState.String())
+            case *ev.NotifyTermChangeEvent:
+                self.logger.Info("term change from %d to %d",
+                    e.OldTerm, e.NewTerm)
+            case *ev.NotifyLeaderChangeEvent:
+                if e.NewLeader != nil {
+                    self.logger.Info("leader change to %s",
+                        e.NewLeader.String())
+                }
+            case *ev.NotifyPersistErrorEvent:
+                self.logger.Error("persist error: %s", e.Error)
+            }
+        }
+    }
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "github.com/hhkbp2/rafted"
+    ev "github.com/hhkbp2/rafted/event"
+    ps "github.com/hhkbp2/rafted/persist"
+    "github.com/hhkbp2/rafted/rafttest"
+    "github.com/hhkbp2/testify/assert"
+    "github.com/hhkbp2/testify/require"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func doKV(t *testing.T, method, url, body string) (int, *KVResult) {
+    request, err := http.NewRequest(method, url, strings.NewReader(body))
+    require.Nil(t, err)
+    response, err := http.DefaultClient.Do(request)
+    require.Nil(t, err)
+    defer response.Body.Close()
+    result := &KVResult{}
+    if response.Header.Get("Content-Type") == "application/json" {
+        require.Nil(t, json.NewDecoder(response.Body).Decode(result))
+    }
+    return response.StatusCode, result
+}
+
+func TestHandler(t *testing.T) {
+    config := rafted.DefaultConfiguration()
+    cluster, err := rafttest.NewClusterWith(
+        config, 3, rafttest.TransportMemory,
+        func(int) ps.StateMachine {
+            return NewKVStateMachine()
+        })
+    require.Nil(t, err)
+    defer cluster.Close()
+    leader, err := cluster.WaitLeader(config.ElectionTimeout * 10)
+    require.Nil(t, err)
+    // serve on a follower, which redirects the requests to the leader
+    follower := (leader + 1) % cluster.Size()
+    server := httptest.NewServer(NewHandler(cluster.Node(follower)))
+    defer server.Close()
+    url := server.URL + "/kv/hello"
+
+    status, _ := doKV(t, "GET", url, "")
+    assert.Equal(t, http.StatusNotFound, status)
+    status, result := doKV(t, "PUT", url, "world")
+    assert.Equal(t, http.StatusOK, status)
+    assert.Equal(t, &KVResult{Key: "hello", Value: "world"}, result)
+    status, result = doKV(t, "GET", url, "")
+    assert.Equal(t, http.StatusOK, status)
+    assert.Equal(t, &KVResult{Key: "hello", Value: "world", Found: true},
+        result)
+    status, result = doKV(t, "POST", url+"?expect=nobody", "again")
+    assert.Equal(t, http.StatusConflict, status)
+    assert.False(t, result.Ok)
+    status, result = doKV(t, "POST", url+"?expect=world", "again")
+    assert.Equal(t, http.StatusOK, status)
+    assert.True(t, result.Ok)
+    status, _ = doKV(t, "POST", url, "again")
+    assert.Equal(t, http.StatusBadRequest, status)
+    status, _ = doKV(t, "DELETE", url, "")
+    assert.Equal(t, http.StatusOK, status)
+    status, _ = doKV(t, "DELETE", url, "")
+    assert.Equal(t, http.StatusNotFound, status)
+    status, _ = doKV(t, "GET", server.URL+"/kv/", "")
+    assert.Equal(t, http.StatusBadRequest, status)
+    status, _ = doKV(t, "PATCH", url, "")
+    assert.Equal(t, http.StatusMethodNotAllowed, status)
+
+    // the writes are applied on all the members
+    index, err := cluster.Log(leader).LastIndex()
+    require.Nil(t, err)
+    require.Nil(t, cluster.WaitIndex(index, config.ElectionTimeout*10))
+    for i := 0; i < cluster.Size(); i++ {
+        stateMachine, ok := cluster.StateMachine(i).(*KVStateMachine)
+        require.True(t, ok)
+        assert.Equal(t, 0, stateMachine.Len())
+    }
+
+    response, err := http.Get(server.URL + "/status")
+    require.Nil(t, err)
+    defer response.Body.Close()
+    assert.Equal(t, http.StatusOK, response.StatusCode)
+    nodeStatus := &ev.QueryNodeStatusResponse{}
+    require.Nil(t, json.NewDecoder(response.Body).Decode(nodeStatus))
+    assert.Equal(t, ev.RaftStateFollower, nodeStatus.State)
+}
+
+func testClusterConfig(size int, basePort int) *ClusterConfig {
+    config := &ClusterConfig{
+        Transport: "socket",
+        Members:   make([]*MemberConfig, 0, size),
+    }
+    for i := 0; i < size; i++ {
+        config.Members = append(config.Members, &MemberConfig{
+            Name:   fmt.Sprintf("kv%d", i),
+            Raft:   fmt.Sprintf("127.0.0.1:%d", basePort+i),
+            Client: fmt.Sprintf("127.0.0.1:%d", basePort+size+i),
+            HTTP:   "127.0.0.1:0",
+        })
+    }
+    return config
+}
+
+func TestServer(t *testing.T) {
+    config := testClusterConfig(3, 7452)
+    require.Nil(t, config.Validate())
+    servers := make([]*Server, 0, len(config.Members))
+    defer func() {
+        for _, server := range servers {
+            server.Close()
+        }
+    }()
+    for _, member := range config.Members {
+        server, err := NewServer(config, member.Name)
+        require.Nil(t, err)
+        servers = append(servers, server)
+        go server.Serve()
+    }
+    _, err := NewServer(config, "kv9")
+    assert.NotNil(t, err)
+
+    // retry until a leader is elected
+    url := "http://" + servers[0].Addr() + "/kv/hello"
+    deadline := time.Now().Add(time.Second * 5)
+    for {
+        status, _ := doKV(t, "PUT", url, "world")
+        if status == http.StatusOK {
+            break
+        }
+        require.True(t, time.Now().Before(deadline))
+        time.Sleep(time.Millisecond * 100)
+    }
+    for _, server := range servers {
+        url := "http://" + server.Addr() + "/kv/hello"
+        status, result := doKV(t, "GET", url, "")
+        require.Equal(t, http.StatusOK, status)
+        assert.Equal(t, "world", result.Value)
+    }
+}
+
+func TestRun(t *testing.T) {
+    stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+    stop := make(chan struct{})
+    assert.Equal(t, 2, run([]string{}, stdout, stderr, stop))
+    assert.Equal(t, 1, run([]string{"-config", "none.json", "-name", "kv1"},
+        stdout, stderr, stop))
+    assert.Contains(t, stderr.String(), "invalid config")
+    stderr.Reset()
+    assert.Equal(t, 1, run([]string{"-name", "kv9"}, stdout, stderr, stop))
+    assert.Contains(t, stderr.String(), "no such member")
+}
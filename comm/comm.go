@@ -1,6 +1,8 @@
 package comm
 
 import (
+    "context"
+    "errors"
     ev "github.com/hhkbp2/rafted/event"
     ps "github.com/hhkbp2/rafted/persist"
     "io"
@@ -30,12 +32,62 @@ type Connection interface {
     CallRPC(request ev.Event) (response ev.Event, err error)
 }
 
+// Client calls rpc to servers. CallRPCToContext is the same as CallRPCTo
+// except that the call is aborted with the error of ctx once ctx is done.
 type Client interface {
     CallRPCTo(
         target ps.MultiAddr, request ev.Event) (response ev.Event, err error)
+    CallRPCToContext(
+        ctx context.Context,
+        target ps.MultiAddr,
+        request ev.Event) (response ev.Event, err error)
     io.Closer
 }
 
+var (
+    ErrorNotifyMissed error = errors.New("notifies missed")
+)
+
+// NotifyStream receives the notifies of a subscription to a remote node.
+// Recv returns ErrorNotifyMissed if some notifies are lost since the last
+// one received, and the stream is still usable after that. Any other
+// error breaks the stream. Close breaks it as well.
+type NotifyStream interface {
+    Recv() (*ev.NotifyMessage, error)
+    io.Closer
+}
+
+// Subscriber subscribes to the notifies of remote nodes. The stream
+// returned is broken with the error of ctx once ctx is done.
+type Subscriber interface {
+    Subscribe(
+        ctx context.Context,
+        target ps.MultiAddr,
+        request *ev.SubscribeRequest) (
+        *ev.SubscribeResponse, NotifyStream, error)
+}
+
+// MaxPipelinedRequests is the max number of requests sent on
+// a connection and waiting for their responses. The servers read ahead
+// no more requests than that on a connection.
+const MaxPipelinedRequests = 64
+
+// PipelineConn sends requests on a dedicated connection without waiting
+// for the responses of the previous ones. The responses are received
+// in the order the requests are sent. Send and Recv could be called
+// concurrently, but neither of them by several goroutines at a time.
+// Any error breaks the connection, so do Close.
+type PipelineConn interface {
+    Send(request ev.Event) error
+    Recv() (ev.Event, error)
+    io.Closer
+}
+
+// Pipeliner opens pipelined connections to remote nodes.
+type Pipeliner interface {
+    Pipeline(target ps.MultiAddr) (PipelineConn, error)
+}
+
 type Server interface {
     Serve()
     io.Closer
@@ -43,3 +95,42 @@ type Server interface {
 
 type RequestEventHandler func(ev.RequestEvent)
 type EventHandler func(ev.Event)
+
+type rpcCaller interface {
+    CallRPC(request ev.Event) (response ev.Event, err error)
+    io.Closer
+}
+
+// callRPCWithContext calls rpc on connection, and aborts the call by
+// closing connection once ctx is done. The connection is closed
+// when the error of ctx is returned, and shouldn't be used any more.
+func callRPCWithContext(
+    ctx context.Context,
+    connection rpcCaller,
+    request ev.Event) (ev.Event, error) {
+
+    if ctx.Done() == nil {
+        return connection.CallRPC(request)
+    }
+    if err := ctx.Err(); err != nil {
+        connection.Close()
+        return nil, err
+    }
+    stopChan := make(chan struct{})
+    abortChan := make(chan bool, 1)
+    go func() {
+        select {
+        case <-ctx.Done():
+            connection.Close()
+            abortChan <- true
+        case <-stopChan:
+            abortChan <- false
+        }
+    }()
+    response, err := connection.CallRPC(request)
+    close(stopChan)
+    if <-abortChan {
+        return nil, ctx.Err()
+    }
+    return response, err
+}
@@ -0,0 +1,355 @@
+package comm
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    ck "github.com/hhkbp2/rafted/clock"
+    ev "github.com/hhkbp2/rafted/event"
+    logging "github.com/hhkbp2/rafted/logging"
+    ps "github.com/hhkbp2/rafted/persist"
+    "sync"
+    "time"
+)
+
+// GroupClient is the client of a raft group running on a shared client.
+// It wraps every request with the group id before sending it, and
+// leaves the shared client open on Close() since other groups are
+// still using it. The heartbeats, that is AppendEntriesRequests without
+// any entry, are sent through coalescer if it's not nil.
+type GroupClient struct {
+    groupID   uint64
+    client    Client
+    coalescer *HeartbeatCoalescer
+}
+
+func NewGroupClient(
+    groupID uint64,
+    client Client,
+    coalescer *HeartbeatCoalescer) *GroupClient {
+
+    return &GroupClient{
+        groupID:   groupID,
+        client:    client,
+        coalescer: coalescer,
+    }
+}
+
+func (self *GroupClient) CallRPCTo(
+    target ps.MultiAddr, request ev.Event) (response ev.Event, err error) {
+
+    return self.CallRPCToContext(context.Background(), target, request)
+}
+
+// CallRPCToContext aborts the call once ctx is done, except for
+// the heartbeats sent through coalescer, which wait for their batches.
+func (self *GroupClient) CallRPCToContext(
+    ctx context.Context,
+    target ps.MultiAddr,
+    request ev.Event) (response ev.Event, err error) {
+
+    if e, ok := request.(*ev.AppendEntriesRequestEvent); ok &&
+        (self.coalescer != nil) && (len(e.Request.Entries) == 0) {
+
+        response, err := self.coalescer.Heartbeat(
+            target, self.groupID, e.Request)
+        if err != nil {
+            return nil, err
+        }
+        return ev.NewAppendEntriesResponseEvent(response), nil
+    }
+    reqEvent, ok := request.(ev.RequestEvent)
+    if !ok {
+        return nil, errors.New("not request event")
+    }
+    event, err := self.client.CallRPCToContext(
+        ctx, target, ev.NewGroupRequestEvent(self.groupID, reqEvent))
+    if err != nil {
+        return nil, err
+    }
+    if event.Type() == ev.EventGroupUnknownResponse {
+        return nil, errors.New(fmt.Sprintf(
+            "group %d unknown to target: %s", self.groupID, target))
+    }
+    return event, nil
+}
+
+func (self *GroupClient) Close() error {
+    return nil
+}
+
+// GroupMux dispatches the requests received by a shared server to
+// the handlers of the raft groups. Requests for unknown groups are
+// answered with GroupUnknownResponseEvent right away, so that they
+// never block the connection they come from. The heartbeats coalesced
+// in one request are dispatched to their groups one by one, and the
+// responses not made in heartbeatTimeout of clock are left out.
+type GroupMux struct {
+    handlers         map[uint64]RequestEventHandler
+    handlerLock      sync.RWMutex
+    heartbeatTimeout time.Duration
+    clock            ck.Clock
+    logger           logging.Logger
+}
+
+func NewGroupMux(
+    heartbeatTimeout time.Duration,
+    clock ck.Clock,
+    logger logging.Logger) *GroupMux {
+
+    return &GroupMux{
+        handlers:         make(map[uint64]RequestEventHandler),
+        heartbeatTimeout: heartbeatTimeout,
+        clock:            clock,
+        logger:           logger,
+    }
+}
+
+func (self *GroupMux) Register(
+    groupID uint64, handler RequestEventHandler) error {
+
+    self.handlerLock.Lock()
+    defer self.handlerLock.Unlock()
+    if _, ok := self.handlers[groupID]; ok {
+        return errors.New(fmt.Sprintf("group %d already registered", groupID))
+    }
+    self.handlers[groupID] = handler
+    return nil
+}
+
+func (self *GroupMux) Unregister(groupID uint64) {
+    self.handlerLock.Lock()
+    defer self.handlerLock.Unlock()
+    delete(self.handlers, groupID)
+}
+
+func (self *GroupMux) getHandler(
+    groupID uint64) (RequestEventHandler, bool) {
+
+    self.handlerLock.RLock()
+    defer self.handlerLock.RUnlock()
+    handler, ok := self.handlers[groupID]
+    return handler, ok
+}
+
+// Handle is the RequestEventHandler for the shared server.
+func (self *GroupMux) Handle(event ev.RequestEvent) {
+    if e, ok := event.(*ev.GroupHeartbeatRequestEvent); ok {
+        self.handleHeartbeats(e)
+        return
+    }
+    e, ok := event.(*ev.GroupRequestEvent)
+    if !ok {
+        self.logger.Warning("receive request: %s without group id",
+            ev.EventString(event))
+        event.SendResponse(ev.NewGroupUnknownResponseEvent(
+            &ev.GroupUnknownResponse{}))
+        return
+    }
+    handler, ok := self.getHandler(e.GroupID)
+    if !ok {
+        self.logger.Debug("receive request: %s for unknown group %d",
+            ev.EventString(e.Request), e.GroupID)
+        e.SendResponse(ev.NewGroupUnknownResponseEvent(
+            &ev.GroupUnknownResponse{
+                GroupID: e.GroupID,
+            }))
+        return
+    }
+    handler(e.Request)
+}
+
+func (self *GroupMux) handleHeartbeats(
+    event *ev.GroupHeartbeatRequestEvent) {
+
+    request := event.Request
+    events := make([]*ev.AppendEntriesRequestEvent, len(request.Heartbeats))
+    for i, heartbeat := range request.Heartbeats {
+        handler, ok := self.getHandler(heartbeat.GroupID)
+        if !ok {
+            self.logger.Debug("receive heartbeat for unknown group %d",
+                heartbeat.GroupID)
+            continue
+        }
+        events[i] = ev.NewAppendEntriesRequestEvent(&ev.AppendEntriesRequest{
+            Term:              heartbeat.Term,
+            Leader:            request.Leader,
+            PrevLogTerm:       heartbeat.PrevLogTerm,
+            PrevLogIndex:      heartbeat.PrevLogIndex,
+            Entries:           make([]*ps.LogEntry, 0),
+            LeaderCommitIndex: heartbeat.LeaderCommitIndex,
+        })
+        handler(events[i])
+    }
+    responses := make([]*ev.AppendEntriesResponse, len(events))
+    timer := self.clock.NewTimer(self.heartbeatTimeout)
+    defer timer.Stop()
+Outermost:
+    for i, e := range events {
+        if e == nil {
+            continue
+        }
+        select {
+        case respEvent := <-e.GetResponseChan():
+            resp, ok := respEvent.(*ev.AppendEntriesResponseEvent)
+            if ok {
+                responses[i] = resp.Response
+            }
+        case <-timer.Chan():
+            self.logger.Warning("heartbeat responses time out after %s",
+                self.heartbeatTimeout)
+            break Outermost
+        }
+    }
+    event.SendResponse(ev.NewGroupHeartbeatResponseEvent(
+        &ev.GroupHeartbeatResponse{
+            Responses: responses,
+        }))
+}
+
+// GroupServer is the server of a raft group running on a shared server.
+// It registers the handler of the group to the mux of the shared server
+// instead of listening on its own, and unregisters it on Close().
+type GroupServer struct {
+    groupID uint64
+    mux     *GroupMux
+}
+
+func NewGroupServer(
+    groupID uint64,
+    handler RequestEventHandler,
+    mux *GroupMux) (*GroupServer, error) {
+
+    if err := mux.Register(groupID, handler); err != nil {
+        return nil, err
+    }
+    return &GroupServer{
+        groupID: groupID,
+        mux:     mux,
+    }, nil
+}
+
+func (self *GroupServer) Serve() {
+    // the shared server is serving already
+}
+
+func (self *GroupServer) Close() error {
+    self.mux.Unregister(self.groupID)
+    return nil
+}
+
+// HeartbeatCoalescer batches the heartbeats of all the raft groups
+// on a host. The heartbeats to the same destination host in an interval
+// are sent in one GroupHeartbeatRequestEvent, so that the number of
+// heartbeat messages scales with the hosts instead of the groups.
+// Each heartbeat waits for the batch it's in, which delays it for at most
+// an interval.
+type HeartbeatCoalescer struct {
+    client    Client
+    interval  time.Duration
+    clock     ck.Clock
+    batches   map[string]*heartbeatBatch
+    batchLock sync.Mutex
+    logger    logging.Logger
+}
+
+type heartbeatCall struct {
+    heartbeat  *ev.GroupHeartbeat
+    resultChan chan *ev.AppendEntriesResponse
+}
+
+type heartbeatBatch struct {
+    target ps.MultiAddr
+    leader *ps.ServerAddress
+    calls  []*heartbeatCall
+}
+
+func NewHeartbeatCoalescer(
+    client Client,
+    interval time.Duration,
+    clock ck.Clock,
+    logger logging.Logger) *HeartbeatCoalescer {
+
+    return &HeartbeatCoalescer{
+        client:   client,
+        interval: interval,
+        clock:    clock,
+        batches:  make(map[string]*heartbeatBatch),
+        logger:   logger,
+    }
+}
+
+// Heartbeat sends request of group groupID to target in the next batch,
+// and returns the response of the group.
+func (self *HeartbeatCoalescer) Heartbeat(
+    target ps.MultiAddr,
+    groupID uint64,
+    request *ev.AppendEntriesRequest) (*ev.AppendEntriesResponse, error) {
+
+    call := &heartbeatCall{
+        heartbeat: &ev.GroupHeartbeat{
+            GroupID:           groupID,
+            Term:              request.Term,
+            PrevLogTerm:       request.PrevLogTerm,
+            PrevLogIndex:      request.PrevLogIndex,
+            LeaderCommitIndex: request.LeaderCommitIndex,
+        },
+        resultChan: make(chan *ev.AppendEntriesResponse, 1),
+    }
+    key := addrKey(target)
+    self.batchLock.Lock()
+    batch, ok := self.batches[key]
+    if !ok {
+        batch = &heartbeatBatch{
+            target: target,
+            leader: request.Leader,
+        }
+        self.batches[key] = batch
+        go self.flushAfterInterval(key, batch)
+    }
+    batch.calls = append(batch.calls, call)
+    self.batchLock.Unlock()
+
+    response := <-call.resultChan
+    if response == nil {
+        return nil, errors.New(fmt.Sprintf(
+            "no heartbeat response of group %d from target: %s",
+            groupID, target))
+    }
+    return response, nil
+}
+
+func (self *HeartbeatCoalescer) flushAfterInterval(
+    key string, batch *heartbeatBatch) {
+
+    <-self.clock.After(self.interval)
+    self.batchLock.Lock()
+    delete(self.batches, key)
+    self.batchLock.Unlock()
+
+    heartbeats := make([]*ev.GroupHeartbeat, 0, len(batch.calls))
+    for _, call := range batch.calls {
+        heartbeats = append(heartbeats, call.heartbeat)
+    }
+    request := &ev.GroupHeartbeatRequest{
+        Leader:     batch.leader,
+        Heartbeats: heartbeats,
+    }
+    responses := make([]*ev.AppendEntriesResponse, len(batch.calls))
+    respEvent, err := self.client.CallRPCTo(
+        batch.target, ev.NewGroupHeartbeatRequestEvent(request))
+    if err != nil {
+        self.logger.Error("fail to send heartbeats to target: %s, error: %s",
+            batch.target, err)
+    } else if e, ok := respEvent.(*ev.GroupHeartbeatResponseEvent); ok &&
+        (len(e.Response.Responses) == len(batch.calls)) {
+
+        responses = e.Response.Responses
+    } else {
+        self.logger.Error("receive invalid response: %s for heartbeats",
+            ev.EventString(respEvent))
+    }
+    for i, call := range batch.calls {
+        call.resultChan <- responses[i]
+    }
+}
@@ -0,0 +1,165 @@
+package comm
+
+import (
+    "errors"
+    "fmt"
+    ck "github.com/hhkbp2/rafted/clock"
+    ev "github.com/hhkbp2/rafted/event"
+    logging "github.com/hhkbp2/rafted/logging"
+    ps "github.com/hhkbp2/rafted/persist"
+    "github.com/hhkbp2/testify/assert"
+    "github.com/hhkbp2/testify/require"
+    "sync"
+    "sync/atomic"
+    "testing"
+)
+
+func getTestGroupHandler(
+    t *testing.T,
+    reqEvent *ev.AppendEntriesRequestEvent,
+    term uint64) RequestEventHandler {
+
+    return func(event ev.RequestEvent) {
+        e, ok := event.(*ev.AppendEntriesRequestEvent)
+        assert.True(t, ok)
+        assert.Equal(t, reqEvent.Request, e.Request)
+        response := &ev.AppendEntriesResponse{
+            Term:    term,
+            Success: true,
+        }
+        e.SendResponse(ev.NewAppendEntriesResponseEvent(response))
+    }
+}
+
+func TestGroupMux(t *testing.T) {
+    addr := ps.RandomMemoryMultiAddr()
+    register := NewMemoryTransportRegister()
+    logger := logging.GetLogger("test")
+    reqEvent, _ := getTestAppendEntriesEvents(addr)
+    mux := NewGroupMux(testTimeout, ck.DefaultClock, logger)
+    server := NewMemoryServer(addr, testTimeout, mux.Handle, register, logger)
+    server.Serve()
+    client := NewMemoryClient(testPoolSize, testTimeout, register)
+    // two groups share the same server and client
+    server1, err := NewGroupServer(1, getTestGroupHandler(t, reqEvent, 1), mux)
+    require.Nil(t, err)
+    server2, err := NewGroupServer(2, getTestGroupHandler(t, reqEvent, 2), mux)
+    require.Nil(t, err)
+    _, err = NewGroupServer(2, getTestGroupHandler(t, reqEvent, 2), mux)
+    assert.NotNil(t, err)
+    for _, groupID := range []uint64{1, 2} {
+        groupClient := NewGroupClient(groupID, client, nil)
+        event, err := groupClient.CallRPCTo(addr, reqEvent)
+        require.Nil(t, err)
+        e, ok := event.(*ev.AppendEntriesResponseEvent)
+        require.True(t, ok)
+        assert.Equal(t, groupID, e.Response.Term)
+    }
+    // requests for unknown groups fail without affecting other groups
+    _, err = NewGroupClient(3, client, nil).CallRPCTo(addr, reqEvent)
+    assert.NotNil(t, err)
+    event, err := client.CallRPCTo(addr, reqEvent)
+    require.Nil(t, err)
+    assert.Equal(t, ev.EventGroupUnknownResponse, event.Type())
+    server1.Close()
+    _, err = NewGroupClient(1, client, nil).CallRPCTo(addr, reqEvent)
+    assert.NotNil(t, err)
+    _, err = NewGroupClient(2, client, nil).CallRPCTo(addr, reqEvent)
+    assert.Nil(t, err)
+    // closing a group client leaves the shared client open
+    err = NewGroupClient(2, client, nil).Close()
+    assert.Nil(t, err)
+    _, err = NewGroupClient(2, client, nil).CallRPCTo(addr, reqEvent)
+    assert.Nil(t, err)
+    server2.Close()
+    client.Close()
+    err = server.Close()
+    assert.Nil(t, err)
+}
+
+type countingClient struct {
+    Client
+    count int32
+}
+
+func (self *countingClient) CallRPCTo(
+    target ps.MultiAddr, request ev.Event) (response ev.Event, err error) {
+
+    atomic.AddInt32(&self.count, 1)
+    return self.Client.CallRPCTo(target, request)
+}
+
+func TestHeartbeatCoalescer(t *testing.T) {
+    addr := ps.RandomMemoryMultiAddr()
+    register := NewMemoryTransportRegister()
+    logger := logging.GetLogger("test")
+    request := &ev.AppendEntriesRequest{
+        Term:              100,
+        Leader:            addr,
+        PrevLogTerm:       8,
+        PrevLogIndex:      199,
+        Entries:           make([]*ps.LogEntry, 0),
+        LeaderCommitIndex: 173,
+    }
+    reqEvent := ev.NewAppendEntriesRequestEvent(request)
+    mux := NewGroupMux(testTimeout, ck.DefaultClock, logger)
+    server := NewMemoryServer(addr, testTimeout, mux.Handle, register, logger)
+    server.Serve()
+    groupSize := uint64(10)
+    for groupID := uint64(1); groupID <= groupSize; groupID++ {
+        _, err := NewGroupServer(
+            groupID, getTestGroupHandler(t, reqEvent, groupID), mux)
+        require.Nil(t, err)
+    }
+    client := &countingClient{
+        Client: NewMemoryClient(testPoolSize, testTimeout, register),
+    }
+    coalescer := NewHeartbeatCoalescer(client, testTimeout, ck.DefaultClock,
+        logger)
+    // the heartbeats of all groups, including an unknown one, are sent
+    // in one message and their responses are fanned out to each group
+    errChan := make(chan error, groupSize+1)
+    var group sync.WaitGroup
+    for groupID := uint64(1); groupID <= groupSize+1; groupID++ {
+        group.Add(1)
+        go func(groupID uint64) {
+            defer group.Done()
+            groupClient := NewGroupClient(groupID, client, coalescer)
+            event, err := groupClient.CallRPCTo(
+                addr, ev.NewAppendEntriesRequestEvent(request))
+            if groupID > groupSize {
+                if err == nil {
+                    errChan <- errors.New(fmt.Sprintf(
+                        "group %d: no error for unknown group", groupID))
+                }
+                return
+            }
+            if err != nil {
+                errChan <- errors.New(fmt.Sprintf(
+                    "group %d: %s", groupID, err))
+                return
+            }
+            e, ok := event.(*ev.AppendEntriesResponseEvent)
+            if !ok {
+                errChan <- errors.New(fmt.Sprintf(
+                    "group %d: unexpected response: %s",
+                    groupID, ev.EventString(event)))
+                return
+            }
+            if e.Response.Term != groupID {
+                errChan <- errors.New(fmt.Sprintf(
+                    "group %d: response of group %d",
+                    groupID, e.Response.Term))
+            }
+        }(groupID)
+    }
+    group.Wait()
+    close(errChan)
+    for err := range errChan {
+        assert.Nil(t, err)
+    }
+    assert.Equal(t, int32(1), atomic.LoadInt32(&client.count))
+    client.Close()
+    err := server.Close()
+    assert.Nil(t, err)
+}
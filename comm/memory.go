@@ -3,8 +3,10 @@ package comm
 import (
     "bufio"
     "bytes"
+    "context"
     "errors"
     "fmt"
+    ck "github.com/hhkbp2/rafted/clock"
     ev "github.com/hhkbp2/rafted/event"
     logging "github.com/hhkbp2/rafted/logging"
     ps "github.com/hhkbp2/rafted/persist"
@@ -23,6 +25,8 @@ var (
         "timeout on memory transport read")
     MemoryTransportWriteTimeout error = errors.New(
         "timeout on memory transport write")
+    MemoryTransportClosed error = errors.New(
+        "memory transport closed")
 )
 
 func FirstAddr(multiAddr ps.MultiAddr) ps.Addr {
@@ -44,6 +48,8 @@ type MemoryServerTransport struct {
     ConsumeCh  chan *TransportChunk
     ResponseCh chan []byte
     register   *MemoryTransportRegister
+    closeChan  chan interface{}
+    closeOnce  sync.Once
 }
 
 func NewMemoryServerTransport(
@@ -53,8 +59,10 @@ func NewMemoryServerTransport(
 
     return &MemoryServerTransport{
         addr:      addr,
+        timeout:   timeout,
         ConsumeCh: make(chan *TransportChunk, DefaultTransportBufferSize),
         register:  register,
+        closeChan: make(chan interface{}),
     }
 }
 
@@ -64,23 +72,33 @@ func (self *MemoryServerTransport) Open() error {
 }
 
 func (self *MemoryServerTransport) ReadNextMessage() *TransportChunk {
-    chunk := <-self.ConsumeCh
+    chunk, _ := self.ReadChunk()
     return chunk
 }
 
 func (self *MemoryServerTransport) ReadChunk() (*TransportChunk, error) {
-    chunk, ok := <-self.ConsumeCh
-    if ok {
+    select {
+    case chunk := <-self.ConsumeCh:
         return chunk, nil
+    case <-self.closeChan:
+        return nil, io.EOF
     }
-    return nil, io.EOF
 }
 
 func (self *MemoryServerTransport) WriteChunk(chunk *TransportChunk) error {
+    select {
+    case <-self.closeChan:
+        return MemoryTransportClosed
+    default:
+    }
+    timer := self.register.Clock().NewTimer(self.timeout)
+    defer timer.Stop()
     select {
     case self.ConsumeCh <- chunk:
         return nil
-    case <-time.After(self.timeout):
+    case <-self.closeChan:
+        return MemoryTransportClosed
+    case <-timer.Chan():
         return MemoryTransportWriteTimeout
     }
 }
@@ -99,7 +117,9 @@ func (self *MemoryServerTransport) Read(p []byte) (int, error) {
         return 0, err
     }
     n := BytesCopy(p, chunk.Data)
-    self.ResponseCh = chunk.SourceCh
+    if self.ResponseCh == nil {
+        self.ResponseCh = chunk.SourceCh
+    }
     return n, nil
 }
 
@@ -111,11 +131,16 @@ func (self *MemoryServerTransport) Write(p []byte) (int, error) {
     return 0, errors.New("don't know where to response")
 }
 
+// Close stops the transport. ConsumeCh is left open, since the clients
+// holding this transport may still write to it. They get
+// MemoryTransportClosed instead.
 func (self *MemoryServerTransport) Close() error {
-    close(self.ConsumeCh)
-    if self.ResponseCh != nil {
-        close(self.ResponseCh)
-    }
+    self.closeOnce.Do(func() {
+        close(self.closeChan)
+        if self.ResponseCh != nil {
+            close(self.ResponseCh)
+        }
+    })
     return self.register.Unregister(FirstAddr(self.addr).String())
 }
 
@@ -126,14 +151,38 @@ func (self *MemoryServerTransport) Addr() ps.MultiAddr {
 type MemoryTransportRegister struct {
     sync.RWMutex
     transports map[string]*MemoryServerTransport
+    clock      ck.Clock
+    faults     *MemoryFaults
 }
 
 func NewMemoryTransportRegister() *MemoryTransportRegister {
     return &MemoryTransportRegister{
         transports: make(map[string]*MemoryServerTransport),
+        clock:      ck.DefaultClock,
+        faults:     NewMemoryFaults(),
     }
 }
 
+// Faults returns the faults injected into all the transports
+// in this register.
+func (self *MemoryTransportRegister) Faults() *MemoryFaults {
+    return self.faults
+}
+
+// SetClock sets the clock used by all the transports in this register
+// for their timeouts.
+func (self *MemoryTransportRegister) SetClock(clock ck.Clock) {
+    self.Lock()
+    defer self.Unlock()
+    self.clock = clock
+}
+
+func (self *MemoryTransportRegister) Clock() ck.Clock {
+    self.RLock()
+    defer self.RUnlock()
+    return self.clock
+}
+
 func (self *MemoryTransportRegister) Register(
     id string, transport *MemoryServerTransport) {
 
@@ -184,6 +233,8 @@ type MemoryTransport struct {
     consumeCh chan []byte
     register  *MemoryTransportRegister
     peer      *MemoryServerTransport
+    closeChan chan interface{}
+    closeOnce sync.Once
 }
 
 func NewMemoryTransport(
@@ -196,6 +247,7 @@ func NewMemoryTransport(
         timeout:   timeout,
         consumeCh: make(chan []byte, DefaultTransportBufferSize),
         register:  register,
+        closeChan: make(chan interface{}),
     }
 }
 
@@ -212,17 +264,25 @@ func (self *MemoryTransport) Open() error {
         "no server transport for id: %v", FirstAddr(self.addr).String()))
 }
 
+// Close aborts the pending read on the transport, which fails
+// with MemoryTransportClosed.
 func (self *MemoryTransport) Close() error {
-    // empty body
+    self.closeOnce.Do(func() {
+        close(self.closeChan)
+    })
     return nil
 }
 
 func (self *MemoryTransport) Read(b []byte) (int, error) {
+    timer := self.register.Clock().NewTimer(self.timeout)
+    defer timer.Stop()
     select {
     case data := <-self.consumeCh:
         n := BytesCopy(b, data)
         return n, nil
-    case <-time.After(self.timeout):
+    case <-self.closeChan:
+        return 0, MemoryTransportClosed
+    case <-timer.Chan():
         return 0, MemoryTransportReadTimeout
     }
 }
@@ -281,9 +341,10 @@ type MemoryClient struct {
     connectionPool     map[string][]*MemoryConnection
     connectionPoolLock sync.Mutex
 
-    poolSize int
-    timeout  time.Duration
-    register *MemoryTransportRegister
+    poolSize  int
+    timeout   time.Duration
+    register  *MemoryTransportRegister
+    localAddr ps.MultiAddr
 }
 
 func NewMemoryClient(
@@ -299,19 +360,147 @@ func NewMemoryClient(
     }
 }
 
+// SetLocalAddr sets the address this client sends from, which is
+// the source of links when injecting faults.
+func (self *MemoryClient) SetLocalAddr(addr ps.MultiAddr) {
+    self.localAddr = addr
+}
+
 func (self *MemoryClient) CallRPCTo(
     target ps.MultiAddr, request ev.Event) (response ev.Event, err error) {
 
+    return self.CallRPCToContext(context.Background(), target, request)
+}
+
+func (self *MemoryClient) CallRPCToContext(
+    ctx context.Context,
+    target ps.MultiAddr,
+    request ev.Event) (response ev.Event, err error) {
+
+    faults := self.register.Faults()
+    if (self.localAddr == nil) && faults.Injected() {
+        // the faults would be looked up for the wrong links
+        panic("memory client sends with faults injected but no local " +
+            "addr, call SetLocalAddr() on it")
+    }
+    clock := self.register.Clock().Fork(
+        addrKey(self.localAddr) + ">" + addrKey(target))
+    duplicate, err := faults.deliver(
+        clock, self.localAddr, target, self.timeout)
+    if err != nil {
+        return nil, err
+    }
+
     connection, err := self.getConnection(target)
     if err != nil {
         return nil, err
     }
 
-    response, err = connection.CallRPC(request)
-    if err == nil {
-        self.returnConnectionToPool(connection)
+    response, err = callRPCWithContext(ctx, connection, request)
+    if err == nil && duplicate {
+        response, err = callRPCWithContext(ctx, connection, request)
+    }
+    if err != nil {
+        return nil, err
+    }
+    self.returnConnectionToPool(connection)
+
+    // the response is sent back on the link in the opposite direction
+    if _, err := faults.deliver(
+        clock, target, self.localAddr, self.timeout); err != nil {
+
+        return nil, err
+    }
+    return response, nil
+}
+
+// Pipeline opens a connection to target for pipelined requests only,
+// which is never pooled. The faults are applied to every request and
+// response on it.
+func (self *MemoryClient) Pipeline(
+    target ps.MultiAddr) (PipelineConn, error) {
+
+    faults := self.register.Faults()
+    if (self.localAddr == nil) && faults.Injected() {
+        panic("memory client sends with faults injected but no local " +
+            "addr, call SetLocalAddr() on it")
+    }
+    connection := NewMemoryConnection(target, self.timeout, self.register)
+    if err := connection.Open(); err != nil {
+        return nil, err
+    }
+    clock := self.register.Clock().Fork(
+        addrKey(self.localAddr) + ">" + addrKey(target))
+    return &memoryPipelineConn{
+        MemoryConnection: connection,
+        faults:           faults,
+        clock:            clock,
+        local:            self.localAddr,
+        target:           target,
+    }, nil
+}
+
+// memoryPipelineConn is a MemoryConnection for pipelined requests.
+// A duplicated request gets two responses, the later of which
+// is dropped.
+type memoryPipelineConn struct {
+    *MemoryConnection
+    faults     *MemoryFaults
+    clock      ck.Clock
+    local      ps.MultiAddr
+    target     ps.MultiAddr
+    duplicates []bool
+    lock       sync.Mutex
+}
+
+func (self *memoryPipelineConn) Send(request ev.Event) error {
+    duplicate, err := self.faults.deliver(
+        self.clock, self.local, self.target, self.timeout)
+    if err != nil {
+        self.Close()
+        return err
+    }
+    self.lock.Lock()
+    self.duplicates = append(self.duplicates, duplicate)
+    self.lock.Unlock()
+    times := 1
+    if duplicate {
+        times = 2
+    }
+    for i := 0; i < times; i++ {
+        if err := WriteEvent(self.writer, self.encoder, request); err != nil {
+            self.Close()
+            return err
+        }
+    }
+    return nil
+}
+
+func (self *memoryPipelineConn) Recv() (ev.Event, error) {
+    self.lock.Lock()
+    if len(self.duplicates) == 0 {
+        self.lock.Unlock()
+        return nil, errors.New("no request waiting for response")
+    }
+    duplicate := self.duplicates[0]
+    self.duplicates = self.duplicates[1:]
+    self.lock.Unlock()
+    event, err := ReadResponse(self.reader, self.decoder)
+    if err == nil && duplicate {
+        _, err = ReadResponse(self.reader, self.decoder)
+    }
+    if err != nil {
+        self.Close()
+        return nil, err
+    }
+    // the response is sent back on the link in the opposite direction
+    if _, err := self.faults.deliver(
+        self.clock, self.target, self.local, self.timeout); err != nil {
+
+        self.Close()
+        return nil, err
     }
-    return response, err
+    return event, nil
 }
 
 func (self *MemoryClient) getConnectionFromPool(
@@ -450,6 +639,8 @@ func (self *MemoryServer) Serve() {
     go routine()
 }
 
+// handleConn serves the requests on transport in a pipelined way,
+// just like SocketServer does.
 func (self *MemoryServer) handleConn(
     transport *MemoryServerTransport) {
 
@@ -462,41 +653,48 @@ func (self *MemoryServer) handleConn(
     decoder := codec.NewDecoder(reader, &codec.MsgpackHandle{})
     encoder := codec.NewEncoder(writer, &codec.MsgpackHandle{})
 
-    for {
-        if err := self.handleCommand(
-            reader, writer, decoder, encoder); err != nil {
+    pending := make(chan ev.RequestEvent, MaxPipelinedRequests)
+    writerDone := make(chan struct{})
+    go func() {
+        defer close(writerDone)
+        self.writeResponses(writer, encoder, pending)
+    }()
+    defer func() {
+        close(pending)
+        <-writerDone
+    }()
 
+    for {
+        event, err := ReadRequest(reader, decoder)
+        if err != nil {
             if err != io.EOF {
                 self.logger.Error(
-                    "memory server fails to handle command, error: %s", err)
+                    "memory server fails to read request, error: %s", err)
             }
             return
         }
-        if err := writer.Flush(); err != nil {
-            self.logger.Error(
-                "memory server fails to flush writer, error: %s", err)
-            return
-        }
+        self.eventHandler(event)
+        pending <- event
     }
 }
 
-func (self *MemoryServer) handleCommand(
-    reader *bufio.Reader,
+func (self *MemoryServer) writeResponses(
     writer *bufio.Writer,
-    decoder Decoder,
-    encoder Encoder) error {
-
-    event, err := ReadRequest(reader, decoder)
-    if err != nil {
-        return err
-    }
-
-    self.eventHandler(event)
-    response := event.RecvResponse()
-    if err := WriteEvent(writer, encoder, response); err != nil {
-        return err
+    encoder Encoder,
+    pending <-chan ev.RequestEvent) {
+
+    broken := false
+    for event := range pending {
+        response := event.RecvResponse()
+        if broken {
+            continue
+        }
+        if err := WriteEvent(writer, encoder, response); err != nil {
+            self.logger.Error(
+                "memory server fails to write response, error: %s", err)
+            broken = true
+        }
     }
-    return nil
 }
 
 func (self *MemoryServer) Close() error {
@@ -0,0 +1,274 @@
+package comm
+
+import (
+    ck "github.com/hhkbp2/rafted/clock"
+    ps "github.com/hhkbp2/rafted/persist"
+    rt "github.com/hhkbp2/rafted/retry"
+    "sync"
+    "time"
+)
+
+// LinkFault describes the faults injected into the messages sent on
+// a link from one address to another.
+type LinkFault struct {
+    // probability to drop a message
+    Drop float64
+    // probability to deliver a request twice
+    Duplicate float64
+    // probability to hold a message back by ReorderDelay, so that
+    // the messages sent after it could overtake it. A caller waits for
+    // the response of its request, so only the messages of concurrent
+    // callers on a link are reordered, never the ones of a single caller.
+    Reorder      float64
+    ReorderDelay time.Duration
+    // every message is delayed by Delay plus a random jitter in [0, Jitter)
+    Delay  time.Duration
+    Jitter time.Duration
+}
+
+type memoryLink struct {
+    from string
+    to   string
+}
+
+// MemoryFaults holds all the faults injected into the memory transports
+// registered in a MemoryTransportRegister. It could be changed at runtime.
+// A lost message is reported to the sender as a timeout after the timeout
+// of the sender passes, just like a real network.
+// The links are keyed by the addresses of both ends, so a client sending
+// with any fault injected must have its local address set.
+type MemoryFaults struct {
+    cuts         map[memoryLink]bool
+    links        map[memoryLink]*LinkFault
+    defaultFault *LinkFault
+    paused       map[string]chan interface{}
+    random       rt.Random
+    randoms      map[memoryLink]rt.Random
+    lock         sync.RWMutex
+}
+
+func NewMemoryFaults() *MemoryFaults {
+    return &MemoryFaults{
+        cuts:    make(map[memoryLink]bool),
+        links:   make(map[memoryLink]*LinkFault),
+        paused:  make(map[string]chan interface{}),
+        random:  rt.DefaultRandom,
+        randoms: make(map[memoryLink]rt.Random),
+    }
+}
+
+func addrKey(addr ps.MultiAddr) string {
+    if addr == nil {
+        return ""
+    }
+    return FirstAddr(addr).String()
+}
+
+// SetRandom sets the random source of all the probabilities and jitters.
+// Every link draws from its own fork of random, so the draws on a link
+// don't depend on the traffic on other links.
+func (self *MemoryFaults) SetRandom(random rt.Random) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.random = random
+    self.randoms = make(map[memoryLink]rt.Random)
+}
+
+// Partition cuts all the links between addresses in different groups,
+// in both directions.
+func (self *MemoryFaults) Partition(groups ...[]ps.MultiAddr) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    for i, group := range groups {
+        for j, other := range groups {
+            if i == j {
+                continue
+            }
+            for _, from := range group {
+                for _, to := range other {
+                    self.cuts[memoryLink{addrKey(from), addrKey(to)}] = true
+                }
+            }
+        }
+    }
+}
+
+// Cut cuts the link from one address to another in one direction.
+func (self *MemoryFaults) Cut(from, to ps.MultiAddr) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.cuts[memoryLink{addrKey(from), addrKey(to)}] = true
+}
+
+// HealLink restores the link from one address to another.
+func (self *MemoryFaults) HealLink(from, to ps.MultiAddr) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    delete(self.cuts, memoryLink{addrKey(from), addrKey(to)})
+}
+
+// Heal restores all the cut links.
+func (self *MemoryFaults) Heal() {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.cuts = make(map[memoryLink]bool)
+}
+
+// SetLinkFault sets the faults on the link from one address to another.
+// A nil fault removes the faults on the link.
+func (self *MemoryFaults) SetLinkFault(
+    from, to ps.MultiAddr, fault *LinkFault) {
+
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    link := memoryLink{addrKey(from), addrKey(to)}
+    if fault == nil {
+        delete(self.links, link)
+        return
+    }
+    self.links[link] = fault
+}
+
+// SetDefaultFault sets the faults on all the links with no specified faults.
+func (self *MemoryFaults) SetDefaultFault(fault *LinkFault) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.defaultFault = fault
+}
+
+// Pause holds all the messages sent from or to the address,
+// until it's resumed or the senders time out.
+func (self *MemoryFaults) Pause(addr ps.MultiAddr) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    key := addrKey(addr)
+    if _, ok := self.paused[key]; !ok {
+        self.paused[key] = make(chan interface{})
+    }
+}
+
+func (self *MemoryFaults) Resume(addr ps.MultiAddr) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    key := addrKey(addr)
+    if resumeChan, ok := self.paused[key]; ok {
+        close(resumeChan)
+        delete(self.paused, key)
+    }
+}
+
+func (self *MemoryFaults) IsPaused(addr ps.MultiAddr) bool {
+    self.lock.RLock()
+    defer self.lock.RUnlock()
+    _, ok := self.paused[addrKey(addr)]
+    return ok
+}
+
+// Reset removes all the faults and resumes all the paused addresses.
+func (self *MemoryFaults) Reset() {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.cuts = make(map[memoryLink]bool)
+    self.links = make(map[memoryLink]*LinkFault)
+    self.defaultFault = nil
+    for _, resumeChan := range self.paused {
+        close(resumeChan)
+    }
+    self.paused = make(map[string]chan interface{})
+}
+
+// Injected returns whether any fault is injected.
+func (self *MemoryFaults) Injected() bool {
+    self.lock.RLock()
+    defer self.lock.RUnlock()
+    return (len(self.cuts) > 0) || (len(self.links) > 0) ||
+        (self.defaultFault != nil) || (len(self.paused) > 0)
+}
+
+func (self *MemoryFaults) getResumeChans(link memoryLink) []chan interface{} {
+    self.lock.RLock()
+    defer self.lock.RUnlock()
+    resumeChans := make([]chan interface{}, 0, 2)
+    for _, key := range []string{link.from, link.to} {
+        if resumeChan, ok := self.paused[key]; ok {
+            resumeChans = append(resumeChans, resumeChan)
+        }
+    }
+    return resumeChans
+}
+
+func (self *MemoryFaults) getLink(
+    link memoryLink) (cut bool, fault *LinkFault, random rt.Random) {
+
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    cut = self.cuts[link]
+    fault, ok := self.links[link]
+    if !ok {
+        fault = self.defaultFault
+    }
+    random, ok = self.randoms[link]
+    if !ok {
+        random = self.random.Fork(link.from + ">" + link.to)
+        self.randoms[link] = random
+    }
+    return cut, fault, random
+}
+
+func chance(random rt.Random, probability float64) bool {
+    if probability <= 0 {
+        return false
+    }
+    return random.Intn(1000000) < int(probability*1000000)
+}
+
+// deliver decides the fate of a message sent on the link from one address
+// to another, and waits on clock for the delay of the message.
+// It returns whether the message should be duplicated, or an error
+// if the message is lost.
+func (self *MemoryFaults) deliver(
+    clock ck.Clock,
+    from, to ps.MultiAddr,
+    timeout time.Duration) (bool, error) {
+
+    link := memoryLink{addrKey(from), addrKey(to)}
+    timer := clock.NewTimer(timeout)
+    defer timer.Stop()
+    for _, resumeChan := range self.getResumeChans(link) {
+        select {
+        case <-resumeChan:
+        case <-timer.Chan():
+            return false, MemoryTransportReadTimeout
+        }
+    }
+    cut, fault, random := self.getLink(link)
+    if cut {
+        <-timer.Chan()
+        return false, MemoryTransportReadTimeout
+    }
+    if fault == nil {
+        return false, nil
+    }
+    if chance(random, fault.Drop) {
+        <-timer.Chan()
+        return false, MemoryTransportReadTimeout
+    }
+    delay := fault.Delay
+    if fault.Jitter > 0 {
+        delay += time.Duration(random.Intn(int(fault.Jitter)))
+    }
+    if chance(random, fault.Reorder) {
+        delay += fault.ReorderDelay
+    }
+    if delay > 0 {
+        delayTimer := clock.NewTimer(delay)
+        defer delayTimer.Stop()
+        select {
+        case <-delayTimer.Chan():
+        case <-timer.Chan():
+            // the sender gives up before the message arrives
+            return false, MemoryTransportReadTimeout
+        }
+    }
+    return chance(random, fault.Duplicate), nil
+}
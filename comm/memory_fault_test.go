@@ -0,0 +1,179 @@
+package comm
+
+import (
+    ck "github.com/hhkbp2/rafted/clock"
+    ev "github.com/hhkbp2/rafted/event"
+    logging "github.com/hhkbp2/rafted/logging"
+    ps "github.com/hhkbp2/rafted/persist"
+    rt "github.com/hhkbp2/rafted/retry"
+    "github.com/hhkbp2/testify/assert"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+type faultTestEnv struct {
+    register   *MemoryTransportRegister
+    client     *MemoryClient
+    clientAddr ps.MultiAddr
+    serverAddr ps.MultiAddr
+    reqEvent   ev.RequestEvent
+    count      *int32
+    cleanup    func()
+}
+
+func setupFaultTest(t *testing.T) *faultTestEnv {
+
+    serverAddr := ps.RandomMemoryMultiAddr()
+    clientAddr := ps.RandomMemoryMultiAddr()
+    register := NewMemoryTransportRegister()
+    register.Faults().SetRandom(rt.NewRandom(0))
+    logger := logging.GetLogger("test")
+    reqEvent, respEvent := getTestAppendEntriesEvents(serverAddr)
+    var count int32 = 0
+    eventHandler := func(event ev.RequestEvent) {
+        e, ok := event.(*ev.AppendEntriesRequestEvent)
+        assert.True(t, ok)
+        assert.Equal(t, reqEvent.Request, e.Request)
+        atomic.AddInt32(&count, 1)
+        e.SendResponse(respEvent)
+    }
+    server := NewMemoryServer(
+        serverAddr, testTimeout, eventHandler, register, logger)
+    server.Serve()
+    client := NewMemoryClient(testPoolSize, testTimeout, register)
+    client.SetLocalAddr(clientAddr)
+    cleanup := func() {
+        client.Close()
+        server.Close()
+    }
+    return &faultTestEnv{
+        register:   register,
+        client:     client,
+        clientAddr: clientAddr,
+        serverAddr: serverAddr,
+        reqEvent:   reqEvent,
+        count:      &count,
+        cleanup:    cleanup,
+    }
+}
+
+func TestMemoryFaultsPartition(t *testing.T) {
+    env := setupFaultTest(t)
+    defer env.cleanup()
+    register, client, count := env.register, env.client, env.count
+    clientAddr, serverAddr := env.clientAddr, env.serverAddr
+    reqEvent := env.reqEvent
+    faults := register.Faults()
+    // symmetric partition
+    faults.Partition([]ps.MultiAddr{clientAddr}, []ps.MultiAddr{serverAddr})
+    _, err := client.CallRPCTo(serverAddr, reqEvent)
+    assert.Equal(t, MemoryTransportReadTimeout, err)
+    assert.Equal(t, int32(0), atomic.LoadInt32(count))
+    // asymmetric partition, the request is handled but the response is lost
+    faults.Heal()
+    faults.Cut(serverAddr, clientAddr)
+    _, err = client.CallRPCTo(serverAddr, reqEvent)
+    assert.Equal(t, MemoryTransportReadTimeout, err)
+    assert.Equal(t, int32(1), atomic.LoadInt32(count))
+    faults.HealLink(serverAddr, clientAddr)
+    event, err := client.CallRPCTo(serverAddr, reqEvent)
+    assert.Nil(t, err)
+    assert.Equal(t, ev.EventAppendEntriesResponse, event.Type())
+    assert.Equal(t, int32(2), atomic.LoadInt32(count))
+}
+
+func TestMemoryFaultsLinkFault(t *testing.T) {
+    env := setupFaultTest(t)
+    defer env.cleanup()
+    register, client, count := env.register, env.client, env.count
+    clientAddr, serverAddr := env.clientAddr, env.serverAddr
+    reqEvent := env.reqEvent
+    faults := register.Faults()
+    // drop all
+    faults.SetLinkFault(clientAddr, serverAddr, &LinkFault{Drop: 1})
+    _, err := client.CallRPCTo(serverAddr, reqEvent)
+    assert.Equal(t, MemoryTransportReadTimeout, err)
+    assert.Equal(t, int32(0), atomic.LoadInt32(count))
+    // duplicate all
+    faults.SetLinkFault(clientAddr, serverAddr, &LinkFault{Duplicate: 1})
+    _, err = client.CallRPCTo(serverAddr, reqEvent)
+    assert.Nil(t, err)
+    assert.Equal(t, int32(2), atomic.LoadInt32(count))
+    // default fault applies to links with no fault specified
+    faults.SetLinkFault(clientAddr, serverAddr, nil)
+    faults.SetDefaultFault(&LinkFault{Delay: testTimeout * 2})
+    _, err = client.CallRPCTo(serverAddr, reqEvent)
+    assert.Equal(t, MemoryTransportReadTimeout, err)
+    faults.Reset()
+    _, err = client.CallRPCTo(serverAddr, reqEvent)
+    assert.Nil(t, err)
+    assert.Equal(t, int32(3), atomic.LoadInt32(count))
+}
+
+func TestMemoryFaultsDelayAndPause(t *testing.T) {
+    env := setupFaultTest(t)
+    defer env.cleanup()
+    register, client, count := env.register, env.client, env.count
+    clientAddr, serverAddr := env.clientAddr, env.serverAddr
+    reqEvent := env.reqEvent
+    clock := ck.NewVirtualClock(time.Unix(0, 0))
+    register.SetClock(clock)
+    faults := register.Faults()
+    errChan := make(chan error, 1)
+    call := func() {
+        _, err := client.CallRPCTo(serverAddr, reqEvent)
+        errChan <- err
+    }
+    waitActivity := func(activity uint64) {
+        for clock.Activity() == activity {
+            time.Sleep(time.Millisecond)
+        }
+    }
+    // the request is held until the delay passes in virtual time
+    delay := testTimeout / 2
+    faults.SetLinkFault(clientAddr, serverAddr, &LinkFault{Delay: delay})
+    activity := clock.Activity()
+    go call()
+    waitActivity(activity)
+    for len(errChan) == 0 {
+        assert.Equal(t, int32(0), atomic.LoadInt32(count))
+        clock.Step()
+        time.Sleep(time.Millisecond)
+    }
+    assert.Nil(t, <-errChan)
+    assert.Equal(t, int32(1), atomic.LoadInt32(count))
+    assert.Equal(t, time.Unix(0, 0).Add(delay), clock.Now())
+    // the request is held until the server is resumed
+    faults.SetLinkFault(clientAddr, serverAddr, nil)
+    faults.Pause(serverAddr)
+    assert.True(t, faults.IsPaused(serverAddr))
+    activity = clock.Activity()
+    go call()
+    waitActivity(activity)
+    time.Sleep(time.Millisecond * 10)
+    assert.Equal(t, 0, len(errChan))
+    assert.Equal(t, int32(1), atomic.LoadInt32(count))
+    faults.Resume(serverAddr)
+    assert.Nil(t, <-errChan)
+    assert.Equal(t, int32(2), atomic.LoadInt32(count))
+}
+
+func TestMemoryFaultsWithoutLocalAddr(t *testing.T) {
+    env := setupFaultTest(t)
+    defer env.cleanup()
+    client := NewMemoryClient(testPoolSize, testTimeout, env.register)
+    defer client.Close()
+    // fine without any fault
+    _, err := client.CallRPCTo(env.serverAddr, env.reqEvent)
+    assert.Nil(t, err)
+    env.register.Faults().Cut(env.clientAddr, env.serverAddr)
+    panicked := func() (panicked bool) {
+        defer func() {
+            panicked = (recover() != nil)
+        }()
+        client.CallRPCTo(env.serverAddr, env.reqEvent)
+        return false
+    }()
+    assert.True(t, panicked)
+}
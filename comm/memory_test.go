@@ -2,12 +2,14 @@ package comm
 
 import (
     "bufio"
+    "context"
     ev "github.com/hhkbp2/rafted/event"
     logging "github.com/hhkbp2/rafted/logging"
     ps "github.com/hhkbp2/rafted/persist"
     "github.com/hhkbp2/rafted/str"
     "github.com/hhkbp2/testify/assert"
     "github.com/ugorji/go/codec"
+    "io"
     "testing"
     "time"
 )
@@ -55,6 +57,11 @@ func TestMemoryServerTransport(t *testing.T) {
     // test Close()
     err = transport.Close()
     assert.Nil(t, err)
+    // write and read after Close() fail without panic
+    err = transport.WriteChunk(chunk)
+    assert.Equal(t, MemoryTransportClosed, err)
+    _, err = transport.ReadChunk()
+    assert.Equal(t, io.EOF, err)
 }
 
 func TestMemoryTransportRegister(t *testing.T) {
@@ -243,3 +250,42 @@ func TestMemoryServer(t *testing.T) {
     err = server.Close()
     assert.Nil(t, err)
 }
+
+func TestMemoryClientCallRPCToContext(t *testing.T) {
+    addr := ps.RandomMemoryMultiAddr()
+    register := NewMemoryTransportRegister()
+    logger := logging.GetLogger("test")
+    reqEvent, respEvent := getTestAppendEntriesEvents(addr)
+    // the server holds the first request, and responses the others
+    holdChan := make(chan ev.RequestEvent, 1)
+    eventHandler := func(event ev.RequestEvent) {
+        select {
+        case holdChan <- event:
+        default:
+            event.SendResponse(respEvent)
+        }
+    }
+    server := NewMemoryServer(addr, testTimeout, eventHandler, register, logger)
+    server.Serve()
+    timeout := time.Second * 10
+    client := NewMemoryClient(testPoolSize, timeout, register)
+    ctx, cancel := context.WithTimeout(
+        context.Background(), time.Millisecond*10)
+    defer cancel()
+    startTime := time.Now()
+    _, err := client.CallRPCToContext(ctx, addr, reqEvent)
+    assert.Equal(t, context.DeadlineExceeded, err)
+    assert.True(t, time.Since(startTime) < timeout)
+    // the client works after the aborted call
+    event, err := client.CallRPCToContext(context.Background(), addr, reqEvent)
+    assert.Nil(t, err)
+    assert.Equal(t, ev.EventAppendEntriesResponse, event.Type())
+    ctx, cancel = context.WithCancel(context.Background())
+    cancel()
+    _, err = client.CallRPCToContext(ctx, addr, reqEvent)
+    assert.Equal(t, context.Canceled, err)
+    (<-holdChan).SendResponse(respEvent)
+    client.Close()
+    err = server.Close()
+    assert.Nil(t, err)
+}
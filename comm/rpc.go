@@ -1,6 +1,7 @@
 package comm
 
 import (
+    "context"
     "errors"
     "fmt"
     hsm "github.com/hhkbp2/go-hsm"
@@ -25,21 +26,45 @@ ClientAppend                    ClientResponse, with Data
                                 LeaderUnknown
                                 LeaderRedirect
                                 PersistError
+                                Overloaded
+                                DeadlineExceeded
 
 ClientReadOnly                  ClientResponse, with Data
                                 LeaderUnknown
                                 LeaderUnsync
                                 LeaderRedirect
                                 PersistError
+                                Overloaded
+                                DeadlineExceeded
 
 ClientGetConfig                 GetConfigResponse, with Conf
                                 LeaderUnknown
                                 LeaderRedirect
                                 PersistError
+                                Overloaded
 
 ClientChangeConfig              ClientResponse, no Data
                                 Redirect
                                 PersistError
+                                Overloaded
+
+ClientJoin                      ClientResponse, no Data
+                                Redirect
+                                PersistError
+                                Overloaded
+
+QueryNodeStatus                 QueryNodeStatusResponse
+                                PersistError
+
+Resume                          ClientResponse, no Data
+                                PersistError
+
+TransferLeadership              ClientResponse, no Data
+
+Snapshot                        ClientResponse, with Data
+                                PersistError
+
+Subscribe                       SubscribeResponse, with notify stream
 
 ------------------------------------------------------------
 map to RPC
@@ -48,6 +73,16 @@ RPCClientAppend                 RPCClientResponse
 RPCClientReadOnly
 RPCClientGetConfig
 RPCClientChangeConfig
+RPCClientJoin
+RPCResumeRequest
+RPCTransferLeadershipRequest
+RPCSnapshotRequest
+RPCQueryNodeStatusRequest       RPCQueryNodeStatusResponse
+RPCPollNotifyRequest            RPCPollNotifyResponse
+
+The notify stream is polled, since rpc is request/response only. Every poll
+resumes the subscription after the last notify returned, and returns the
+notifies within a while.
 */
 
 type RPCRaftService struct {
@@ -72,6 +107,10 @@ type RPCInstallSnapshotRequest ev.InstallSnapshotRequest
 type RPCInstallSnapshotResponse struct {
     Response *ev.InstallSnapshotResponse
 }
+type RPCTimeoutNowRequest ev.TimeoutNowRequest
+type RPCTimeoutNowResponse struct {
+    Response *ev.TimeoutNowResponse
+}
 
 func (self *RPCRaftService) AppendEntries(
     args *RPCAppendEntriesRequest, reply *RPCAppendEntriesResponse) error {
@@ -112,10 +151,51 @@ func (self *RPCRaftService) InstallStapshot(
     return nil
 }
 
+func (self *RPCRaftService) TimeoutNow(
+    args *RPCTimeoutNowRequest, reply *RPCTimeoutNowResponse) error {
+
+    request := (*ev.TimeoutNowRequest)(args)
+    reqEvent := ev.NewTimeoutNowRequestEvent(request)
+    self.eventHandler(reqEvent)
+    event := reqEvent.RecvResponse()
+    e, ok := event.(*ev.TimeoutNowResponseEvent)
+    hsm.AssertTrue(ok)
+    reply.Response = e.Response
+    return nil
+}
+
 type RPCClientAppendRequest ev.ClientAppendRequest
 type RPCClientReadOnlyRequest ev.ClientReadOnlyRequest
 type RPCClientGetConfigRequest ev.ClientGetConfigRequest
 type RPCClientChangeConfigRequest ev.ClientChangeConfigRequest
+type RPCClientJoinRequest ev.ClientJoinRequest
+type RPCClientUpdateAddrRequest ev.ClientUpdateAddrRequest
+type RPCResumeRequest ev.ResumeRequest
+type RPCTransferLeadershipRequest ev.TransferLeadershipRequest
+type RPCSnapshotRequest ev.SnapshotRequest
+
+type RPCQueryNodeStatusRequest ev.QueryNodeStatusRequest
+type RPCQueryNodeStatusResponse struct {
+    Response *ev.QueryNodeStatusResponse
+    Error    string
+}
+
+type RPCPollNotifyRequest struct {
+    Request *ev.SubscribeRequest
+    // how long to wait for the first notify
+    Wait time.Duration
+}
+type RPCPollNotifyResponse struct {
+    Response *ev.SubscribeResponse
+    Messages []*ev.NotifyMessage
+}
+
+const (
+    // the most notifies returned by a poll
+    RPCNotifyBatchSize = 256
+    // how long to wait for more notifies after one is polled
+    RPCNotifyLinger = time.Millisecond * 5
+)
 
 type RPCResultType int
 
@@ -129,6 +209,9 @@ const (
     RPCResultLeaderInMemberChange
     RPCResultPersistError
     RPCResultGetConfig
+    RPCResultLeaderChanged
+    RPCResultOverloaded
+    RPCResultDeadlineExceeded
 )
 
 type RPCClientResponse struct {
@@ -161,6 +244,15 @@ func setRPCClientResponse(event ev.Event, reply *RPCClientResponse) {
         reply.Leader = e.Response.Leader
     case ev.EventLeaderInMemberChangeResponse:
         reply.Result = RPCResultLeaderInMemberChange
+    case ev.EventLeaderChangedResponse:
+        e, ok := event.(*ev.LeaderChangedResponseEvent)
+        hsm.AssertTrue(ok)
+        reply.Result = RPCResultLeaderChanged
+        reply.Leader = e.Response.Leader
+    case ev.EventOverloadedResponse:
+        reply.Result = RPCResultOverloaded
+    case ev.EventDeadlineExceededResponse:
+        reply.Result = RPCResultDeadlineExceeded
     case ev.EventPersistErrorResponse:
         e, ok := event.(*ev.PersistErrorResponseEvent)
         hsm.AssertTrue(ok)
@@ -202,6 +294,15 @@ func getRPCClientResponse(reply *RPCClientResponse) (ev.Event, error) {
         event = ev.NewLeaderRedirectResponseEvent(response)
     case RPCResultLeaderInMemberChange:
         event = ev.NewLeaderInMemberChangeResponseEvent()
+    case RPCResultLeaderChanged:
+        response := &ev.LeaderChangedResponse{
+            Leader: reply.Leader,
+        }
+        event = ev.NewLeaderChangedResponseEvent(response)
+    case RPCResultOverloaded:
+        event = ev.NewOverloadedResponseEvent()
+    case RPCResultDeadlineExceeded:
+        event = ev.NewDeadlineExceededResponseEvent()
     case RPCResultPersistError:
         err := errors.New(reply.Error)
         event = ev.NewPersistErrorResponseEvent(err)
@@ -270,6 +371,116 @@ func (self *RPCClientService) ChangeConfig(
     return nil
 }
 
+func (self *RPCClientService) Join(
+    args *RPCClientJoinRequest, reply *RPCClientResponse) error {
+
+    request := (*ev.ClientJoinRequest)(args)
+    reqEvent := ev.NewClientJoinRequestEvent(request)
+    self.eventHandler(reqEvent)
+    event := reqEvent.RecvResponse()
+    setRPCClientResponse(event, reply)
+    return nil
+}
+
+func (self *RPCClientService) UpdateAddr(
+    args *RPCClientUpdateAddrRequest, reply *RPCClientResponse) error {
+
+    request := (*ev.ClientUpdateAddrRequest)(args)
+    reqEvent := ev.NewClientUpdateAddrRequestEvent(request)
+    self.eventHandler(reqEvent)
+    event := reqEvent.RecvResponse()
+    setRPCClientResponse(event, reply)
+    return nil
+}
+
+func (self *RPCClientService) Resume(
+    args *RPCResumeRequest, reply *RPCClientResponse) error {
+
+    request := (*ev.ResumeRequest)(args)
+    reqEvent := ev.NewResumeRequestEvent(request)
+    self.eventHandler(reqEvent)
+    event := reqEvent.RecvResponse()
+    setRPCClientResponse(event, reply)
+    return nil
+}
+
+func (self *RPCClientService) TransferLeadership(
+    args *RPCTransferLeadershipRequest, reply *RPCClientResponse) error {
+
+    request := (*ev.TransferLeadershipRequest)(args)
+    reqEvent := ev.NewTransferLeadershipRequestEvent(request)
+    self.eventHandler(reqEvent)
+    event := reqEvent.RecvResponse()
+    setRPCClientResponse(event, reply)
+    return nil
+}
+
+func (self *RPCClientService) Snapshot(
+    args *RPCSnapshotRequest, reply *RPCClientResponse) error {
+
+    request := (*ev.SnapshotRequest)(args)
+    reqEvent := ev.NewSnapshotRequestEvent(request)
+    self.eventHandler(reqEvent)
+    event := reqEvent.RecvResponse()
+    setRPCClientResponse(event, reply)
+    return nil
+}
+
+func (self *RPCClientService) QueryNodeStatus(
+    args *RPCQueryNodeStatusRequest, reply *RPCQueryNodeStatusResponse) error {
+
+    request := (*ev.QueryNodeStatusRequest)(args)
+    reqEvent := ev.NewQueryNodeStatusRequestEvent(request)
+    self.eventHandler(reqEvent)
+    event := reqEvent.RecvResponse()
+    switch event.Type() {
+    case ev.EventQueryNodeStatusResponse:
+        e, ok := event.(*ev.QueryNodeStatusResponseEvent)
+        hsm.AssertTrue(ok)
+        reply.Response = e.Response
+    case ev.EventPersistErrorResponse:
+        e, ok := event.(*ev.PersistErrorResponseEvent)
+        hsm.AssertTrue(ok)
+        reply.Error = e.Error.Error()
+    default:
+        return RPCErrorInvalidResponse
+    }
+    return nil
+}
+
+// PollNotify subscribes to the notifies, and returns the ones delivered
+// within args.Wait, or shortly after the first one. The subscription is
+// canceled then, for the next poll to resume it.
+func (self *RPCClientService) PollNotify(
+    args *RPCPollNotifyRequest, reply *RPCPollNotifyResponse) error {
+
+    reqEvent := ev.NewSubscribeRequestEvent(args.Request)
+    self.eventHandler(reqEvent)
+    event := reqEvent.RecvResponse()
+    e, ok := event.(*ev.SubscribeResponseEvent)
+    if !ok {
+        return RPCErrorInvalidResponse
+    }
+    defer e.Cancel()
+    reply.Response = e.Response
+    reply.Messages = make([]*ev.NotifyMessage, 0)
+    timer := time.NewTimer(args.Wait)
+    defer timer.Stop()
+    for len(reply.Messages) < RPCNotifyBatchSize {
+        select {
+        case message, ok := <-e.Stream:
+            if !ok {
+                return nil
+            }
+            reply.Messages = append(reply.Messages, message)
+            timer.Reset(RPCNotifyLinger)
+        case <-timer.C:
+            return nil
+        }
+    }
+    return nil
+}
+
 var (
     RPCErrorInvalidRequest        error = errors.New("invalid rpc request")
     RPCErrorInvalidResponse             = errors.New("invalid rpc response")
@@ -372,6 +583,17 @@ func (self *RPCConnection) CallRPC(
         }
         event := ev.NewInstallSnapshotResponseEvent(reply.Response)
         return event, nil
+    case ev.EventTimeoutNowRequest:
+        e, ok := request.(*ev.TimeoutNowRequestEvent)
+        hsm.AssertTrue(ok)
+        args := (*RPCTimeoutNowRequest)(e.Request)
+        reply := new(RPCTimeoutNowResponse)
+        err := self.client.Call("RPCRaftService.TimeoutNow", args, reply)
+        if err != nil {
+            return nil, err
+        }
+        event := ev.NewTimeoutNowResponseEvent(reply.Response)
+        return event, nil
     case ev.EventClientAppendRequest:
         e, ok := request.(*ev.ClientAppendRequestEvent)
         hsm.AssertTrue(ok)
@@ -412,6 +634,92 @@ func (self *RPCConnection) CallRPC(
             return nil, err
         }
         return getRPCClientResponse(reply)
+    case ev.EventClientJoinRequest:
+        e, ok := request.(*ev.ClientJoinRequestEvent)
+        hsm.AssertTrue(ok)
+        args := (*RPCClientJoinRequest)(e.Request)
+        reply := new(RPCClientResponse)
+        err := self.client.Call("RPCClientService.Join", args, reply)
+        if err != nil {
+            return nil, err
+        }
+        return getRPCClientResponse(reply)
+    case ev.EventClientUpdateAddrRequest:
+        e, ok := request.(*ev.ClientUpdateAddrRequestEvent)
+        hsm.AssertTrue(ok)
+        args := (*RPCClientUpdateAddrRequest)(e.Request)
+        reply := new(RPCClientResponse)
+        err := self.client.Call("RPCClientService.UpdateAddr", args, reply)
+        if err != nil {
+            return nil, err
+        }
+        return getRPCClientResponse(reply)
+    case ev.EventResumeRequest:
+        e, ok := request.(*ev.ResumeRequestEvent)
+        hsm.AssertTrue(ok)
+        args := (*RPCResumeRequest)(e.Request)
+        reply := new(RPCClientResponse)
+        err := self.client.Call("RPCClientService.Resume", args, reply)
+        if err != nil {
+            return nil, err
+        }
+        return getRPCClientResponse(reply)
+    case ev.EventTransferLeadershipRequest:
+        e, ok := request.(*ev.TransferLeadershipRequestEvent)
+        hsm.AssertTrue(ok)
+        args := (*RPCTransferLeadershipRequest)(e.Request)
+        reply := new(RPCClientResponse)
+        err := self.client.Call(
+            "RPCClientService.TransferLeadership", args, reply)
+        if err != nil {
+            return nil, err
+        }
+        return getRPCClientResponse(reply)
+    case ev.EventSnapshotRequest:
+        e, ok := request.(*ev.SnapshotRequestEvent)
+        hsm.AssertTrue(ok)
+        args := (*RPCSnapshotRequest)(e.Request)
+        reply := new(RPCClientResponse)
+        err := self.client.Call("RPCClientService.Snapshot", args, reply)
+        if err != nil {
+            return nil, err
+        }
+        return getRPCClientResponse(reply)
+    case ev.EventQueryNodeStatusRequest:
+        e, ok := request.(*ev.QueryNodeStatusRequestEvent)
+        hsm.AssertTrue(ok)
+        args := (*RPCQueryNodeStatusRequest)(e.Request)
+        reply := new(RPCQueryNodeStatusResponse)
+        err := self.client.Call(
+            "RPCClientService.QueryNodeStatus", args, reply)
+        if err != nil {
+            return nil, err
+        }
+        if reply.Response == nil {
+            err := errors.New(reply.Error)
+            return ev.NewPersistErrorResponseEvent(err), nil
+        }
+        return ev.NewQueryNodeStatusResponseEvent(reply.Response), nil
+    case ev.EventSubscribeRequest:
+        e, ok := request.(*ev.SubscribeRequestEvent)
+        hsm.AssertTrue(ok)
+        args := &RPCPollNotifyRequest{
+            Request: e.Request,
+            Wait:    self.timeout / 2,
+        }
+        reply := new(RPCPollNotifyResponse)
+        err := self.client.Call("RPCClientService.PollNotify", args, reply)
+        if err != nil {
+            return nil, err
+        }
+        // the stream of a poll holds all the notifies returned
+        stream := make(chan *ev.NotifyMessage, len(reply.Messages))
+        for _, message := range reply.Messages {
+            stream <- message
+        }
+        close(stream)
+        event := ev.NewSubscribeResponseEvent(reply.Response, stream, func() {})
+        return event, nil
     default:
         return nil, RPCErrorInvalidRequest
     }
@@ -435,11 +743,19 @@ func NewRPCClient(timeout time.Duration, auth *RPCAuth) *RPCClient {
 func (self *RPCClient) CallRPCTo(
     target ps.MultiAddr, request ev.Event) (response ev.Event, err error) {
 
+    return self.CallRPCToContext(context.Background(), target, request)
+}
+
+func (self *RPCClient) CallRPCToContext(
+    ctx context.Context,
+    target ps.MultiAddr,
+    request ev.Event) (response ev.Event, err error) {
+
     connection, err := self.getConnection(target)
     if err != nil {
         return nil, err
     }
-    response, err = connection.CallRPC(request)
+    response, err = callRPCWithContext(ctx, connection, request)
     if err == nil {
         self.returnConnectionToPool(connection)
     } else {
@@ -448,6 +764,84 @@ func (self *RPCClient) CallRPCTo(
     return response, err
 }
 
+// Subscribe makes a notify stream that polls target. The first poll is
+// made before it returns.
+func (self *RPCClient) Subscribe(
+    ctx context.Context,
+    target ps.MultiAddr,
+    request *ev.SubscribeRequest) (
+    *ev.SubscribeResponse, NotifyStream, error) {
+
+    ctx, cancel := context.WithCancel(ctx)
+    stream := &RPCNotifyStream{
+        ctx:     ctx,
+        cancel:  cancel,
+        client:  self,
+        target:  target,
+        request: *request,
+    }
+    response, err := stream.poll()
+    if err != nil {
+        cancel()
+        return nil, nil, err
+    }
+    return response, stream, nil
+}
+
+// RPCNotifyStream receives the notifies by polling a remote node.
+type RPCNotifyStream struct {
+    ctx      context.Context
+    cancel   context.CancelFunc
+    client   *RPCClient
+    target   ps.MultiAddr
+    request  ev.SubscribeRequest
+    messages []*ev.NotifyMessage
+}
+
+func (self *RPCNotifyStream) poll() (*ev.SubscribeResponse, error) {
+    request := self.request
+    reqEvent := ev.NewSubscribeRequestEvent(&request)
+    event, err := self.client.CallRPCToContext(self.ctx, self.target, reqEvent)
+    if err != nil {
+        return nil, err
+    }
+    e, ok := event.(*ev.SubscribeResponseEvent)
+    if !ok {
+        return nil, RPCErrorInvalidResponse
+    }
+    self.request.Follow(e.Response)
+    for message := range e.Stream {
+        self.messages = append(self.messages, message)
+    }
+    if (len(self.messages) == 0) && (self.request.After < e.Response.Seq) {
+        // none of the notifies up to the seq is subscribed, so that
+        // the later polls don't look for them in history
+        self.request.After = e.Response.Seq
+    }
+    return e.Response, nil
+}
+
+func (self *RPCNotifyStream) Recv() (*ev.NotifyMessage, error) {
+    for len(self.messages) == 0 {
+        response, err := self.poll()
+        if err != nil {
+            return nil, err
+        }
+        if response.Missed {
+            return nil, ErrorNotifyMissed
+        }
+    }
+    message := self.messages[0]
+    self.messages = self.messages[1:]
+    self.request.Receive(message)
+    return message, nil
+}
+
+func (self *RPCNotifyStream) Close() error {
+    self.cancel()
+    return nil
+}
+
 func (self *RPCClient) getConnection(target ps.MultiAddr) (*RPCConnection, error) {
     connection, err := self.getConnectionFromPool(target)
     if err == nil {
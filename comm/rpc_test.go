@@ -1,6 +1,7 @@
 package comm
 
 import (
+    "context"
     ev "github.com/hhkbp2/rafted/event"
     logging "github.com/hhkbp2/rafted/logging"
     "github.com/hhkbp2/testify/assert"
@@ -85,3 +86,31 @@ func TestRPCMultiServers(t *testing.T) {
     assert.Nil(t, client1.Close())
     assert.Nil(t, client2.Close())
 }
+
+func TestRPCPollNotify(t *testing.T) {
+    bindAddr, serverAddr := prepareAddrs(TestSocketHost, TestSocketPort)
+    handler := newHistoryHandler(t, 7, 5, 2)
+    logger := logging.GetLogger("test rpc server")
+    server, err := NewRPCServer(
+        bindAddr, testTimeout, TestAuth, handler.Handle, logger)
+    require.Nil(t, err)
+    server.Serve()
+
+    client := NewRPCClient(testTimeout, TestAuth)
+    request := &ev.SubscribeRequest{}
+    response, stream, err := client.Subscribe(
+        context.Background(), serverAddr, request)
+    require.Nil(t, err)
+    assert.Equal(t, uint64(7), response.Epoch)
+    // every poll returns a batch, and the next one resumes after it
+    for i := 1; i <= 5; i++ {
+        message, err := stream.Recv()
+        require.Nil(t, err)
+        assert.Equal(t, uint64(i), message.Seq)
+        assert.Equal(t, uint64(i), message.LogIndex)
+    }
+    handler.assertResumed(3)
+    assert.Nil(t, stream.Close())
+    assert.Nil(t, client.Close())
+    assert.Nil(t, server.Close())
+}
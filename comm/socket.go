@@ -2,6 +2,7 @@ package comm
 
 import (
     "bufio"
+    "context"
     "errors"
     hsm "github.com/hhkbp2/go-hsm"
     ev "github.com/hhkbp2/rafted/event"
@@ -72,8 +73,14 @@ func (self *SocketTransport) Close() error {
     return self.conn.Close()
 }
 
+// Read reads from the connection within the read timeout. A zero timeout
+// means to wait for ever.
 func (self *SocketTransport) Read(b []byte) (int, error) {
-    self.conn.SetReadDeadline(time.Now().Add(self.readTimeout))
+    if self.readTimeout > 0 {
+        self.conn.SetReadDeadline(time.Now().Add(self.readTimeout))
+    } else {
+        self.conn.SetReadDeadline(time.Time{})
+    }
     return self.conn.Read(b)
 }
 
@@ -132,6 +139,27 @@ func (self *SocketConnection) CallRPC(
     return event, nil
 }
 
+// Send writes request to the connection without waiting for
+// the response.
+func (self *SocketConnection) Send(request ev.Event) error {
+    if err := WriteEvent(self.writer, self.encoder, request); err != nil {
+        self.Close()
+        return err
+    }
+    return nil
+}
+
+// Recv reads the response of the earliest request sent and not
+// responded yet.
+func (self *SocketConnection) Recv() (ev.Event, error) {
+    event, err := ReadResponse(self.reader, self.decoder)
+    if err != nil {
+        self.Close()
+        return nil, err
+    }
+    return event, nil
+}
+
 type SocketClient struct {
     connectionPool     map[string][]*SocketConnection
     connectionPoolLock sync.Mutex
@@ -149,7 +177,15 @@ func NewSocketClient(poolSize int, timeout time.Duration) *SocketClient {
 }
 
 func (self *SocketClient) CallRPCTo(
-    target1 ps.MultiAddr, request ev.Event) (response ev.Event, err error) {
+    target ps.MultiAddr, request ev.Event) (response ev.Event, err error) {
+
+    return self.CallRPCToContext(context.Background(), target, request)
+}
+
+func (self *SocketClient) CallRPCToContext(
+    ctx context.Context,
+    target1 ps.MultiAddr,
+    request ev.Event) (response ev.Event, err error) {
 
     target, err := ps.FirstAddr(target1)
     if err != nil {
@@ -160,13 +196,62 @@ func (self *SocketClient) CallRPCTo(
         return nil, err
     }
 
-    response, err = connection.CallRPC(request)
+    response, err = callRPCWithContext(ctx, connection, request)
     if err == nil {
         self.returnConnectionToPool(connection)
     }
     return response, err
 }
 
+// Subscribe opens a connection to target for the notify stream only,
+// which is never pooled. The stream waits for notifies for ever, until
+// it's closed, ctx is done or the connection breaks.
+func (self *SocketClient) Subscribe(
+    ctx context.Context,
+    target1 ps.MultiAddr,
+    request *ev.SubscribeRequest) (
+    *ev.SubscribeResponse, NotifyStream, error) {
+
+    target, err := ps.FirstAddr(target1)
+    if err != nil {
+        return nil, nil, err
+    }
+    connection := NewSocketConnection(target, self.timeout)
+    if err := connection.Open(); err != nil {
+        return nil, nil, err
+    }
+    reqEvent := ev.NewSubscribeRequestEvent(request)
+    event, err := callRPCWithContext(ctx, connection, reqEvent)
+    if err != nil {
+        // the connection may be closed already, closing it again is harmless
+        connection.Close()
+        return nil, nil, err
+    }
+    e, ok := event.(*ev.SubscribeResponseEvent)
+    if !ok {
+        connection.Close()
+        return nil, nil, errors.New("not subscribe response")
+    }
+    connection.SetReadTimeout(0)
+    return e.Response, NewSocketNotifyStream(ctx, connection), nil
+}
+
+// Pipeline opens a connection to target for pipelined requests only,
+// which is never pooled.
+func (self *SocketClient) Pipeline(
+    target1 ps.MultiAddr) (PipelineConn, error) {
+
+    target, err := ps.FirstAddr(target1)
+    if err != nil {
+        return nil, err
+    }
+    connection := NewSocketConnection(target, self.timeout)
+    if err := connection.Open(); err != nil {
+        return nil, err
+    }
+    return connection, nil
+}
+
 func (self *SocketClient) getConnectionFromPool(
     target net.Addr) (*SocketConnection, error) {
 
@@ -236,6 +321,53 @@ func (self *SocketClient) Close() error {
     return err
 }
 
+// SocketNotifyStream receives the notifies from a connection, which is
+// closed once ctx is done.
+type SocketNotifyStream struct {
+    ctx        context.Context
+    connection *SocketConnection
+    stopChan   chan struct{}
+    stopOnce   sync.Once
+}
+
+func NewSocketNotifyStream(
+    ctx context.Context, connection *SocketConnection) *SocketNotifyStream {
+
+    object := &SocketNotifyStream{
+        ctx:        ctx,
+        connection: connection,
+        stopChan:   make(chan struct{}),
+    }
+    if ctx.Done() != nil {
+        go func() {
+            select {
+            case <-ctx.Done():
+                connection.Close()
+            case <-object.stopChan:
+            }
+        }()
+    }
+    return object
+}
+
+func (self *SocketNotifyStream) Recv() (*ev.NotifyMessage, error) {
+    message := &ev.NotifyMessage{}
+    if err := self.connection.decoder.Decode(message); err != nil {
+        if e := self.ctx.Err(); e != nil {
+            return nil, e
+        }
+        return nil, err
+    }
+    return message, nil
+}
+
+func (self *SocketNotifyStream) Close() error {
+    self.stopOnce.Do(func() {
+        close(self.stopChan)
+    })
+    return self.connection.Close()
+}
+
 type SocketServer struct {
     bindAddr     net.Addr
     readTimeout  time.Duration
@@ -292,6 +424,10 @@ func (self *SocketServer) Serve() {
     go routine()
 }
 
+// handleConn serves the requests on conn in a pipelined way. The requests
+// are read ahead and dispatched without waiting for the responses of
+// the previous ones, at most MaxPipelinedRequests of them, and
+// the responses are written back in the order of the requests.
 func (self *SocketServer) handleConn(conn net.Conn) {
     defer conn.Close()
     reader := bufio.NewReader(conn)
@@ -299,50 +435,135 @@ func (self *SocketServer) handleConn(conn net.Conn) {
     decoder := codec.NewDecoder(reader, &codec.MsgpackHandle{})
     encoder := codec.NewEncoder(writer, &codec.MsgpackHandle{})
 
+    pending := make(chan ev.RequestEvent, MaxPipelinedRequests)
+    writerDone := make(chan struct{})
+    go func() {
+        defer close(writerDone)
+        self.writeResponses(conn, reader, writer, encoder, pending)
+    }()
+    defer func() {
+        close(pending)
+        <-writerDone
+    }()
+
     for {
         conn.SetReadDeadline(time.Now().Add(self.readTimeout))
-        if err := self.handleCommand(
-            reader, writer, decoder, encoder); err != nil {
-
+        event, err := ReadRequest(reader, decoder)
+        if err != nil {
             if err != io.EOF {
                 self.logger.Error(
-                    "fail to handle command from connection: %s, error: %s",
+                    "fail to read request from connection: %s, error: %s",
                     conn.RemoteAddr().String(), err)
             }
             return
         }
-        conn.SetWriteDeadline(time.Now().Add(self.writeTimeout))
-        if err := writer.Flush(); err != nil {
-            self.logger.Error("fail to write to connection: %s, error: %s",
-                conn.RemoteAddr().String(), err)
+        // dispatch event
+        self.eventHandler(event)
+        pending <- event
+        if event.Type() == ev.EventSubscribeRequest {
+            // the connection turns into a notify stream,
+            // nothing else is read from it
             return
         }
     }
 }
 
-func (self *SocketServer) handleCommand(
+// writeResponses writes back the responses of the requests in pending
+// one after another. After it fails to write, it closes conn and
+// only waits for the rest of the responses.
+func (self *SocketServer) writeResponses(
+    conn net.Conn,
     reader *bufio.Reader,
     writer *bufio.Writer,
-    decoder Decoder,
-    encoder Encoder) error {
+    encoder Encoder,
+    pending <-chan ev.RequestEvent) {
+
+    broken := false
+    for event := range pending {
+        // wait for response
+        response := event.RecvResponse()
+        e, isSubscribe := response.(*ev.SubscribeResponseEvent)
+        if broken {
+            if isSubscribe {
+                e.Cancel()
+            }
+            continue
+        }
+        if err := self.writeResponse(
+            conn, reader, writer, encoder, response); err != nil {
 
-    // read request
-    event, err := ReadRequest(reader, decoder)
-    if err != nil {
-        return err
+            if err != io.EOF {
+                self.logger.Error(
+                    "fail to write to connection: %s, error: %s",
+                    conn.RemoteAddr().String(), err)
+            }
+            conn.Close()
+            broken = true
+        }
     }
+}
+
+func (self *SocketServer) writeResponse(
+    conn net.Conn,
+    reader *bufio.Reader,
+    writer *bufio.Writer,
+    encoder Encoder,
+    response ev.Event) error {
 
-    // dispatch event
-    self.eventHandler(event)
-    // wait for response
-    response := event.RecvResponse()
-    // send response
+    conn.SetWriteDeadline(time.Now().Add(self.writeTimeout))
+    e, isSubscribe := response.(*ev.SubscribeResponseEvent)
     if err := WriteEvent(writer, encoder, response); err != nil {
+        if isSubscribe {
+            e.Cancel()
+        }
         return err
     }
+    if isSubscribe {
+        return self.streamNotifies(conn, reader, writer, encoder, e)
+    }
     return nil
 }
 
+// streamNotifies sends the notifies of a subscription through conn,
+// until the subscriber closes conn or the subscription ends. Nothing else
+// is served on conn after that. It returns io.EOF if nothing goes wrong.
+func (self *SocketServer) streamNotifies(
+    conn net.Conn,
+    reader *bufio.Reader,
+    writer *bufio.Writer,
+    encoder Encoder,
+    event *ev.SubscribeResponseEvent) error {
+
+    defer event.Cancel()
+    // the subscriber sends nothing but closes conn
+    conn.SetReadDeadline(time.Time{})
+    closeChan := make(chan error, 1)
+    go func() {
+        _, err := reader.ReadByte()
+        if err == nil {
+            err = errors.New("unexpected data from subscriber")
+        }
+        closeChan <- err
+    }()
+    for {
+        select {
+        case err := <-closeChan:
+            return err
+        case message, ok := <-event.Stream:
+            if !ok {
+                return io.EOF
+            }
+            conn.SetWriteDeadline(time.Now().Add(self.writeTimeout))
+            if err := encoder.Encode(message); err != nil {
+                return err
+            }
+            if err := writer.Flush(); err != nil {
+                return err
+            }
+        }
+    }
+}
+
 func (self *SocketServer) Close() error {
     err := self.listener.Close()
     self.group.Wait()
@@ -375,6 +596,10 @@ func WriteEvent(
     if err := encoder.Encode(event.Message()); err != nil {
         return err
     }
+    // write the wrapped request right after the group id
+    if e, ok := event.(*ev.GroupRequestEvent); ok {
+        return WriteEvent(writer, encoder, e.Request)
+    }
 
     return writer.Flush()
 }
@@ -409,6 +634,13 @@ func ReadRequest(
         }
         event := ev.NewInstallSnapshotRequestEvent(request)
         return event, nil
+    case ev.EventTimeoutNowRequest:
+        request := &ev.TimeoutNowRequest{}
+        if err := decoder.Decode(request); err != nil {
+            return nil, err
+        }
+        event := ev.NewTimeoutNowRequestEvent(request)
+        return event, nil
     case ev.EventClientAppendRequest:
         request := &ev.ClientAppendRequest{}
         if err := decoder.Decode(request); err != nil {
@@ -437,6 +669,76 @@ func ReadRequest(
         }
         event := ev.NewClientChangeConfigRequestEvent(request)
         return event, nil
+    case ev.EventClientJoinRequest:
+        request := &ev.ClientJoinRequest{}
+        if err := decoder.Decode(request); err != nil {
+            return nil, err
+        }
+        event := ev.NewClientJoinRequestEvent(request)
+        return event, nil
+    case ev.EventClientUpdateAddrRequest:
+        request := &ev.ClientUpdateAddrRequest{}
+        if err := decoder.Decode(request); err != nil {
+            return nil, err
+        }
+        event := ev.NewClientUpdateAddrRequestEvent(request)
+        return event, nil
+    case ev.EventQueryNodeStatusRequest:
+        request := &ev.QueryNodeStatusRequest{}
+        if err := decoder.Decode(request); err != nil {
+            return nil, err
+        }
+        event := ev.NewQueryNodeStatusRequestEvent(request)
+        return event, nil
+    case ev.EventResumeRequest:
+        request := &ev.ResumeRequest{}
+        if err := decoder.Decode(request); err != nil {
+            return nil, err
+        }
+        event := ev.NewResumeRequestEvent(request)
+        return event, nil
+    case ev.EventSnapshotRequest:
+        request := &ev.SnapshotRequest{}
+        if err := decoder.Decode(request); err != nil {
+            return nil, err
+        }
+        event := ev.NewSnapshotRequestEvent(request)
+        return event, nil
+    case ev.EventTransferLeadershipRequest:
+        request := &ev.TransferLeadershipRequest{}
+        if err := decoder.Decode(request); err != nil {
+            return nil, err
+        }
+        event := ev.NewTransferLeadershipRequestEvent(request)
+        return event, nil
+    case ev.EventSubscribeRequest:
+        request := &ev.SubscribeRequest{}
+        if err := decoder.Decode(request); err != nil {
+            return nil, err
+        }
+        event := ev.NewSubscribeRequestEvent(request)
+        return event, nil
+    case ev.EventGroupRequest:
+        var groupID uint64
+        if err := decoder.Decode(&groupID); err != nil {
+            return nil, err
+        }
+        request, err := ReadRequest(reader, decoder)
+        if err != nil {
+            return nil, err
+        }
+        if _, ok := request.(*ev.GroupRequestEvent); ok {
+            return nil, errors.New("nested group request event")
+        }
+        event := ev.NewGroupRequestEvent(groupID, request)
+        return event, nil
+    case ev.EventGroupHeartbeatRequest:
+        request := &ev.GroupHeartbeatRequest{}
+        if err := decoder.Decode(request); err != nil {
+            return nil, err
+        }
+        event := ev.NewGroupHeartbeatRequestEvent(request)
+        return event, nil
     default:
         return nil, errors.New("not request event")
     }
@@ -472,6 +774,13 @@ func ReadResponse(
         }
         event := ev.NewInstallSnapshotResponseEvent(response)
         return event, nil
+    case ev.EventTimeoutNowResponse:
+        response := &ev.TimeoutNowResponse{}
+        if err := decoder.Decode(response); err != nil {
+            return nil, err
+        }
+        event := ev.NewTimeoutNowResponseEvent(response)
+        return event, nil
     case ev.EventClientResponse:
         response := &ev.ClientResponse{}
         if err := decoder.Decode(response); err != nil {
@@ -486,6 +795,20 @@ func ReadResponse(
         }
         event := ev.NewClientGetConfigResponseEvent(response)
         return event, nil
+    case ev.EventQueryNodeStatusResponse:
+        response := &ev.QueryNodeStatusResponse{}
+        if err := decoder.Decode(response); err != nil {
+            return nil, err
+        }
+        event := ev.NewQueryNodeStatusResponseEvent(response)
+        return event, nil
+    case ev.EventSubscribeResponse:
+        response := &ev.SubscribeResponse{}
+        if err := decoder.Decode(response); err != nil {
+            return nil, err
+        }
+        event := ev.NewSubscribeResponseEvent(response, nil, nil)
+        return event, nil
     case ev.EventLeaderRedirectResponse:
         response := &ev.LeaderRedirectResponse{}
         if err := decoder.Decode(response); err != nil {
@@ -502,6 +825,19 @@ func ReadResponse(
     case ev.EventLeaderInMemberChangeResponse:
         event := ev.NewLeaderInMemberChangeResponseEvent()
         return event, nil
+    case ev.EventOverloadedResponse:
+        event := ev.NewOverloadedResponseEvent()
+        return event, nil
+    case ev.EventDeadlineExceededResponse:
+        event := ev.NewDeadlineExceededResponseEvent()
+        return event, nil
+    case ev.EventLeaderChangedResponse:
+        response := &ev.LeaderChangedResponse{}
+        if err := decoder.Decode(response); err != nil {
+            return nil, err
+        }
+        event := ev.NewLeaderChangedResponseEvent(response)
+        return event, nil
     case ev.EventPersistErrorResponse:
         var err error
         if err := decoder.Decode(err); err != nil {
@@ -509,6 +845,20 @@ func ReadResponse(
         }
         event := ev.NewPersistErrorResponseEvent(err)
         return event, nil
+    case ev.EventGroupUnknownResponse:
+        response := &ev.GroupUnknownResponse{}
+        if err := decoder.Decode(response); err != nil {
+            return nil, err
+        }
+        event := ev.NewGroupUnknownResponseEvent(response)
+        return event, nil
+    case ev.EventGroupHeartbeatResponse:
+        response := &ev.GroupHeartbeatResponse{}
+        if err := decoder.Decode(response); err != nil {
+            return nil, err
+        }
+        event := ev.NewGroupHeartbeatResponseEvent(response)
+        return event, nil
     }
     return nil, errors.New("not request event")
 }
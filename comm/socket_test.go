@@ -2,7 +2,9 @@ package comm
 
 import (
     "bufio"
+    "context"
     "fmt"
+    hsm "github.com/hhkbp2/go-hsm"
     ev "github.com/hhkbp2/rafted/event"
     logging "github.com/hhkbp2/rafted/logging"
     ps "github.com/hhkbp2/rafted/persist"
@@ -12,7 +14,9 @@ import (
     "github.com/ugorji/go/codec"
     "io"
     "net"
+    "sync"
     "testing"
+    "time"
 )
 
 type MockSocketServer struct {
@@ -254,3 +258,225 @@ func TestSocketServer(t *testing.T) {
     assert.Nil(t, client.Close())
     assert.Nil(t, server.Close())
 }
+
+func TestSocketServerPipeline(t *testing.T) {
+    bindAddr1, serverAddr := prepareAddrs(TestSocketHost, TestSocketPort)
+    bindAddr := FirstAddr(bindAddr1)
+    size := MaxPipelinedRequests
+    events := make(chan ev.RequestEvent, size)
+    handler := func(event ev.RequestEvent) {
+        events <- event
+    }
+    logger := logging.GetLogger("test socket server")
+    server, err := NewSocketServer(bindAddr, testTimeout, handler, logger)
+    require.Nil(t, err)
+    server.Serve()
+    defer server.Close()
+
+    client := NewSocketClient(1, testTimeout)
+    defer client.Close()
+    conn, err := client.Pipeline(serverAddr)
+    require.Nil(t, err)
+    defer conn.Close()
+    for i := 0; i < size; i++ {
+        request := &ev.AppendEntriesRequest{
+            Term: uint64(i),
+        }
+        require.Nil(t, conn.Send(ev.NewAppendEntriesRequestEvent(request)))
+    }
+    // all the requests are served before any response,
+    // which are responsed in the reverse order
+    received := make([]ev.RequestEvent, 0, size)
+    for i := 0; i < size; i++ {
+        event := <-events
+        e, ok := event.(*ev.AppendEntriesRequestEvent)
+        require.True(t, ok)
+        assert.Equal(t, uint64(i), e.Request.Term)
+        received = append(received, event)
+    }
+    for i := size - 1; i >= 0; i-- {
+        response := &ev.AppendEntriesResponse{
+            Term: uint64(i),
+        }
+        received[i].SendResponse(ev.NewAppendEntriesResponseEvent(response))
+    }
+    // the responses come back in the order of the requests
+    for i := 0; i < size; i++ {
+        event, err := conn.Recv()
+        require.Nil(t, err)
+        e, ok := event.(*ev.AppendEntriesResponseEvent)
+        require.True(t, ok)
+        assert.Equal(t, uint64(i), e.Response.Term)
+    }
+}
+
+func TestSocketSubscribe(t *testing.T) {
+    bindAddr1, serverAddr := prepareAddrs(TestSocketHost, TestSocketPort)
+    bindAddr := FirstAddr(bindAddr1)
+    messages := []*ev.NotifyMessage{
+        ev.NewNotifyMessage(3, ev.NewNotifyCommitEvent(10, 100)),
+        ev.NewNotifyMessage(4, ev.NewNotifyStateChangeEvent(
+            ev.RaftStateFollower, ev.RaftStateCandidate)),
+    }
+    expected := &ev.SubscribeResponse{
+        Epoch: 1,
+        Seq:   2,
+    }
+    canceled := make(chan bool, 1)
+    handler := func(event ev.RequestEvent) {
+        e, ok := event.(*ev.SubscribeRequestEvent)
+        if !assert.True(t, ok) {
+            return
+        }
+        assert.Equal(t, []hsm.EventType{ev.EventNotifyCommit}, e.Request.Types)
+        stream := make(chan *ev.NotifyMessage, len(messages))
+        for _, message := range messages {
+            stream <- message
+        }
+        cancel := func() {
+            canceled <- true
+        }
+        e.SendResponse(ev.NewSubscribeResponseEvent(expected, stream, cancel))
+    }
+    logger := logging.GetLogger("test socket server")
+    server, err := NewSocketServer(bindAddr, testTimeout, handler, logger)
+    require.Nil(t, err)
+    server.Serve()
+
+    client := NewSocketClient(1, testTimeout)
+    request := &ev.SubscribeRequest{
+        Types: []hsm.EventType{ev.EventNotifyCommit},
+    }
+    response, stream, err := client.Subscribe(
+        context.Background(), serverAddr, request)
+    require.Nil(t, err)
+    assert.Equal(t, expected, response)
+    for _, message := range messages {
+        m, err := stream.Recv()
+        require.Nil(t, err)
+        assert.Equal(t, message.Seq, m.Seq)
+        assert.Equal(t, message.Type, m.Type)
+        assert.Equal(t, message.Term, m.Term)
+        assert.Equal(t, message.LogIndex, m.LogIndex)
+        assert.Equal(t, message.OldState, m.OldState)
+        assert.Equal(t, message.NewState, m.NewState)
+    }
+    // the subscription is canceled once the stream is closed
+    stream.Close()
+    select {
+    case <-canceled:
+    case <-time.After(testTimeout):
+        assert.True(t, false, "subscription not canceled")
+    }
+    assert.Nil(t, client.Close())
+    assert.Nil(t, server.Close())
+}
+
+// historyHandler serves the subscriptions from a history of notifies,
+// as if they are all made after the subscription, and ends every
+// subscription after a batch of notifies. It records the requests.
+type historyHandler struct {
+    t        *testing.T
+    epoch    uint64
+    history  []*ev.NotifyMessage
+    batch    int
+    requests []ev.SubscribeRequest
+    lock     sync.Mutex
+}
+
+func newHistoryHandler(
+    t *testing.T, epoch uint64, size int, batch int) *historyHandler {
+
+    history := make([]*ev.NotifyMessage, 0, size)
+    for i := 1; i <= size; i++ {
+        event := ev.NewNotifyCommitEvent(1, uint64(i))
+        history = append(history, ev.NewNotifyMessage(uint64(i), event))
+    }
+    return &historyHandler{
+        t:       t,
+        epoch:   epoch,
+        history: history,
+        batch:   batch,
+    }
+}
+
+func (self *historyHandler) Handle(event ev.RequestEvent) {
+    e, ok := event.(*ev.SubscribeRequestEvent)
+    if !assert.True(self.t, ok) {
+        return
+    }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.requests = append(self.requests, *e.Request)
+    stream := make(chan *ev.NotifyMessage, self.batch)
+    for _, message := range self.history {
+        if (message.Seq > e.Request.After) && (len(stream) < self.batch) {
+            stream <- message
+        }
+    }
+    close(stream)
+    response := &ev.SubscribeResponse{
+        Epoch: self.epoch,
+    }
+    e.SendResponse(ev.NewSubscribeResponseEvent(response, stream, func() {}))
+}
+
+func (self *historyHandler) Requests() []ev.SubscribeRequest {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return append(make([]ev.SubscribeRequest, 0), self.requests...)
+}
+
+// assertResumed asserts that every subscription resumes right after
+// the last notify received by the former one.
+func (self *historyHandler) assertResumed(subscriptions int) {
+    requests := self.Requests()
+    if !assert.Equal(self.t, subscriptions, len(requests)) {
+        return
+    }
+    for i, request := range requests {
+        if i == 0 {
+            assert.Equal(self.t, uint64(0), request.Epoch)
+            assert.Equal(self.t, uint64(0), request.After)
+            continue
+        }
+        assert.Equal(self.t, self.epoch, request.Epoch)
+        assert.Equal(self.t, uint64(i*self.batch), request.After)
+    }
+}
+
+func TestSocketSubscribeResume(t *testing.T) {
+    bindAddr1, serverAddr := prepareAddrs(TestSocketHost, TestSocketPort)
+    bindAddr := FirstAddr(bindAddr1)
+    handler := newHistoryHandler(t, 7, 5, 2)
+    logger := logging.GetLogger("test socket server")
+    server, err := NewSocketServer(
+        bindAddr, testTimeout, handler.Handle, logger)
+    require.Nil(t, err)
+    server.Serve()
+
+    client := NewSocketClient(1, testTimeout)
+    request := &ev.SubscribeRequest{}
+    received := make([]uint64, 0)
+    // the stream breaks after every batch, and is subscribed again
+    for i := 0; (i < 5) && (len(received) < 5); i++ {
+        response, stream, err := client.Subscribe(
+            context.Background(), serverAddr, request)
+        require.Nil(t, err)
+        assert.False(t, response.Missed)
+        request.Follow(response)
+        for {
+            message, err := stream.Recv()
+            if err != nil {
+                break
+            }
+            request.Receive(message)
+            received = append(received, message.Seq)
+        }
+        stream.Close()
+    }
+    assert.Equal(t, []uint64{1, 2, 3, 4, 5}, received)
+    handler.assertResumed(3)
+    assert.Nil(t, client.Close())
+    assert.Nil(t, server.Close())
+}
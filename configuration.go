@@ -1,24 +1,54 @@
 package rafted
 
 import (
+    ck "github.com/hhkbp2/rafted/clock"
     cm "github.com/hhkbp2/rafted/comm"
+    rt "github.com/hhkbp2/rafted/retry"
     "time"
 )
 
+// PersistErrorPolicy is how a node recovers from the persist error state.
+// Whatever the policy is, the node could be resumed by the operator with
+// a ResumeRequest after the persist error is fixed.
+type PersistErrorPolicy uint8
+
+const (
+    // PersistErrorWaitResume waits for the operator to resume the node.
+    PersistErrorWaitResume PersistErrorPolicy = iota
+    // PersistErrorAutoRetry checks the log and config with the backoff of
+    // PersistErrorRetry, and resumes the node once they work again.
+    PersistErrorAutoRetry
+    // PersistErrorEvacuate transfers the leadership before stepping down
+    // if the node is leader, and waits for the operator to resume it.
+    PersistErrorEvacuate
+)
+
 type Configuration struct {
     HeartbeatTimeout                time.Duration
     ElectionTimeout                 time.Duration
     ElectionTimeoutThresholdPersent float64
     MaxTimeoutJitter                float32
+    CheckQuorum                     bool
     PersistErrorNotifyTimeout       time.Duration
+    PersistErrorPolicy              PersistErrorPolicy
+    PersistErrorRetry               *rt.ErrorRetry
     MaxAppendEntriesSize            uint64
     MaxSnapshotChunkSize            uint64
     CommClientTimeout               time.Duration
     CommServerTimeout               time.Duration
     CommPoolSize                    int
+    HeartbeatCoalesceInterval       time.Duration
     ClientTimeout                   time.Duration
+    MaxPendingRequests              int
+    RequestOverflowPolicy           OverflowPolicy
+    MaxPendingApplies               int
+    MaxPendingNotifies              int
+    NotifyHistorySize               int
     RPCServerAuth                   *cm.RPCAuth
     RPCClientAuth                   *cm.RPCAuth
+    DrainPollInterval               time.Duration
+    Clock                           ck.Clock
+    Random                          rt.Random
 }
 
 func DefaultConfiguration() *Configuration {
@@ -26,19 +56,33 @@ func DefaultConfiguration() *Configuration {
         User:     "user",
         Password: "password",
     }
+    persistErrorRetry := rt.NewErrorRetry().Delay(
+        time.Millisecond * 100).MaxDelay(time.Second * 10)
     return &Configuration{
         HeartbeatTimeout:                time.Millisecond * 50,
         ElectionTimeout:                 time.Millisecond * 200,
         ElectionTimeoutThresholdPersent: float64(0.8),
         MaxTimeoutJitter:                float32(0.1),
+        CheckQuorum:                     false,
         PersistErrorNotifyTimeout:       time.Millisecond * 100,
+        PersistErrorPolicy:              PersistErrorWaitResume,
+        PersistErrorRetry:               persistErrorRetry,
         MaxAppendEntriesSize:            uint64(10),
         MaxSnapshotChunkSize:            uint64(1000),
         CommClientTimeout:               time.Millisecond * 500,
         CommServerTimeout:               time.Minute * 30,
         CommPoolSize:                    10,
+        HeartbeatCoalesceInterval:       time.Millisecond * 5,
         ClientTimeout:                   time.Millisecond * 100,
+        MaxPendingRequests:              4096,
+        RequestOverflowPolicy:           OverflowReject,
+        MaxPendingApplies:               4096,
+        MaxPendingNotifies:              1024,
+        NotifyHistorySize:               1024,
         RPCServerAuth:                   auth,
         RPCClientAuth:                   auth,
+        DrainPollInterval:               time.Millisecond * 10,
+        Clock:                           ck.DefaultClock,
+        Random:                          rt.DefaultRandom,
     }
 }
@@ -4,6 +4,7 @@ import (
     "fmt"
     hsm "github.com/hhkbp2/go-hsm"
     ps "github.com/hhkbp2/rafted/persist"
+    "time"
 )
 
 const (
@@ -55,6 +56,34 @@ const (
     EventClientUser = hsm.EventUser + 1000 + iota
 )
 
+// The event types added after the ones above. They're numbered on from
+// the last one above, and new types are only appended at the end of
+// this list, so that the numbers of the existing types on the wire
+// never change. The ranges above are extended by the helpers below
+// for the types here that belong to them.
+const (
+    EventQueryNodeStatusRequest = EventPersistErrorResponse + 1 + iota
+    EventQueryNodeStatusResponse
+    EventGroupRequest
+    EventGroupUnknownResponse
+    EventClientJoinRequest
+    EventBootstrapRequest
+    EventGroupHeartbeatRequest
+    EventGroupHeartbeatResponse
+    EventLeaderChangedResponse
+    EventTimeoutNowRequest
+    EventTimeoutNowResponse
+    EventResumeRequest
+    EventOverloadedResponse
+    EventTimeoutCheckQuorum
+    EventClientUpdateAddrRequest
+    EventTransferLeadershipRequest
+    EventSubscribeRequest
+    EventSubscribeResponse
+    EventDeadlineExceededResponse
+    EventSnapshotRequest
+)
+
 func EventString(event hsm.Event) string {
     return EventTypeString(event.Type())
 }
@@ -81,10 +110,16 @@ func EventTypeString(event hsm.EventType) string {
         return "InstallSnapshotRequestEvent"
     case EventInstallSnapshotResponse:
         return "InstallSnapshotResponseEvent"
+    case EventTimeoutNowRequest:
+        return "TimeoutNowRequestEvent"
+    case EventTimeoutNowResponse:
+        return "TimeoutNowResponseEvent"
     case EventTimeoutHeartbeat:
         return "HearbeatTiemoutEvent"
     case EventTimeoutElection:
         return "ElectionTimeoutEvent"
+    case EventTimeoutCheckQuorum:
+        return "CheckQuorumTimeoutEvent"
     case EventQueryStateRequest:
         return "QueryStateRequestEvent"
     case EventQueryStateResponse:
@@ -127,10 +162,28 @@ func EventTypeString(event hsm.EventType) string {
         return "ClientGetConfigRequestEvent"
     case EventClientChangeConfigRequest:
         return "ClientChangeConfigRequestEvent"
+    case EventClientJoinRequest:
+        return "ClientJoinRequestEvent"
+    case EventClientUpdateAddrRequest:
+        return "ClientUpdateAddrRequestEvent"
     case EventClientResponse:
         return "ClientResponseEvent"
     case EventClientGetConfigResponse:
         return "ClientGetConfigResponseEvent"
+    case EventQueryNodeStatusRequest:
+        return "QueryNodeStatusRequestEvent"
+    case EventBootstrapRequest:
+        return "BootstrapRequestEvent"
+    case EventResumeRequest:
+        return "ResumeRequestEvent"
+    case EventTransferLeadershipRequest:
+        return "TransferLeadershipRequestEvent"
+    case EventSubscribeRequest:
+        return "SubscribeRequestEvent"
+    case EventQueryNodeStatusResponse:
+        return "QueryNodeStatusResponseEvent"
+    case EventSubscribeResponse:
+        return "SubscribeResponseEvent"
     case EventLeaderRedirectResponse:
         return "LeaderRedirectResponseEvent"
     case EventLeaderUnknownResponse:
@@ -139,8 +192,24 @@ func EventTypeString(event hsm.EventType) string {
         return "LeaderUnsyncResponseEvent"
     case EventLeaderInMemberChangeResponse:
         return "LeaderInMemberChangeResponseEvent"
+    case EventLeaderChangedResponse:
+        return "LeaderChangedResponseEvent"
+    case EventOverloadedResponse:
+        return "OverloadedResponseEvent"
+    case EventDeadlineExceededResponse:
+        return "DeadlineExceededResponseEvent"
+    case EventSnapshotRequest:
+        return "SnapshotRequestEvent"
     case EventPersistErrorResponse:
         return "PersistErrorResponseEvent"
+    case EventGroupRequest:
+        return "GroupRequestEvent"
+    case EventGroupUnknownResponse:
+        return "GroupUnknownResponseEvent"
+    case EventGroupHeartbeatRequest:
+        return "GroupHeartbeatRequestEvent"
+    case EventGroupHeartbeatResponse:
+        return "GroupHeartbeatResponseEvent"
     default:
         return fmt.Sprintf("Unknown Event: %d", event)
     }
@@ -154,7 +223,14 @@ func IsEventBetween(eventType, beginEvent, endEvent hsm.EventType) bool {
 }
 
 func IsRaftEvent(eventType hsm.EventType) bool {
-    return IsEventBetween(eventType, EventRaftBegin, EventRaftEnd)
+    switch eventType {
+    case EventTimeoutNowRequest:
+        fallthrough
+    case EventTimeoutNowResponse:
+        return true
+    default:
+        return IsEventBetween(eventType, EventRaftBegin, EventRaftEnd)
+    }
 }
 
 func IsRaftRequest(eventType hsm.EventType) bool {
@@ -164,6 +240,8 @@ func IsRaftRequest(eventType hsm.EventType) bool {
     case EventRequestVoteRequest:
         fallthrough
     case EventInstallSnapshotRequest:
+        fallthrough
+    case EventTimeoutNowRequest:
         return true
     default:
         return false
@@ -171,12 +249,22 @@ func IsRaftRequest(eventType hsm.EventType) bool {
 }
 
 func IsTimeoutEvent(eventType hsm.EventType) bool {
+    if eventType == EventTimeoutCheckQuorum {
+        return true
+    }
     return IsEventBetween(eventType, EventTimeoutBegin, EventTimeoutEnd)
 }
 
 func IsClientRequestEvent(eventType hsm.EventType) bool {
-    return IsEventBetween(
-        eventType, EventClientRequestBegin, EventClientRequestEnd)
+    switch eventType {
+    case EventClientJoinRequest:
+        fallthrough
+    case EventClientUpdateAddrRequest:
+        return true
+    default:
+        return IsEventBetween(
+            eventType, EventClientRequestBegin, EventClientRequestEnd)
+    }
 }
 
 // ------------------------------------------------------------
@@ -333,6 +421,44 @@ func (self *InstallSnapshotResponseEvent) Message() interface{} {
     return self.Response
 }
 
+// Event for TimeoutNowRequest message.
+type TimeoutNowRequestEvent struct {
+    *RequestEventHead
+    Request *TimeoutNowRequest
+}
+
+func NewTimeoutNowRequestEvent(
+    request *TimeoutNowRequest) *TimeoutNowRequestEvent {
+
+    return &TimeoutNowRequestEvent{
+        RequestEventHead: NewRequestEventHead(EventTimeoutNowRequest),
+        Request:          request,
+    }
+}
+
+func (self *TimeoutNowRequestEvent) Message() interface{} {
+    return self.Request
+}
+
+// Event for TimeoutNowResponse message.
+type TimeoutNowResponseEvent struct {
+    *hsm.StdEvent
+    Response *TimeoutNowResponse
+}
+
+func NewTimeoutNowResponseEvent(
+    response *TimeoutNowResponse) *TimeoutNowResponseEvent {
+
+    return &TimeoutNowResponseEvent{
+        StdEvent: hsm.NewStdEvent(EventTimeoutNowResponse),
+        Response: response,
+    }
+}
+
+func (self *TimeoutNowResponseEvent) Message() interface{} {
+    return self.Response
+}
+
 // ------------------------------------------------------------
 // Client Events
 // ------------------------------------------------------------
@@ -340,6 +466,9 @@ func (self *InstallSnapshotResponseEvent) Message() interface{} {
 type ClientAppendRequestEvent struct {
     *RequestEventHead
     Request *ClientAppendRequest
+    // the time after which the request is dropped, set from the timeout
+    // of request on its arrival, zero for no deadline
+    Deadline time.Time
 }
 
 func NewClientAppendRequestEvent(
@@ -359,6 +488,9 @@ func (self *ClientAppendRequestEvent) Message() interface{} {
 type ClientReadOnlyRequestEvent struct {
     *RequestEventHead
     Request *ClientReadOnlyRequest
+    // the time after which the request is dropped, set from the timeout
+    // of request on its arrival, zero for no deadline
+    Deadline time.Time
 }
 
 func NewClientReadOnlyRequestEvent(
@@ -411,6 +543,44 @@ func (self *ClientChangeConfigRequestEvent) Message() interface{} {
     return self.Request
 }
 
+// Event for ClientJoinRequest message.
+type ClientJoinRequestEvent struct {
+    *RequestEventHead
+    Request *ClientJoinRequest
+}
+
+func NewClientJoinRequestEvent(
+    request *ClientJoinRequest) *ClientJoinRequestEvent {
+
+    return &ClientJoinRequestEvent{
+        RequestEventHead: NewRequestEventHead(EventClientJoinRequest),
+        Request:          request,
+    }
+}
+
+func (self *ClientJoinRequestEvent) Message() interface{} {
+    return self.Request
+}
+
+// Event for ClientUpdateAddrRequest message.
+type ClientUpdateAddrRequestEvent struct {
+    *RequestEventHead
+    Request *ClientUpdateAddrRequest
+}
+
+func NewClientUpdateAddrRequestEvent(
+    request *ClientUpdateAddrRequest) *ClientUpdateAddrRequestEvent {
+
+    return &ClientUpdateAddrRequestEvent{
+        RequestEventHead: NewRequestEventHead(EventClientUpdateAddrRequest),
+        Request:          request,
+    }
+}
+
+func (self *ClientUpdateAddrRequestEvent) Message() interface{} {
+    return self.Request
+}
+
 // ClientResponseEvent is the general response event to client.
 type ClientResponseEvent struct {
     *hsm.StdEvent
@@ -448,6 +618,175 @@ func (self *ClientGetConfigResponseEvent) Message() interface{} {
     return self.Response
 }
 
+// QueryNodeStatusRequestEvent is a request to query the full status of
+// a node. It could be served by any node regardless of its raft state.
+type QueryNodeStatusRequestEvent struct {
+    *RequestEventHead
+    Request *QueryNodeStatusRequest
+}
+
+func NewQueryNodeStatusRequestEvent(
+    request *QueryNodeStatusRequest) *QueryNodeStatusRequestEvent {
+
+    return &QueryNodeStatusRequestEvent{
+        RequestEventHead: NewRequestEventHead(EventQueryNodeStatusRequest),
+        Request:          request,
+    }
+}
+
+func (self *QueryNodeStatusRequestEvent) Message() interface{} {
+    return self.Request
+}
+
+// BootstrapRequestEvent is a request to bootstrap a fresh node.
+// It's served by the local node only, and never sent over network.
+type BootstrapRequestEvent struct {
+    *RequestEventHead
+    Request *BootstrapRequest
+}
+
+func NewBootstrapRequestEvent(
+    request *BootstrapRequest) *BootstrapRequestEvent {
+
+    return &BootstrapRequestEvent{
+        RequestEventHead: NewRequestEventHead(EventBootstrapRequest),
+        Request:          request,
+    }
+}
+
+func (self *BootstrapRequestEvent) Message() interface{} {
+    return self.Request
+}
+
+// ResumeRequestEvent is a request for a node in persist error state to
+// resume serving, after the persist error is fixed. It's served by
+// the node it's sent to, and never redirected.
+type ResumeRequestEvent struct {
+    *RequestEventHead
+    Request *ResumeRequest
+}
+
+func NewResumeRequestEvent(request *ResumeRequest) *ResumeRequestEvent {
+    return &ResumeRequestEvent{
+        RequestEventHead: NewRequestEventHead(EventResumeRequest),
+        Request:          request,
+    }
+}
+
+func (self *ResumeRequestEvent) Message() interface{} {
+    return self.Request
+}
+
+// SnapshotRequestEvent is a request for a node to take a snapshot of its
+// state machine. It's served by the node it's sent to, and never
+// redirected.
+type SnapshotRequestEvent struct {
+    *RequestEventHead
+    Request *SnapshotRequest
+}
+
+func NewSnapshotRequestEvent(request *SnapshotRequest) *SnapshotRequestEvent {
+    return &SnapshotRequestEvent{
+        RequestEventHead: NewRequestEventHead(EventSnapshotRequest),
+        Request:          request,
+    }
+}
+
+func (self *SnapshotRequestEvent) Message() interface{} {
+    return self.Request
+}
+
+// TransferLeadershipRequestEvent is a request for a leader to hand over
+// its leadership, e.g. before it shuts down. It's served by the node
+// it's sent to, and never redirected.
+type TransferLeadershipRequestEvent struct {
+    *RequestEventHead
+    Request *TransferLeadershipRequest
+}
+
+func NewTransferLeadershipRequestEvent(
+    request *TransferLeadershipRequest) *TransferLeadershipRequestEvent {
+
+    return &TransferLeadershipRequestEvent{
+        RequestEventHead: NewRequestEventHead(EventTransferLeadershipRequest),
+        Request:          request,
+    }
+}
+
+func (self *TransferLeadershipRequestEvent) Message() interface{} {
+    return self.Request
+}
+
+// SubscribeRequestEvent is a request to subscribe to the notifies of
+// a node, for a remote subscriber. It's served by the node it's sent to,
+// and never redirected.
+type SubscribeRequestEvent struct {
+    *RequestEventHead
+    Request *SubscribeRequest
+}
+
+func NewSubscribeRequestEvent(
+    request *SubscribeRequest) *SubscribeRequestEvent {
+
+    return &SubscribeRequestEvent{
+        RequestEventHead: NewRequestEventHead(EventSubscribeRequest),
+        Request:          request,
+    }
+}
+
+func (self *SubscribeRequestEvent) Message() interface{} {
+    return self.Request
+}
+
+// QueryNodeStatusResponseEvent is the response of
+// QueryNodeStatusRequestEvent.
+type QueryNodeStatusResponseEvent struct {
+    *hsm.StdEvent
+    Response *QueryNodeStatusResponse
+}
+
+func NewQueryNodeStatusResponseEvent(
+    response *QueryNodeStatusResponse) *QueryNodeStatusResponseEvent {
+
+    return &QueryNodeStatusResponseEvent{
+        StdEvent: hsm.NewStdEvent(EventQueryNodeStatusResponse),
+        Response: response,
+    }
+}
+
+func (self *QueryNodeStatusResponseEvent) Message() interface{} {
+    return self.Response
+}
+
+// SubscribeResponseEvent is the response of SubscribeRequestEvent.
+// Only Response goes over the network. Stream delivers the notifies of
+// the subscription, and is closed when the subscription ends. Cancel
+// ends the subscription, and must be called once the stream is no
+// longer received.
+type SubscribeResponseEvent struct {
+    *hsm.StdEvent
+    Response *SubscribeResponse
+    Stream   <-chan *NotifyMessage
+    Cancel   func()
+}
+
+func NewSubscribeResponseEvent(
+    response *SubscribeResponse,
+    stream <-chan *NotifyMessage,
+    cancel func()) *SubscribeResponseEvent {
+
+    return &SubscribeResponseEvent{
+        StdEvent: hsm.NewStdEvent(EventSubscribeResponse),
+        Response: response,
+        Stream:   stream,
+        Cancel:   cancel,
+    }
+}
+
+func (self *SubscribeResponseEvent) Message() interface{} {
+    return self.Response
+}
+
 // LeaderRedirectResponseEvent is to tell client we are not leader and
 // the leader address at this moment for client to redirect.
 type LeaderRedirectResponseEvent struct {
@@ -519,6 +858,60 @@ func (self *LeaderInMemberChangeResponseEvent) Message() interface{} {
     return nil
 }
 
+// LeaderChangedResponseEvent is to tell client the leader lost its
+// leadership before the request is committed, so whether the request
+// takes effect is unknown. It carries the new leader if it's known.
+type LeaderChangedResponseEvent struct {
+    *hsm.StdEvent
+    Response *LeaderChangedResponse
+}
+
+func NewLeaderChangedResponseEvent(
+    response *LeaderChangedResponse) *LeaderChangedResponseEvent {
+
+    return &LeaderChangedResponseEvent{
+        StdEvent: hsm.NewStdEvent(EventLeaderChangedResponse),
+        Response: response,
+    }
+}
+
+func (self *LeaderChangedResponseEvent) Message() interface{} {
+    return self.Response
+}
+
+// OverloadedResponseEvent is to tell client there are too many requests
+// pending on the node, so the request is rejected. It's good for client
+// to back off before retrying.
+type OverloadedResponseEvent struct {
+    *hsm.StdEvent
+}
+
+func NewOverloadedResponseEvent() *OverloadedResponseEvent {
+    return &OverloadedResponseEvent{
+        StdEvent: hsm.NewStdEvent(EventOverloadedResponse),
+    }
+}
+
+func (self *OverloadedResponseEvent) Message() interface{} {
+    return nil
+}
+
+// DeadlineExceededResponseEvent is to tell client that the deadline of
+// the request has passed before it's served, so it's dropped.
+type DeadlineExceededResponseEvent struct {
+    *hsm.StdEvent
+}
+
+func NewDeadlineExceededResponseEvent() *DeadlineExceededResponseEvent {
+    return &DeadlineExceededResponseEvent{
+        StdEvent: hsm.NewStdEvent(EventDeadlineExceededResponse),
+    }
+}
+
+func (self *DeadlineExceededResponseEvent) Message() interface{} {
+    return nil
+}
+
 // PersistErrorResponseEvent is to tell client that a persist error happened.
 // It's probably a hard disk failure. This module should be restarted and
 // the whole hsm should be re-instablished after fixing the persist error.
@@ -538,6 +931,101 @@ func (self *PersistErrorResponseEvent) Message() interface{} {
     return self.Error
 }
 
+// GroupRequestEvent wraps a request to a raft group, so that many groups
+// could share one transport. Only the group id is its message, the wrapped
+// request is written right after it. The response of the wrapped request
+// is the response of this event.
+type GroupRequestEvent struct {
+    *hsm.StdEvent
+    GroupID uint64
+    Request RequestEvent
+}
+
+func NewGroupRequestEvent(
+    groupID uint64, request RequestEvent) *GroupRequestEvent {
+
+    return &GroupRequestEvent{
+        StdEvent: hsm.NewStdEvent(EventGroupRequest),
+        GroupID:  groupID,
+        Request:  request,
+    }
+}
+
+func (self *GroupRequestEvent) Message() interface{} {
+    return self.GroupID
+}
+
+func (self *GroupRequestEvent) SendResponse(event Event) {
+    self.Request.SendResponse(event)
+}
+
+func (self *GroupRequestEvent) RecvResponse() Event {
+    return self.Request.RecvResponse()
+}
+
+func (self *GroupRequestEvent) GetResponseChan() <-chan Event {
+    return self.Request.GetResponseChan()
+}
+
+// GroupUnknownResponseEvent is to tell the sender of a GroupRequestEvent
+// that the target group doesn't run on the receiving host.
+type GroupUnknownResponseEvent struct {
+    *hsm.StdEvent
+    Response *GroupUnknownResponse
+}
+
+func NewGroupUnknownResponseEvent(
+    response *GroupUnknownResponse) *GroupUnknownResponseEvent {
+
+    return &GroupUnknownResponseEvent{
+        StdEvent: hsm.NewStdEvent(EventGroupUnknownResponse),
+        Response: response,
+    }
+}
+
+func (self *GroupUnknownResponseEvent) Message() interface{} {
+    return self.Response
+}
+
+// GroupHeartbeatRequestEvent carries the heartbeats of many raft groups
+// from one host to another in a single message.
+type GroupHeartbeatRequestEvent struct {
+    *RequestEventHead
+    Request *GroupHeartbeatRequest
+}
+
+func NewGroupHeartbeatRequestEvent(
+    request *GroupHeartbeatRequest) *GroupHeartbeatRequestEvent {
+
+    return &GroupHeartbeatRequestEvent{
+        RequestEventHead: NewRequestEventHead(EventGroupHeartbeatRequest),
+        Request:          request,
+    }
+}
+
+func (self *GroupHeartbeatRequestEvent) Message() interface{} {
+    return self.Request
+}
+
+// GroupHeartbeatResponseEvent is the response of GroupHeartbeatRequestEvent.
+type GroupHeartbeatResponseEvent struct {
+    *hsm.StdEvent
+    Response *GroupHeartbeatResponse
+}
+
+func NewGroupHeartbeatResponseEvent(
+    response *GroupHeartbeatResponse) *GroupHeartbeatResponseEvent {
+
+    return &GroupHeartbeatResponseEvent{
+        StdEvent: hsm.NewStdEvent(EventGroupHeartbeatResponse),
+        Response: response,
+    }
+}
+
+func (self *GroupHeartbeatResponseEvent) Message() interface{} {
+    return self.Response
+}
+
 // ------------------------------------------------------------
 // Internal Events
 // ------------------------------------------------------------
@@ -600,6 +1088,20 @@ func NewElectionTimeoutEvent(message *Timeout) *ElectionTimeoutEvent {
     }
 }
 
+// CheckQuorumTimeoutEvent is the event for leader to check whether
+// it still has contact with a majority of the cluster.
+type CheckQuorumTimeoutEvent struct {
+    *hsm.StdEvent
+    Message *Timeout
+}
+
+func NewCheckQuorumTimeoutEvent(message *Timeout) *CheckQuorumTimeoutEvent {
+    return &CheckQuorumTimeoutEvent{
+        StdEvent: hsm.NewStdEvent(EventTimeoutCheckQuorum),
+        Message:  message,
+    }
+}
+
 // AbortSnapshotRecoveryEvent is an event for snapshot recovery state to exit.
 type AbortSnapshotRecoveryEvent struct {
     *hsm.StdEvent
@@ -614,14 +1116,21 @@ func NewAbortSnapshotRecoveryEvent(err error) *AbortSnapshotRecoveryEvent {
 }
 
 // StepdownEvent is an event for candidate state or leader state to
-// transfer back to follower state.
+// transfer back to follower state. Leader is the new leader which causes
+// the stepdown, nil if it's unknown.
 type StepdownEvent struct {
     *hsm.StdEvent
+    Leader *ps.ServerAddress
 }
 
 func NewStepdownEvent() *StepdownEvent {
+    return NewStepdownEventWithLeader(nil)
+}
+
+func NewStepdownEventWithLeader(leader *ps.ServerAddress) *StepdownEvent {
     return &StepdownEvent{
         StdEvent: hsm.NewStdEvent(EventStepdown),
+        Leader:   leader,
     }
 }
 
@@ -1,6 +1,7 @@
 package event
 
 import (
+    hsm "github.com/hhkbp2/go-hsm"
     ps "github.com/hhkbp2/rafted/persist"
     "time"
 )
@@ -38,6 +39,14 @@ type AppendEntriesResponse struct {
 
     // We may not succeed if we have a conflicting entry
     Success bool
+
+    // The term of the conflicting entry at PrevLogIndex, and the first index
+    // of that term in local log. They help the leader to skip all the
+    // conflicting entries of a term in one round trip. ConflictTerm is 0 if
+    // there is no entry at PrevLogIndex, then ConflictIndex is the next
+    // index of local log. Both are 0 if it fails for other reasons.
+    ConflictTerm  uint64
+    ConflictIndex uint64
 }
 
 // RequestVoteRequest is the command used by a candidate to ask a Raft peer
@@ -97,6 +106,23 @@ type InstallSnapshotResponse struct {
     Success bool
 }
 
+// TimeoutNowRequest is sent by leader to transfer its leadership to
+// the receiver, which starts an election right away.
+type TimeoutNowRequest struct {
+    // Leader's current term
+    Term uint64
+    // Leader ID
+    Leader *ps.ServerAddress
+}
+
+// TimeoutNowResponse is the response of a TimeoutNowRequest.
+type TimeoutNowResponse struct {
+    // current term of the receiver
+    Term uint64
+    // whether the receiver starts an election
+    Success bool
+}
+
 // ------------------------------------------------------------
 // Client Messages
 // ------------------------------------------------------------
@@ -105,12 +131,20 @@ type InstallSnapshotResponse struct {
 type ClientAppendRequest struct {
     // the request content, to be applied to state machine
     Data []byte
+    // the time the client waits for the request since it's sent,
+    // zero for no timeout. It's counted from the request arriving
+    // at a node, by the clock of the node.
+    Timeout time.Duration
 }
 
 // ClientReadOnlyRequest is a read-only request not to be appended to raft log.
 type ClientReadOnlyRequest struct {
     // the request content, to be applied to state machine
     Data []byte
+    // the time the client waits for the request since it's sent,
+    // zero for no timeout. It's counted from the request arriving
+    // at a node, by the clock of the node.
+    Timeout time.Duration
 }
 
 type ClientGetConfigRequest struct {
@@ -121,6 +155,20 @@ type ClientChangeConfigRequest struct {
     Conf *ps.Config
 }
 
+// ClientJoinRequest is a request to add a new server into cluster.
+// It's a member change from the current config to the one with
+// the new server, which leader issues on behalf of the new server.
+type ClientJoinRequest struct {
+    Addr *ps.ServerAddress
+}
+
+// ClientUpdateAddrRequest is a request to update the addresses of
+// the member with the same ID as Addr, e.g. after it moves to another host.
+// It changes no membership, so it's done without member change.
+type ClientUpdateAddrRequest struct {
+    Addr *ps.ServerAddress
+}
+
 // ClientResponse is a general response of raft module answer to client.
 type ClientResponse struct {
     // whether the request handling is a success or failure.
@@ -135,10 +183,175 @@ type LeaderRedirectResponse struct {
     Leader *ps.ServerAddress
 }
 
+// LeaderChangedResponse contains the new leader info, for client to
+// retry the request whose leader lost leadership.
+type LeaderChangedResponse struct {
+    // The network address of new leader, nil if it's unknown
+    Leader *ps.ServerAddress
+}
+
 type ClientGetConfigResponse struct {
     Conf *ps.Config
 }
 
+// QueryNodeStatusRequest is a request for the status of a node.
+type QueryNodeStatusRequest struct {
+}
+
+// BootstrapRequest is a request to setup a fresh node, which has
+// neither log nor config, with the initial config of the cluster.
+type BootstrapRequest struct {
+    Conf *ps.Config
+}
+
+// ResumeRequest is a request for a node to leave persist error state.
+type ResumeRequest struct {
+}
+
+// SnapshotRequest is a request for a node to take a snapshot of its
+// state machine, up through the last applied log entry. The Data of
+// the response is the id of the snapshot.
+type SnapshotRequest struct {
+}
+
+// TransferLeadershipRequest is a request for a leader to transfer its
+// leadership to Target, or the peer with the most log replicated if
+// Target is nil. The response tells whether a transfer is started.
+type TransferLeadershipRequest struct {
+    Target *ps.ServerAddress
+}
+
+// SubscribeRequest is a request to subscribe to the notifies of Types,
+// or all the notifies if none is specified. The node keeps at most
+// Capacity notifies not sent yet, zero for its default capacity.
+// A new subscription has a zero Epoch, and receives only the notifies
+// after it's made. To resume a former subscription, Epoch and After are
+// set to the epoch it's responded with and the seq of the last notify
+// received, by Follow() and Receive(). The notifies after that still
+// kept in the history of the node are sent first.
+type SubscribeRequest struct {
+    Types    []hsm.EventType
+    Capacity int
+    Epoch    uint64
+    After    uint64
+}
+
+// Follow sets request to resume the subscription it made,
+// which is responded with response.
+func (self *SubscribeRequest) Follow(response *SubscribeResponse) {
+    if self.Epoch == 0 {
+        self.After = response.Seq
+    } else if self.Epoch != response.Epoch {
+        // the node has restarted, all its history is sent
+        self.After = 0
+    }
+    self.Epoch = response.Epoch
+}
+
+// Receive sets request to resume after message.
+func (self *SubscribeRequest) Receive(message *NotifyMessage) {
+    self.After = message.Seq
+}
+
+// SubscribeResponse is the response of SubscribeRequest. Epoch identifies
+// the lifetime of the node, which changes once it restarts. Seq is the seq
+// of the latest notify of the node when it's subscribed. Missed tells
+// whether some notifies after the ones received are lost when resuming,
+// for they're out of the history of the node, or the node has restarted.
+type SubscribeResponse struct {
+    Epoch  uint64
+    Seq    uint64
+    Missed bool
+}
+
+// PeerStatus is the replication status of a peer from the view of leader.
+type PeerStatus struct {
+    // network addr of the peer
+    Addr *ps.ServerAddress
+    // the current state of the peer hsm
+    StateID string
+    // index of highest log entry known to be replicated on the peer
+    MatchIndex uint64
+    // index of the next log entry to send to the peer
+    NextIndex uint64
+    // last time the leader has contact from the peer
+    LastContactTime time.Time
+}
+
+// QueryNodeStatusResponse contains the status of a node.
+type QueryNodeStatusResponse struct {
+    // the current term
+    Term uint64
+    // the current raft state and the exact state of local hsm
+    State   RaftStateType
+    StateID string
+    // network addr of this node
+    LocalAddr *ps.ServerAddress
+    // the leader known by this node, nil if unknown
+    Leader *ps.ServerAddress
+    // candidate that received vote in current term, nil if none
+    VotedFor *ps.ServerAddress
+
+    // log status
+    FirstLogIndex    uint64
+    LastLogIndex     uint64
+    CommittedIndex   uint64
+    LastAppliedIndex uint64
+    // the last entry started by a leader, which may be not stored in
+    // log yet. It's the same as LastLogIndex on the other nodes.
+    StartedIndex uint64
+
+    // metadata of the latest snapshot, nil if no snapshot at all
+    LastSnapshot *ps.SnapshotMeta
+
+    // the committed configuration
+    Conf *ps.Config
+    // the configuration not committed yet during member change,
+    // nil if none
+    PendingConf *ps.Config
+    // the member change status
+    MemberChangeStatus string
+
+    // depth of the queues, which grow when this node is overloaded
+    PendingRequests int
+    PendingApplies  int
+    PendingNotifies int
+
+    // replication status of all peers, only available on leader
+    Peers []*PeerStatus
+}
+
+// GroupUnknownResponse is the response to a request for a raft group
+// which doesn't run on the receiving host.
+type GroupUnknownResponse struct {
+    GroupID uint64
+}
+
+// GroupHeartbeat is the heartbeat of a raft group, which stands for
+// an AppendEntriesRequest without any entry.
+type GroupHeartbeat struct {
+    GroupID           uint64
+    Term              uint64
+    PrevLogTerm       uint64
+    PrevLogIndex      uint64
+    LeaderCommitIndex uint64
+}
+
+// GroupHeartbeatRequest batches the heartbeats of all the raft groups
+// led by the same host to the same destination host.
+type GroupHeartbeatRequest struct {
+    // the host of all the leaders
+    Leader     *ps.ServerAddress
+    Heartbeats []*GroupHeartbeat
+}
+
+// GroupHeartbeatResponse is the response of GroupHeartbeatRequest.
+type GroupHeartbeatResponse struct {
+    // the responses in the order of the heartbeats, nil for a group
+    // which is unknown or fails to response in time
+    Responses []*AppendEntriesResponse
+}
+
 // ------------------------------------------------------------
 // Internal Messages
 // ------------------------------------------------------------
@@ -166,7 +379,9 @@ type PeerReplicateLog struct {
 // MemberChangeNewConf contains new configuration of the cluster.
 // It is used in member change prodedure for follower state.
 type MemberChangeNewConf struct {
-    Conf *ps.Config
+    // the index of the member change log entry
+    Index uint64
+    Conf  *ps.Config
 }
 
 type LeaderForwardMemberChangePhase struct {
@@ -1,6 +1,7 @@
 package event
 
 import (
+    "errors"
     hsm "github.com/hhkbp2/go-hsm"
     ps "github.com/hhkbp2/rafted/persist"
     "time"
@@ -244,3 +245,96 @@ func NewNotifyPersistErrorEvent(err error) *NotifyPersistErrorEvent {
         Error:    err,
     }
 }
+
+// NotifyMessage is the form of a notify event to send to the remote
+// subscribers. Seq is the seq of the notify, counted from 1 by the node
+// that makes it. Only the fields of the notify type are set.
+type NotifyMessage struct {
+    Seq        uint64
+    Type       hsm.EventType
+    Time       time.Time
+    Timeout    time.Duration
+    OldState   RaftStateType
+    NewState   RaftStateType
+    Leader     *ps.ServerAddress
+    OldTerm    uint64
+    NewTerm    uint64
+    Term       uint64
+    LogIndex   uint64
+    OldServers *ps.ServerAddressSlice
+    NewServers *ps.ServerAddressSlice
+    Error      string
+}
+
+func NewNotifyMessage(seq uint64, event NotifyEvent) *NotifyMessage {
+    message := &NotifyMessage{
+        Seq:  seq,
+        Type: event.Type(),
+    }
+    switch e := event.(type) {
+    case *NotifyHeartbeatTimeoutEvent:
+        message.Time = e.LastHeartbeatTime
+        message.Timeout = e.Timeout
+    case *NotifyElectionTimeoutEvent:
+        message.Time = e.LastElectionTime
+        message.Timeout = e.Timeout
+    case *NotifyElectionTimeoutThresholdEvent:
+        message.Time = e.LastContactTime
+        message.Timeout = e.Timeout
+    case *NotifyStateChangeEvent:
+        message.OldState = e.OldState
+        message.NewState = e.NewState
+    case *NotifyLeaderChangeEvent:
+        message.Leader = e.NewLeader
+    case *NotifyTermChangeEvent:
+        message.OldTerm = e.OldTerm
+        message.NewTerm = e.NewTerm
+    case *NotifyCommitEvent:
+        message.Term = e.Term
+        message.LogIndex = e.LogIndex
+    case *NotifyApplyEvent:
+        message.Term = e.Term
+        message.LogIndex = e.LogIndex
+    case *NotifyMemberChangeEvent:
+        message.OldServers = e.OldServers
+        message.NewServers = e.NewServers
+    case *NotifyPersistErrorEvent:
+        if e.Error != nil {
+            message.Error = e.Error.Error()
+        }
+    }
+    return message
+}
+
+// Event returns the notify event that message is made from.
+// It returns nil for an unknown notify type.
+func (self *NotifyMessage) Event() NotifyEvent {
+    switch self.Type {
+    case EventNotifyHeartbeatTimeout:
+        return NewNotifyHeartbeatTimeoutEvent(self.Time, self.Timeout)
+    case EventNotifyElectionTimeout:
+        return NewNotifyElectionTimeoutEvent(self.Time, self.Timeout)
+    case EventNotifyElectionTimeoutThreshold:
+        return NewNotifyElectionTimeoutThresholdEvent(self.Time, self.Timeout)
+    case EventNotifyStateChange:
+        return NewNotifyStateChangeEvent(self.OldState, self.NewState)
+    case EventNotifyLeaderChange:
+        return NewNotifyLeaderChangeEvent(self.Leader)
+    case EventNotifyTermChange:
+        return NewNotifyTermChangeEvent(self.OldTerm, self.NewTerm)
+    case EventNotifyCommit:
+        return NewNotifyCommitEvent(self.Term, self.LogIndex)
+    case EventNotifyApply:
+        return NewNotifyApplyEvent(self.Term, self.LogIndex)
+    case EventNotifyMemberChange:
+        return NewNotifyMemberChangeEvent(self.OldServers, self.NewServers)
+    case EventNotifyPersistError:
+        var err error
+        if self.Error != "" {
+            err = errors.New(self.Error)
+        }
+        return NewNotifyPersistErrorEvent(err)
+    default:
+        return nil
+    }
+}
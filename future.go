@@ -0,0 +1,438 @@
+package rafted
+
+import (
+    "context"
+    hsm "github.com/hhkbp2/go-hsm"
+    cm "github.com/hhkbp2/rafted/comm"
+    ev "github.com/hhkbp2/rafted/event"
+    ps "github.com/hhkbp2/rafted/persist"
+    rt "github.com/hhkbp2/rafted/retry"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// AsyncClient is the asynchronous version of the data operations
+// in Client. Each call returns right after the request is sent, with
+// a future for its result. The futures of a client complete in the order
+// their requests are submitted. A request failed is retried along with
+// the ones submitted after it and sent already, in the same order, so
+// a request may take effect more than once.
+// The methods with a Context suffix are the same as the ones without,
+// except that the request fails with the error of ctx once ctx is done,
+// and the deadline of ctx travels in the request for the leader to drop
+// it after that. They wait for ctx when too many requests are in flight.
+type AsyncClient interface {
+    AppendAsync(data []byte) *Future
+    ReadOnlyAsync(data []byte) *Future
+    AppendAsyncContext(ctx context.Context, data []byte) *Future
+    ReadOnlyAsyncContext(ctx context.Context, data []byte) *Future
+}
+
+// FutureCallback is called with the result of a request once
+// it finishes.
+type FutureCallback func(result []byte, err error)
+
+// FutureResult is the result of a request delivered by
+// Future.ResultChan().
+type FutureResult struct {
+    Result []byte
+    Error  error
+}
+
+// Future is the result of an asynchronous request, which is available
+// after the request finishes.
+type Future struct {
+    done      chan struct{}
+    finished  bool
+    result    []byte
+    err       error
+    callbacks []FutureCallback
+    lock      sync.Mutex
+}
+
+func newFuture() *Future {
+    return &Future{
+        done: make(chan struct{}),
+    }
+}
+
+func (self *Future) complete(result []byte, err error) {
+    self.lock.Lock()
+    self.result = result
+    self.err = err
+    self.finished = true
+    close(self.done)
+    callbacks := self.callbacks
+    self.callbacks = nil
+    self.lock.Unlock()
+    for _, callback := range callbacks {
+        callback(result, err)
+    }
+}
+
+// Wait blocks until the request finishes and returns its result.
+func (self *Future) Wait() ([]byte, error) {
+    <-self.done
+    return self.result, self.err
+}
+
+// WaitContext is the same as Wait except that it returns the error of
+// ctx once ctx is done before the request finishes. The request itself
+// goes on, and its result is still available through the future.
+func (self *Future) WaitContext(ctx context.Context) ([]byte, error) {
+    select {
+    case <-self.done:
+        return self.result, self.err
+    case <-ctx.Done():
+        return nil, ctx.Err()
+    }
+}
+
+// Done returns a channel which is closed when the request finishes.
+func (self *Future) Done() <-chan struct{} {
+    return self.done
+}
+
+// ResultChan returns a channel which receives the result once
+// the request finishes.
+func (self *Future) ResultChan() <-chan *FutureResult {
+    resultChan := make(chan *FutureResult, 1)
+    self.OnComplete(func(result []byte, err error) {
+        resultChan <- &FutureResult{
+            Result: result,
+            Error:  err,
+        }
+    })
+    return resultChan
+}
+
+// OnComplete registers callback to be called with the result once
+// the request finishes, or right away if it has finished. The callbacks
+// of a client are called one by one in the order of the requests, so
+// they should not block.
+func (self *Future) OnComplete(callback FutureCallback) {
+    self.lock.Lock()
+    if !self.finished {
+        self.callbacks = append(self.callbacks, callback)
+        self.lock.Unlock()
+        return
+    }
+    self.lock.Unlock()
+    callback(self.result, self.err)
+}
+
+// maxInflightRequests is the max number of requests in a pipeline not
+// finished yet. Submitting more blocks until the earliest finishes.
+const maxInflightRequests = 1024
+
+type pipelineRequest struct {
+    ctx      context.Context
+    reqEvent ev.RequestEvent
+    future   *Future
+}
+
+// pipeline sends the requests submitted to backend one after another
+// without waiting for the responses of the previous ones. The responses
+// are handled in the submission order, along with the redirecting and
+// retrying of the requests, so the futures complete in the same order.
+// With a pipeliner, the redirected requests are forwarded to the leader
+// on a pipelined connection, at most cm.MaxPipelinedRequests of them
+// waiting for their responses. Once any of them fails, it and the ones
+// after it are retried one by one in order, before any later request
+// is forwarded. Without a pipeliner, a redirected request is handled
+// by redirectHandler after the previous ones finish.
+type pipeline struct {
+    backend         Backend
+    timeout         time.Duration
+    retry           rt.Retry
+    redirectRetry   rt.Retry
+    redirectHandler RedirectResponseHandler
+    pipeliner       cm.Pipeliner
+
+    // the stream to leader, only used by handleResponses()
+    stream       *forwardStream
+    slots        chan struct{}
+    inflightChan chan *pipelineRequest
+    closed       bool
+    lock         sync.Mutex
+    startOnce    sync.Once
+    group        sync.WaitGroup
+}
+
+func newPipeline(
+    backend Backend,
+    timeout time.Duration,
+    retry rt.Retry,
+    redirectRetry rt.Retry,
+    redirectHandler RedirectResponseHandler,
+    pipeliner cm.Pipeliner) *pipeline {
+
+    return &pipeline{
+        backend:         backend,
+        timeout:         timeout,
+        retry:           retry,
+        redirectRetry:   redirectRetry,
+        redirectHandler: redirectHandler,
+        pipeliner:       pipeliner,
+        slots:           make(chan struct{}, maxInflightRequests),
+        inflightChan:    make(chan *pipelineRequest, maxInflightRequests),
+    }
+}
+
+// Submit sends reqEvent and returns the future for its result. If ctx
+// is done before there is room for the request, it isn't sent and
+// the future fails with the error of ctx right away.
+func (self *pipeline) Submit(
+    ctx context.Context, reqEvent ev.RequestEvent) *Future {
+
+    future := newFuture()
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if self.closed {
+        future.complete(nil, Closed)
+        return future
+    }
+    if err := ctx.Err(); err != nil {
+        future.complete(nil, err)
+        return future
+    }
+    select {
+    case self.slots <- struct{}{}:
+    case <-ctx.Done():
+        future.complete(nil, ctx.Err())
+        return future
+    }
+    self.startOnce.Do(func() {
+        self.group.Add(1)
+        go self.handleResponses()
+    })
+    self.backend.Send(reqEvent)
+    self.inflightChan <- &pipelineRequest{
+        ctx:      ctx,
+        reqEvent: reqEvent,
+        future:   future,
+    }
+    return future
+}
+
+func (self *pipeline) handleResponses() {
+    defer self.group.Done()
+    defer self.finishStream()
+    for {
+        var brokenChan <-chan struct{}
+        if self.stream != nil {
+            brokenChan = self.stream.BrokenChan()
+        }
+        select {
+        case request, ok := <-self.inflightChan:
+            if !ok {
+                return
+            }
+            self.handleResponse(request)
+        case <-brokenChan:
+            // retry the failed requests without waiting for
+            // the next request
+            self.finishStream()
+        }
+    }
+}
+
+func (self *pipeline) handleResponse(request *pipelineRequest) {
+    // the first response is for the request sent on submission,
+    // any retry sends it again
+    first, firstErr := recvFromBackend(
+        request.ctx, request.reqEvent, self.timeout)
+    if (firstErr == nil) && self.forward(request, first) {
+        return
+    }
+    // the requests forwarded before finish first
+    self.finishStream()
+    sent := true
+    send := func() (ev.Event, error) {
+        if sent {
+            sent = false
+            return first, firstErr
+        }
+        return sendToBackend(
+            request.ctx, self.backend, request.reqEvent, self.timeout)
+    }
+    result, err := doRequestWith(request.ctx, send, request.reqEvent,
+        self.retry, self.redirectRetry, self.redirectHandler)
+    self.finish(request, result, err)
+}
+
+// forward sends request on the stream to the leader in respEvent, if
+// it's a redirect response. It returns false if request isn't forwarded.
+func (self *pipeline) forward(
+    request *pipelineRequest, respEvent ev.Event) bool {
+
+    if (self.pipeliner == nil) ||
+        (respEvent.Type() != ev.EventLeaderRedirectResponse) {
+        return false
+    }
+    e, ok := respEvent.(*ev.LeaderRedirectResponseEvent)
+    hsm.AssertTrue(ok)
+    leader := e.Response.Leader
+    if leader == nil {
+        return false
+    }
+    if (self.stream != nil) &&
+        (self.stream.Broken() ||
+            (self.stream.leader.String() != leader.String())) {
+        self.finishStream()
+    }
+    if self.stream == nil {
+        conn, err := self.pipeliner.Pipeline(leader)
+        if err != nil {
+            // fall back to redirectHandler
+            return false
+        }
+        self.stream = newForwardStream(self, leader, conn)
+    }
+    self.stream.Forward(request)
+    return true
+}
+
+// finishStream waits for all the requests on the stream to finish,
+// and retries the failed ones one by one in order.
+func (self *pipeline) finishStream() {
+    if self.stream == nil {
+        return
+    }
+    failed := self.stream.Finish()
+    self.stream = nil
+    for _, request := range failed {
+        result, err := doRequest(request.ctx, self.backend, request.reqEvent,
+            self.timeout, self.retry, self.redirectRetry, self.redirectHandler)
+        self.finish(request, result, err)
+    }
+}
+
+func (self *pipeline) finish(
+    request *pipelineRequest, result []byte, err error) {
+
+    <-self.slots
+    request.future.complete(result, err)
+}
+
+// Close waits for all the submitted requests to finish, and fails
+// the ones submitted afterwards.
+func (self *pipeline) Close() error {
+    self.lock.Lock()
+    if !self.closed {
+        self.closed = true
+        close(self.inflightChan)
+    }
+    self.lock.Unlock()
+    self.group.Wait()
+    return nil
+}
+
+type forwardedRequest struct {
+    request *pipelineRequest
+    sent    bool
+}
+
+// forwardStream forwards requests to leader on a pipelined connection,
+// and completes them in order as their responses arrive. Once any
+// request fails, the stream is broken, and the request and all the ones
+// after it are left for the pipeline to retry.
+type forwardStream struct {
+    owner   *pipeline
+    leader  *ps.ServerAddress
+    conn    cm.PipelineConn
+    window  chan struct{}
+    pending chan *forwardedRequest
+    // only touched by the receiving routine until Finish() returns
+    failed     []*pipelineRequest
+    broken     int32
+    brokenChan chan struct{}
+    group      sync.WaitGroup
+}
+
+func newForwardStream(
+    owner *pipeline,
+    leader *ps.ServerAddress,
+    conn cm.PipelineConn) *forwardStream {
+
+    object := &forwardStream{
+        owner:      owner,
+        leader:     leader,
+        conn:       conn,
+        window:     make(chan struct{}, cm.MaxPipelinedRequests),
+        pending:    make(chan *forwardedRequest, cm.MaxPipelinedRequests),
+        failed:     make([]*pipelineRequest, 0),
+        brokenChan: make(chan struct{}),
+    }
+    object.group.Add(1)
+    go object.receive()
+    return object
+}
+
+// Forward sends request to leader, after the window has room for it.
+func (self *forwardStream) Forward(request *pipelineRequest) {
+    self.window <- struct{}{}
+    sent := false
+    if !self.Broken() {
+        if err := self.conn.Send(request.reqEvent); err != nil {
+            self.breakOff()
+        } else {
+            sent = true
+        }
+    }
+    self.pending <- &forwardedRequest{
+        request: request,
+        sent:    sent,
+    }
+}
+
+func (self *forwardStream) receive() {
+    defer self.group.Done()
+    for forwarded := range self.pending {
+        if forwarded.sent && !self.Broken() {
+            result, err := self.recv()
+            if err == nil {
+                self.owner.finish(forwarded.request, result, nil)
+                <-self.window
+                continue
+            }
+            self.breakOff()
+        }
+        self.failed = append(self.failed, forwarded.request)
+        <-self.window
+    }
+}
+
+func (self *forwardStream) recv() ([]byte, error) {
+    respEvent, err := self.conn.Recv()
+    if err != nil {
+        return nil, err
+    }
+    return resultOf(respEvent)
+}
+
+func (self *forwardStream) Broken() bool {
+    return atomic.LoadInt32(&self.broken) != 0
+}
+
+// BrokenChan returns a channel which is closed once the stream breaks.
+func (self *forwardStream) BrokenChan() <-chan struct{} {
+    return self.brokenChan
+}
+
+func (self *forwardStream) breakOff() {
+    if atomic.CompareAndSwapInt32(&self.broken, 0, 1) {
+        self.conn.Close()
+        close(self.brokenChan)
+    }
+}
+
+// Finish waits for the responses of all the requests forwarded, and
+// returns the failed ones in order.
+func (self *forwardStream) Finish() []*pipelineRequest {
+    close(self.pending)
+    self.group.Wait()
+    self.conn.Close()
+    return self.failed
+}
@@ -14,7 +14,9 @@ type CommitCondition interface {
 }
 
 type MajorityCommitCondition struct {
-    VoteStatus   map[ps.MultiAddr]bool
+    // votes keyed by ServerKey() of the servers, since the same server
+    // may be referred by different address objects
+    VoteStatus   map[string]bool
     VoteCount    uint32
     MajoritySize uint32
 }
@@ -22,9 +24,9 @@ type MajorityCommitCondition struct {
 func NewMajorityCommitCondition(
     addrSlice *ps.ServerAddressSlice) *MajorityCommitCondition {
 
-    voteStatus := make(map[ps.MultiAddr]bool)
+    voteStatus := make(map[string]bool)
     for _, addr := range addrSlice.AllMultiAddr() {
-        voteStatus[addr] = false
+        voteStatus[ps.ServerKey(addr)] = false
     }
     return &MajorityCommitCondition{
         VoteStatus:   voteStatus,
@@ -34,20 +36,20 @@ func NewMajorityCommitCondition(
 }
 
 func (self *MajorityCommitCondition) AddVote(addr ps.MultiAddr) error {
-    voteStatus, ok := self.VoteStatus[addr]
+    voteStatus, ok := self.VoteStatus[ps.ServerKey(addr)]
     if !ok {
         return errors.New(fmt.Sprintf("%s not in cluster", addr.String()))
     }
     if voteStatus {
         return errors.New(fmt.Sprintf("%s already voted", addr.String()))
     }
-    self.VoteStatus[addr] = true
+    self.VoteStatus[ps.ServerKey(addr)] = true
     self.VoteCount++
     return nil
 }
 
 func (self *MajorityCommitCondition) IsInCluster(addr ps.MultiAddr) bool {
-    if _, ok := self.VoteStatus[addr]; ok {
+    if _, ok := self.VoteStatus[ps.ServerKey(addr)]; ok {
         return true
     }
     return false
@@ -109,37 +111,46 @@ type InflightEntry struct {
 }
 
 func NewInflightEntry(request *InflightRequest) *InflightEntry {
-    if request.LogEntry.Conf.IsNormalConfig() {
-        return &InflightEntry{
-            Request: request,
-            Condition: NewMajorityCommitCondition(
-                request.LogEntry.Conf.Servers),
-        }
-    }
     return &InflightEntry{
         Request:   request,
-        Condition: NewMemberChangeCommitCondition(request.LogEntry.Conf),
+        Condition: NewConfigCommitCondition(request.LogEntry.Conf),
     }
 }
 
+// NewConfigCommitCondition returns the condition of a majority in conf.
+// During member change, it needs a majority in both the old and
+// new servers.
+func NewConfigCommitCondition(conf *ps.Config) CommitCondition {
+    if conf.IsNormalConfig() {
+        return NewMajorityCommitCondition(conf.Servers)
+    }
+    if conf.IsNewConfig() {
+        // the old servers are out of the picture since the new config,
+        // only the new servers are counted in
+        return NewMajorityCommitCondition(conf.NewServers)
+    }
+    return NewMemberChangeCommitCondition(conf)
+}
+
 type Inflight struct {
     MaxIndex           uint64
     ToCommitEntries    []*InflightEntry
     CommittedEntries   []*InflightEntry
-    ServerMatchIndexes map[ps.MultiAddr]uint64
+    // match indexes keyed by ServerKey() of the servers
+    ServerMatchIndexes map[string]uint64
 
     sync.Mutex
 }
 
 func setupServerMatchIndexes(
-    conf *ps.Config, prev map[ps.MultiAddr]uint64) map[ps.MultiAddr]uint64 {
+    conf *ps.Config, prev map[string]uint64) map[string]uint64 {
 
-    serverMatchIndexes := make(map[ps.MultiAddr]uint64)
-    initIndex := func(m map[ps.MultiAddr]uint64,
+    serverMatchIndexes := make(map[string]uint64)
+    initIndex := func(m map[string]uint64,
         addrSlice *ps.ServerAddressSlice) {
 
         for _, addr := range addrSlice.AllMultiAddr() {
-            serverMatchIndexes[addr] = 0
+            serverMatchIndexes[ps.ServerKey(addr)] = 0
         }
     }
     if conf.Servers != nil {
@@ -158,7 +169,7 @@ func setupServerMatchIndexes(
 }
 
 func NewInflight(conf *ps.Config) *Inflight {
-    defaultValue := make(map[ps.MultiAddr]uint64)
+    defaultValue := make(map[string]uint64)
     matchIndexes := setupServerMatchIndexes(conf, defaultValue)
     return &Inflight{
         MaxIndex:           0,
@@ -232,9 +243,10 @@ func (self *Inflight) Replicate(
     defer self.Unlock()
 
     // health check
-    matchIndex, ok := self.ServerMatchIndexes[addr]
+    matchIndex, ok := self.ServerMatchIndexes[ps.ServerKey(addr)]
     if !ok {
-        return false, errors.New(fmt.Sprintf("unknown address %#v", addr))
+        return false, errors.New(
+            fmt.Sprintf("unknown address %s", addr.String()))
     }
     if matchIndex >= newMatchIndex {
         return false, errors.New(
@@ -250,7 +262,7 @@ func (self *Inflight) Replicate(
     }
 
     // update match index for the specified server
-    self.ServerMatchIndexes[addr] = newMatchIndex
+    self.ServerMatchIndexes[ps.ServerKey(addr)] = newMatchIndex
 
     // only inflight requests with log index up to(including)
     // newMatchIndex are possible to be good to commit
@@ -274,6 +286,15 @@ func (self *Inflight) Replicate(
     }
 }
 
+// MatchIndex returns the highest log index known to be replicated
+// on server addr.
+func (self *Inflight) MatchIndex(addr ps.MultiAddr) uint64 {
+    self.Lock()
+    defer self.Unlock()
+
+    return self.ServerMatchIndexes[ps.ServerKey(addr)]
+}
+
 func (self *Inflight) GetCommitted() []*InflightEntry {
     self.Lock()
     defer self.Unlock()
@@ -282,3 +303,13 @@ func (self *Inflight) GetCommitted() []*InflightEntry {
     self.CommittedEntries = make([]*InflightEntry, 0)
     return committed
 }
+
+// GetToCommit takes all the entries not committed yet out of inflight.
+func (self *Inflight) GetToCommit() []*InflightEntry {
+    self.Lock()
+    defer self.Unlock()
+
+    toCommit := self.ToCommitEntries
+    self.ToCommitEntries = make([]*InflightEntry, 0)
+    return toCommit
+}
@@ -170,6 +170,71 @@ func TestInflightAddAll(t *testing.T) {
     assert.Equal(t, inflightEntries[1], committedEntries[0])
 }
 
-func TestInflightChangeMemeber(_ *testing.T) {
-    // TODO add impl
+// copyServerAddress returns a copy of addr, which is another object
+// referring to the same server.
+func copyServerAddress(addr *ps.ServerAddress) *ps.ServerAddress {
+    addresses := make([]*ps.Address, 0, len(addr.Addresses))
+    for _, a := range addr.Addresses {
+        copied := *a
+        addresses = append(addresses, &copied)
+    }
+    return &ps.ServerAddress{
+        ID:        addr.ID,
+        Addresses: addresses,
+    }
+}
+
+func TestMajorityCommitConditionAddressCopy(t *testing.T) {
+    slice := ps.RandomMemoryMultiAddrSlice(3)
+    cond := NewMajorityCommitCondition(slice)
+    // votes are counted by servers rather than address objects
+    addr := copyServerAddress(slice.Addresses[0])
+    assert.True(t, cond.IsInCluster(addr))
+    assert.Nil(t, cond.AddVote(addr))
+    assert.NotNil(t, cond.AddVote(slice.Addresses[0]))
+    assert.Nil(t, cond.AddVote(copyServerAddress(slice.Addresses[1])))
+    assert.True(t, cond.IsCommitted())
+}
+
+func TestInflightChangeMemeber(t *testing.T) {
+    clusterSize := 3
+    slice := ps.RandomMemoryMultiAddrSlice(clusterSize + 1)
+    oldServers := &ps.ServerAddressSlice{
+        Addresses: slice.Addresses[:clusterSize],
+    }
+    conf := &ps.Config{
+        Servers:    oldServers,
+        NewServers: nil,
+    }
+    inflight := NewInflight(conf)
+    good, err := inflight.Replicate(oldServers.Addresses[0], testIndex)
+    assert.Nil(t, err)
+    assert.False(t, good)
+    // the new config may refer to the same servers with other objects
+    newServers := &ps.ServerAddressSlice{
+        Addresses: make([]*ps.ServerAddress, 0, clusterSize),
+    }
+    for _, addr := range slice.Addresses[1:] {
+        newServers.Addresses = append(
+            newServers.Addresses, copyServerAddress(addr))
+    }
+    inflight.ChangeMember(&ps.Config{
+        Servers:    oldServers,
+        NewServers: newServers,
+    })
+    assert.Equal(t, testIndex, inflight.MatchIndex(oldServers.Addresses[0]))
+    assert.Equal(t, 0, inflight.MatchIndex(slice.Addresses[clusterSize]))
+    // the server left out of the new config is dropped
+    inflight.ChangeMember(&ps.Config{
+        Servers:    newServers,
+        NewServers: nil,
+    })
+    assert.Equal(t, clusterSize, len(inflight.ServerMatchIndexes))
+    _, err = inflight.Replicate(oldServers.Addresses[0], testIndex+1)
+    assert.NotNil(t, err)
+    good, err = inflight.Replicate(slice.Addresses[1], testIndex)
+    assert.Nil(t, err)
+    assert.False(t, good)
+    assert.Equal(t, testIndex,
+        inflight.MatchIndex(copyServerAddress(slice.Addresses[1])))
 }
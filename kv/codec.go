@@ -0,0 +1,57 @@
+package kv
+
+import (
+    "encoding/json"
+)
+
+const (
+    Get    = "get"
+    Put    = "put"
+    Delete = "delete"
+    Cas    = "cas"
+)
+
+// Input is a command to a kv store. Value is the value to put, or
+// the new value of a cas, which succeeds only if the current value is
+// Expect.
+type Input struct {
+    Op     string
+    Key    string
+    Value  string
+    Expect string
+}
+
+// Output is the result of a kv command. Found tells whether the key
+// exists before the command. Value is the value got. Ok tells whether
+// a cas succeeds.
+type Output struct {
+    Value string
+    Found bool
+    Ok    bool
+}
+
+func EncodeInput(input *Input) []byte {
+    data, _ := json.Marshal(input)
+    return data
+}
+
+func DecodeInput(data []byte) (*Input, error) {
+    input := &Input{}
+    if err := json.Unmarshal(data, input); err != nil {
+        return nil, err
+    }
+    return input, nil
+}
+
+func EncodeOutput(output *Output) []byte {
+    data, _ := json.Marshal(output)
+    return data
+}
+
+func DecodeOutput(data []byte) (*Output, error) {
+    output := &Output{}
+    if err := json.Unmarshal(data, output); err != nil {
+        return nil, err
+    }
+    return output, nil
+}
@@ -0,0 +1,25 @@
+package kv
+
+import (
+    "github.com/hhkbp2/testify/assert"
+    "github.com/hhkbp2/testify/require"
+    "testing"
+)
+
+func TestInputCodec(t *testing.T) {
+    input := &Input{Op: Cas, Key: "a", Value: "2", Expect: "1"}
+    decoded, err := DecodeInput(EncodeInput(input))
+    require.Nil(t, err)
+    assert.Equal(t, input, decoded)
+    _, err = DecodeInput([]byte("garbage"))
+    assert.NotNil(t, err)
+}
+
+func TestOutputCodec(t *testing.T) {
+    output := &Output{Value: "1", Found: true}
+    decoded, err := DecodeOutput(EncodeOutput(output))
+    require.Nil(t, err)
+    assert.Equal(t, output, decoded)
+    _, err = DecodeOutput([]byte("garbage"))
+    assert.NotNil(t, err)
+}
@@ -178,7 +178,9 @@ func (self *LeaderMemberChangeActivatedState) Init(
     hsm.AssertTrue(ok)
     switch memberChangeHSM.LocalHSM.GetMemberChangeStatus() {
     case OldNewConfigSeen:
+        fallthrough
     case OldNewConfigCommitted:
+        fallthrough
     case NewConfigSeen:
         sm.QInit(StateLeaderInMemberChangeID)
     case NotInMemeberChange:
@@ -253,7 +255,6 @@ func (self *LeaderNotInMemberChangeState) Handle(
     memberChangeHSM, ok := sm.(*LeaderMemberChangeHSM)
     hsm.AssertTrue(ok)
     localHSM := memberChangeHSM.LocalHSM
-    leaderState := memberChangeHSM.LeaderState
     switch event.Type() {
     case ev.EventClientChangeConfigRequest:
         e, ok := event.(*ev.ClientChangeConfigRequestEvent)
@@ -273,41 +274,153 @@ func (self *LeaderNotInMemberChangeState) Handle(
             resultChan <- ev.NewPersistErrorResponseEvent(err)
             return nil
         }
-
-        newConf := e.Request.Conf
-
-        lastLogIndex, err := localHSM.Log().LastIndex()
+        self.StartMemberChange(memberChangeHSM, e.Request.Conf, resultChan)
+        return nil
+    case ev.EventClientJoinRequest:
+        e, ok := event.(*ev.ClientJoinRequestEvent)
+        hsm.AssertTrue(ok)
+        resultChan := e.ResultChan
+        conf, err := localHSM.ConfigManager().RNth(0)
         if err != nil {
-            message := fmt.Sprintf(
-                "fail to read last index of log, error: %s", err)
-            e := errors.New(message)
-            localHSM.SelfDispatch(ev.NewPersistErrorEvent(e))
-            resultChan <- ev.NewPersistErrorResponseEvent(e)
+            localHSM.SelfDispatch(ev.NewPersistErrorEvent(errors.New(
+                "fail to read last config")))
+            resultChan <- ev.NewPersistErrorResponseEvent(err)
             return nil
         }
-        nextLogIndex := lastLogIndex + 1
-        err = localHSM.ConfigManager().Push(lastLogIndex+1, newConf)
-        if err != nil {
-            pushError := DispatchPushConfigError(localHSM, nextLogIndex)
-            resultChan <- ev.NewPersistErrorResponseEvent(pushError)
+        if !conf.IsNormalConfig() {
+            err = DispatchInconsistantError(localHSM)
+            resultChan <- ev.NewPersistErrorResponseEvent(err)
             return nil
         }
-
-        logType := ps.LogMemberChange
-        logData := make([]byte, 0)
-        err = leaderState.StartFlight(localHSM, logType, logData, resultChan)
+        addr := e.Request.Addr
+        if conf.Servers.Contains(addr) {
+            // already joined, e.g. a retry after a lost response
+            response := &ev.ClientResponse{
+                Success: true,
+            }
+            resultChan <- ev.NewClientResponseEvent(response)
+            return nil
+        }
+        addresses := make([]*ps.ServerAddress, 0, conf.Servers.Len()+1)
+        addresses = append(addresses, conf.Servers.Addresses...)
+        addresses = append(addresses, addr)
+        newConf := &ps.Config{
+            Servers: conf.Servers,
+            NewServers: &ps.ServerAddressSlice{
+                Addresses: addresses,
+            },
+            Priorities: conf.Priorities,
+        }
+        self.Info("join server: %s", addr.String())
+        self.StartMemberChange(memberChangeHSM, newConf, resultChan)
+        return nil
+    case ev.EventClientUpdateAddrRequest:
+        e, ok := event.(*ev.ClientUpdateAddrRequestEvent)
+        hsm.AssertTrue(ok)
+        resultChan := e.ResultChan
+        conf, err := localHSM.ConfigManager().RNth(0)
         if err != nil {
-            localHSM.SelfDispatch(ev.NewPersistErrorEvent(err))
+            localHSM.SelfDispatch(ev.NewPersistErrorEvent(errors.New(
+                "fail to read last config")))
+            resultChan <- ev.NewPersistErrorResponseEvent(err)
+            return nil
+        }
+        if !conf.IsNormalConfig() {
+            err = DispatchInconsistantError(localHSM)
             resultChan <- ev.NewPersistErrorResponseEvent(err)
             return nil
         }
-        localHSM.SetMemberChangeStatus(OldNewConfigSeen)
-        sm.QTran(StateLeaderMemberChangePhase1ID)
+        addr := e.Request.Addr
+        if server := conf.Servers.Get(addr); (server != nil) &&
+            ps.AddressesEqual(server, addr) {
+
+            // already updated, e.g. a retry after a lost response
+            response := &ev.ClientResponse{
+                Success: true,
+            }
+            resultChan <- ev.NewClientResponseEvent(response)
+            return nil
+        }
+        newConf, ok := conf.UpdateAddr(addr)
+        if !ok {
+            self.Warning("no member to update with id: %#v", addr.ID)
+            response := &ev.ClientResponse{
+                Success: false,
+            }
+            resultChan <- ev.NewClientResponseEvent(response)
+            return nil
+        }
+        self.Info("update server: %s to: %s", addr.ID, addr.String())
+        self.UpdateAddr(memberChangeHSM, newConf, resultChan)
         return nil
     }
     return self.Super()
 }
 
+// UpdateAddr replicates the normal config newConf, in which a member
+// moves to new addresses. Since the membership stays the same, the config
+// takes effect right away like the other configs, but it's done in
+// a single log entry rather than a member change procedure.
+func (self *LeaderNotInMemberChangeState) UpdateAddr(
+    memberChangeHSM *LeaderMemberChangeHSM,
+    newConf *ps.Config,
+    resultChan chan ev.Event) {
+
+    localHSM := memberChangeHSM.LocalHSM
+    leaderState := memberChangeHSM.LeaderState
+    nextLogIndex := leaderState.LastLogIndex() + 1
+    err := localHSM.ConfigManager().Push(nextLogIndex, newConf)
+    if err != nil {
+        pushError := DispatchPushConfigError(localHSM, nextLogIndex)
+        resultChan <- ev.NewPersistErrorResponseEvent(pushError)
+        return
+    }
+
+    logType := ps.LogAddrUpdate
+    logData := make([]byte, 0)
+    err = leaderState.StartFlight(localHSM, logType, logData, resultChan)
+    if err != nil {
+        localHSM.SelfDispatch(ev.NewPersistErrorEvent(err))
+        resultChan <- ev.NewPersistErrorResponseEvent(err)
+        return
+    }
+    // the peer to the old addresses is replaced by a new one
+    peers := localHSM.Peers()
+    peers.AddPeers(GetPeers(localHSM.GetLocalAddr(), newConf))
+    peers.Broadcast(ev.NewPeerActivateEvent())
+    peers.Broadcast(ev.NewPeerEnterLeaderEvent())
+}
+
+// StartMemberChange begins the member change to the old/new config
+// newConf, the result of which is sent to resultChan finally.
+func (self *LeaderNotInMemberChangeState) StartMemberChange(
+    memberChangeHSM *LeaderMemberChangeHSM,
+    newConf *ps.Config,
+    resultChan chan ev.Event) {
+
+    localHSM := memberChangeHSM.LocalHSM
+    leaderState := memberChangeHSM.LeaderState
+    lastLogIndex := leaderState.LastLogIndex()
+    nextLogIndex := lastLogIndex + 1
+    err := localHSM.ConfigManager().Push(nextLogIndex, newConf)
+    if err != nil {
+        pushError := DispatchPushConfigError(localHSM, nextLogIndex)
+        resultChan <- ev.NewPersistErrorResponseEvent(pushError)
+        return
+    }
+
+    logType := ps.LogMemberChange
+    logData := make([]byte, 0)
+    err = leaderState.StartFlight(localHSM, logType, logData, resultChan)
+    if err != nil {
+        localHSM.SelfDispatch(ev.NewPersistErrorEvent(err))
+        resultChan <- ev.NewPersistErrorResponseEvent(err)
+        return
+    }
+    localHSM.SetMemberChangeStatus(OldNewConfigSeen)
+    memberChangeHSM.QTran(StateLeaderMemberChangePhase1ID)
+}
+
 type LeaderInMemberChangeState struct {
     *LogStateHead
 }
@@ -352,7 +465,8 @@ func (self *LeaderInMemberChangeState) Init(
             return nil
         }
         message := &ev.LeaderForwardMemberChangePhase{
-            Conf: conf,
+            Conf:       conf,
+            ResultChan: memberChangeHSM.LeaderState.listener.GetChan(),
         }
         localHSM.SelfDispatch(
             ev.NewLeaderForwardMemberChangePhaseEvent(message))
@@ -382,6 +496,16 @@ func (self *LeaderInMemberChangeState) Handle(
         hsm.AssertTrue(ok)
         e.SendResponse(ev.NewLeaderInMemberChangeResponseEvent())
         return nil
+    case ev.EventClientJoinRequest:
+        e, ok := event.(*ev.ClientJoinRequestEvent)
+        hsm.AssertTrue(ok)
+        e.SendResponse(ev.NewLeaderInMemberChangeResponseEvent())
+        return nil
+    case ev.EventClientUpdateAddrRequest:
+        e, ok := event.(*ev.ClientUpdateAddrRequestEvent)
+        hsm.AssertTrue(ok)
+        e.SendResponse(ev.NewLeaderInMemberChangeResponseEvent())
+        return nil
     }
 
     return self.Super()
@@ -446,7 +570,7 @@ func (self *LeaderMemberChangePhase1State) Handle(
             resultChan <- ev.NewPersistErrorResponseEvent(err)
             return nil
         }
-        if !(conf.IsOldNewConfig()) && ps.ConfigEqual(e.Message.Conf, conf) {
+        if !(conf.IsOldNewConfig() && ps.ConfigEqual(e.Message.Conf, conf)) {
             err = DispatchInconsistantError(localHSM)
             resultChan <- ev.NewPersistErrorResponseEvent(err)
             return nil
@@ -458,16 +582,9 @@ func (self *LeaderMemberChangePhase1State) Handle(
         newConf := &ps.Config{
             Servers:    nil,
             NewServers: e.Message.Conf.NewServers,
+            Priorities: e.Message.Conf.Priorities,
         }
-        lastLogIndex, err := localHSM.Log().LastIndex()
-        if err != nil {
-            message := fmt.Sprintf(
-                "fail to read last index of log, error: %s", err)
-            e := errors.New(message)
-            localHSM.SelfDispatch(ev.NewPersistErrorEvent(e))
-            resultChan <- ev.NewPersistErrorResponseEvent(err)
-            return nil
-        }
+        lastLogIndex := leaderState.LastLogIndex()
 
         nextLogIndex := lastLogIndex + 1
         err = localHSM.ConfigManager().Push(nextLogIndex, newConf)
@@ -487,7 +604,7 @@ func (self *LeaderMemberChangePhase1State) Handle(
         }
 
         // update member change status
-        localHSM.SetMemberChangeStatus(OldNewConfigCommitted)
+        localHSM.SetMemberChangeStatus(NewConfigSeen)
 
         sm.QTran(StateLeaderMemberChangePhase2ID)
         return nil
@@ -535,6 +652,7 @@ func (self *LeaderMemberChangePhase2State) Handle(
     memberChangeHSM, ok := sm.(*LeaderMemberChangeHSM)
     hsm.AssertTrue(ok)
     localHSM := memberChangeHSM.LocalHSM
+    leaderState := memberChangeHSM.LeaderState
     switch event.Type() {
     case ev.EventLeaderReenterMemberChangeState:
         // Re-replicate the logs update util now, which include
@@ -562,17 +680,10 @@ func (self *LeaderMemberChangePhase2State) Handle(
         newConf := &ps.Config{
             Servers:    e.Message.Conf.NewServers,
             NewServers: nil,
+            Priorities: e.Message.Conf.Priorities,
         }
 
-        lastLogIndex, err := localHSM.Log().LastIndex()
-        if err != nil {
-            message := fmt.Sprintf(
-                "fail to read last index of log, error: %s", err)
-            e := errors.New(message)
-            localHSM.SelfDispatch(ev.NewPersistErrorEvent(e))
-            resultChan <- ev.NewPersistErrorResponseEvent(err)
-            return nil
-        }
+        lastLogIndex := leaderState.LastLogIndex()
 
         nextLogIndex := lastLogIndex + 1
         err = localHSM.ConfigManager().Push(nextLogIndex, newConf)
@@ -585,14 +696,17 @@ func (self *LeaderMemberChangePhase2State) Handle(
         // update member change status
         localHSM.SetMemberChangeStatus(NewConfigCommitted)
 
+        // the servers left out of the new config are not peers any more
+        localHSM.Peers().RemovePeers(
+            GetPeers(localHSM.GetLocalAddr(), newConf))
+        leaderState.Inflight.ChangeMember(newConf)
+
         // response client
         response := &ev.ClientResponse{
             Success: true,
         }
         resultChan <- ev.NewClientResponseEvent(response)
 
-        // TODO stepdown if we are not part of the new cluster
-
         if err = localHSM.SendMemberChangeNotify(); err != nil {
             message := fmt.Sprintf(
                 "fail to send member change notify, error: %s", err)
@@ -600,6 +714,10 @@ func (self *LeaderMemberChangePhase2State) Handle(
         }
 
         sm.QTran(StateLeaderNotInMemberChangeID)
+        // stepdown if we are not part of the new cluster
+        if !newConf.Servers.Contains(localHSM.GetLocalAddr()) {
+            localHSM.SelfDispatch(ev.NewStepdownEvent())
+        }
         return nil
     }
     return self.Super()
@@ -617,5 +735,6 @@ func SetupLeaderMemberChangeHSM(logger logging.Logger) *LeaderMemberChangeHSM {
     NewLeaderMemberChangePhase1State(inMemberChangeState, logger)
     NewLeaderMemberChangePhase2State(inMemberChangeState, logger)
     leaderMemberChangeHSM := NewLeaderMemberChangeHSM(top, initial)
+    leaderMemberChangeHSM.Init()
     return leaderMemberChangeHSM
 }
@@ -0,0 +1,126 @@
+package linearize
+
+import (
+    ck "github.com/hhkbp2/rafted/clock"
+    "sync"
+)
+
+// History records the operations issued by concurrent clients.
+// Invocations and completions are ordered by the time they're recorded,
+// so a client should record an invocation right before it sends
+// the request, and the completion right after the response arrives.
+type History struct {
+    clock      ck.Clock
+    operations []*Operation
+    sequence   int64
+    lock       sync.Mutex
+}
+
+func NewHistory(clock ck.Clock) *History {
+    return &History{
+        clock:      clock,
+        operations: make([]*Operation, 0),
+    }
+}
+
+// Invoke records the invocation of an operation, and returns
+// the id to complete it.
+func (self *History) Invoke(clientID int, input interface{}) int {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.sequence++
+    op := &Operation{
+        ClientID: clientID,
+        Input:    input,
+        Call:     self.sequence,
+        Return:   PendingReturn,
+        CallTime: self.clock.Now(),
+    }
+    self.operations = append(self.operations, op)
+    return len(self.operations) - 1
+}
+
+// Complete records the output of an operation. An operation which is
+// never completed is left pending.
+func (self *History) Complete(id int, output interface{}) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.sequence++
+    op := self.operations[id]
+    op.Output = output
+    op.Return = self.sequence
+    op.ReturnTime = self.clock.Now()
+}
+
+// Operations returns a copy of all the recorded operations.
+func (self *History) Operations() []*Operation {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    operations := make([]*Operation, 0, len(self.operations))
+    for _, op := range self.operations {
+        copied := *op
+        operations = append(operations, &copied)
+    }
+    return operations
+}
+
+// Client is the part of the raft client interface whose operations
+// could be recorded. Every implementation of rafted.Client satisfies it.
+type Client interface {
+    Append(data []byte) (result []byte, err error)
+    ReadOnly(data []byte) (result []byte, err error)
+}
+
+// ClientInput is the input of an operation issued through a Client.
+type ClientInput struct {
+    ReadOnly bool
+    Data     []byte
+}
+
+// RecordingClient is a Client which records all the operations issued
+// through it into a history. The input of an operation is a *ClientInput
+// and the output is the []byte result. An operation failing with an error
+// is left pending, since it may take effect or not.
+type RecordingClient struct {
+    client   Client
+    history  *History
+    clientID int
+}
+
+func NewRecordingClient(
+    client Client, history *History, clientID int) *RecordingClient {
+
+    return &RecordingClient{
+        client:   client,
+        history:  history,
+        clientID: clientID,
+    }
+}
+
+func (self *RecordingClient) Append(data []byte) ([]byte, error) {
+    input := &ClientInput{
+        ReadOnly: false,
+        Data:     data,
+    }
+    id := self.history.Invoke(self.clientID, input)
+    result, err := self.client.Append(data)
+    if err != nil {
+        return nil, err
+    }
+    self.history.Complete(id, result)
+    return result, nil
+}
+
+func (self *RecordingClient) ReadOnly(data []byte) ([]byte, error) {
+    input := &ClientInput{
+        ReadOnly: true,
+        Data:     data,
+    }
+    id := self.history.Invoke(self.clientID, input)
+    result, err := self.client.ReadOnly(data)
+    if err != nil {
+        return nil, err
+    }
+    self.history.Complete(id, result)
+    return result, nil
+}
@@ -0,0 +1,237 @@
+package linearize
+
+import (
+    "fmt"
+    "github.com/hhkbp2/rafted/kv"
+    ps "github.com/hhkbp2/rafted/persist"
+    "sync"
+)
+
+// toKVInput converts the input recorded by RecordingClient or
+// a plain *kv.Input.
+func toKVInput(input interface{}) *kv.Input {
+    switch in := input.(type) {
+    case *kv.Input:
+        return in
+    case *ClientInput:
+        kvInput, err := kv.DecodeInput(in.Data)
+        if err != nil {
+            return nil
+        }
+        return kvInput
+    }
+    return nil
+}
+
+// toKVOutput converts the output recorded by RecordingClient or
+// a plain *kv.Output. It returns nil for a pending operation.
+func toKVOutput(output interface{}) (*kv.Output, bool) {
+    switch out := output.(type) {
+    case nil:
+        return nil, true
+    case *kv.Output:
+        return out, true
+    case []byte:
+        kvOutput, err := kv.DecodeOutput(out)
+        if err != nil {
+            return nil, false
+        }
+        return kvOutput, true
+    }
+    return nil, false
+}
+
+type registerState struct {
+    value string
+    found bool
+}
+
+// stepRegister applies a kv command on the value of a single key.
+// A nil output is the output of a pending command, which is always legal.
+func stepRegister(
+    state registerState, input *kv.Input, output *kv.Output) (
+    bool, registerState) {
+
+    switch input.Op {
+    case kv.Get:
+        legal := output == nil ||
+            (output.Found == state.found && output.Value == state.value)
+        return legal, state
+    case kv.Put:
+        legal := output == nil || output.Found == state.found
+        return legal, registerState{value: input.Value, found: true}
+    case kv.Delete:
+        legal := output == nil || output.Found == state.found
+        return legal, registerState{}
+    case kv.Cas:
+        success := state.found && state.value == input.Expect
+        legal := output == nil || output.Ok == success
+        if success {
+            return legal, registerState{value: input.Value, found: true}
+        }
+        return legal, state
+    }
+    return false, state
+}
+
+// RegisterModel is the model of a single register. The keys of
+// the commands are ignored.
+type RegisterModel struct{}
+
+func NewRegisterModel() *RegisterModel {
+    return &RegisterModel{}
+}
+
+func (self *RegisterModel) Init() interface{} {
+    return registerState{}
+}
+
+func (self *RegisterModel) Step(
+    state, input, output interface{}) (bool, interface{}) {
+
+    kvInput := toKVInput(input)
+    kvOutput, ok := toKVOutput(output)
+    if kvInput == nil || !ok {
+        return false, state
+    }
+    return stepRegister(state.(registerState), kvInput, kvOutput)
+}
+
+func (self *RegisterModel) Equal(state1, state2 interface{}) bool {
+    return state1.(registerState) == state2.(registerState)
+}
+
+func (self *RegisterModel) Describe(input, output interface{}) string {
+    return describeKV(input, output)
+}
+
+// KVModel is the model of a kv store. Since the keys are independent,
+// the history is partitioned by keys and every key is checked
+// as a register.
+type KVModel struct {
+    RegisterModel
+}
+
+func NewKVModel() *KVModel {
+    return &KVModel{}
+}
+
+func (self *KVModel) Partition(operations []*Operation) [][]*Operation {
+    keys := make([]string, 0)
+    partitions := make(map[string][]*Operation)
+    for _, op := range operations {
+        key := ""
+        if input := toKVInput(op.Input); input != nil {
+            key = input.Key
+        }
+        if _, ok := partitions[key]; !ok {
+            keys = append(keys, key)
+        }
+        partitions[key] = append(partitions[key], op)
+    }
+    result := make([][]*Operation, 0, len(keys))
+    for _, key := range keys {
+        result = append(result, partitions[key])
+    }
+    return result
+}
+
+func describeKV(input, output interface{}) string {
+    kvInput := toKVInput(input)
+    if kvInput == nil {
+        return fmt.Sprintf("invalid input: %#v", input)
+    }
+    var call string
+    switch kvInput.Op {
+    case kv.Put:
+        call = fmt.Sprintf("put(%s, %s)", kvInput.Key, kvInput.Value)
+    case kv.Cas:
+        call = fmt.Sprintf("cas(%s, %s, %s)",
+            kvInput.Key, kvInput.Expect, kvInput.Value)
+    default:
+        call = fmt.Sprintf("%s(%s)", kvInput.Op, kvInput.Key)
+    }
+    kvOutput, ok := toKVOutput(output)
+    switch {
+    case !ok:
+        return fmt.Sprintf("%s -> invalid output: %#v", call, output)
+    case kvOutput == nil:
+        return call + " -> ?"
+    case kvInput.Op == kv.Get && kvOutput.Found:
+        return fmt.Sprintf("%s -> %s", call, kvOutput.Value)
+    case kvInput.Op == kv.Get:
+        return call + " -> not found"
+    case kvInput.Op == kv.Cas:
+        return fmt.Sprintf("%s -> %t", call, kvOutput.Ok)
+    }
+    return fmt.Sprintf("%s -> found: %t", call, kvOutput.Found)
+}
+
+// KVStateMachine is a state machine of a kv store, which applies
+// the commands encoded by kv.EncodeInput. The snapshots are managed by
+// the embedded MemoryStateMachine, which keeps all the applied commands,
+// so the store is rebuilt by replaying them on restore.
+type KVStateMachine struct {
+    *ps.MemoryStateMachine
+    data map[string]string
+    lock sync.RWMutex
+}
+
+func NewKVStateMachine() *KVStateMachine {
+    return &KVStateMachine{
+        MemoryStateMachine: ps.NewMemoryStateMachine(),
+        data:               make(map[string]string),
+    }
+}
+
+func (self *KVStateMachine) Apply(p []byte) []byte {
+    self.MemoryStateMachine.Apply(p)
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return kv.EncodeOutput(self.apply(p))
+}
+
+func (self *KVStateMachine) apply(p []byte) *kv.Output {
+    input, err := kv.DecodeInput(p)
+    if err != nil {
+        return &kv.Output{}
+    }
+    value, found := self.data[input.Key]
+    output := &kv.Output{Found: found}
+    switch input.Op {
+    case kv.Get:
+        output.Value = value
+    case kv.Put:
+        self.data[input.Key] = input.Value
+    case kv.Delete:
+        delete(self.data, input.Key)
+    case kv.Cas:
+        if found && value == input.Expect {
+            self.data[input.Key] = input.Value
+            output.Ok = true
+        }
+    }
+    return output
+}
+
+func (self *KVStateMachine) RestoreFromSnapshot(id string) error {
+    if err := self.MemoryStateMachine.RestoreFromSnapshot(id); err != nil {
+        return err
+    }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.data = make(map[string]string)
+    for e := self.Data().Front(); e != nil; e = e.Next() {
+        p, _ := e.Value.([]byte)
+        self.apply(p)
+    }
+    return nil
+}
+
+// Get returns the value of key in the store.
+func (self *KVStateMachine) Get(key string) (string, bool) {
+    self.lock.RLock()
+    defer self.lock.RUnlock()
+    value, ok := self.data[key]
+    return value, ok
+}
@@ -0,0 +1,172 @@
+package linearize
+
+import (
+    "flag"
+    "fmt"
+    "github.com/hhkbp2/rafted"
+    ev "github.com/hhkbp2/rafted/event"
+    "github.com/hhkbp2/rafted/kv"
+    ps "github.com/hhkbp2/rafted/persist"
+    "github.com/hhkbp2/rafted/rafttest"
+    "github.com/hhkbp2/testify/assert"
+    "github.com/hhkbp2/testify/require"
+    "testing"
+    "time"
+)
+
+func TestKVStateMachineRestore(t *testing.T) {
+    stateMachine := NewKVStateMachine()
+    apply := func(input *kv.Input) *kv.Output {
+        output, err := kv.DecodeOutput(
+            stateMachine.Apply(kv.EncodeInput(input)))
+        require.Nil(t, err)
+        return output
+    }
+    assert.Equal(t, &kv.Output{}, apply(put("x", "1")))
+    assert.Equal(t,
+        &kv.Output{Found: true, Ok: true}, apply(cas("x", "1", "2")))
+    assert.Equal(t, &kv.Output{Found: true}, apply(cas("x", "1", "3")))
+    assert.Equal(t, found("2"), apply(get("x")))
+    id, err := stateMachine.MakeSnapshot(1, 4, nil)
+    require.Nil(t, err)
+    apply(&kv.Input{Op: kv.Delete, Key: "x"})
+    apply(put("y", "1"))
+    _, ok := stateMachine.Get("x")
+    assert.False(t, ok)
+    require.Nil(t, stateMachine.RestoreFromSnapshot(id))
+    value, ok := stateMachine.Get("x")
+    assert.True(t, ok)
+    assert.Equal(t, "2", value)
+    _, ok = stateMachine.Get("y")
+    assert.False(t, ok)
+}
+
+type pendingRequest struct {
+    id       int
+    reqEvent ev.RequestEvent
+}
+
+// runRound issues one request for every client to the leader of
+// the simulation concurrently, and runs the simulation until they're
+// all responded or timeout. The requests without responses are left
+// pending in the history.
+func runRound(
+    sim *rafttest.Simulation,
+    history *History,
+    inputs []*kv.Input,
+    timeout time.Duration) {
+
+    leader, ok := sim.Leader()
+    if !ok {
+        leader = 0
+    }
+    pendings := make([]*pendingRequest, 0, len(inputs))
+    for clientID, input := range inputs {
+        data := kv.EncodeInput(input)
+        var reqEvent ev.RequestEvent
+        if input.Op == kv.Get {
+            reqEvent = ev.NewClientReadOnlyRequestEvent(
+                &ev.ClientReadOnlyRequest{Data: data})
+        } else {
+            reqEvent = ev.NewClientAppendRequestEvent(
+                &ev.ClientAppendRequest{Data: data})
+        }
+        id := history.Invoke(clientID, input)
+        sim.Nodes()[leader].Backend().Send(reqEvent)
+        pendings = append(pendings, &pendingRequest{id, reqEvent})
+    }
+    cond := func() bool {
+        left := pendings[:0]
+        for _, pending := range pendings {
+            select {
+            case event := <-pending.reqEvent.GetResponseChan():
+                e, ok := event.(*ev.ClientResponseEvent)
+                if ok && e.Response.Success {
+                    output, err := kv.DecodeOutput(e.Response.Data)
+                    if err == nil {
+                        history.Complete(pending.id, output)
+                    }
+                }
+            default:
+                left = append(left, pending)
+            }
+        }
+        pendings = left
+        return len(pendings) == 0
+    }
+    sim.RunUntil(cond, sim.Clock().Now().Add(timeout))
+}
+
+// The seed of the simulation is fixed, so that its failures reproduce.
+// Other schedules could be explored with -sim.seed.
+var testSimulationSeed = flag.Int64(
+    "sim.seed", 20161018, "seed of the simulation tests")
+
+func TestKVSimulationLinearizable(t *testing.T) {
+    config := rafted.DefaultConfiguration()
+    seed := *testSimulationSeed
+    t.Logf("simulation seed: %d", seed)
+    newStateMachine := func(_ int) ps.StateMachine {
+        return NewKVStateMachine()
+    }
+    sim, err := rafttest.NewSimulationWith(config, 3, seed, newStateMachine)
+    require.Nil(t, err)
+    defer sim.Close()
+    leader, ok := sim.WaitLeader(config.ElectionTimeout * 10)
+    require.True(t, ok, "no leader elected with seed: %d", seed)
+
+    history := NewHistory(sim.Clock())
+    keys := []string{"a", "b"}
+    clients := 3
+    rounds := 12
+    for round := 0; round < rounds; round++ {
+        switch round {
+        case rounds / 3:
+            // isolate the leader to force a leadership change, and wait for
+            // a new leader, so that no entry is appended to the old leader
+            others := make([]int, 0, 2)
+            for i := 0; i < 3; i++ {
+                if i != leader {
+                    others = append(others, i)
+                }
+            }
+            sim.Faults().Partition(sim.Addrs(leader), sim.Addrs(others...))
+            cond := func() bool {
+                current, ok := sim.Leader()
+                return ok && current != leader
+            }
+            deadline := sim.Clock().Now().Add(config.ElectionTimeout * 10)
+            require.True(t, sim.RunUntil(cond, deadline),
+                "no new leader elected with seed: %d", seed)
+        case rounds * 2 / 3:
+            sim.Faults().Heal()
+        }
+        inputs := make([]*kv.Input, 0, clients)
+        for i := 0; i < clients; i++ {
+            key := keys[(round+i)%len(keys)]
+            value := fmt.Sprintf("%d-%d", round, i)
+            switch (round + i) % 3 {
+            case 0:
+                inputs = append(inputs, put(key, value))
+            case 1:
+                inputs = append(inputs, get(key))
+            default:
+                inputs = append(inputs,
+                    cas(key, fmt.Sprintf("%d-%d", round-1, i), value))
+            }
+        }
+        runRound(sim, history, inputs, config.ElectionTimeout*5)
+    }
+    operations := history.Operations()
+    completed := 0
+    for _, op := range operations {
+        if !op.Pending() {
+            completed++
+        }
+    }
+    assert.NotEqual(t, 0, completed)
+    model := NewKVModel()
+    result := CheckTimeout(model, operations, time.Second*10)
+    assert.True(t, result.Ok,
+        "seed %d: %s", seed, result.Describe(model))
+}
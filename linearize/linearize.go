@@ -0,0 +1,384 @@
+package linearize
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+)
+
+// Operation is a client operation in a history. Call and Return are
+// positions in the real time order of all the events in the history.
+// An operation which never returns, e.g. it times out, is pending and
+// may or may not take effect. Its Output is nil and its Return is
+// PendingReturn.
+type Operation struct {
+    ClientID   int
+    Input      interface{}
+    Output     interface{}
+    Call       int64
+    Return     int64
+    CallTime   time.Time
+    ReturnTime time.Time
+}
+
+const (
+    PendingReturn int64 = 1<<63 - 1
+)
+
+func (self *Operation) Pending() bool {
+    return self.Return == PendingReturn
+}
+
+// Model is a sequential specification of the object under test.
+type Model interface {
+    // Init returns the initial state.
+    Init() interface{}
+    // Step returns whether the operation with input and output is legal
+    // in the state, and the state after it. The output is nil for
+    // a pending operation, which is legal in every state.
+    Step(state, input, output interface{}) (bool, interface{})
+    // Equal returns whether two states are the same.
+    Equal(state1, state2 interface{}) bool
+    // Describe returns a readable form of an operation.
+    Describe(input, output interface{}) string
+}
+
+// Partitioner is an optional interface of Model. A model could partition
+// a history into independent sub-histories, e.g. by the keys of a kv store,
+// which are checked separately and much faster.
+type Partitioner interface {
+    Partition(operations []*Operation) [][]*Operation
+}
+
+// Result is the result of a check. On failure, Counterexample is
+// the shortest prefix of the first non-linearizable partition which is
+// still not linearizable, and Linearized is the longest linearization
+// found for it.
+type Result struct {
+    Ok             bool
+    Unknown        bool
+    Counterexample []*Operation
+    Linearized     []*Operation
+}
+
+// Describe returns a readable report of the result.
+func (self *Result) Describe(model Model) string {
+    if self.Ok {
+        return "linearizable"
+    }
+    if self.Unknown {
+        return "unknown: check timeout"
+    }
+    lines := make([]string, 0, len(self.Counterexample)+3)
+    lines = append(lines, "not linearizable, counterexample:")
+    for _, op := range self.Counterexample {
+        lines = append(lines, "    "+describeOperation(model, op))
+    }
+    lines = append(lines, "longest linearization:")
+    for _, op := range self.Linearized {
+        lines = append(lines, "    "+describeOperation(model, op))
+    }
+    return strings.Join(lines, "\n")
+}
+
+func describeOperation(model Model, op *Operation) string {
+    ret := "pending"
+    if !op.Pending() {
+        ret = fmt.Sprintf("%d", op.Return)
+    }
+    return fmt.Sprintf("client %d [%d, %s] %s",
+        op.ClientID, op.Call, ret, model.Describe(op.Input, op.Output))
+}
+
+// Check checks whether the history of operations is linearizable
+// with respect to model.
+func Check(model Model, operations []*Operation) *Result {
+    return CheckTimeout(model, operations, 0)
+}
+
+// CheckTimeout is the same as Check, except that it gives up after
+// timeout and reports an unknown result. A zero timeout means no limit.
+func CheckTimeout(
+    model Model, operations []*Operation, timeout time.Duration) *Result {
+
+    var deadline time.Time
+    if timeout > 0 {
+        deadline = time.Now().Add(timeout)
+    }
+    partitions := [][]*Operation{operations}
+    if partitioner, ok := model.(Partitioner); ok {
+        partitions = partitioner.Partition(operations)
+    }
+    for _, partition := range partitions {
+        ok, _, unknown := checkPartition(model, partition, deadline)
+        if unknown {
+            return &Result{Unknown: true}
+        }
+        if !ok {
+            return minimize(model, partition, deadline)
+        }
+    }
+    return &Result{Ok: true}
+}
+
+// minimize finds the shortest non-linearizable prefix of a partition.
+// A prefix ends right after some return, where the operations
+// which haven't returned yet are pending. Since every prefix of
+// a linearizable history is linearizable, the shortest one could be
+// searched in binary.
+func minimize(
+    model Model, operations []*Operation, deadline time.Time) *Result {
+
+    returns := make([]int64, 0, len(operations))
+    for _, op := range operations {
+        if !op.Pending() {
+            returns = append(returns, op.Return)
+        }
+    }
+    sort.Slice(returns, func(i, j int) bool {
+        return returns[i] < returns[j]
+    })
+    counterexample := operations
+    low, high := 0, len(returns)-1
+    for low <= high {
+        middle := (low + high) / 2
+        prefix := historyPrefix(operations, returns[middle])
+        ok, _, unknown := checkPartition(model, prefix, deadline)
+        if unknown {
+            break
+        }
+        if ok {
+            low = middle + 1
+        } else {
+            counterexample = prefix
+            high = middle - 1
+        }
+    }
+    _, linearized, _ := checkPartition(model, counterexample, time.Time{})
+    return &Result{
+        Ok:             false,
+        Counterexample: counterexample,
+        Linearized:     linearized,
+    }
+}
+
+func historyPrefix(operations []*Operation, end int64) []*Operation {
+    prefix := make([]*Operation, 0, len(operations))
+    for _, op := range operations {
+        if op.Call > end {
+            continue
+        }
+        if op.Return > end {
+            pending := *op
+            pending.Output = nil
+            pending.Return = PendingReturn
+            pending.ReturnTime = time.Time{}
+            prefix = append(prefix, &pending)
+            continue
+        }
+        prefix = append(prefix, op)
+    }
+    return prefix
+}
+
+// entry is a call or return event in the doubly linked list
+// of the history.
+type entry struct {
+    id     int
+    isCall bool
+    time   int64
+    op     *Operation
+    match  *entry
+    prev   *entry
+    next   *entry
+}
+
+func makeEntries(operations []*Operation) *entry {
+    entries := make([]*entry, 0, len(operations)*2)
+    for id, op := range operations {
+        call := &entry{id: id, isCall: true, time: op.Call, op: op}
+        ret := &entry{id: id, isCall: false, time: op.Return, op: op}
+        call.match = ret
+        entries = append(entries, call, ret)
+    }
+    // calls go before returns at the same time, which makes
+    // the operations concurrent rather than ordered
+    sort.SliceStable(entries, func(i, j int) bool {
+        if entries[i].time != entries[j].time {
+            return entries[i].time < entries[j].time
+        }
+        return entries[i].isCall && !entries[j].isCall
+    })
+    head := &entry{id: -1}
+    last := head
+    for _, e := range entries {
+        last.next = e
+        e.prev = last
+        last = e
+    }
+    return head
+}
+
+// lift removes a call and its return from the list.
+func lift(e *entry) {
+    e.prev.next = e.next
+    if e.next != nil {
+        e.next.prev = e.prev
+    }
+    match := e.match
+    match.prev.next = match.next
+    if match.next != nil {
+        match.next.prev = match.prev
+    }
+}
+
+// unlift puts back a call and its return, in the reverse order of lift.
+func unlift(e *entry) {
+    match := e.match
+    match.prev.next = match
+    if match.next != nil {
+        match.next.prev = match
+    }
+    e.prev.next = e
+    if e.next != nil {
+        e.next.prev = e
+    }
+}
+
+type bitset []uint64
+
+func newBitset(size int) bitset {
+    return make(bitset, (size+63)/64)
+}
+
+func (self bitset) set(i int) {
+    self[i/64] |= 1 << uint(i%64)
+}
+
+func (self bitset) clear(i int) {
+    self[i/64] &^= 1 << uint(i%64)
+}
+
+func (self bitset) clone() bitset {
+    other := make(bitset, len(self))
+    copy(other, self)
+    return other
+}
+
+func (self bitset) equal(other bitset) bool {
+    for i := range self {
+        if self[i] != other[i] {
+            return false
+        }
+    }
+    return true
+}
+
+func (self bitset) hash() uint64 {
+    var h uint64 = 14695981039346656037
+    for _, word := range self {
+        h ^= word
+        h *= 1099511628211
+    }
+    return h
+}
+
+type cacheEntry struct {
+    linearized bitset
+    state      interface{}
+}
+
+type callFrame struct {
+    entry *entry
+    state interface{}
+}
+
+// checkPartition searches a linearization of the operations in
+// the way of Wing & Gong with the memoization of Lowe. It returns
+// whether the operations are linearizable, and the longest
+// linearization it finds.
+func checkPartition(
+    model Model,
+    operations []*Operation,
+    deadline time.Time) (ok bool, longest []*Operation, unknown bool) {
+
+    head := makeEntries(operations)
+    state := model.Init()
+    linearized := newBitset(len(operations))
+    cache := make(map[uint64][]cacheEntry)
+    calls := make([]callFrame, 0, len(operations))
+    longest = make([]*Operation, 0)
+    steps := 0
+    e := head.next
+    for head.next != nil {
+        steps++
+        if !deadline.IsZero() && steps%1000 == 0 &&
+            time.Now().After(deadline) {
+
+            return false, longest, true
+        }
+        if e.isCall {
+            legal, newState := model.Step(state, e.op.Input, e.op.Output)
+            if legal {
+                newLinearized := linearized.clone()
+                newLinearized.set(e.id)
+                if !cacheContains(model, cache, newLinearized, newState) {
+                    h := newLinearized.hash()
+                    cache[h] = append(cache[h], cacheEntry{
+                        linearized: newLinearized,
+                        state:      newState,
+                    })
+                    calls = append(calls, callFrame{entry: e, state: state})
+                    if len(calls) > len(longest) {
+                        longest = framesToOperations(calls)
+                    }
+                    state = newState
+                    linearized.set(e.id)
+                    lift(e)
+                    e = head.next
+                    continue
+                }
+            }
+            e = e.next
+            continue
+        }
+        // a return is reached before its call could be linearized,
+        // so backtrack to the last linearized call
+        if len(calls) == 0 {
+            return false, longest, false
+        }
+        top := calls[len(calls)-1]
+        calls = calls[:len(calls)-1]
+        e = top.entry
+        state = top.state
+        linearized.clear(e.id)
+        unlift(e)
+        e = e.next
+    }
+    return true, framesToOperations(calls), false
+}
+
+func framesToOperations(calls []callFrame) []*Operation {
+    operations := make([]*Operation, 0, len(calls))
+    for _, frame := range calls {
+        operations = append(operations, frame.entry.op)
+    }
+    return operations
+}
+
+func cacheContains(
+    model Model,
+    cache map[uint64][]cacheEntry,
+    linearized bitset,
+    state interface{}) bool {
+
+    for _, entry := range cache[linearized.hash()] {
+        if linearized.equal(entry.linearized) &&
+            model.Equal(state, entry.state) {
+
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,177 @@
+package linearize
+
+import (
+    "errors"
+    ck "github.com/hhkbp2/rafted/clock"
+    "github.com/hhkbp2/rafted/kv"
+    "github.com/hhkbp2/testify/assert"
+    "github.com/hhkbp2/testify/require"
+    "testing"
+)
+
+func op(clientID int,
+    input *kv.Input, output *kv.Output, call, ret int64) *Operation {
+
+    var out interface{}
+    if output != nil {
+        out = output
+    }
+    return &Operation{
+        ClientID: clientID,
+        Input:    input,
+        Output:   out,
+        Call:     call,
+        Return:   ret,
+    }
+}
+
+func put(key, value string) *kv.Input {
+    return &kv.Input{Op: kv.Put, Key: key, Value: value}
+}
+
+func get(key string) *kv.Input {
+    return &kv.Input{Op: kv.Get, Key: key}
+}
+
+func cas(key, expect, value string) *kv.Input {
+    return &kv.Input{Op: kv.Cas, Key: key, Expect: expect, Value: value}
+}
+
+func found(value string) *kv.Output {
+    return &kv.Output{Value: value, Found: true}
+}
+
+func TestCheckLinearizable(t *testing.T) {
+    model := NewRegisterModel()
+    // the get overlaps both puts, so it could see either value
+    operations := []*Operation{
+        op(0, put("x", "1"), &kv.Output{}, 1, 3),
+        op(1, get("x"), found("2"), 2, 7),
+        op(2, put("x", "2"), found("1"), 4, 5),
+        op(0, get("x"), found("2"), 6, 8),
+    }
+    result := Check(model, operations)
+    assert.True(t, result.Ok, result.Describe(model))
+    assert.Equal(t, "linearizable", result.Describe(model))
+}
+
+func TestCheckNotLinearizable(t *testing.T) {
+    model := NewRegisterModel()
+    // the second get starts after the put of 2 returns,
+    // but still sees the old value
+    operations := []*Operation{
+        op(0, put("x", "1"), &kv.Output{}, 1, 2),
+        op(1, put("x", "2"), found("1"), 3, 4),
+        op(2, get("x"), found("2"), 5, 6),
+        op(0, get("x"), found("1"), 7, 8),
+        op(1, put("x", "3"), found("2"), 9, 10),
+        op(2, get("x"), found("3"), 11, 12),
+    }
+    result := Check(model, operations)
+    require.False(t, result.Ok)
+    assert.False(t, result.Unknown)
+    // the operations after the stale read are cut off
+    require.Equal(t, 4, len(result.Counterexample))
+    assert.Equal(t, operations[:4], result.Counterexample)
+    assert.Equal(t, operations[:3], result.Linearized)
+    assert.Contains(t, result.Describe(model), "client 0 [7, 8] get(x) -> 1")
+}
+
+func TestCheckPending(t *testing.T) {
+    model := NewRegisterModel()
+    // a pending put takes effect
+    operations := []*Operation{
+        op(0, put("x", "1"), nil, 1, PendingReturn),
+        op(1, get("x"), found("1"), 2, 3),
+    }
+    assert.True(t, Check(model, operations).Ok)
+    // a pending put doesn't take effect
+    operations = []*Operation{
+        op(0, put("x", "1"), nil, 1, PendingReturn),
+        op(1, get("x"), &kv.Output{}, 2, 3),
+    }
+    assert.True(t, Check(model, operations).Ok)
+    // a pending put can't take effect before its call
+    operations = []*Operation{
+        op(1, get("x"), found("1"), 1, 2),
+        op(0, put("x", "1"), nil, 3, PendingReturn),
+    }
+    assert.False(t, Check(model, operations).Ok)
+}
+
+func TestCheckCas(t *testing.T) {
+    model := NewRegisterModel()
+    // two concurrent cas on the same value can't both succeed
+    operations := []*Operation{
+        op(0, put("x", "0"), &kv.Output{}, 1, 2),
+        op(1, cas("x", "0", "1"), &kv.Output{Found: true, Ok: true}, 3, 6),
+        op(2, cas("x", "0", "2"), &kv.Output{Found: true, Ok: true}, 4, 5),
+    }
+    assert.False(t, Check(model, operations).Ok)
+    operations[2].Output = &kv.Output{Found: true, Ok: false}
+    assert.True(t, Check(model, operations).Ok)
+}
+
+func TestCheckKVPartition(t *testing.T) {
+    model := NewKVModel()
+    operations := []*Operation{
+        op(0, put("x", "1"), &kv.Output{}, 1, 2),
+        op(1, put("y", "1"), &kv.Output{}, 3, 4),
+        op(0, get("x"), found("1"), 5, 6),
+        op(1, get("y"), &kv.Output{}, 7, 8),
+        op(0, get("x"), found("1"), 9, 10),
+    }
+    result := Check(model, operations)
+    require.False(t, result.Ok)
+    // only the operations on the violated key are reported
+    assert.Equal(t, []*Operation{operations[1], operations[3]},
+        result.Counterexample)
+    // neither is it linearizable as a single register
+    assert.False(t, Check(NewRegisterModel(), operations).Ok)
+    operations[3].Output = found("1")
+    assert.True(t, Check(model, operations).Ok)
+}
+
+type fakeClient struct {
+    stateMachine *KVStateMachine
+    fail         bool
+}
+
+func (self *fakeClient) Append(data []byte) ([]byte, error) {
+    if self.fail {
+        return nil, errors.New("fail")
+    }
+    return self.stateMachine.Apply(data), nil
+}
+
+func (self *fakeClient) ReadOnly(data []byte) ([]byte, error) {
+    return self.Append(data)
+}
+
+func TestRecordingClient(t *testing.T) {
+    history := NewHistory(ck.NewVirtualClock(ck.DefaultClock.Now()))
+    fake := &fakeClient{stateMachine: NewKVStateMachine()}
+    client := NewRecordingClient(fake, history, 1)
+    _, err := client.Append(kv.EncodeInput(put("x", "1")))
+    require.Nil(t, err)
+    fake.fail = true
+    _, err = client.Append(kv.EncodeInput(put("x", "2")))
+    require.NotNil(t, err)
+    fake.fail = false
+    result, err := client.ReadOnly(kv.EncodeInput(get("x")))
+    require.Nil(t, err)
+    output, err := kv.DecodeOutput(result)
+    require.Nil(t, err)
+    assert.Equal(t, found("1"), output)
+
+    operations := history.Operations()
+    require.Equal(t, 3, len(operations))
+    assert.Equal(t, int64(1), operations[0].Call)
+    assert.Equal(t, int64(2), operations[0].Return)
+    assert.True(t, operations[1].Pending())
+    assert.Nil(t, operations[1].Output)
+    assert.True(t, operations[2].Input.(*ClientInput).ReadOnly)
+    model := NewKVModel()
+    result2 := Check(model, operations)
+    assert.True(t, result2.Ok, result2.Describe(model))
+}
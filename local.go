@@ -4,10 +4,12 @@ import (
     "errors"
     "fmt"
     hsm "github.com/hhkbp2/go-hsm"
+    ck "github.com/hhkbp2/rafted/clock"
     ev "github.com/hhkbp2/rafted/event"
     logging "github.com/hhkbp2/rafted/logging"
     ps "github.com/hhkbp2/rafted/persist"
     "io"
+    "math"
     "sync"
     "sync/atomic"
     "time"
@@ -30,6 +32,25 @@ const (
     NewConfigCommitted
 )
 
+func (status MemberChangeStatusType) String() string {
+    switch status {
+    case MemberChangeStatusNotSet:
+        return "MemberChangeStatusNotSet"
+    case NotInMemeberChange:
+        return "NotInMemeberChange"
+    case OldNewConfigSeen:
+        return "OldNewConfigSeen"
+    case OldNewConfigCommitted:
+        return "OldNewConfigCommitted"
+    case NewConfigSeen:
+        return "NewConfigSeen"
+    case NewConfigCommitted:
+        return "NewConfigCommitted"
+    default:
+        return "unknown member change status"
+    }
+}
+
 type SelfDispatchHSM interface {
     hsm.HSM
     SelfDispatch(event hsm.Event)
@@ -51,6 +72,17 @@ type LocalHSM struct {
     selfDispatchChan *ReliableEventChannel
     stopChan         chan interface{}
     group            sync.WaitGroup
+    // set once it starts terminating, when the client requests are
+    // no longer handled
+    terminating int32
+
+    // client requests are queued apart from the raft events, and only
+    // they are bounded, so that a backlog of them never holds off
+    // the rpcs from peers and the timeouts
+    requestChan           *ReliableEventChannel
+    requestOverflowPolicy OverflowPolicy
+    // the clock to count the timeouts of requests from their arrival
+    clock ck.Clock
 
     // the current term
     currentTerm uint64
@@ -80,18 +112,29 @@ type LocalHSM struct {
     logging.Logger
 }
 
+// NewLocalHSM creates the local hsm. The events dispatched to it,
+// the commits to apply and the notifies are queued within the limits
+// in config.
 func NewLocalHSM(
     top hsm.State,
     initial hsm.State,
+    config *Configuration,
     localAddr *ps.ServerAddress,
     configManager ps.ConfigManager,
     stateMachine ps.StateMachine,
     log ps.Log,
     logger logging.Logger) (*LocalHSM, error) {
 
-    // TODO check the integrety between log and configManager
-    // try to fix the inconsistant base on log status.
-    // Return error if fail to do that
+    snapshotMeta, err := RestoreSnapshot(configManager, stateMachine, log)
+    if err != nil {
+        logger.Error("fail to restore from snapshot, error: %s", err)
+        return nil, err
+    }
+
+    if err = ReconcileConfigWithLog(configManager, log, logger); err != nil {
+        logger.Error("fail to reconcile config with log, error: %s", err)
+        return nil, err
+    }
 
     memberChangeStatus, err := InitMemberChangeStatus(configManager, log)
     if err != nil {
@@ -104,8 +147,13 @@ func NewLocalHSM(
         logger.Error("fail to read last entry term of log")
         return nil, err
     }
+    if snapshotMeta != nil && snapshotMeta.LastIncludedTerm > term {
+        // all entries are compacted into the snapshot
+        term = snapshotMeta.LastIncludedTerm
+    }
 
-    notifier := NewNotifier()
+    notifier := NewHistoryNotifier(
+        config.MaxPendingNotifies, config.NotifyHistorySize)
     object := &LocalHSM{
         // hsm
         StdHSM:           hsm.NewStdHSM(HSMTypeLocal, top, initial),
@@ -113,6 +161,10 @@ func NewLocalHSM(
         selfDispatchChan: NewReliableEventChannel(),
         stopChan:         make(chan interface{}, 1),
         group:            sync.WaitGroup{},
+        requestChan: NewBoundedEventChannel(
+            config.MaxPendingRequests, OverflowBlock),
+        requestOverflowPolicy: config.RequestOverflowPolicy,
+        clock:                 config.Clock,
         // additional fields
         currentTerm:        term,
         localAddr:          localAddr,
@@ -127,7 +179,8 @@ func NewLocalHSM(
     dispatcher := func(event hsm.Event) {
         object.SelfDispatch(event)
     }
-    applier := NewApplier(log, stateMachine, dispatcher, notifier, logger)
+    applier := NewBoundedApplier(log, configManager, stateMachine,
+        dispatcher, notifier, config.MaxPendingApplies, logger)
     object.SetApplier(applier)
     return object, nil
 }
@@ -143,6 +196,7 @@ func (self *LocalHSM) loop() {
         // loop forever to process incoming event
         priorityChan := self.selfDispatchChan.GetOutChan()
         eventChan := self.dispatchChan.GetOutChan()
+        requestChan := self.requestChan.GetOutChan()
         for {
             // Event in selfDispatchChan has higher priority to be processed
             select {
@@ -154,6 +208,19 @@ func (self *LocalHSM) loop() {
             case <-time.After(0):
                 // no event in priorityChan
             }
+            // and then the events other than client requests
+            select {
+            case <-self.stopChan:
+                return
+            case event := <-priorityChan:
+                self.StdHSM.Dispatch2(self, event)
+                continue
+            case event := <-eventChan:
+                self.StdHSM.Dispatch2(self, event)
+                continue
+            case <-time.After(0):
+                // no event in eventChan
+            }
             select {
             case <-self.stopChan:
                 return
@@ -161,6 +228,12 @@ func (self *LocalHSM) loop() {
                 self.StdHSM.Dispatch2(self, event)
             case event := <-eventChan:
                 self.StdHSM.Dispatch2(self, event)
+            case event := <-requestChan:
+                if atomic.LoadInt32(&self.terminating) == 1 {
+                    failUnhandledRequest(event)
+                } else {
+                    self.StdHSM.Dispatch2(self, event)
+                }
             }
         }
     }
@@ -168,8 +241,28 @@ func (self *LocalHSM) loop() {
     go routine()
 }
 
+// Dispatch queues event for the hsm to handle. The client requests are
+// queued in a bounded queue. If it's full, a request is responded with
+// OverloadedResponseEvent right away unless the overflow policy of
+// requests is OverflowBlock, which waits for the room. Other events
+// are never held off by the requests.
 func (self *LocalHSM) Dispatch(event hsm.Event) {
-    self.dispatchChan.Send(event)
+    if !ev.IsClientRequestEvent(event.Type()) {
+        self.dispatchChan.Send(event)
+        return
+    }
+    SetRequestDeadline(event, self.clock.Now())
+    if self.requestOverflowPolicy == OverflowBlock {
+        self.requestChan.Send(event)
+        return
+    }
+    if !self.requestChan.TrySend(event) {
+        e, ok := event.(ev.RequestEvent)
+        hsm.AssertTrue(ok)
+        self.Warning("too many pending requests, reject request: %s",
+            ev.EventString(event))
+        e.SendResponse(ev.NewOverloadedResponseEvent())
+    }
 }
 
 func (self *LocalHSM) QTran(targetStateID string) {
@@ -187,15 +280,27 @@ func (self *LocalHSM) SelfDispatch(event hsm.Event) {
 }
 
 func (self *LocalHSM) Terminate() {
+    atomic.StoreInt32(&self.terminating, 1)
     self.SelfDispatch(hsm.NewStdEvent(ev.EventTerm))
     self.stopChan <- self
     self.group.Wait()
+    for _, event := range self.requestChan.CloseAndDrain() {
+        failUnhandledRequest(event)
+    }
     self.dispatchChan.Close()
     self.selfDispatchChan.Close()
     self.applier.Close()
     self.notifier.Close()
 }
 
+// failUnhandledRequest fails a client request never handled by the hsm
+// as if the leader is unknown, rather than leaving it waiting for ever.
+func failUnhandledRequest(event hsm.Event) {
+    if e, ok := event.(ev.RequestEvent); ok {
+        e.SendResponse(ev.NewLeaderUnknownResponseEvent())
+    }
+}
+
 func (self *LocalHSM) GetCurrentTerm() uint64 {
     return atomic.LoadUint64(&self.currentTerm)
 }
@@ -276,6 +381,31 @@ func (self *LocalHSM) SendMemberChangeNotify() error {
     return nil
 }
 
+// IsMember returns whether addr is in the latest config, either in
+// the servers or the new servers of it. No one is a member of a node
+// which is not bootstrapped or joined yet.
+func (self *LocalHSM) IsMember(addr ps.MultiAddr) bool {
+    conf, err := self.configManager.RNth(0)
+    if err != nil {
+        return false
+    }
+    if conf.Servers != nil && conf.Servers.Contains(addr) {
+        return true
+    }
+    return conf.NewServers != nil && conf.NewServers.Contains(addr)
+}
+
+// ElectionTimeoutScale returns how many election timeouts the local node
+// waits before starting an election. The members of lower priority wait
+// longer, so that the ones of higher priority are likely to win.
+func (self *LocalHSM) ElectionTimeoutScale() int {
+    conf, err := self.configManager.RNth(0)
+    if err != nil {
+        return 1
+    }
+    return 1 + conf.PriorityRank(self.GetLocalAddr())
+}
+
 func (self *LocalHSM) ConfigManager() ps.ConfigManager {
     return self.configManager
 }
@@ -296,6 +426,10 @@ func (self *LocalHSM) SetPeers(peers Peers) {
     self.peers = peers
 }
 
+func (self *LocalHSM) Applier() *Applier {
+    return self.applier
+}
+
 func (self *LocalHSM) SetApplier(applier *Applier) {
     self.applier = applier
 }
@@ -346,6 +480,365 @@ func (self *LocalHSM) CommitInflightLog(entry *InflightEntry) error {
     return nil
 }
 
+// QueryNodeStatus collects the status of local node, except the status
+// of peers, which is only available on leader and filled by leader state.
+// It should be called in the hsm goroutine.
+func (self *LocalHSM) QueryNodeStatus() (*ev.QueryNodeStatusResponse, error) {
+    stateID := self.StdHSM.State.ID()
+    response := &ev.QueryNodeStatusResponse{
+        Term:               self.GetCurrentTerm(),
+        State:              RaftStateOf(stateID),
+        StateID:            stateID,
+        LocalAddr:          self.GetLocalAddr(),
+        Leader:             self.GetLeader(),
+        VotedFor:           self.GetVotedFor(),
+        MemberChangeStatus: self.GetMemberChangeStatus().String(),
+        PendingRequests:    self.requestChan.Len(),
+        PendingApplies:     self.applier.Pending(),
+        PendingNotifies:    self.notifier.Pending(),
+    }
+    firstLogIndex, err := self.log.FirstIndex()
+    if err != nil {
+        message := fmt.Sprintf(
+            "fail to read first index of log, error: %s", err)
+        return nil, errors.New(message)
+    }
+    lastLogIndex, err := self.log.LastIndex()
+    if err != nil {
+        message := fmt.Sprintf(
+            "fail to read last index of log, error: %s", err)
+        return nil, errors.New(message)
+    }
+    committedIndex, err := self.log.CommittedIndex()
+    if err != nil {
+        message := fmt.Sprintf(
+            "fail to read committed index of log, error: %s", err)
+        return nil, errors.New(message)
+    }
+    lastAppliedIndex, err := self.log.LastAppliedIndex()
+    if err != nil {
+        message := fmt.Sprintf(
+            "fail to read last applied index of log, error: %s", err)
+        return nil, errors.New(message)
+    }
+    response.FirstLogIndex = firstLogIndex
+    response.LastLogIndex = lastLogIndex
+    response.StartedIndex = lastLogIndex
+    response.CommittedIndex = committedIndex
+    response.LastAppliedIndex = lastAppliedIndex
+
+    snapshotMeta, err := self.stateMachine.LastSnapshotInfo()
+    if err != nil && err != ps.ErrorNoSnapshot {
+        message := fmt.Sprintf(
+            "fail to read last snapshot info, error: %s", err)
+        return nil, errors.New(message)
+    }
+    response.LastSnapshot = snapshotMeta
+
+    // the first config listed is the committed one which covers
+    // the committed index, the last one is pending if not the same
+    metas, err := ListConfigsAfter(self.configManager, committedIndex)
+    if err == ps.ErrorNoConfig {
+        // not bootstrapped or joined yet
+        return response, nil
+    }
+    if err != nil {
+        message := fmt.Sprintf(
+            "fail to list config after index: %d, error: %s",
+            committedIndex, err)
+        return nil, errors.New(message)
+    }
+    if len(metas) == 0 {
+        return nil, errors.New(fmt.Sprintf(
+            "no config after committed index %d", committedIndex))
+    }
+    response.Conf = metas[0].Conf
+    if length := len(metas); length > 1 {
+        response.PendingConf = metas[length-1].Conf
+    }
+    return response, nil
+}
+
+// RestoreSnapshot restores stateMachine from its latest snapshot on
+// startup, and returns the meta of that snapshot, or nil if there is none.
+// The log and configManager are checked to be consistent with
+// the snapshot first: the log should contain all the entries after it,
+// and the config at the last included index should be the same as its.
+// A configManager without any config takes the config of the snapshot.
+// After that, the last applied index of log is set to the last included
+// index, so that only the committed entries after it are replayed.
+func RestoreSnapshot(
+    configManager ps.ConfigManager,
+    stateMachine ps.StateMachine,
+    log ps.Log) (*ps.SnapshotMeta, error) {
+
+    meta, err := stateMachine.LastSnapshotInfo()
+    if err == ps.ErrorNoSnapshot {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    index := meta.LastIncludedIndex
+    if err = checkLogWithSnapshot(log, meta); err != nil {
+        return nil, err
+    }
+    if meta.Conf != nil {
+        metas, err := configManager.ListAfter(index)
+        switch {
+        case err == ps.ErrorNoConfig:
+            if err = configManager.Push(index, meta.Conf); err != nil {
+                return nil, err
+            }
+        case err != nil:
+            return nil, errors.New(fmt.Sprintf(
+                "fail to list config after index: %d, error: %s",
+                index, err))
+        case !ps.ConfigEqual(metas[0].Conf, meta.Conf):
+            return nil, errors.New(fmt.Sprintf(
+                "config at index: %d inconsistant with snapshot", index))
+        }
+    }
+    if err = stateMachine.RestoreFromSnapshot(meta.ID); err != nil {
+        return nil, errors.New(fmt.Sprintf(
+            "fail to restore snapshot, id: %s, error: %s", meta.ID, err))
+    }
+    committedIndex, err := log.CommittedIndex()
+    if err != nil {
+        return nil, err
+    }
+    if committedIndex < index {
+        if err = log.StoreCommittedIndex(index); err != nil {
+            return nil, err
+        }
+    }
+    if err = log.StoreLastAppliedIndex(index); err != nil {
+        return nil, err
+    }
+    return meta, nil
+}
+
+// checkLogWithSnapshot checks that log has no gap after the snapshot
+// of meta, and agrees with it on the entry at the last included index.
+func checkLogWithSnapshot(log ps.Log, meta *ps.SnapshotMeta) error {
+    index := meta.LastIncludedIndex
+    firstIndex, err := log.FirstIndex()
+    if err != nil {
+        return err
+    }
+    lastIndex, err := log.LastIndex()
+    if err != nil {
+        return err
+    }
+    committedIndex, err := log.CommittedIndex()
+    if err != nil {
+        return err
+    }
+    if lastIndex > 0 && firstIndex > index+1 {
+        return errors.New(fmt.Sprintf(
+            "gap between snapshot index: %d and first log index: %d",
+            index, firstIndex))
+    }
+    if lastIndex < committedIndex && committedIndex > index {
+        return errors.New(fmt.Sprintf(
+            "log misses committed entries after snapshot index: %d, "+
+                "last log index: %d, committed index: %d",
+            index, lastIndex, committedIndex))
+    }
+    if lastIndex == 0 || firstIndex > index || lastIndex < index {
+        // no entry at the last included index to check
+        return nil
+    }
+    entry, err := log.GetLog(index)
+    if err != nil {
+        return err
+    }
+    if entry.Term != meta.LastIncludedTerm {
+        return errors.New(fmt.Sprintf(
+            "log entry at index: %d with term: %d inconsistant with "+
+                "snapshot term: %d", index, entry.Term, meta.LastIncludedTerm))
+    }
+    return nil
+}
+
+// ReconcileConfigWithLog repairs the inconsistance between configManager
+// and log left by a crash. Configs of member change are pushed to
+// configManager and entries stored to log in two steps, in different orders
+// on leader and followers, so that a crash between them leaves:
+// 1. an uncommitted member change config without its log entry, which is
+//    dropped along with all the configs after it.
+//    So is an address update config without its log entry.
+// 2. member change entries without configs, whose configs are pushed again.
+// 3. a committed new config without the normal config following it,
+//    which is pushed then.
+// It returns an error if the inconsistance can't be repaired.
+func ReconcileConfigWithLog(
+    configManager ps.ConfigManager,
+    log ps.Log,
+    logger logging.Logger) error {
+
+    firstIndex, err := log.FirstIndex()
+    if err != nil {
+        return err
+    }
+    lastIndex, err := log.LastIndex()
+    if err != nil {
+        return err
+    }
+    committedIndex, err := log.CommittedIndex()
+    if err != nil {
+        return err
+    }
+    configEntryAt := func(index uint64) (*ps.LogEntry, bool) {
+        if lastIndex == 0 || index < firstIndex || index > lastIndex {
+            return nil, false
+        }
+        entry, err := log.GetLog(index)
+        if err != nil || (entry.Type != ps.LogMemberChange &&
+            entry.Type != ps.LogAddrUpdate) {
+            return nil, false
+        }
+        return entry, true
+    }
+
+    // drop the configs without log entries
+    metas, err := ListConfigsAfter(configManager, committedIndex)
+    if err != nil && err != ps.ErrorNoConfig {
+        return errors.New(fmt.Sprintf(
+            "fail to list config after index: %d, error: %s",
+            committedIndex, err))
+    }
+    for _, meta := range metas {
+        index := meta.FromLogIndex
+        if meta.Conf.IsNormalConfig() && index <= lastIndex {
+            // normal configs of member change are pushed without
+            // log entries, only the ones of address update beyond
+            // the log are dangling
+            continue
+        }
+        entry, ok := configEntryAt(index)
+        if ok && ps.ConfigEqual(entry.Conf, meta.Conf) {
+            continue
+        }
+        if index <= committedIndex {
+            if index < firstIndex {
+                // the entry is compacted
+                continue
+            }
+            return errors.New(fmt.Sprintf(
+                "config at index: %d inconsistant with committed log", index))
+        }
+        logger.Warning("drop config at index: %d without log entry", index)
+        if _, err = configManager.TruncateAfter(index); err != nil {
+            return err
+        }
+        break
+    }
+
+    // push the configs of the entries after the latest config
+    var conf *ps.Config
+    var confIndex uint64
+    metas, err = ListConfigsAfter(configManager, committedIndex)
+    if err != nil && err != ps.ErrorNoConfig {
+        return err
+    }
+    fromIndex := firstIndex
+    if length := len(metas); length > 0 {
+        conf = metas[length-1].Conf
+        confIndex = metas[length-1].FromLogIndex
+        fromIndex = Max(confIndex+1, firstIndex)
+    }
+    for index := fromIndex; lastIndex > 0 && index <= lastIndex; index++ {
+        entry, ok := configEntryAt(index)
+        if !ok {
+            continue
+        }
+        if conf != nil && conf.IsNewConfig() && !entry.Conf.IsNewConfig() {
+            // the new config is committed before the next member change
+            // or address update
+            conf = &ps.Config{
+                Servers:    conf.NewServers,
+                NewServers: nil,
+                Priorities: conf.Priorities,
+            }
+            if err = configManager.Push(index, conf); err != nil {
+                return err
+            }
+        }
+        if !IsNextConfig(conf, entry.Conf) {
+            return errors.New(fmt.Sprintf(
+                "config of log entry at index: %d doesn't follow "+
+                    "the previous config", index))
+        }
+        logger.Warning("push missing config at index: %d", index)
+        if err = configManager.Push(index, entry.Conf); err != nil {
+            return err
+        }
+        conf, confIndex = entry.Conf, index
+    }
+
+    // finish the member change of the committed new config
+    if conf != nil && conf.IsNewConfig() && confIndex <= committedIndex {
+        logger.Warning("push normal config after committed new config "+
+            "at index: %d", confIndex)
+        normalConf := &ps.Config{
+            Servers:    conf.NewServers,
+            NewServers: nil,
+            Priorities: conf.Priorities,
+        }
+        if err = configManager.Push(confIndex+1, normalConf); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// ListConfigsAfter is the same as ListAfter() of configManager, except that
+// it lists all the configs if they start after index, e.g. on a newly
+// joined node whose committed index hasn't caught up with its first config.
+func ListConfigsAfter(
+    configManager ps.ConfigManager, index uint64) ([]*ps.ConfigMeta, error) {
+
+    metas, err := configManager.ListAfter(index)
+    if err == nil || err == ps.ErrorNoConfig {
+        return metas, err
+    }
+    // look for the first config
+    first, e := configManager.PreviousOf(math.MaxUint64)
+    if e != nil {
+        return nil, err
+    }
+    for {
+        meta, e := configManager.PreviousOf(first.FromLogIndex)
+        if e != nil {
+            break
+        }
+        first = meta
+    }
+    if first.FromLogIndex <= index {
+        return nil, err
+    }
+    return configManager.ListAfter(first.FromLogIndex)
+}
+
+// IsNextConfig returns whether next could be the config following conf
+// in a member change or an address update. Any config could be
+// the first one.
+func IsNextConfig(conf *ps.Config, next *ps.Config) bool {
+    switch {
+    case conf == nil:
+        return true
+    case conf.IsNormalConfig():
+        // an address update keeps the same members
+        return (next.IsOldNewConfig() || next.IsNormalConfig()) &&
+            ps.MultiAddrSliceEqual(conf.Servers, next.Servers)
+    case conf.IsOldNewConfig():
+        return next.IsNewConfig() &&
+            ps.MultiAddrSliceEqual(conf.NewServers, next.NewServers)
+    }
+    return false
+}
+
 func InitMemberChangeStatus(
     configManager ps.ConfigManager,
     log ps.Log) (MemberChangeStatusType, error) {
@@ -355,7 +848,11 @@ func InitMemberChangeStatus(
     if err != nil {
         return MemberChangeStatusNotSet, err
     }
-    metas, err := configManager.ListAfter(committedIndex)
+    metas, err := ListConfigsAfter(configManager, committedIndex)
+    if err == ps.ErrorNoConfig {
+        // a node to be bootstrapped or joined
+        return NotInMemeberChange, nil
+    }
     if err != nil {
         return MemberChangeStatusNotSet, err
     }
@@ -365,15 +862,24 @@ func InitMemberChangeStatus(
     }
     length := len(metas)
     if length > 2 {
-        return MemberChangeStatusNotSet, errors.New(fmt.Sprintf(
-            "%d configs after committed index %d", length, committedIndex))
+        // A member change config is appended only after the previous one
+        // is committed, so the configs before the last two are committed,
+        // even though the committed index hasn't caught up yet.
+        metas = metas[length-2:]
+        length = 2
     }
     if length == 1 {
         conf := metas[0].Conf
+        // the only config of a newly joined node may not be committed yet
+        committed := metas[0].FromLogIndex <= committedIndex
         if conf.IsNormalConfig() {
             return NotInMemeberChange, nil
-        } else if conf.IsOldNewConfig() {
+        } else if conf.IsOldNewConfig() && committed {
             return OldNewConfigCommitted, nil
+        } else if conf.IsOldNewConfig() {
+            return OldNewConfigSeen, nil
+        } else if conf.IsNewConfig() && !committed {
+            return NewConfigSeen, nil
         }
     } else { // length == 2
         prevConf := metas[0].Conf
@@ -396,6 +902,7 @@ type Local interface {
     io.Closer
 
     QueryState() string
+    QueryStatus() *ev.QueryNodeStatusResponse
     GetCurrentTerm() uint64
     GetLocalAddr() *ps.ServerAddress
     GetVotedFor() *ps.ServerAddress
@@ -429,6 +936,8 @@ func NewLocalManager(
         config.ElectionTimeout,
         config.ElectionTimeoutThresholdPersent,
         config.MaxTimeoutJitter,
+        config.Clock.Fork(StateFollowerID),
+        config.Random.Fork(StateFollowerID),
         logger)
     NewSnapshotRecoveryState(followerState, logger)
     followerMemberChangeState := NewFollowerMemberChangeState(
@@ -438,15 +947,33 @@ func NewLocalManager(
     NewFollowerNewConfigSeenState(followerMemberChangeState, logger)
     needPeersState := NewNeedPeersState(localState, logger)
     NewCandidateState(
-        needPeersState, config.ElectionTimeout, config.MaxTimeoutJitter, logger)
-    leaderState := NewLeaderState(needPeersState, logger)
+        needPeersState,
+        config.ElectionTimeout,
+        config.MaxTimeoutJitter,
+        config.Clock.Fork(StateCandidateID),
+        config.Random.Fork(StateCandidateID),
+        logger)
+    leaderState := NewLeaderState(
+        needPeersState,
+        config.ElectionTimeout,
+        config.CheckQuorum,
+        config.PersistErrorPolicy,
+        config.Clock.Fork(StateLeaderID),
+        logger)
     NewUnsyncState(leaderState, logger)
     NewSyncState(leaderState, logger)
-    NewPersistErrorState(localState, config.PersistErrorNotifyTimeout, logger)
+    NewPersistErrorState(
+        localState,
+        config.PersistErrorNotifyTimeout,
+        config.PersistErrorPolicy,
+        config.PersistErrorRetry,
+        config.Clock.Fork(StatePersistErrorID),
+        logger)
     hsm.NewTerminal(top)
     localHSM, err := NewLocalHSM(
         top,
         initial,
+        config,
         localAddr,
         configManager,
         stateMachine,
@@ -482,6 +1009,19 @@ func (self *LocalManager) QueryState() string {
     return event.Response.StateID
 }
 
+func (self *LocalManager) QueryStatus() *ev.QueryNodeStatusResponse {
+    requestEvent := ev.NewQueryNodeStatusRequestEvent(
+        &ev.QueryNodeStatusRequest{})
+    self.localHSM.Dispatch(requestEvent)
+    responseEvent := requestEvent.RecvResponse()
+    if responseEvent.Type() != ev.EventQueryNodeStatusResponse {
+        return nil
+    }
+    event, ok := responseEvent.(*ev.QueryNodeStatusResponseEvent)
+    hsm.AssertTrue(ok)
+    return event.Response
+}
+
 func (self *LocalManager) GetCurrentTerm() uint64 {
     return self.localHSM.GetCurrentTerm()
 }
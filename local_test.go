@@ -1,6 +1,7 @@
 package rafted
 
 import (
+    "fmt"
     hsm "github.com/hhkbp2/go-hsm"
     ev "github.com/hhkbp2/rafted/event"
     logging "github.com/hhkbp2/rafted/logging"
@@ -8,6 +9,7 @@ import (
     "github.com/hhkbp2/rafted/str"
     "github.com/hhkbp2/testify/assert"
     "github.com/hhkbp2/testify/mock"
+    "github.com/hhkbp2/testify/require"
     "testing"
     "time"
 )
@@ -86,6 +88,116 @@ func getTestLocal() (Local, error) {
     return local, nil
 }
 
+func TestLocalHSMOverloaded(t *testing.T) {
+    config := *testConfig
+    config.MaxPendingRequests = 2
+    logger := logging.GetLogger("test local")
+    top := hsm.NewTop()
+    initial := hsm.NewInitial(top, StateLocalID)
+    NewLocalState(top, logger)
+    conf := &ps.Config{
+        Servers:    testServers,
+        NewServers: nil,
+    }
+    log := ps.NewMemoryLog()
+    configManager := ps.NewMemoryConfigManager(0, conf)
+    localHSM, err := NewLocalHSM(top, initial, &config,
+        testServers.Addresses[0], configManager,
+        ps.NewMemoryStateMachine(), log, logger)
+    require.Nil(t, err)
+    defer localHSM.Terminate()
+    // the hsm isn't started, so the requests dispatched keep pending
+    request := &ev.ClientAppendRequest{
+        Data: testData,
+    }
+    for i := 0; i < config.MaxPendingRequests; i++ {
+        localHSM.Dispatch(ev.NewClientAppendRequestEvent(request))
+    }
+    reqEvent := ev.NewClientAppendRequestEvent(request)
+    localHSM.Dispatch(reqEvent)
+    assert.Equal(t, ev.EventOverloadedResponse,
+        reqEvent.RecvResponse().Type())
+    require.True(t, waitChannelLen(localHSM.requestChan, 2))
+    status, err := localHSM.QueryNodeStatus()
+    require.Nil(t, err)
+    assert.Equal(t, config.MaxPendingRequests, status.PendingRequests)
+}
+
+func TestLocalHSMRequestsNotHoldOffRaftEvents(t *testing.T) {
+    config := *testConfig
+    config.MaxPendingRequests = 1
+    config.RequestOverflowPolicy = OverflowBlock
+    logger := logging.GetLogger("test local")
+    top := hsm.NewTop()
+    initial := hsm.NewInitial(top, StateLocalID)
+    NewLocalState(top, logger)
+    conf := &ps.Config{
+        Servers:    testServers,
+        NewServers: nil,
+    }
+    configManager := ps.NewMemoryConfigManager(0, conf)
+    localHSM, err := NewLocalHSM(top, initial, &config,
+        testServers.Addresses[0], configManager,
+        ps.NewMemoryStateMachine(), ps.NewMemoryLog(), logger)
+    require.Nil(t, err)
+    defer localHSM.Terminate()
+    // the hsm isn't started, so the request queue is full after this
+    request := &ev.ClientAppendRequest{
+        Data: testData,
+    }
+    localHSM.Dispatch(ev.NewClientAppendRequestEvent(request))
+    require.True(t, waitChannelLen(localHSM.requestChan, 1))
+    // the raft events are still queued without waiting
+    dispatched := make(chan bool, 1)
+    go func() {
+        voteRequest := &ev.RequestVoteRequest{
+            Term:      testTerm,
+            Candidate: testServers.Addresses[1],
+        }
+        localHSM.Dispatch(ev.NewRequestVoteRequestEvent(voteRequest))
+        localHSM.Dispatch(ev.NewStepdownEvent())
+        dispatched <- true
+    }()
+    select {
+    case <-dispatched:
+    case <-time.After(time.Second):
+        assert.True(t, false, "raft events blocked by requests")
+    }
+    assert.True(t, waitChannelLen(localHSM.dispatchChan, 2))
+}
+
+func TestLocalHSMTerminateFailsQueuedRequests(t *testing.T) {
+    logger := logging.GetLogger("test local")
+    top := hsm.NewTop()
+    initial := hsm.NewInitial(top, StateLocalID)
+    NewLocalState(top, logger)
+    conf := &ps.Config{
+        Servers:    testServers,
+        NewServers: nil,
+    }
+    configManager := ps.NewMemoryConfigManager(0, conf)
+    localHSM, err := NewLocalHSM(top, initial, testConfig,
+        testServers.Addresses[0], configManager,
+        ps.NewMemoryStateMachine(), ps.NewMemoryLog(), logger)
+    require.Nil(t, err)
+    // the hsm isn't started, so the requests dispatched keep queued
+    request := &ev.ClientAppendRequest{
+        Data: testData,
+    }
+    reqEvents := make([]ev.RequestEvent, 0, 2)
+    for i := 0; i < 2; i++ {
+        reqEvent := ev.NewClientAppendRequestEvent(request)
+        localHSM.Dispatch(reqEvent)
+        reqEvents = append(reqEvents, reqEvent)
+    }
+    require.True(t, waitChannelLen(localHSM.requestChan, 2))
+    localHSM.Terminate()
+    for _, reqEvent := range reqEvents {
+        assert.Equal(t, ev.EventLeaderUnknownResponse,
+            reqEvent.RecvResponse().Type())
+    }
+}
+
 func BeforeTimeout(timeout time.Duration, startTime time.Time) time.Duration {
     d := time.Duration(
         int64(float32(int64(timeout)) * (1 - testConfig.MaxTimeoutJitter)))
@@ -114,6 +226,33 @@ func (self *MockPeers) RemovePeers(peerAddrSlice *ps.ServerAddressSlice) {
     self.Mock.Called(peerAddrSlice)
 }
 
+func (self *MockPeers) QueryStatus() []*ev.PeerStatus {
+    args := self.Mock.Called()
+    result, _ := args.Get(0).([]*ev.PeerStatus)
+    return result
+}
+
+// LastContactTimes reports all the test servers in contact right now,
+// so that the leader under test never steps down for check quorum.
+func (self *MockPeers) LastContactTimes() map[string]time.Time {
+    now := time.Now()
+    result := make(map[string]time.Time)
+    for _, addr := range testServers.Addresses {
+        result[ps.ServerKey(addr)] = now
+    }
+    return result
+}
+
+func (self *MockPeers) ResetLastContactTimes() {
+    // nothing to reset, since all the test servers are always in contact
+}
+
+func (self *MockPeers) SendTimeoutNow(
+    target *ps.ServerAddress, request *ev.TimeoutNowRequest) {
+
+    self.Mock.Called(target, request)
+}
+
 func (self *MockPeers) Close() error {
     args := self.Mock.Called()
     return args.Error(0)
@@ -200,6 +339,18 @@ func assertGetLeaderUnsyncResponseEvent(t *testing.T, reqEvent ev.RequestEvent)
     assert.True(t, ok)
 }
 
+func assertGetDeadlineExceededResponseEvent(
+    t *testing.T, reqEvent ev.RequestEvent) {
+
+    respEvent := reqEvent.RecvResponse()
+    assert.Equal(t, ev.EventDeadlineExceededResponse, respEvent.Type(),
+        "expect %s but actual %s",
+        ev.EventTypeString(ev.EventDeadlineExceededResponse),
+        ev.EventTypeString(respEvent.Type()))
+    _, ok := respEvent.(*ev.DeadlineExceededResponseEvent)
+    assert.True(t, ok)
+}
+
 func assertGetClientResponseEvent(
     t *testing.T, reqEvent ev.RequestEvent, success bool, data []byte) {
 
@@ -395,3 +546,282 @@ func assertLogCommittedIndex(t *testing.T, log ps.Log, index uint64) {
 // ------------------------------------------------------------
 // Test Case
 // ------------------------------------------------------------
+
+func getTestSnapshotEntries(from, to uint64) []*ps.LogEntry {
+    entries := make([]*ps.LogEntry, 0, to-from+1)
+    for i := from; i <= to; i++ {
+        entries = append(entries, &ps.LogEntry{
+            Term:  testTerm,
+            Index: i,
+            Type:  ps.LogCommand,
+            Data:  []byte(fmt.Sprintf("data%d", i)),
+        })
+    }
+    return entries
+}
+
+func TestRestoreSnapshotNoSnapshot(t *testing.T) {
+    log, err := getTestLog(3, 2, getTestSnapshotEntries(1, 3))
+    require.Nil(t, err)
+    conf := &ps.Config{Servers: testServers}
+    configManager := ps.NewMemoryConfigManager(1, conf)
+    meta, err := RestoreSnapshot(
+        configManager, ps.NewMemoryStateMachine(), log)
+    assert.Nil(t, err)
+    assert.Nil(t, meta)
+    lastAppliedIndex, err := log.LastAppliedIndex()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(2), lastAppliedIndex)
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+    conf := &ps.Config{Servers: testServers}
+    stateMachine := ps.NewMemoryStateMachine()
+    stateMachine.Apply([]byte("data1"))
+    stateMachine.Apply([]byte("data2"))
+    _, err := stateMachine.MakeSnapshot(testTerm, 2, conf)
+    require.Nil(t, err)
+    // the state after the snapshot is lost on restart
+    stateMachine.Apply([]byte("data3"))
+    // the compacted log keeps the entries from the last included index
+    log, err := getTestLog(4, 3, getTestSnapshotEntries(1, 4))
+    require.Nil(t, err)
+    require.Nil(t, log.TruncateBefore(1))
+    configManager := ps.NewMemoryConfigManager(1, conf)
+
+    meta, err := RestoreSnapshot(configManager, stateMachine, log)
+    require.Nil(t, err)
+    require.NotNil(t, meta)
+    assert.Equal(t, uint64(2), meta.LastIncludedIndex)
+    assert.Equal(t, 2, stateMachine.Data().Len())
+    lastAppliedIndex, err := log.LastAppliedIndex()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(2), lastAppliedIndex)
+    assertLogCommittedIndex(t, log, 4)
+}
+
+func TestRestoreSnapshotWithoutConfig(t *testing.T) {
+    conf := &ps.Config{Servers: testServers}
+    stateMachine := ps.NewMemoryStateMachine()
+    _, err := stateMachine.MakeSnapshot(testTerm, 2, conf)
+    require.Nil(t, err)
+    log, err := getTestLog(2, 2, getTestSnapshotEntries(1, 2))
+    require.Nil(t, err)
+    configManager := ps.NewMemoryConfigManager(0, nil)
+
+    _, err = RestoreSnapshot(configManager, stateMachine, log)
+    require.Nil(t, err)
+    restored, err := configManager.RNth(0)
+    require.Nil(t, err)
+    assert.True(t, ps.ConfigEqual(conf, restored))
+}
+
+func TestRestoreSnapshotInconsistant(t *testing.T) {
+    conf := &ps.Config{Servers: testServers}
+    otherConf := &ps.Config{Servers: ps.SetupMemoryMultiAddrSlice(5)}
+    newStateMachine := func(term uint64) ps.StateMachine {
+        stateMachine := ps.NewMemoryStateMachine()
+        _, err := stateMachine.MakeSnapshot(term, 2, conf)
+        require.Nil(t, err)
+        return stateMachine
+    }
+    // term of the entry at the last included index differs
+    log, err := getTestLog(3, 3, getTestSnapshotEntries(1, 3))
+    require.Nil(t, err)
+    _, err = RestoreSnapshot(
+        ps.NewMemoryConfigManager(1, conf), newStateMachine(testTerm+1), log)
+    assert.NotNil(t, err)
+    // a gap between the snapshot and the log
+    log, err = getTestLog(5, 5, getTestSnapshotEntries(1, 5))
+    require.Nil(t, err)
+    require.Nil(t, log.TruncateBefore(3))
+    _, err = RestoreSnapshot(
+        ps.NewMemoryConfigManager(1, conf), newStateMachine(testTerm), log)
+    assert.NotNil(t, err)
+    // config at the last included index differs
+    log, err = getTestLog(3, 3, getTestSnapshotEntries(1, 3))
+    require.Nil(t, err)
+    _, err = RestoreSnapshot(
+        ps.NewMemoryConfigManager(1, otherConf), newStateMachine(testTerm),
+        log)
+    assert.NotNil(t, err)
+}
+
+type testConfigPush struct {
+    index uint64
+    conf  *ps.Config
+}
+
+// testCrashState is the state of log and config manager left by
+// a crash in some window of member change.
+type testCrashState struct {
+    name           string
+    entries        []*ps.LogEntry
+    committedIndex uint64
+    pushes         []testConfigPush
+    // expected result after reconcile
+    fail   bool
+    status MemberChangeStatusType
+    conf   *ps.Config
+}
+
+func getTestCrashLog(
+    t *testing.T,
+    entries []*ps.LogEntry,
+    committedIndex uint64) ps.Log {
+
+    log := ps.NewMemoryLog()
+    require.Nil(t, log.StoreLogs(entries))
+    if committedIndex > 0 {
+        require.Nil(t, log.StoreCommittedIndex(committedIndex))
+    }
+    return log
+}
+
+func TestReconcileConfigWithLog(t *testing.T) {
+    servers := testServers
+    newServers := ps.SetupMemoryMultiAddrSlice(4)
+    normal := &ps.Config{Servers: servers}
+    oldNew := &ps.Config{Servers: servers, NewServers: newServers}
+    newConf := &ps.Config{NewServers: newServers}
+    newNormal := &ps.Config{Servers: newServers}
+    command := func(index uint64) *ps.LogEntry {
+        return &ps.LogEntry{
+            Term:  testTerm,
+            Index: index,
+            Type:  ps.LogCommand,
+            Data:  testData,
+        }
+    }
+    memberChange := func(index uint64, conf *ps.Config) *ps.LogEntry {
+        return &ps.LogEntry{
+            Term:  testTerm,
+            Index: index,
+            Type:  ps.LogMemberChange,
+            Conf:  conf,
+        }
+    }
+    // a member change with old/new config at index 2 and new config at 4
+    entries := []*ps.LogEntry{
+        command(1),
+        memberChange(2, oldNew),
+        command(3),
+        memberChange(4, newConf),
+        command(5),
+    }
+    cases := []*testCrashState{
+        &testCrashState{
+            name:           "leader pushes old/new config, not stored",
+            entries:        entries[:1],
+            committedIndex: 1,
+            pushes:         []testConfigPush{{1, normal}, {2, oldNew}},
+            status:         NotInMemeberChange,
+            conf:           normal,
+        },
+        &testCrashState{
+            name:           "follower stores old/new entry, not pushed",
+            entries:        entries[:2],
+            committedIndex: 1,
+            pushes:         []testConfigPush{{1, normal}},
+            status:         OldNewConfigSeen,
+            conf:           oldNew,
+        },
+        &testCrashState{
+            name:           "follower stores both entries, none pushed",
+            entries:        entries[:4],
+            committedIndex: 1,
+            pushes:         []testConfigPush{{1, normal}},
+            status:         NewConfigSeen,
+            conf:           newConf,
+        },
+        &testCrashState{
+            name:           "leader pushes new config, not stored",
+            entries:        entries[:3],
+            committedIndex: 2,
+            pushes: []testConfigPush{
+                {1, normal}, {2, oldNew}, {4, newConf}},
+            status: OldNewConfigCommitted,
+            conf:   oldNew,
+        },
+        &testCrashState{
+            name:           "new config committed, normal config not pushed",
+            entries:        entries,
+            committedIndex: 4,
+            pushes: []testConfigPush{
+                {1, normal}, {2, oldNew}, {4, newConf}},
+            status: NotInMemeberChange,
+            conf:   newNormal,
+        },
+        &testCrashState{
+            name:           "fresh node stores entries, none pushed",
+            entries:        entries[:2],
+            committedIndex: 1,
+            pushes:         []testConfigPush{},
+            status:         OldNewConfigSeen,
+            conf:           oldNew,
+        },
+        &testCrashState{
+            name:           "committed config differs from log entry",
+            entries:        entries[:3],
+            committedIndex: 3,
+            pushes: []testConfigPush{
+                {1, normal},
+                {2, &ps.Config{Servers: servers, NewServers: servers}}},
+            fail: true,
+        },
+        &testCrashState{
+            name:           "log entry doesn't follow config",
+            entries:        entries[:2],
+            committedIndex: 1,
+            pushes:         []testConfigPush{{1, newNormal}},
+            fail:           true,
+        },
+    }
+    logger := logging.GetLogger("test reconcile")
+    for _, c := range cases {
+        log := getTestCrashLog(t, c.entries, c.committedIndex)
+        configManager := ps.NewMemoryConfigManager(0, nil)
+        for _, push := range c.pushes {
+            require.Nil(t, configManager.Push(push.index, push.conf))
+        }
+        err := ReconcileConfigWithLog(configManager, log, logger)
+        if c.fail {
+            assert.NotNil(t, err, c.name)
+            continue
+        }
+        require.Nil(t, err, c.name)
+        conf, err := configManager.RNth(0)
+        require.Nil(t, err, c.name)
+        assert.True(t, ps.ConfigEqual(c.conf, conf), c.name)
+        status, err := InitMemberChangeStatus(configManager, log)
+        assert.Nil(t, err, c.name)
+        assert.Equal(t, c.status, status, c.name)
+    }
+}
+
+func TestLocalRefuseUnreconcilableConfig(t *testing.T) {
+    conf := &ps.Config{Servers: testServers}
+    oldNew := &ps.Config{
+        Servers:    ps.SetupMemoryMultiAddrSlice(5),
+        NewServers: testServers,
+    }
+    // a member change entry which doesn't follow the config
+    entries := []*ps.LogEntry{
+        &ps.LogEntry{
+            Term:  testTerm,
+            Index: 1,
+            Type:  ps.LogMemberChange,
+            Conf:  oldNew,
+        },
+    }
+    log := getTestCrashLog(t, entries, 0)
+    local, err := NewLocalManager(
+        testConfig,
+        testServers.Addresses[0],
+        log,
+        ps.NewMemoryStateMachine(),
+        ps.NewMemoryConfigManager(0, conf),
+        logging.GetLogger("test local"))
+    assert.Nil(t, local)
+    assert.NotNil(t, err)
+}
@@ -0,0 +1,158 @@
+package rafted
+
+import (
+    "errors"
+    "fmt"
+    cm "github.com/hhkbp2/rafted/comm"
+    logging "github.com/hhkbp2/rafted/logging"
+    ps "github.com/hhkbp2/rafted/persist"
+    "sync"
+)
+
+// MultiRaftHost runs many raft groups in one process. All the groups
+// share one server and one client pool, and every request between hosts
+// carries the id of the group it's sent to. Groups could be created and
+// destroyed at runtime. Each group has its own log, state machine,
+// hsm and tickers, so a failure of one group, e.g. a persist error,
+// never affects the others. Requests for a group not running on the
+// receiving host fail like unreachable peers.
+// The heartbeats of the groups to the same host are coalesced in every
+// config.HeartbeatCoalesceInterval, zero for not coalescing.
+// The groups share the clock in config, along with the other settings.
+// The net/rpc transport doesn't support group requests, so only the
+// socket and memory transports could be used.
+type MultiRaftHost struct {
+    config    *Configuration
+    localAddr *ps.ServerAddress
+    client    cm.Client
+    server    cm.Server
+    mux       *cm.GroupMux
+    coalescer *cm.HeartbeatCoalescer
+    groups    map[uint64]*HSMBackend
+    groupLock sync.Mutex
+    logger    logging.Logger
+}
+
+func NewMultiRaftHost(
+    config *Configuration,
+    localAddr *ps.ServerAddress,
+    bindAddr *ps.ServerAddress,
+    logger logging.Logger) (*MultiRaftHost, error) {
+
+    client := cm.NewSocketClient(config.CommPoolSize, config.CommClientTimeout)
+    genServer := func(
+        handler cm.RequestEventHandler,
+        logger logging.Logger) (cm.Server, error) {
+
+        return cm.NewSocketServer(
+            cm.FirstAddr(bindAddr), config.CommServerTimeout, handler, logger)
+    }
+    return NewMultiRaftHostWith(config, localAddr, client, genServer, logger)
+}
+
+// NewMultiRaftHostWith creates a host which talks to other hosts with
+// client and serves them with the server created by genServer.
+func NewMultiRaftHostWith(
+    config *Configuration,
+    localAddr *ps.ServerAddress,
+    client cm.Client,
+    genServer GenServerFunc,
+    logger logging.Logger) (*MultiRaftHost, error) {
+
+    mux := cm.NewGroupMux(config.HeartbeatTimeout, config.Clock, logger)
+    server, err := genServer(mux.Handle, logger)
+    if err != nil {
+        client.Close()
+        return nil, err
+    }
+    server.Serve()
+    var coalescer *cm.HeartbeatCoalescer
+    if config.HeartbeatCoalesceInterval > 0 {
+        coalescer = cm.NewHeartbeatCoalescer(
+            client, config.HeartbeatCoalesceInterval, config.Clock, logger)
+    }
+    return &MultiRaftHost{
+        config:    config,
+        localAddr: localAddr,
+        client:    client,
+        server:    server,
+        mux:       mux,
+        coalescer: coalescer,
+        groups:    make(map[uint64]*HSMBackend),
+        logger:    logger,
+    }, nil
+}
+
+// CreateGroup starts the raft group groupID on this host with
+// the given persist components.
+func (self *MultiRaftHost) CreateGroup(
+    groupID uint64,
+    configManager ps.ConfigManager,
+    stateMachine ps.StateMachine,
+    log ps.Log) (*HSMBackend, error) {
+
+    self.groupLock.Lock()
+    defer self.groupLock.Unlock()
+    if self.groups == nil {
+        return nil, errors.New("host closed")
+    }
+    if _, ok := self.groups[groupID]; ok {
+        return nil, errors.New(fmt.Sprintf("group %d exists", groupID))
+    }
+    genServer := func(
+        handler cm.RequestEventHandler,
+        logger logging.Logger) (cm.Server, error) {
+
+        return cm.NewGroupServer(groupID, handler, self.mux)
+    }
+    backend, err := NewHSMBackendWith(
+        self.config,
+        self.localAddr,
+        configManager,
+        stateMachine,
+        log,
+        cm.NewGroupClient(groupID, self.client, self.coalescer),
+        genServer,
+        self.logger)
+    if err != nil {
+        return nil, err
+    }
+    self.groups[groupID] = backend
+    return backend, nil
+}
+
+// Group returns the backend of the raft group groupID running on
+// this host.
+func (self *MultiRaftHost) Group(groupID uint64) (*HSMBackend, bool) {
+    self.groupLock.Lock()
+    defer self.groupLock.Unlock()
+    backend, ok := self.groups[groupID]
+    return backend, ok
+}
+
+// DestroyGroup stops the raft group groupID on this host. The other
+// hosts see it as an unreachable peer of the group afterwards.
+func (self *MultiRaftHost) DestroyGroup(groupID uint64) error {
+    self.groupLock.Lock()
+    backend, ok := self.groups[groupID]
+    delete(self.groups, groupID)
+    self.groupLock.Unlock()
+    if !ok {
+        return errors.New(fmt.Sprintf("group %d not found", groupID))
+    }
+    return backend.Close()
+}
+
+// Close destroys all the groups on this host, and then shuts down
+// the shared server and client.
+func (self *MultiRaftHost) Close() error {
+    self.groupLock.Lock()
+    groups := self.groups
+    self.groups = nil
+    self.groupLock.Unlock()
+    for _, backend := range groups {
+        backend.Close()
+    }
+    self.server.Close()
+    return self.client.Close()
+}
@@ -0,0 +1,125 @@
+package rafted
+
+import (
+    cm "github.com/hhkbp2/rafted/comm"
+    ev "github.com/hhkbp2/rafted/event"
+    logging "github.com/hhkbp2/rafted/logging"
+    ps "github.com/hhkbp2/rafted/persist"
+    "github.com/hhkbp2/testify/assert"
+    "github.com/hhkbp2/testify/require"
+    "testing"
+    "time"
+)
+
+func NewTestMemoryMultiRaftHost(
+    config *Configuration,
+    localAddr *ps.ServerAddress) (*MultiRaftHost, error) {
+
+    client := cm.NewMemoryClient(
+        config.CommPoolSize, config.CommClientTimeout, testRegister)
+    genServer := func(
+        handler cm.RequestEventHandler,
+        logger logging.Logger) (cm.Server, error) {
+
+        server := cm.NewMemoryServer(
+            localAddr,
+            config.CommServerTimeout,
+            handler,
+            testRegister,
+            logger)
+        return server, nil
+    }
+    logger := logging.GetLogger("host" + "#" + localAddr.String())
+    return NewMultiRaftHostWith(config, localAddr, client, genServer, logger)
+}
+
+func createTestGroup(
+    host *MultiRaftHost,
+    groupID uint64,
+    addrSlice *ps.ServerAddressSlice) (*HSMBackend, error) {
+
+    log := ps.NewMemoryLog()
+    firstLogIndex, err := log.FirstIndex()
+    if err != nil {
+        return nil, err
+    }
+    config := &ps.Config{
+        Servers:    addrSlice,
+        NewServers: nil,
+    }
+    configManager := ps.NewMemoryConfigManager(firstLogIndex, config)
+    stateMachine := ps.NewMemoryStateMachine()
+    return host.CreateGroup(groupID, configManager, stateMachine, log)
+}
+
+func assertGroupAppend(t *testing.T, backends []*HSMBackend) {
+    request := &ev.ClientAppendRequest{
+        Data: testData,
+    }
+    deadline := time.Now().Add(testConfig.ElectionTimeout * 20)
+    for i := 0; time.Now().Before(deadline); i = (i + 1) % len(backends) {
+        reqEvent := ev.NewClientAppendRequestEvent(request)
+        backends[i].Send(reqEvent)
+        event := reqEvent.RecvResponse()
+        if event.Type() == ev.EventClientResponse {
+            e, ok := event.(*ev.ClientResponseEvent)
+            require.True(t, ok)
+            assert.Equal(t, true, e.Response.Success)
+            assert.Equal(t, testData, e.Response.Data)
+            return
+        }
+        time.Sleep(testConfig.HeartbeatTimeout)
+    }
+    assert.True(t, false, "group fails to append in time")
+}
+
+func testMultiRaftHost(t *testing.T, config *Configuration) {
+    size := 3
+    servers := ps.RandomMemoryMultiAddrSlice(size)
+    hosts := make([]*MultiRaftHost, 0, size)
+    for _, addr := range servers.Addresses {
+        host, err := NewTestMemoryMultiRaftHost(config, addr)
+        require.Nil(t, err)
+        hosts = append(hosts, host)
+    }
+    groupIDs := []uint64{1, 2}
+    groups := make(map[uint64][]*HSMBackend)
+    for _, groupID := range groupIDs {
+        for _, host := range hosts {
+            backend, err := createTestGroup(host, groupID, servers)
+            require.Nil(t, err)
+            groups[groupID] = append(groups[groupID], backend)
+        }
+    }
+    _, err := createTestGroup(hosts[0], groupIDs[0], servers)
+    assert.NotNil(t, err)
+    for _, groupID := range groupIDs {
+        assertGroupAppend(t, groups[groupID])
+    }
+    // destroying a group on one host affects neither the other groups
+    // nor the same group on other hosts
+    require.Nil(t, hosts[0].DestroyGroup(groupIDs[0]))
+    assert.NotNil(t, hosts[0].DestroyGroup(groupIDs[0]))
+    _, ok := hosts[0].Group(groupIDs[0])
+    assert.False(t, ok)
+    assertGroupAppend(t, groups[groupIDs[0]][1:])
+    assertGroupAppend(t, groups[groupIDs[1]])
+    // the group could be created again on the same host
+    _, err = createTestGroup(hosts[0], groupIDs[0], servers)
+    assert.Nil(t, err)
+    for _, host := range hosts {
+        assert.Nil(t, host.Close())
+    }
+    _, err = createTestGroup(hosts[0], groupIDs[1], servers)
+    assert.NotNil(t, err)
+}
+
+func TestMultiRaftHost(t *testing.T) {
+    testMultiRaftHost(t, testConfig)
+}
+
+func TestMultiRaftHostWithoutHeartbeatCoalescing(t *testing.T) {
+    config := *testConfig
+    config.HeartbeatCoalesceInterval = 0
+    testMultiRaftHost(t, &config)
+}
@@ -1,12 +1,16 @@
 package rafted
 
 import (
+    "context"
+    hsm "github.com/hhkbp2/go-hsm"
     ev "github.com/hhkbp2/rafted/event"
+    ps "github.com/hhkbp2/rafted/persist"
 )
 
 type Node interface {
     Client
     Notifiable
+    Subscribable
 }
 
 type RaftNode struct {
@@ -21,12 +25,215 @@ func NewRaftNode(backend *HSMBackend, client *RedirectClient) *RaftNode {
     }
 }
 
+func (self *RaftNode) Backend() *HSMBackend {
+    return self.backend
+}
+
+// Bootstrap forms a new cluster of the servers in conf, which should be
+// a normal config containing this node. It succeeds only on a fresh node
+// which has neither log nor config. It's safe to bootstrap every server
+// of the cluster with the same conf. But bootstrapping servers with
+// different configs leads to separate clusters, each of which ignores
+// the votes from the others.
+func (self *RaftNode) Bootstrap(conf *ps.Config) error {
+    localAddr := self.backend.local.GetLocalAddr()
+    if conf == nil || !conf.IsNormalConfig() ||
+        !conf.Servers.Contains(localAddr) {
+
+        return InvalidConfig
+    }
+    request := &ev.BootstrapRequest{
+        Conf: conf,
+    }
+    reqEvent := ev.NewBootstrapRequestEvent(request)
+    respEvent, err := sendToBackend(
+        context.Background(), self.backend, reqEvent, self.timeout)
+    if err != nil {
+        return err
+    }
+    switch respEvent.Type() {
+    case ev.EventClientResponse:
+        e, ok := respEvent.(*ev.ClientResponseEvent)
+        hsm.AssertTrue(ok)
+        if e.Response.Success {
+            return nil
+        }
+        return NodeNotFresh
+    case ev.EventPersistErrorResponse:
+        return PersistError
+    default:
+        return InvalidResponseType
+    }
+}
+
+// Resume brings this node back to serve after it stops on a persist
+// error, once the persist error is fixed. It fails with PersistError if
+// the log or config still can't be read. Resuming a node not in persist
+// error state is a no-op.
+func (self *RaftNode) Resume() error {
+    reqEvent := ev.NewResumeRequestEvent(&ev.ResumeRequest{})
+    respEvent, err := sendToBackend(
+        context.Background(), self.backend, reqEvent, self.timeout)
+    if err != nil {
+        return err
+    }
+    switch respEvent.Type() {
+    case ev.EventClientResponse:
+        e, ok := respEvent.(*ev.ClientResponseEvent)
+        hsm.AssertTrue(ok)
+        if e.Response.Success {
+            return nil
+        }
+        return InvalidResponseType
+    case ev.EventPersistErrorResponse:
+        return PersistError
+    default:
+        return InvalidResponseType
+    }
+}
+
+// Snapshot takes a snapshot of the state machine of this node, up through
+// the last applied log entry, and returns the id of the snapshot. It fails
+// with Failure if nothing is applied yet.
+func (self *RaftNode) Snapshot() (string, error) {
+    reqEvent := ev.NewSnapshotRequestEvent(&ev.SnapshotRequest{})
+    respEvent, err := sendToBackend(
+        context.Background(), self.backend, reqEvent, self.timeout)
+    if err != nil {
+        return "", err
+    }
+    switch respEvent.Type() {
+    case ev.EventClientResponse:
+        e, ok := respEvent.(*ev.ClientResponseEvent)
+        hsm.AssertTrue(ok)
+        if e.Response.Success {
+            return string(e.Response.Data), nil
+        }
+        return "", Failure
+    case ev.EventPersistErrorResponse:
+        return "", PersistError
+    default:
+        return "", InvalidResponseType
+    }
+}
+
+// Join adds this fresh node to the cluster which member belongs to.
+// The request is redirected to the leader of that cluster, who changes
+// the config to include this node. It returns after the member change
+// completes. Joining an existing member again is a no-op. This node
+// can't bootstrap once it starts to join, even if joining fails, since
+// the leader may have added it to the cluster anyway.
+func (self *RaftNode) Join(member *ps.ServerAddress) error {
+    request := &ev.ClientJoinRequest{
+        Addr: self.backend.local.GetLocalAddr(),
+    }
+    if err := self.startJoin(request); err != nil {
+        return err
+    }
+    reqEvent := ev.NewClientJoinRequestEvent(request)
+    ctx := context.Background()
+    send := func() (ev.Event, error) {
+        return self.client.CallRPCToContext(ctx, member, reqEvent)
+    }
+    _, err := doRequestWith(ctx, send, reqEvent, self.retry,
+        self.redirectRetry, self.genRedirectHandler())
+    return err
+}
+
+// startJoin sends the join request to this node itself first, which
+// checks whether it's fresh in its hsm, so that the check doesn't race
+// with a bootstrap or the log replicated to it.
+func (self *RaftNode) startJoin(request *ev.ClientJoinRequest) error {
+    reqEvent := ev.NewClientJoinRequestEvent(request)
+    respEvent, err := sendToBackend(
+        context.Background(), self.backend, reqEvent, self.timeout)
+    if err != nil {
+        return err
+    }
+    switch respEvent.Type() {
+    case ev.EventClientResponse:
+        e, ok := respEvent.(*ev.ClientResponseEvent)
+        hsm.AssertTrue(ok)
+        if e.Response.Success {
+            return nil
+        }
+        return NodeNotFresh
+    case ev.EventLeaderUnknownResponse:
+        // a candidate is a member of some cluster already
+        return NodeNotFresh
+    case ev.EventPersistErrorResponse:
+        return PersistError
+    case ev.EventOverloadedResponse:
+        return Overloaded
+    default:
+        return InvalidResponseType
+    }
+}
+
+// UpdateAddr tells the cluster which member belongs to that this node
+// moves to its current addresses, e.g. after it restarts on another host
+// with its persisted state. The node is matched by its ID, which should
+// be set. The request is redirected to the leader of that cluster, who
+// replaces the addresses in the config without a member change.
+func (self *RaftNode) UpdateAddr(member *ps.ServerAddress) error {
+    localAddr := self.backend.local.GetLocalAddr()
+    if localAddr.ID == "" {
+        return InvalidConfig
+    }
+    request := &ev.ClientUpdateAddrRequest{
+        Addr: localAddr,
+    }
+    reqEvent := ev.NewClientUpdateAddrRequestEvent(request)
+    ctx := context.Background()
+    send := func() (ev.Event, error) {
+        return self.client.CallRPCToContext(ctx, member, reqEvent)
+    }
+    _, err := doRequestWith(ctx, send, reqEvent, self.retry,
+        self.redirectRetry, self.genRedirectHandler())
+    return err
+}
+
+// GetNotifyChan returns the channel of the default subscription
+// to all notifies of this node. Use Subscribe() instead if there is
+// more than one consumer, since they steal notifies from each other
+// on the same channel.
 func (self *RaftNode) GetNotifyChan() <-chan ev.NotifyEvent {
     return self.backend.GetNotifyChan()
 }
 
+// Subscribe creates an independent subscription to the notifies of types,
+// or all the notifies if no type is specified. It keeps at most capacity
+// notifies not received yet and counts the ones dropped beyond that.
+// A zero capacity means the same as MaxPendingNotifies.
+func (self *RaftNode) Subscribe(
+    capacity int, types ...hsm.EventType) *Subscription {
+
+    return self.backend.Subscribe(capacity, types...)
+}
+
+// Unsubscribe stops the notifies to subscription.
+func (self *RaftNode) Unsubscribe(subscription *Subscription) {
+    self.backend.Unsubscribe(subscription)
+}
+
+// Shutdown closes the node gracefully. It stops accepting client requests,
+// waits for the ones accepted to commit and apply, and hands over the
+// leadership if it's leader, so that the cluster doesn't wait for
+// an election timeout to elect another leader. The node is closed
+// anyway, with ctx.Err() returned if ctx is done before draining finishes.
+func (self *RaftNode) Shutdown(ctx context.Context) error {
+    err := self.backend.Drain(ctx)
+    if e := self.Close(); err == nil {
+        err = e
+    }
+    return err
+}
+
+// Close shuts down the node. The client is closed before the backend,
+// so that the pending asynchronous requests finish first.
 func (self *RaftNode) Close() error {
-    self.backend.Close()
+    self.RedirectClient.Close()
+    err := self.backend.Close()
     self.client.Close()
-    return nil
+    return err
 }
@@ -16,11 +16,17 @@ type Peers interface {
     Broadcast(event hsm.Event)
     AddPeers(peerAddrSlice *ps.ServerAddressSlice)
     RemovePeers(peerAddrSlice *ps.ServerAddressSlice)
+    QueryStatus() []*ev.PeerStatus
+    LastContactTimes() map[string]time.Time
+    ResetLastContactTimes()
+    SendTimeoutNow(target *ps.ServerAddress, request *ev.TimeoutNowRequest)
     io.Closer
 }
 
 type PeerManager struct {
-    peerMap  map[*ps.ServerAddress]Peer
+    // peers keyed by ServerKey() of their addresses, since the same
+    // server may be referred by different address objects
+    peerMap  map[string]Peer
     peerLock sync.RWMutex
 
     config           *Configuration
@@ -38,7 +44,7 @@ func NewPeerManager(
     logger logging.Logger) *PeerManager {
 
     object := &PeerManager{
-        peerMap:          make(map[*ps.ServerAddress]Peer),
+        peerMap:          make(map[string]Peer),
         config:           config,
         client:           client,
         local:            local,
@@ -58,17 +64,32 @@ func (self *PeerManager) Broadcast(event hsm.Event) {
     }
 }
 
+// AddPeers adds the peers not managed yet. The ones whose addresses
+// have changed are replaced by new peers to the new addresses.
 func (self *PeerManager) AddPeers(peerAddrSlice *ps.ServerAddressSlice) {
     self.peerLock.Lock()
     defer self.peerLock.Unlock()
     self.logger.Debug("AddPeers(): %#v", peerAddrSlice)
-    newPeerMap := AddrSliceToMap(peerAddrSlice)
-    peersToAdd := MapSetMinus(newPeerMap, self.peerMap)
+    peersToAdd := make([]*ps.ServerAddress, 0)
+    for _, addr := range peerAddrSlice.Addresses {
+        key := ps.ServerKey(addr)
+        peer, ok := self.peerMap[key]
+        if ok && ps.AddressesEqual(peer.Addr(), addr) {
+            continue
+        }
+        if ok {
+            self.logger.Info("peer %s moves from: %s to: %s",
+                key, peer.Addr().String(), addr.String())
+            peer.Close()
+            delete(self.peerMap, key)
+        }
+        peersToAdd = append(peersToAdd, addr)
+    }
     self.logger.Debug(
         "peers to add: %#v", strings.Join(AddrsString(peersToAdd), " "))
     for _, addr := range peersToAdd {
         logger := self.getLoggerForPeer(addr)
-        self.peerMap[addr] = NewPeerMan(
+        self.peerMap[ps.ServerKey(addr)] = NewPeerMan(
             self.config,
             addr,
             self.client,
@@ -81,17 +102,84 @@ func (self *PeerManager) RemovePeers(peerAddrSlice *ps.ServerAddressSlice) {
     self.peerLock.Lock()
     defer self.peerLock.Unlock()
     self.logger.Debug("RemovePeers(): %#v", peerAddrSlice)
-    newPeerMap := AddrSliceToMap(peerAddrSlice)
-    peersToRemove := MapSetMinus(self.peerMap, newPeerMap)
+    toKeep := make(map[string]bool)
+    for _, addr := range peerAddrSlice.Addresses {
+        toKeep[ps.ServerKey(addr)] = true
+    }
+    peersToRemove := make([]string, 0)
+    for key, _ := range self.peerMap {
+        if !toKeep[key] {
+            peersToRemove = append(peersToRemove, key)
+        }
+    }
     self.logger.Debug(
-        "peers to remove: %#v", strings.Join(AddrsString(peersToRemove), " "))
-    for _, addr := range peersToRemove {
-        peer, _ := self.peerMap[addr]
-        peer.Close()
-        delete(self.peerMap, addr)
+        "peers to remove: %#v", strings.Join(peersToRemove, " "))
+    for _, key := range peersToRemove {
+        self.peerMap[key].Close()
+        delete(self.peerMap, key)
+    }
+}
+
+func (self *PeerManager) QueryStatus() []*ev.PeerStatus {
+    self.peerLock.RLock()
+    defer self.peerLock.RUnlock()
+    result := make([]*ev.PeerStatus, 0, len(self.peerMap))
+    for _, peer := range self.peerMap {
+        result = append(result, peer.QueryStatus())
+    }
+    return result
+}
+
+// LastContactTimes returns the last time the leader has contact from
+// every peer, keyed by ServerKey() of their addresses. It doesn't
+// wait for the peer hsms, which may be busy on rpc.
+func (self *PeerManager) LastContactTimes() map[string]time.Time {
+    self.peerLock.RLock()
+    defer self.peerLock.RUnlock()
+    result := make(map[string]time.Time, len(self.peerMap))
+    for key, peer := range self.peerMap {
+        result[key] = peer.LastContactTime()
+    }
+    return result
+}
+
+// ResetLastContactTimes counts every peer as contacted right now, so that
+// the contact times of a former term don't carry over to a new leader.
+func (self *PeerManager) ResetLastContactTimes() {
+    self.peerLock.RLock()
+    defer self.peerLock.RUnlock()
+    for _, peer := range self.peerMap {
+        peer.ResetLastContactTime()
     }
 }
 
+// SendTimeoutNow asks target to start an election right away, which is
+// used to transfer the leadership. It doesn't wait for the response,
+// since the leadership transfer is observed by the new term anyway.
+func (self *PeerManager) SendTimeoutNow(
+    target *ps.ServerAddress, request *ev.TimeoutNowRequest) {
+
+    go func() {
+        event, err := self.client.CallRPCTo(
+            target, ev.NewTimeoutNowRequestEvent(request))
+        if err != nil {
+            self.logger.Warning("fail to send TimeoutNowRequest to: %s, "+
+                "error: %s", target.String(), err)
+            return
+        }
+        e, ok := event.(*ev.TimeoutNowResponseEvent)
+        if !ok {
+            self.logger.Warning("receive invalid response: %s for "+
+                "TimeoutNowRequest", ev.EventString(event))
+            return
+        }
+        if !e.Response.Success {
+            self.logger.Warning("TimeoutNowRequest refused by: %s, term: %d",
+                target.String(), e.Response.Term)
+        }
+    }()
+}
+
 func (self *PeerManager) Close() error {
     self.peerLock.Lock()
     defer self.peerLock.Unlock()
@@ -105,15 +193,20 @@ func (self *PeerManager) Close() error {
 }
 
 type Peer interface {
+    Addr() *ps.ServerAddress
     Send(Event hsm.Event)
     SendPrior(event hsm.Event)
     Close()
 
     QueryState() string
+    QueryStatus() *ev.PeerStatus
+    LastContactTime() time.Time
+    ResetLastContactTime()
 }
 
 type PeerMan struct {
-    peerHSM *PeerHSM
+    peerHSM         *PeerHSM
+    leaderPeerState *LeaderPeerState
 }
 
 func NewPeerMan(
@@ -133,6 +226,8 @@ func NewPeerMan(
         activatedPeerState,
         config.HeartbeatTimeout,
         config.MaxTimeoutJitter,
+        config.Clock.Fork(addr.String()),
+        config.Random.Fork(addr.String()),
         logger)
     NewStandardModePeerState(leaderPeerState, config.MaxAppendEntriesSize, logger)
     NewSnapshotModePeerState(leaderPeerState, config.MaxSnapshotChunkSize, logger)
@@ -141,7 +236,14 @@ func NewPeerMan(
     hsm.NewTerminal(top)
     peerHSM := NewPeerHSM(top, initial, addr, client, local)
     peerHSM.Init()
-    return &PeerMan{peerHSM}
+    return &PeerMan{
+        peerHSM:         peerHSM,
+        leaderPeerState: leaderPeerState,
+    }
+}
+
+func (self *PeerMan) Addr() *ps.ServerAddress {
+    return self.peerHSM.Addr()
 }
 
 func (self *PeerMan) Send(event hsm.Event) {
@@ -166,6 +268,28 @@ func (self *PeerMan) QueryState() string {
     return event.Response.StateID
 }
 
+func (self *PeerMan) QueryStatus() *ev.PeerStatus {
+    // the index info and last contact time are only meaningful
+    // when peer is in leader peer state
+    stateID := self.QueryState()
+    matchIndex, nextIndex := self.leaderPeerState.GetIndexInfo()
+    return &ev.PeerStatus{
+        Addr:            self.peerHSM.Addr(),
+        StateID:         stateID,
+        MatchIndex:      matchIndex,
+        NextIndex:       nextIndex,
+        LastContactTime: self.leaderPeerState.LastContactTime(),
+    }
+}
+
+func (self *PeerMan) LastContactTime() time.Time {
+    return self.leaderPeerState.LastContactTime()
+}
+
+func (self *PeerMan) ResetLastContactTime() {
+    self.leaderPeerState.UpdateLastContactTime()
+}
+
 type PeerHSM struct {
     *hsm.StdHSM
     dispatchChan     *ReliableEventChannel
@@ -4,6 +4,7 @@ import (
     "fmt"
     hsm "github.com/hhkbp2/go-hsm"
     cm "github.com/hhkbp2/rafted/comm"
+    ev "github.com/hhkbp2/rafted/event"
     logging "github.com/hhkbp2/rafted/logging"
     ps "github.com/hhkbp2/rafted/persist"
     "github.com/hhkbp2/testify/assert"
@@ -58,6 +59,12 @@ func (self *MockLocal) QueryState() string {
     return args.String(0)
 }
 
+func (self *MockLocal) QueryStatus() *ev.QueryNodeStatusResponse {
+    args := self.Mock.Called()
+    result, _ := args.Get(0).(*ev.QueryNodeStatusResponse)
+    return result
+}
+
 func (self *MockLocal) GetCurrentTerm() uint64 {
     args := self.Mock.Called()
     return args.Uint64(0)
@@ -181,3 +188,37 @@ func getTestPeerAndLocalSafe(t *testing.T) (Peer, *MockLocal) {
     assert.Nil(t, err)
     return peer, local
 }
+
+func TestPeerManagerAddressCopy(t *testing.T) {
+    conf := &ps.Config{
+        Servers:    testServers,
+        NewServers: nil,
+    }
+    configManager := ps.NewMemoryConfigManager(testIndex, conf)
+    local := NewMockLocal(ps.NewMemoryLog(), ps.NewMemoryStateMachine(),
+        configManager, NewNotifier())
+    local.On("SetPeers", mock.Anything).Return()
+    client := cm.NewMemoryClient(
+        testConfig.CommPoolSize, testConfig.CommClientTimeout, testRegister)
+    getLoggerForPeer := func(addr ps.MultiAddr) logging.Logger {
+        return logging.GetLogger("test peer #" + addr.String())
+    }
+    peers := NewPeerManager(testConfig, client, local, getLoggerForPeer,
+        logging.GetLogger("test peer manager"))
+    defer peers.Close()
+    peerAddrs := testServers.Addresses[1:]
+    peers.AddPeers(&ps.ServerAddressSlice{Addresses: peerAddrs})
+    assert.Equal(t, len(peerAddrs), len(peers.LastContactTimes()))
+    // the same servers referred by other objects are managed already
+    copies := make([]*ps.ServerAddress, 0, len(peerAddrs))
+    for _, addr := range peerAddrs {
+        copies = append(copies, copyServerAddress(addr))
+    }
+    peers.AddPeers(&ps.ServerAddressSlice{Addresses: copies})
+    assert.Equal(t, len(peerAddrs), len(peers.LastContactTimes()))
+    peers.RemovePeers(&ps.ServerAddressSlice{Addresses: copies[1:]})
+    contactTimes := peers.LastContactTimes()
+    assert.Equal(t, len(peerAddrs)-1, len(contactTimes))
+    _, ok := contactTimes[ps.ServerKey(peerAddrs[0])]
+    assert.False(t, ok)
+}
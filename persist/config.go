@@ -1,5 +1,13 @@
 package persist
 
+import (
+    "errors"
+)
+
+var (
+    ErrorNoConfig error = errors.New("No config")
+)
+
 // ConfigMeta is metadata for a Config.
 type ConfigMeta struct {
     // the index of log entry at which this config starts to take effect.
@@ -13,6 +21,8 @@ type ConfigMeta struct {
 
 // ConfigManager is the interface for durable config management.
 // It provides functions to store and restrieve config.
+// A config manager for a node which is not bootstrapped or joined yet
+// holds no config, and returns ErrorNoConfig on RNth() and ListAfter().
 type ConfigManager interface {
     // Store a new config at the log entry with specified index
     Push(logIndex uint64, conf *Config) error
@@ -0,0 +1,244 @@
+package persist
+
+import (
+    "errors"
+    "sync"
+)
+
+var (
+    ErrorLogFault error = errors.New("Log fault injected")
+)
+
+// FaultLog wraps a Log to inject persist errors, e.g. to simulate
+// a disk failure and its repair. Every operation fails with the injected
+// error between Fail() and Heal(), and goes to the wrapped log otherwise.
+// Only the writes fail between FailWrites() and Heal(), e.g. to simulate
+// a disk which is still readable.
+// Storing log entries could also be held between Block() and Unblock(),
+// e.g. to simulate a slow disk.
+type FaultLog struct {
+    log       Log
+    err       error
+    writeErr  error
+    gate      chan interface{}
+    faultLock sync.RWMutex
+}
+
+func NewFaultLog(log Log) *FaultLog {
+    return &FaultLog{
+        log: log,
+    }
+}
+
+// Fail makes all the following operations fail with err, or
+// ErrorLogFault if err is nil.
+func (self *FaultLog) Fail(err error) {
+    if err == nil {
+        err = ErrorLogFault
+    }
+    self.faultLock.Lock()
+    defer self.faultLock.Unlock()
+    self.err = err
+}
+
+// FailWrites makes all the following writes fail with err, or
+// ErrorLogFault if err is nil, while reads go on, even if they're failed
+// by Fail() before.
+func (self *FaultLog) FailWrites(err error) {
+    if err == nil {
+        err = ErrorLogFault
+    }
+    self.faultLock.Lock()
+    defer self.faultLock.Unlock()
+    self.err = nil
+    self.writeErr = err
+}
+
+// Heal stops injecting errors.
+func (self *FaultLog) Heal() {
+    self.faultLock.Lock()
+    defer self.faultLock.Unlock()
+    self.err = nil
+    self.writeErr = nil
+}
+
+// Block holds storing log entries until Unblock() is called.
+func (self *FaultLog) Block() {
+    self.faultLock.Lock()
+    defer self.faultLock.Unlock()
+    if self.gate == nil {
+        self.gate = make(chan interface{})
+    }
+}
+
+// Unblock releases the held and following stores of log entries.
+func (self *FaultLog) Unblock() {
+    self.faultLock.Lock()
+    defer self.faultLock.Unlock()
+    if self.gate != nil {
+        close(self.gate)
+        self.gate = nil
+    }
+}
+
+func (self *FaultLog) wait() {
+    self.faultLock.RLock()
+    gate := self.gate
+    self.faultLock.RUnlock()
+    if gate != nil {
+        <-gate
+    }
+}
+
+func (self *FaultLog) fault() error {
+    self.faultLock.RLock()
+    defer self.faultLock.RUnlock()
+    return self.err
+}
+
+func (self *FaultLog) writeFault() error {
+    self.faultLock.RLock()
+    defer self.faultLock.RUnlock()
+    if self.err != nil {
+        return self.err
+    }
+    return self.writeErr
+}
+
+func (self *FaultLog) FirstTerm() (uint64, error) {
+    if err := self.fault(); err != nil {
+        return 0, err
+    }
+    return self.log.FirstTerm()
+}
+
+func (self *FaultLog) FirstIndex() (uint64, error) {
+    if err := self.fault(); err != nil {
+        return 0, err
+    }
+    return self.log.FirstIndex()
+}
+
+func (self *FaultLog) FirstEntryInfo() (uint64, uint64, error) {
+    if err := self.fault(); err != nil {
+        return 0, 0, err
+    }
+    return self.log.FirstEntryInfo()
+}
+
+func (self *FaultLog) LastTerm() (uint64, error) {
+    if err := self.fault(); err != nil {
+        return 0, err
+    }
+    return self.log.LastTerm()
+}
+
+func (self *FaultLog) LastIndex() (uint64, error) {
+    if err := self.fault(); err != nil {
+        return 0, err
+    }
+    return self.log.LastIndex()
+}
+
+func (self *FaultLog) LastEntryInfo() (uint64, uint64, error) {
+    if err := self.fault(); err != nil {
+        return 0, 0, err
+    }
+    return self.log.LastEntryInfo()
+}
+
+func (self *FaultLog) CommittedIndex() (uint64, error) {
+    if err := self.fault(); err != nil {
+        return 0, err
+    }
+    return self.log.CommittedIndex()
+}
+
+func (self *FaultLog) StoreCommittedIndex(index uint64) error {
+    if err := self.writeFault(); err != nil {
+        return err
+    }
+    return self.log.StoreCommittedIndex(index)
+}
+
+func (self *FaultLog) LastAppliedIndex() (uint64, error) {
+    if err := self.fault(); err != nil {
+        return 0, err
+    }
+    return self.log.LastAppliedIndex()
+}
+
+func (self *FaultLog) StoreLastAppliedIndex(index uint64) error {
+    if err := self.writeFault(); err != nil {
+        return err
+    }
+    return self.log.StoreLastAppliedIndex(index)
+}
+
+func (self *FaultLog) GetLog(index uint64) (*LogEntry, error) {
+    if err := self.fault(); err != nil {
+        return nil, err
+    }
+    return self.log.GetLog(index)
+}
+
+func (self *FaultLog) GetLogInRange(
+    fromIndex uint64, toIndex uint64) ([]*LogEntry, error) {
+
+    if err := self.fault(); err != nil {
+        return nil, err
+    }
+    return self.log.GetLogInRange(fromIndex, toIndex)
+}
+
+func (self *FaultLog) StoreLog(log *LogEntry) error {
+    self.wait()
+    if err := self.writeFault(); err != nil {
+        return err
+    }
+    return self.log.StoreLog(log)
+}
+
+func (self *FaultLog) StoreLogs(logs []*LogEntry) error {
+    self.wait()
+    if err := self.writeFault(); err != nil {
+        return err
+    }
+    return self.log.StoreLogs(logs)
+}
+
+func (self *FaultLog) TruncateBefore(index uint64) error {
+    if err := self.writeFault(); err != nil {
+        return err
+    }
+    return self.log.TruncateBefore(index)
+}
+
+func (self *FaultLog) TruncateAfter(index uint64) error {
+    if err := self.writeFault(); err != nil {
+        return err
+    }
+    return self.log.TruncateAfter(index)
+}
+
+// Sync flushes the wrapped log if it implements Syncer.
+func (self *FaultLog) Sync() error {
+    if err := self.writeFault(); err != nil {
+        return err
+    }
+    if syncer, ok := self.log.(Syncer); ok {
+        return syncer.Sync()
+    }
+    return nil
+}
+
+// Probe checks the wrapped log could be written if it implements Prober.
+func (self *FaultLog) Probe() error {
+    if err := self.writeFault(); err != nil {
+        return err
+    }
+    if prober, ok := self.log.(Prober); ok {
+        return prober.Probe()
+    }
+    return nil
+}
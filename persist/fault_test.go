@@ -0,0 +1,100 @@
+package persist
+
+import (
+    "errors"
+    "github.com/hhkbp2/testify/assert"
+    "testing"
+    "time"
+)
+
+func TestFaultLog(t *testing.T) {
+    log := NewFaultLog(NewMemoryLog())
+    entry := getTestLogEntry(1, 1)
+    assert.Nil(t, log.StoreLog(entry))
+    checkLastEntryInfo(t, log, 1, 1)
+    // every operation fails with the injected error
+    log.Fail(nil)
+    _, err := log.LastIndex()
+    assert.Equal(t, ErrorLogFault, err)
+    _, err = log.GetLog(1)
+    assert.Equal(t, ErrorLogFault, err)
+    assert.Equal(t, ErrorLogFault, log.StoreLog(getTestLogEntry(1, 2)))
+    diskError := errors.New("disk error")
+    log.Fail(diskError)
+    _, _, err = log.LastEntryInfo()
+    assert.Equal(t, diskError, err)
+    // the wrapped log is untouched by the failed operations
+    log.Heal()
+    checkLastEntryInfo(t, log, 1, 1)
+    result, err := log.GetLog(1)
+    assert.Nil(t, err)
+    assert.Equal(t, entry, result)
+}
+
+func TestFaultLogFailWrites(t *testing.T) {
+    log := NewFaultLog(NewMemoryLog())
+    entry := getTestLogEntry(1, 1)
+    assert.Nil(t, log.StoreLog(entry))
+    log.FailWrites(nil)
+    // reads go on while writes fail
+    checkLastEntryInfo(t, log, 1, 1)
+    result, err := log.GetLog(1)
+    assert.Nil(t, err)
+    assert.Equal(t, entry, result)
+    assert.Equal(t, ErrorLogFault, log.StoreLog(getTestLogEntry(1, 2)))
+    assert.Equal(t, ErrorLogFault, log.StoreCommittedIndex(1))
+    assert.Equal(t, ErrorLogFault, log.TruncateAfter(1))
+    assert.Equal(t, ErrorLogFault, log.Sync())
+    var prober Prober = log
+    assert.Equal(t, ErrorLogFault, prober.Probe())
+    log.Heal()
+    assert.Nil(t, log.Probe())
+    assert.Nil(t, log.StoreLog(getTestLogEntry(1, 2)))
+    checkLastEntryInfo(t, log, 1, 2)
+}
+
+func TestFaultLogBlock(t *testing.T) {
+    log := NewFaultLog(NewMemoryLog())
+    log.Block()
+    done := make(chan error, 1)
+    go func() {
+        done <- log.StoreLog(getTestLogEntry(1, 1))
+    }()
+    // storing is held while reading goes on
+    select {
+    case <-done:
+        assert.Fail(t, "store log not blocked")
+    case <-time.After(time.Millisecond * 10):
+    }
+    index, err := log.LastIndex()
+    assert.Nil(t, err)
+    assert.Equal(t, uint64(0), index)
+    log.Unblock()
+    assert.Nil(t, <-done)
+    checkLastEntryInfo(t, log, 1, 1)
+}
+
+type syncCountLog struct {
+    Log
+    syncs int
+}
+
+func (self *syncCountLog) Sync() error {
+    self.syncs++
+    return nil
+}
+
+func TestFaultLogSync(t *testing.T) {
+    inner := &syncCountLog{Log: NewMemoryLog()}
+    log := NewFaultLog(inner)
+    var syncer Syncer = log
+    assert.Nil(t, syncer.Sync())
+    assert.Equal(t, 1, inner.syncs)
+    // the injected error fails sync without flushing the wrapped log
+    log.Fail(nil)
+    assert.Equal(t, ErrorLogFault, log.Sync())
+    assert.Equal(t, 1, inner.syncs)
+    log.Heal()
+    // a wrapped log without Sync() is left alone
+    assert.Nil(t, NewFaultLog(NewMemoryLog()).Sync())
+}
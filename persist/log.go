@@ -23,6 +23,10 @@ const (
     // LogBarrier is used to ensure all preceeding operations have heen
     // applied to the FSM. A loan from hashicorp-raft.
     LogBarrier
+
+    // LogAddrUpdate is used to update the addresses of a member, which
+    // changes no membership and takes effect without member change.
+    LogAddrUpdate
 )
 
 // Config represents the membership of the cluster.
@@ -39,8 +43,16 @@ type Config struct {
     //     all the new members of the cluster.
     Servers    *ServerAddressSlice
     NewServers *ServerAddressSlice
+    // The election priorities of members, keyed by ServerKey() of
+    // their addresses. The members with higher priority are preferred
+    // to be leader. The ones not listed have DefaultPriority.
+    Priorities map[string]uint32
 }
 
+const (
+    DefaultPriority uint32 = 0
+)
+
 func (self *Config) IsInMemeberChange() bool {
     return (self.NewServers != nil)
 }
@@ -57,7 +69,108 @@ func (self *Config) IsNewConfig() bool {
     return (self.Servers == nil) && (self.NewServers != nil)
 }
 
+// Priority returns the election priority of addr.
+func (self *Config) Priority(addr MultiAddr) uint32 {
+    if priority, ok := self.Priorities[ServerKey(addr)]; ok {
+        return priority
+    }
+    return DefaultPriority
+}
+
+// PriorityRank returns how many different priorities of the members
+// are higher than the one of addr, 0 for a member of the highest priority.
+func (self *Config) PriorityRank(addr MultiAddr) int {
+    priority := self.Priority(addr)
+    higher := make(map[uint32]bool)
+    for _, servers := range []*ServerAddressSlice{
+        self.Servers, self.NewServers} {
+
+        if servers == nil {
+            continue
+        }
+        for _, server := range servers.Addresses {
+            if p := self.Priority(server); p > priority {
+                higher[p] = true
+            }
+        }
+    }
+    return len(higher)
+}
+
+// UpdateAddr returns a copy of this normal config, in which the member
+// with the same ID as addr has the addresses of addr. It returns false
+// if there is no such member.
+func (self *Config) UpdateAddr(addr *ServerAddress) (*Config, bool) {
+    if !self.IsNormalConfig() || (addr.ID == "") {
+        return nil, false
+    }
+    addresses := make([]*ServerAddress, 0, self.Servers.Len())
+    found := false
+    for _, server := range self.Servers.Addresses {
+        if server.ID == addr.ID {
+            server = addr
+            found = true
+        }
+        addresses = append(addresses, server)
+    }
+    if !found {
+        return nil, false
+    }
+    conf := &Config{
+        Servers: &ServerAddressSlice{
+            Addresses: addresses,
+        },
+        NewServers: nil,
+        Priorities: self.Priorities,
+    }
+    return conf, true
+}
+
+func PrioritiesEqual(
+    priorities1 map[string]uint32, priorities2 map[string]uint32) bool {
+
+    get := func(priorities map[string]uint32, key string) uint32 {
+        if priority, ok := priorities[key]; ok {
+            return priority
+        }
+        return DefaultPriority
+    }
+    for key, priority := range priorities1 {
+        if get(priorities2, key) != priority {
+            return false
+        }
+    }
+    for key, priority := range priorities2 {
+        if get(priorities1, key) != priority {
+            return false
+        }
+    }
+    return true
+}
+
+// sameAddresses returns whether the servers paired up in slice1 and slice2
+// have the same addresses. The members are compared in MultiAddrSliceEqual.
+func sameAddresses(slice1 *ServerAddressSlice, slice2 *ServerAddressSlice) bool {
+    if (Len(slice1) == 0) || (Len(slice1) != Len(slice2)) {
+        return true
+    }
+    for i, addr := range slice1.Addresses {
+        if !AddressesEqual(addr, slice2.Addresses[i]) {
+            return false
+        }
+    }
+    return true
+}
+
 func ConfigEqual(conf1 *Config, conf2 *Config) bool {
+    if !PrioritiesEqual(conf1.Priorities, conf2.Priorities) {
+        return false
+    }
+    // the configs before and after an address update have the same members
+    if !sameAddresses(conf1.Servers, conf2.Servers) ||
+        !sameAddresses(conf1.NewServers, conf2.NewServers) {
+        return false
+    }
     if (conf1.Servers == nil) && (conf2.Servers == nil) {
         if (conf1.NewServers == nil) && (conf2.NewServers == nil) {
             return true
@@ -90,7 +203,19 @@ func ConfigCopy(conf *Config) *Config {
         NewServers: &ServerAddressSlice{
             Addresses: conf.NewServers.Addresses[:],
         },
+        Priorities: PrioritiesCopy(conf.Priorities),
+    }
+}
+
+func PrioritiesCopy(priorities map[string]uint32) map[string]uint32 {
+    if priorities == nil {
+        return nil
+    }
+    result := make(map[string]uint32, len(priorities))
+    for key, priority := range priorities {
+        result[key] = priority
     }
+    return result
 }
 
 // LogEntry is the element of replicated log in raft.
@@ -162,3 +287,19 @@ type Log interface {
     // including the log entry right at index.
     TruncateAfter(index uint64) error
 }
+
+// Syncer could be implemented by the Log and ConfigManager which buffer
+// writes, to flush them to durable storage before the node shuts down.
+// The memory stores in this package don't buffer and don't implement it,
+// FaultLog forwards it to the wrapped log.
+type Syncer interface {
+    Sync() error
+}
+
+// Prober could be implemented by the Log and ConfigManager to check whether
+// they could be written, without changing what's stored, e.g. by writing
+// a scratch record. It tells a disk failing writes from a healthy one,
+// where reading alone passes on both.
+type Prober interface {
+    Probe() error
+}
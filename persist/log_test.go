@@ -0,0 +1,87 @@
+package persist
+
+import (
+    "github.com/hhkbp2/testify/assert"
+    "github.com/hhkbp2/testify/require"
+    "testing"
+)
+
+func TestConfigPriority(t *testing.T) {
+    servers := RandomMemoryMultiAddrSlice(4)
+    addrs := servers.Addresses
+    conf := &Config{
+        Servers:    servers,
+        NewServers: nil,
+        Priorities: map[string]uint32{
+            addrs[0].String(): 2,
+            addrs[1].String(): 2,
+            addrs[2].String(): 1,
+        },
+    }
+    assert.Equal(t, uint32(2), conf.Priority(addrs[0]))
+    assert.Equal(t, DefaultPriority, conf.Priority(addrs[3]))
+    assert.Equal(t, 0, conf.PriorityRank(addrs[0]))
+    assert.Equal(t, 0, conf.PriorityRank(addrs[1]))
+    assert.Equal(t, 1, conf.PriorityRank(addrs[2]))
+    assert.Equal(t, 2, conf.PriorityRank(addrs[3]))
+    // no priority at all ranks every member the highest
+    plain := &Config{
+        Servers:    servers,
+        NewServers: nil,
+    }
+    for _, addr := range addrs {
+        assert.Equal(t, 0, plain.PriorityRank(addr))
+    }
+}
+
+func TestConfigEqualWithPriorities(t *testing.T) {
+    servers := RandomMemoryMultiAddrSlice(3)
+    addr := servers.Addresses[0]
+    conf1 := &Config{
+        Servers:    servers,
+        NewServers: nil,
+    }
+    conf2 := &Config{
+        Servers:    servers,
+        NewServers: nil,
+        Priorities: map[string]uint32{
+            addr.String(): DefaultPriority,
+        },
+    }
+    assert.True(t, ConfigEqual(conf1, conf2))
+    conf2.Priorities[addr.String()] = 1
+    assert.False(t, ConfigEqual(conf1, conf2))
+    assert.False(t, ConfigEqual(conf2, conf1))
+}
+
+func TestConfigUpdateAddr(t *testing.T) {
+    servers := SetupMemoryMultiAddrSlice(3)
+    for i, addr := range servers.Addresses {
+        addr.ID = string('a' + byte(i))
+    }
+    conf := &Config{
+        Servers:    servers,
+        NewServers: nil,
+        Priorities: map[string]uint32{
+            "b": 1,
+        },
+    }
+    moved := RandomMemoryMultiAddr()
+    moved.ID = "b"
+    newConf, ok := conf.UpdateAddr(moved)
+    require.True(t, ok)
+    assert.True(t, newConf.IsNormalConfig())
+    assert.True(t, MultiAddrSliceEqual(conf.Servers, newConf.Servers))
+    assert.True(t, AddressesEqual(moved, newConf.Servers.Addresses[1]))
+    assert.Equal(t, uint32(1), newConf.Priority(moved))
+    // the configs differ in addresses only
+    assert.False(t, ConfigEqual(conf, newConf))
+    // the original config stays unchanged
+    assert.False(t, AddressesEqual(moved, conf.Servers.Addresses[1]))
+    unknown := RandomMemoryMultiAddr()
+    unknown.ID = "d"
+    _, ok = conf.UpdateAddr(unknown)
+    assert.False(t, ok)
+    _, ok = conf.UpdateAddr(RandomMemoryMultiAddr())
+    assert.False(t, ok)
+}
@@ -468,16 +468,20 @@ type MemoryConfigManager struct {
     lock    sync.RWMutex
 }
 
+// NewMemoryConfigManager creates a config manager with conf taking
+// effect from firstLogIndex. It holds no config if conf is nil.
 func NewMemoryConfigManager(
     firstLogIndex uint64, conf *Config) *MemoryConfigManager {
 
     lst := list.New()
-    meta := &ConfigMeta{
-        FromLogIndex: firstLogIndex,
-        ToLogIndex:   0,
-        Conf:         conf,
+    if conf != nil {
+        meta := &ConfigMeta{
+            FromLogIndex: firstLogIndex,
+            ToLogIndex:   0,
+            Conf:         conf,
+        }
+        lst.PushBack(meta)
     }
-    lst.PushBack(meta)
     return &MemoryConfigManager{
         configs: lst,
     }
@@ -486,9 +490,10 @@ func NewMemoryConfigManager(
 func (self *MemoryConfigManager) Push(logIndex uint64, conf *Config) error {
     self.lock.Lock()
     defer self.lock.Unlock()
-    elem := self.configs.Back()
-    meta, _ := elem.Value.(*ConfigMeta)
-    meta.ToLogIndex = logIndex - 1
+    if elem := self.configs.Back(); elem != nil {
+        meta, _ := elem.Value.(*ConfigMeta)
+        meta.ToLogIndex = logIndex - 1
+    }
 
     newMeta := &ConfigMeta{
         FromLogIndex: logIndex,
@@ -502,6 +507,9 @@ func (self *MemoryConfigManager) Push(logIndex uint64, conf *Config) error {
 func (self *MemoryConfigManager) RNth(n uint32) (*Config, error) {
     self.lock.RLock()
     defer self.lock.RUnlock()
+    if self.configs.Len() == 0 {
+        return nil, ErrorNoConfig
+    }
     elem := self.configs.Back()
     for i := uint32(0); (i < n) && (elem != nil); i++ {
         elem = elem.Prev()
@@ -531,6 +539,9 @@ func (self *MemoryConfigManager) PreviousOf(
 func (self *MemoryConfigManager) ListAfter(logIndex uint64) ([]*ConfigMeta, error) {
     self.lock.RLock()
     defer self.lock.RUnlock()
+    if self.configs.Len() == 0 {
+        return nil, ErrorNoConfig
+    }
     e := self.configs.Back()
     found := false
     count := 0
@@ -599,6 +610,8 @@ func (self *MemoryConfigManager) TruncateAfter(
                 prev := e.Prev()
                 meta, _ := prev.Value.(*ConfigMeta)
                 ListTruncate(self.configs, e)
+                // the previous one is the latest now
+                meta.ToLogIndex = 0
                 return meta.Conf, nil
             }
         } else {
@@ -256,3 +256,49 @@ func TestMemoryConfigManager(t *testing.T) {
     metas, err = manager.ListAfter(firstIndex)
     assert.NotNil(t, err)
 }
+
+func TestMemoryConfigManagerNoConfig(t *testing.T) {
+    firstIndex := uint64(1)
+    manager := NewMemoryConfigManager(firstIndex, nil)
+    _, err := manager.RNth(0)
+    assert.Equal(t, ErrorNoConfig, err)
+    _, err = manager.ListAfter(firstIndex)
+    assert.Equal(t, ErrorNoConfig, err)
+    // the first config pushed takes effect from the specified index
+    conf := &Config{
+        Servers:    SetupMemoryMultiAddrSlice(3),
+        NewServers: nil,
+    }
+    assert.Nil(t, manager.Push(firstIndex, conf))
+    c, err := manager.RNth(0)
+    assert.Nil(t, err)
+    assert.Equal(t, conf, c)
+    metas, err := manager.ListAfter(firstIndex)
+    assert.Nil(t, err)
+    assert.Equal(t, 1, len(metas))
+    assert.Equal(t, firstIndex, metas[0].FromLogIndex)
+}
+
+func TestMemoryConfigManagerTruncateAfterLatest(t *testing.T) {
+    firstIndex := uint64(1)
+    servers := SetupMemoryMultiAddrSlice(3)
+    conf := &Config{
+        Servers:    servers,
+        NewServers: nil,
+    }
+    manager := NewMemoryConfigManager(firstIndex, conf)
+    nextIndex := uint64(10)
+    conf2 := &Config{
+        Servers:    servers,
+        NewServers: SetupMemoryMultiAddrSlice(4),
+    }
+    assert.Nil(t, manager.Push(nextIndex, conf2))
+    c, err := manager.TruncateAfter(nextIndex)
+    assert.Nil(t, err)
+    assert.Equal(t, conf, c)
+    // the remaining config covers all the indexes after it again
+    metas, err := manager.ListAfter(nextIndex + 1)
+    assert.Nil(t, err)
+    assert.Equal(t, 1, len(metas))
+    assert.Equal(t, conf, metas[0].Conf)
+}
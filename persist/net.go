@@ -7,6 +7,7 @@ import (
     "math/rand"
     "net"
     "reflect"
+    "strconv"
     "strings"
     "time"
 )
@@ -17,6 +18,7 @@ var (
 
 var (
     MultiAddrStringSeperator string = ","
+    ServerAddressIDSeperator string = "@"
 )
 
 var (
@@ -72,6 +74,7 @@ func AddrNotEqual(addr1 Addr, addr2 Addr) bool {
 }
 
 type MultiAddr interface {
+    GetID() string
     AllAddr() []Addr
     Len() int
     String() string
@@ -86,10 +89,18 @@ func FirstAddr(multiAddr MultiAddr) (Addr, error) {
 }
 
 // ServerAddress represents the network address of any node in the cluster.
+// A server is identified by its ID, which stays the same when its addresses
+// change. The servers without ID, e.g. the ones set up before IDs are
+// introduced, are identified by their addresses instead.
 type ServerAddress struct {
+    ID        string
     Addresses []*Address
 }
 
+func (self *ServerAddress) GetID() string {
+    return self.ID
+}
+
 func (self *ServerAddress) AllAddr() []Addr {
     length := len(self.Addresses)
     result := make([]Addr, 0, length)
@@ -112,12 +123,90 @@ func (self *ServerAddress) String() string {
     return strings.Join(addrsInString, MultiAddrStringSeperator)
 }
 
+// ParseServerAddress parses an address in the form of host:port, or
+// id@host:port to give the server an ID.
+func ParseServerAddress(s string) (*ServerAddress, error) {
+    id := ""
+    hostPort := s
+    if i := strings.Index(s, ServerAddressIDSeperator); i >= 0 {
+        id = s[:i]
+        hostPort = s[i+len(ServerAddressIDSeperator):]
+        if id == "" {
+            return nil, errors.New(fmt.Sprintf("empty id in: %s", s))
+        }
+    }
+    host, portString, err := net.SplitHostPort(hostPort)
+    if err != nil {
+        return nil, err
+    }
+    port, err := strconv.ParseUint(portString, 10, 16)
+    if err != nil {
+        return nil, errors.New(fmt.Sprintf("invalid port in: %s", s))
+    }
+    return &ServerAddress{
+        ID: id,
+        Addresses: []*Address{
+            &Address{
+                Protocol: "tcp",
+                IP:       host,
+                Port:     uint16(port),
+            },
+        },
+    }, nil
+}
+
+// FormatServerAddress returns addr in the form ParseServerAddress parses,
+// with its ID if any.
+func FormatServerAddress(addr *ServerAddress) string {
+    if addr.ID == "" {
+        return addr.String()
+    }
+    return addr.ID + ServerAddressIDSeperator + addr.String()
+}
+
+// ParseServerAddresses parses a comma separated list of addresses.
+func ParseServerAddresses(s string) ([]*ServerAddress, error) {
+    addrs := make([]*ServerAddress, 0)
+    for _, part := range strings.Split(s, ",") {
+        part = strings.TrimSpace(part)
+        if part == "" {
+            continue
+        }
+        addr, err := ParseServerAddress(part)
+        if err != nil {
+            return nil, err
+        }
+        addrs = append(addrs, addr)
+    }
+    return addrs, nil
+}
+
+// ServerKey returns the string to identify the server at addr, which is
+// its ID if any, or the string form of its addresses otherwise.
+func ServerKey(addr MultiAddr) string {
+    if id := addr.GetID(); id != "" {
+        return id
+    }
+    return addr.String()
+}
+
+// MultiAddrEqual returns whether addr1 and addr2 refer to the same server.
+// They are compared by IDs if both have, or by addresses otherwise.
 func MultiAddrEqual(addr1 MultiAddr, addr2 MultiAddr) bool {
     if IsNil(addr1) && IsNil(addr2) {
         return true
     } else if IsNil(addr1) || IsNil(addr2) {
         return false
     }
+    if (addr1.GetID() != "") && (addr2.GetID() != "") {
+        return addr1.GetID() == addr2.GetID()
+    }
+    return AddressesEqual(addr1, addr2)
+}
+
+// AddressesEqual returns whether addr1 and addr2 have the same addresses,
+// regardless of their IDs.
+func AddressesEqual(addr1 MultiAddr, addr2 MultiAddr) bool {
     addrs1 := addr1.AllAddr()
     addrs2 := addr2.AllAddr()
     if len(addrs1) != len(addrs2) {
@@ -164,6 +253,22 @@ func (self *ServerAddressSlice) Len() int {
     return len(self.Addresses)
 }
 
+// Contains returns whether addr is one of the addresses in this slice.
+func (self *ServerAddressSlice) Contains(addr MultiAddr) bool {
+    return self.Get(addr) != nil
+}
+
+// Get returns the address in this slice which refers to the same server
+// as addr, or nil if there is none.
+func (self *ServerAddressSlice) Get(addr MultiAddr) *ServerAddress {
+    for _, address := range self.Addresses {
+        if MultiAddrEqual(address, addr) {
+            return address
+        }
+    }
+    return nil
+}
+
 func MultiAddrSliceEqual(slice1 MultiAddrSlice, slice2 MultiAddrSlice) bool {
     if IsNil(slice1) && IsNil(slice2) {
         return true
@@ -3,9 +3,23 @@ package persist
 import (
     "github.com/deckarep/golang-set"
     "github.com/hhkbp2/testify/assert"
+    "github.com/hhkbp2/testify/require"
     "testing"
 )
 
+func TestParseServerAddresses(t *testing.T) {
+    addrs, err := ParseServerAddresses("127.0.0.1:6152, localhost:6153,")
+    require.Nil(t, err)
+    require.Equal(t, 2, len(addrs))
+    assert.Equal(t, "127.0.0.1", addrs[0].Addresses[0].IP)
+    assert.Equal(t, uint16(6152), addrs[0].Addresses[0].Port)
+    assert.Equal(t, "localhost", addrs[1].Addresses[0].IP)
+    _, err = ParseServerAddresses("127.0.0.1")
+    assert.NotNil(t, err)
+    _, err = ParseServerAddresses("127.0.0.1:port")
+    assert.NotNil(t, err)
+}
+
 func TestMultiAddrEqual(t *testing.T) {
     addr1 := RandomMemoryMultiAddr()
     addr2 := RandomMemoryMultiAddr()
@@ -17,6 +31,26 @@ func TestMultiAddrEqual(t *testing.T) {
     assert.False(t, MultiAddrEqual(addr2, addr1))
 }
 
+func TestMultiAddrEqualWithID(t *testing.T) {
+    addr1 := RandomMemoryMultiAddr()
+    addr2 := RandomMemoryMultiAddr()
+    assert.Equal(t, addr1.String(), ServerKey(addr1))
+    addr1.ID = "node0"
+    addr2.ID = "node0"
+    assert.Equal(t, "node0", ServerKey(addr1))
+    // the same server moved to other addresses
+    assert.True(t, MultiAddrEqual(addr1, addr2))
+    assert.False(t, AddressesEqual(addr1, addr2))
+    addr2.ID = "node1"
+    assert.False(t, MultiAddrEqual(addr1, addr2))
+    // compared by addresses if either has no ID
+    addr3 := &ServerAddress{
+        Addresses: addr1.Addresses,
+    }
+    assert.True(t, MultiAddrEqual(addr1, addr3))
+    assert.True(t, AddressesEqual(addr1, addr3))
+}
+
 func TestMultiAddrNotEqual(t *testing.T) {
     addr1 := RandomMemoryMultiAddr()
     addr2 := RandomMemoryMultiAddr()
@@ -84,3 +118,24 @@ func TestRandomMemoryMultiAddr(t *testing.T) {
 func TestRandomMemoryMultiAddrSlice(t *testing.T) {
     testSetupMultiAddrSlice(t, RandomMemoryMultiAddrSlice)
 }
+
+func TestParseServerAddressWithID(t *testing.T) {
+    addr, err := ParseServerAddress("kv1@127.0.0.1:6152")
+    require.Nil(t, err)
+    assert.Equal(t, "kv1", addr.ID)
+    assert.Equal(t, "127.0.0.1:6152", addr.String())
+    assert.Equal(t, "kv1@127.0.0.1:6152", FormatServerAddress(addr))
+    addr, err = ParseServerAddress("127.0.0.1:6152")
+    require.Nil(t, err)
+    assert.Equal(t, "", addr.ID)
+    assert.Equal(t, "127.0.0.1:6152", FormatServerAddress(addr))
+    addrs, err := ParseServerAddresses("kv1@127.0.0.1:6152,127.0.0.1:6153")
+    require.Nil(t, err)
+    require.Equal(t, 2, len(addrs))
+    assert.Equal(t, "kv1", addrs[0].ID)
+    assert.Equal(t, "", addrs[1].ID)
+    for _, invalid := range []string{"@127.0.0.1:6152", "kv1@127.0.0.1"} {
+        _, err = ParseServerAddress(invalid)
+        assert.NotNil(t, err, invalid)
+    }
+}
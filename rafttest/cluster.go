@@ -0,0 +1,566 @@
+package rafttest
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "github.com/hhkbp2/rafted"
+    cm "github.com/hhkbp2/rafted/comm"
+    ev "github.com/hhkbp2/rafted/event"
+    logging "github.com/hhkbp2/rafted/logging"
+    ps "github.com/hhkbp2/rafted/persist"
+    rt "github.com/hhkbp2/rafted/retry"
+    "sync"
+    "time"
+)
+
+// Transport is the transport the nodes of a cluster talk over.
+type Transport int
+
+const (
+    TransportMemory Transport = iota
+    TransportSocket
+    TransportRPC
+)
+
+const (
+    // DefaultStableRounds is how many polls in a row a leader should be
+    // seen before it's considered stable.
+    DefaultStableRounds = 3
+)
+
+var (
+    // BasePort is the first port used by the clusters running over
+    // socket and rpc. A cluster of n nodes takes 2n ports after it,
+    // n for the nodes and n for their clients.
+    BasePort uint16 = 7152
+)
+
+var (
+    ErrorNotSupported = errors.New(
+        "faults are only supported by the memory transport")
+    ErrorNodeRunning = errors.New("node is running")
+    ErrorNodeStopped = errors.New("node is stopped")
+    ErrorNoLeader    = errors.New("no stable leader")
+    ErrorWaitTimeout = errors.New("wait timeout")
+)
+
+func (self Transport) String() string {
+    switch self {
+    case TransportMemory:
+        return "memory"
+    case TransportSocket:
+        return "socket"
+    case TransportRPC:
+        return "rpc"
+    }
+    return fmt.Sprintf("unknown transport: %d", int(self))
+}
+
+// clusterNode is a node of a cluster. Its log, config manager and state
+// machine outlive the running RaftNode, so that a stopped node could be
+// restarted with all its persisted states, and checked while it's down.
+type clusterNode struct {
+    index         int
+    addr          *ps.ServerAddress
+    clientAddr    *ps.ServerAddress
+    log           ps.Log
+    configManager ps.ConfigManager
+    stateMachine  ps.StateMachine
+    node          *rafted.RaftNode
+    closeChan     chan interface{}
+    group         *sync.WaitGroup
+}
+
+// Cluster runs a cluster of RaftNodes in real time, for the integration
+// tests of raft and the state machines running on it. The notifications
+// of the nodes are consumed by the cluster, to keep track of the leaders
+// elected in every term.
+type Cluster struct {
+    config          *rafted.Configuration
+    transport       Transport
+    newStateMachine func(index int) ps.StateMachine
+    register        *cm.MemoryTransportRegister
+    addrs           *ps.ServerAddressSlice
+    nodes           []*clusterNode
+    isolated        map[int]bool
+    leaders         map[uint64]int
+    violations      []string
+    lock            sync.Mutex
+}
+
+func NewCluster(
+    config *rafted.Configuration,
+    size int,
+    transport Transport) (*Cluster, error) {
+
+    newStateMachine := func(_ int) ps.StateMachine {
+        return ps.NewMemoryStateMachine()
+    }
+    return NewClusterWith(config, size, transport, newStateMachine)
+}
+
+// NewClusterWith starts a cluster whose nodes run the state machines
+// created by newStateMachine with their indexes.
+func NewClusterWith(
+    config *rafted.Configuration,
+    size int,
+    transport Transport,
+    newStateMachine func(index int) ps.StateMachine) (*Cluster, error) {
+
+    var allAddrs *ps.ServerAddressSlice
+    switch transport {
+    case TransportMemory:
+        allAddrs = ps.SetupMemoryMultiAddrSlice(size * 2)
+    case TransportSocket, TransportRPC:
+        allAddrs = setupSocketAddrs(size * 2)
+    default:
+        return nil, errors.New(fmt.Sprintf(
+            "unsupported transport: %s", transport.String()))
+    }
+    object := &Cluster{
+        config:          config,
+        transport:       transport,
+        newStateMachine: newStateMachine,
+        register:        cm.NewMemoryTransportRegister(),
+        addrs: &ps.ServerAddressSlice{
+            Addresses: allAddrs.Addresses[:size],
+        },
+        nodes:      make([]*clusterNode, 0, size),
+        isolated:   make(map[int]bool),
+        leaders:    make(map[uint64]int),
+        violations: make([]string, 0),
+    }
+    for i := 0; i < size; i++ {
+        conf := &ps.Config{
+            Servers:    object.addrs,
+            NewServers: nil,
+        }
+        node, err := object.newNode(
+            i, object.addrs.Addresses[i], allAddrs.Addresses[size+i], conf)
+        if err != nil {
+            object.Close()
+            return nil, err
+        }
+        object.nodes = append(object.nodes, node)
+        if err := object.start(node); err != nil {
+            object.Close()
+            return nil, err
+        }
+    }
+    return object, nil
+}
+
+func setupSocketAddrs(number int) *ps.ServerAddressSlice {
+    slice := ps.SetupSocketMultiAddrSlice(number)
+    for i, addr := range slice.Addresses {
+        for _, a := range addr.Addresses {
+            a.Port = BasePort + uint16(i)
+        }
+    }
+    return slice
+}
+
+// newNode creates a node with conf as its initial config. A nil conf
+// makes a fresh node, which is to bootstrap or join a cluster.
+func (self *Cluster) newNode(
+    index int,
+    addr *ps.ServerAddress,
+    clientAddr *ps.ServerAddress,
+    conf *ps.Config) (*clusterNode, error) {
+
+    log := ps.NewMemoryLog()
+    firstLogIndex, err := log.FirstIndex()
+    if err != nil {
+        return nil, err
+    }
+    return &clusterNode{
+        index:         index,
+        addr:          addr,
+        clientAddr:    clientAddr,
+        log:           log,
+        configManager: ps.NewMemoryConfigManager(firstLogIndex, conf),
+        stateMachine:  self.newStateMachine(index),
+    }, nil
+}
+
+func (self *Cluster) newClient(addr *ps.ServerAddress) cm.Client {
+    switch self.transport {
+    case TransportSocket:
+        return cm.NewSocketClient(
+            self.config.CommPoolSize, self.config.CommClientTimeout)
+    case TransportRPC:
+        return cm.NewRPCClient(
+            self.config.CommClientTimeout, self.config.RPCClientAuth)
+    }
+    client := cm.NewMemoryClient(
+        self.config.CommPoolSize, self.config.CommClientTimeout, self.register)
+    if addr != nil {
+        client.SetLocalAddr(addr)
+    }
+    return client
+}
+
+func (self *Cluster) genServer(addr *ps.ServerAddress) rafted.GenServerFunc {
+    return func(
+        handler cm.RequestEventHandler,
+        logger logging.Logger) (cm.Server, error) {
+
+        switch self.transport {
+        case TransportSocket:
+            return cm.NewSocketServer(
+                cm.FirstAddr(addr), self.config.CommServerTimeout, handler,
+                logger)
+        case TransportRPC:
+            return cm.NewRPCServer(
+                addr, self.config.CommServerTimeout,
+                self.config.RPCServerAuth, handler, logger)
+        }
+        server := cm.NewMemoryServer(
+            addr, self.config.CommServerTimeout, handler, self.register,
+            logger)
+        return server, nil
+    }
+}
+
+func (self *Cluster) start(node *clusterNode) error {
+    name := fmt.Sprintf("node%d#%s", node.index, node.addr.String())
+    backend, err := rafted.NewHSMBackendWith(
+        self.config,
+        node.addr,
+        node.configManager,
+        node.stateMachine,
+        node.log,
+        self.newClient(node.addr),
+        self.genServer(node.addr),
+        logging.GetLogger("backend"+"#"+name))
+    if err != nil {
+        return err
+    }
+    logger := logging.GetLogger("client" + "#" + name)
+    server, err := self.genServer(node.clientAddr)(
+        func(event ev.RequestEvent) {
+            backend.Send(event)
+        },
+        logger)
+    if err != nil {
+        backend.Close()
+        return err
+    }
+    redirectRetry := rt.NewErrorRetry().
+        MaxTries(3).
+        Delay(self.config.HeartbeatTimeout)
+    retry := redirectRetry.Copy().
+        OnError(rafted.LeaderUnknown).
+        OnError(rafted.LeaderUnsync)
+    client := rafted.NewRedirectClient(
+        self.config.ClientTimeout,
+        retry,
+        redirectRetry,
+        backend,
+        self.newClient(node.addr),
+        server,
+        logger)
+    client.Start()
+    term, err := node.log.LastTerm()
+    if err != nil {
+        client.Close()
+        backend.Close()
+        return err
+    }
+    node.node = rafted.NewRaftNode(backend, client)
+    node.closeChan = make(chan interface{})
+    node.group = &sync.WaitGroup{}
+    node.group.Add(1)
+    go self.collect(node, term)
+    return nil
+}
+
+// collect keeps track of the term of a node through its notifications,
+// and records it as the leader of the term when it steps up.
+func (self *Cluster) collect(node *clusterNode, term uint64) {
+    defer node.group.Done()
+    notifyChan := node.node.GetNotifyChan()
+    for {
+        select {
+        case <-node.closeChan:
+            return
+        case event := <-notifyChan:
+            switch e := event.(type) {
+            case *ev.NotifyTermChangeEvent:
+                term = e.NewTerm
+            case *ev.NotifyStateChangeEvent:
+                if e.NewState == ev.RaftStateLeader {
+                    self.observeLeader(node.index, term)
+                }
+            }
+        }
+    }
+}
+
+func (self *Cluster) observeLeader(index int, term uint64) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    leader, ok := self.leaders[term]
+    if !ok {
+        self.leaders[term] = index
+        return
+    }
+    if leader != index {
+        self.violations = append(self.violations, fmt.Sprintf(
+            "both node %d and node %d are leaders in term %d",
+            leader, index, term))
+    }
+}
+
+// AddNode starts a fresh node which has neither log nor config, and
+// returns its index. It stays idle until it bootstraps or joins a cluster.
+// The addresses returned by Addrs() are not changed by it. It's only
+// supported by the memory transport.
+func (self *Cluster) AddNode() (int, error) {
+    if self.transport != TransportMemory {
+        return -1, ErrorNotSupported
+    }
+    index := len(self.nodes)
+    node, err := self.newNode(
+        index, ps.RandomMemoryMultiAddr(), ps.RandomMemoryMultiAddr(), nil)
+    if err != nil {
+        return -1, err
+    }
+    if err := self.start(node); err != nil {
+        return -1, err
+    }
+    self.nodes = append(self.nodes, node)
+    return index, nil
+}
+
+func (self *Cluster) Size() int {
+    return len(self.nodes)
+}
+
+func (self *Cluster) Transport() Transport {
+    return self.transport
+}
+
+// Addrs returns the addresses of all the nodes.
+func (self *Cluster) Addrs() *ps.ServerAddressSlice {
+    return self.addrs
+}
+
+// NewClient returns a client which talks to the nodes over the transport
+// of the cluster, e.g. for the tools driven against the cluster.
+func (self *Cluster) NewClient() cm.Client {
+    return self.newClient(nil)
+}
+
+func (self *Cluster) Addr(index int) *ps.ServerAddress {
+    return self.nodes[index].addr
+}
+
+// Node returns the node with the specified index, or nil if it's stopped.
+func (self *Cluster) Node(index int) *rafted.RaftNode {
+    return self.nodes[index].node
+}
+
+func (self *Cluster) Log(index int) ps.Log {
+    return self.nodes[index].log
+}
+
+func (self *Cluster) StateMachine(index int) ps.StateMachine {
+    return self.nodes[index].stateMachine
+}
+
+func (self *Cluster) Running(index int) bool {
+    return self.nodes[index].node != nil
+}
+
+// Stop shuts down the node with the specified index. Its log, config
+// manager and state machine are kept for Restart().
+func (self *Cluster) Stop(index int) error {
+    node := self.nodes[index]
+    if node.node == nil {
+        return ErrorNodeStopped
+    }
+    node.node.Close()
+    close(node.closeChan)
+    node.group.Wait()
+    node.node = nil
+    return nil
+}
+
+// Shutdown closes the node with the specified index gracefully,
+// as RaftNode.Shutdown() does. The node is stopped even if ctx is done
+// before it finishes, with ctx.Err() returned.
+func (self *Cluster) Shutdown(ctx context.Context, index int) error {
+    node := self.nodes[index]
+    if node.node == nil {
+        return ErrorNodeStopped
+    }
+    err := node.node.Shutdown(ctx)
+    close(node.closeChan)
+    node.group.Wait()
+    node.node = nil
+    return err
+}
+
+// Restart starts the stopped node with the specified index again,
+// on the log, config manager and state machine it runs before.
+func (self *Cluster) Restart(index int) error {
+    node := self.nodes[index]
+    if node.node != nil {
+        return ErrorNodeRunning
+    }
+    return self.start(node)
+}
+
+// Isolate cuts all the links between the node with the specified index
+// and the other nodes. It's only supported by the memory transport.
+func (self *Cluster) Isolate(index int) error {
+    if self.transport != TransportMemory {
+        return ErrorNotSupported
+    }
+    faults := self.register.Faults()
+    for i, node := range self.nodes {
+        if i == index {
+            continue
+        }
+        faults.Cut(self.nodes[index].addr, node.addr)
+        faults.Cut(node.addr, self.nodes[index].addr)
+    }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.isolated[index] = true
+    return nil
+}
+
+// Heal restores all the links cut by Isolate().
+func (self *Cluster) Heal() error {
+    if self.transport != TransportMemory {
+        return ErrorNotSupported
+    }
+    self.register.Faults().Heal()
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.isolated = make(map[int]bool)
+    return nil
+}
+
+// Faults returns the faults of the memory transport, for the faults
+// beyond Isolate(). It returns nil for the other transports.
+func (self *Cluster) Faults() *cm.MemoryFaults {
+    if self.transport != TransportMemory {
+        return nil
+    }
+    return self.register.Faults()
+}
+
+func (self *Cluster) isIsolated(index int) bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.isolated[index]
+}
+
+// State returns the raft state and the current term of the running node
+// with the specified index.
+func (self *Cluster) State(index int) (ev.RaftStateType, uint64) {
+    return self.nodes[index].node.Backend().State()
+}
+
+// Leader returns the index and the term of the leader among the running
+// nodes which are not isolated. There is a leader only if it has
+// the highest term among them.
+func (self *Cluster) Leader() (int, uint64, bool) {
+    leader := -1
+    var leaderTerm, maxTerm uint64
+    for i, node := range self.nodes {
+        if node.node == nil || self.isIsolated(i) {
+            continue
+        }
+        state, term := self.State(i)
+        if term > maxTerm {
+            maxTerm = term
+        }
+        if state == ev.RaftStateLeader && (leader < 0 || term > leaderTerm) {
+            leader = i
+            leaderTerm = term
+        }
+    }
+    if leader < 0 || leaderTerm < maxTerm {
+        return -1, 0, false
+    }
+    self.observeLeader(leader, leaderTerm)
+    return leader, leaderTerm, true
+}
+
+// WaitLeader waits until a stable leader is elected, which is the same
+// leader in the same term for DefaultStableRounds polls in a row,
+// one for every heartbeat timeout.
+func (self *Cluster) WaitLeader(timeout time.Duration) (int, error) {
+    deadline := time.Now().Add(timeout)
+    last, rounds := -1, 0
+    var lastTerm uint64
+    for {
+        leader, term, ok := self.Leader()
+        switch {
+        case !ok:
+            last, rounds = -1, 0
+        case leader == last && term == lastTerm:
+            rounds++
+        default:
+            last, lastTerm, rounds = leader, term, 1
+        }
+        if rounds >= DefaultStableRounds {
+            return leader, nil
+        }
+        if time.Now().After(deadline) {
+            return -1, ErrorNoLeader
+        }
+        time.Sleep(self.config.HeartbeatTimeout)
+    }
+}
+
+// WaitIndex waits until the log entry with the specified index is
+// applied on all the running nodes which are not isolated.
+func (self *Cluster) WaitIndex(index uint64, timeout time.Duration) error {
+    deadline := time.Now().Add(timeout)
+    for {
+        done := true
+        for i, node := range self.nodes {
+            if node.node == nil || self.isIsolated(i) {
+                continue
+            }
+            applied, err := node.log.LastAppliedIndex()
+            if err != nil {
+                return err
+            }
+            if applied < index {
+                done = false
+                break
+            }
+        }
+        if done {
+            return nil
+        }
+        if time.Now().After(deadline) {
+            return ErrorWaitTimeout
+        }
+        time.Sleep(self.config.HeartbeatTimeout)
+    }
+}
+
+// Close shuts down all the running nodes.
+func (self *Cluster) Close() error {
+    todo := make([]func(), 0, len(self.nodes))
+    for _, node := range self.nodes {
+        if node.node == nil {
+            continue
+        }
+        index := node.index
+        todo = append(todo, func() {
+            self.Stop(index)
+        })
+    }
+    rafted.ParallelDo(todo)
+    self.register.Faults().Reset()
+    return nil
+}
@@ -0,0 +1,345 @@
+package rafttest
+
+import (
+    "context"
+    "fmt"
+    "github.com/hhkbp2/rafted"
+    ev "github.com/hhkbp2/rafted/event"
+    ps "github.com/hhkbp2/rafted/persist"
+    "github.com/hhkbp2/testify/assert"
+    "github.com/hhkbp2/testify/require"
+    "testing"
+)
+
+func entry(term, index uint64, data string) *ps.LogEntry {
+    return &ps.LogEntry{
+        Term:  term,
+        Index: index,
+        Type:  ps.LogCommand,
+        Data:  []byte(data),
+    }
+}
+
+func snapshot(entries ...*ps.LogEntry) *logSnapshot {
+    return &logSnapshot{entries: entries}
+}
+
+func TestCheckLogMatching(t *testing.T) {
+    log1 := snapshot(entry(1, 1, "a"), entry(1, 2, "b"), entry(2, 3, "c"))
+    // a shorter log
+    log2 := snapshot(entry(1, 1, "a"), entry(1, 2, "b"))
+    assert.Nil(t, checkLogMatching(log1, log2))
+    assert.Nil(t, checkLogMatching(log2, log1))
+    // a log diverging after index 2
+    log3 := snapshot(entry(1, 1, "a"), entry(1, 2, "b"), entry(3, 3, "d"))
+    assert.Nil(t, checkLogMatching(log1, log3))
+    // a log compacted before index 2
+    log4 := snapshot(entry(1, 2, "b"), entry(2, 3, "c"), entry(2, 4, "e"))
+    assert.Nil(t, checkLogMatching(log1, log4))
+    // a log with the same entry at index 3 but a different one before
+    log5 := snapshot(entry(1, 1, "x"), entry(1, 2, "b"), entry(2, 3, "c"))
+    assert.NotNil(t, checkLogMatching(log1, log5))
+    assert.NotNil(t, checkLogMatching(log5, log1))
+}
+
+func TestCheckElectionSafety(t *testing.T) {
+    cluster := &Cluster{
+        leaders:    make(map[uint64]int),
+        violations: make([]string, 0),
+    }
+    cluster.observeLeader(0, 1)
+    cluster.observeLeader(0, 1)
+    cluster.observeLeader(1, 2)
+    assert.Nil(t, cluster.CheckElectionSafety())
+    cluster.observeLeader(2, 2)
+    assert.NotNil(t, cluster.CheckElectionSafety())
+}
+
+func appendTo(t *testing.T, cluster *Cluster, leader int, count int) uint64 {
+    for i := 0; i < count; i++ {
+        data := []byte(fmt.Sprintf("data%d", i))
+        result, err := cluster.Node(leader).Append(data)
+        require.Nil(t, err)
+        require.Equal(t, data, result)
+    }
+    index, err := cluster.Log(leader).LastIndex()
+    require.Nil(t, err)
+    return index
+}
+
+func testClusterSimple(t *testing.T, transport Transport) {
+    config := rafted.DefaultConfiguration()
+    cluster, err := NewCluster(config, 3, transport)
+    require.Nil(t, err)
+    defer cluster.Close()
+    timeout := config.ElectionTimeout * 10
+    leader, err := cluster.WaitLeader(timeout)
+    require.Nil(t, err)
+    index := appendTo(t, cluster, leader, 5)
+    require.Nil(t, cluster.WaitIndex(index, timeout))
+    assert.Nil(t, cluster.CheckStateMachines(MemoryStateMachineEqual))
+    assert.Nil(t, cluster.CheckInvariants())
+}
+
+func TestMemoryClusterSimple(t *testing.T) {
+    testClusterSimple(t, TransportMemory)
+}
+
+func TestSocketClusterSimple(t *testing.T) {
+    testClusterSimple(t, TransportSocket)
+}
+
+func TestRPCClusterSimple(t *testing.T) {
+    testClusterSimple(t, TransportRPC)
+}
+
+func TestClusterRestart(t *testing.T) {
+    config := rafted.DefaultConfiguration()
+    cluster, err := NewCluster(config, 3, TransportMemory)
+    require.Nil(t, err)
+    defer cluster.Close()
+    timeout := config.ElectionTimeout * 10
+    leader, err := cluster.WaitLeader(timeout)
+    require.Nil(t, err)
+    follower := (leader + 1) % cluster.Size()
+    require.Nil(t, cluster.Stop(follower))
+    assert.Equal(t, ErrorNodeStopped, cluster.Stop(follower))
+    assert.False(t, cluster.Running(follower))
+    // the others still make a majority
+    index := appendTo(t, cluster, leader, 3)
+    require.Nil(t, cluster.WaitIndex(index, timeout))
+    require.Nil(t, cluster.Restart(follower))
+    assert.Equal(t, ErrorNodeRunning, cluster.Restart(follower))
+    // the restarted node catches up
+    require.Nil(t, cluster.WaitIndex(index, timeout))
+    assert.Nil(t, cluster.CheckStateMachines(MemoryStateMachineEqual))
+    assert.Nil(t, cluster.CheckInvariants())
+}
+
+func TestClusterShutdownFollower(t *testing.T) {
+    config := rafted.DefaultConfiguration()
+    cluster, err := NewCluster(config, 3, TransportMemory)
+    require.Nil(t, err)
+    defer cluster.Close()
+    timeout := config.ElectionTimeout * 10
+    leader, err := cluster.WaitLeader(timeout)
+    require.Nil(t, err)
+    _, term, _ := cluster.Leader()
+    index := appendTo(t, cluster, leader, 3)
+    follower := (leader + 1) % cluster.Size()
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    require.Nil(t, cluster.Shutdown(ctx, follower))
+    assert.False(t, cluster.Running(follower))
+    assert.Equal(t, ErrorNodeStopped, cluster.Shutdown(ctx, follower))
+    // a follower leaves the leadership alone
+    current, currentTerm, ok := cluster.Leader()
+    require.True(t, ok)
+    assert.Equal(t, leader, current)
+    assert.Equal(t, term, currentTerm)
+    index = appendTo(t, cluster, leader, 3)
+    require.Nil(t, cluster.WaitIndex(index, timeout))
+    require.Nil(t, cluster.Restart(follower))
+    require.Nil(t, cluster.WaitIndex(index, timeout))
+    assert.Nil(t, cluster.CheckStateMachines(MemoryStateMachineEqual))
+    assert.Nil(t, cluster.CheckInvariants())
+}
+
+func TestClusterShutdownExpired(t *testing.T) {
+    config := rafted.DefaultConfiguration()
+    cluster, err := NewCluster(config, 3, TransportMemory)
+    require.Nil(t, err)
+    defer cluster.Close()
+    timeout := config.ElectionTimeout * 10
+    leader, err := cluster.WaitLeader(timeout)
+    require.Nil(t, err)
+    appendTo(t, cluster, leader, 3)
+    // the node is closed anyway, with the ctx error returned
+    ctx, cancel := context.WithTimeout(context.Background(), 0)
+    defer cancel()
+    assert.Equal(t, context.DeadlineExceeded, cluster.Shutdown(ctx, leader))
+    assert.False(t, cluster.Running(leader))
+    follower := (leader + 1) % cluster.Size()
+    ctx, cancel = context.WithCancel(context.Background())
+    cancel()
+    assert.Equal(t, context.Canceled, cluster.Shutdown(ctx, follower))
+    assert.False(t, cluster.Running(follower))
+    // the cluster comes back once they restart
+    require.Nil(t, cluster.Restart(leader))
+    require.Nil(t, cluster.Restart(follower))
+    leader, err = cluster.WaitLeader(timeout)
+    require.Nil(t, err)
+    index := appendTo(t, cluster, leader, 1)
+    require.Nil(t, cluster.WaitIndex(index, timeout))
+    assert.Nil(t, cluster.CheckInvariants())
+}
+
+func TestClusterRestartFromSnapshot(t *testing.T) {
+    config := rafted.DefaultConfiguration()
+    cluster, err := NewCluster(config, 3, TransportMemory)
+    require.Nil(t, err)
+    defer cluster.Close()
+    timeout := config.ElectionTimeout * 10
+    leader, err := cluster.WaitLeader(timeout)
+    require.Nil(t, err)
+    index := appendTo(t, cluster, leader, 5)
+    require.Nil(t, cluster.WaitIndex(index, timeout))
+    follower := (leader + 1) % cluster.Size()
+    require.Nil(t, cluster.Stop(follower))
+    // compact the log of the stopped node into a snapshot
+    log := cluster.Log(follower)
+    entry, err := log.GetLog(index)
+    require.Nil(t, err)
+    stateMachine := cluster.StateMachine(follower)
+    conf := &ps.Config{
+        Servers: cluster.Addrs(),
+    }
+    _, err = stateMachine.MakeSnapshot(entry.Term, index, conf)
+    require.Nil(t, err)
+    require.Nil(t, log.TruncateBefore(index-1))
+    // the state not in the snapshot is dropped on restart
+    stateMachine.Apply([]byte("garbage"))
+    require.Nil(t, cluster.Restart(follower))
+    index = appendTo(t, cluster, leader, 3)
+    require.Nil(t, cluster.WaitIndex(index, timeout))
+    assert.Nil(t, cluster.CheckStateMachines(MemoryStateMachineEqual))
+    assert.Nil(t, cluster.CheckInvariants())
+}
+
+func TestClusterIsolate(t *testing.T) {
+    config := rafted.DefaultConfiguration()
+    cluster, err := NewCluster(config, 3, TransportMemory)
+    require.Nil(t, err)
+    defer cluster.Close()
+    timeout := config.ElectionTimeout * 10
+    leader, err := cluster.WaitLeader(timeout)
+    require.Nil(t, err)
+    require.Nil(t, cluster.Isolate(leader))
+    newLeader, err := cluster.WaitLeader(timeout)
+    require.Nil(t, err)
+    require.NotEqual(t, leader, newLeader)
+    index := appendTo(t, cluster, newLeader, 3)
+    require.Nil(t, cluster.WaitIndex(index, timeout))
+    require.Nil(t, cluster.Heal())
+    // the old leader steps down and catches up
+    require.Nil(t, cluster.WaitIndex(index, timeout))
+    _, err = cluster.WaitLeader(timeout)
+    require.Nil(t, err)
+    assert.Nil(t, cluster.CheckStateMachines(MemoryStateMachineEqual))
+    assert.Nil(t, cluster.CheckInvariants())
+}
+
+func TestClusterIsolateNotSupported(t *testing.T) {
+    config := rafted.DefaultConfiguration()
+    cluster, err := NewCluster(config, 3, TransportSocket)
+    require.Nil(t, err)
+    defer cluster.Close()
+    assert.Equal(t, ErrorNotSupported, cluster.Isolate(0))
+    assert.Nil(t, cluster.Faults())
+}
+
+func TestClusterBootstrap(t *testing.T) {
+    config := rafted.DefaultConfiguration()
+    cluster, err := NewCluster(config, 0, TransportMemory)
+    require.Nil(t, err)
+    defer cluster.Close()
+    addrs := make([]*ps.ServerAddress, 0, 3)
+    for i := 0; i < 3; i++ {
+        index, err := cluster.AddNode()
+        require.Nil(t, err)
+        addrs = append(addrs, cluster.Addr(index))
+    }
+    // fresh nodes never campaign
+    timeout := config.ElectionTimeout * 10
+    _, _, ok := cluster.Leader()
+    assert.False(t, ok)
+    conf := &ps.Config{
+        Servers: &ps.ServerAddressSlice{
+            Addresses: addrs,
+        },
+    }
+    invalid := &ps.Config{
+        Servers: &ps.ServerAddressSlice{
+            Addresses: addrs[1:],
+        },
+    }
+    assert.Equal(t, rafted.InvalidConfig, cluster.Node(0).Bootstrap(invalid))
+    for i := 0; i < 3; i++ {
+        require.Nil(t, cluster.Node(i).Bootstrap(conf))
+    }
+    assert.Equal(t, rafted.NodeNotFresh, cluster.Node(0).Bootstrap(conf))
+    leader, err := cluster.WaitLeader(timeout)
+    require.Nil(t, err)
+    index := appendTo(t, cluster, leader, 3)
+    require.Nil(t, cluster.WaitIndex(index, timeout))
+    assert.Nil(t, cluster.CheckStateMachines(MemoryStateMachineEqual))
+    assert.Nil(t, cluster.CheckInvariants())
+}
+
+func TestClusterJoin(t *testing.T) {
+    config := rafted.DefaultConfiguration()
+    cluster, err := NewCluster(config, 3, TransportMemory)
+    require.Nil(t, err)
+    defer cluster.Close()
+    timeout := config.ElectionTimeout * 10
+    leader, err := cluster.WaitLeader(timeout)
+    require.Nil(t, err)
+    appendTo(t, cluster, leader, 3)
+    joiner, err := cluster.AddNode()
+    require.Nil(t, err)
+    // join through a follower, which redirects it to the leader
+    follower := (leader + 1) % 3
+    require.Nil(t, cluster.Node(joiner).Join(cluster.Addr(follower)))
+    assert.Equal(t, rafted.NodeNotFresh,
+        cluster.Node(joiner).Join(cluster.Addr(follower)))
+    assert.Equal(t, rafted.NodeNotFresh,
+        cluster.Node(leader).Bootstrap(&ps.Config{Servers: cluster.Addrs()}))
+    leader, err = cluster.WaitLeader(timeout)
+    require.Nil(t, err)
+    index := appendTo(t, cluster, leader, 3)
+    require.Nil(t, cluster.WaitIndex(index, timeout))
+    status, err := cluster.Node(joiner).QueryNodeStatus()
+    require.Nil(t, err)
+    require.NotNil(t, status.Conf)
+    assert.True(t, status.Conf.IsNormalConfig())
+    assert.Equal(t, 4, status.Conf.Servers.Len())
+    assert.True(t, status.Conf.Servers.Contains(cluster.Addr(joiner)))
+    assert.Nil(t, cluster.CheckStateMachines(MemoryStateMachineEqual))
+    assert.Nil(t, cluster.CheckInvariants())
+}
+
+func TestClusterJoinForbidsBootstrap(t *testing.T) {
+    config := rafted.DefaultConfiguration()
+    cluster, err := NewCluster(config, 3, TransportMemory)
+    require.Nil(t, err)
+    defer cluster.Close()
+    timeout := config.ElectionTimeout * 10
+    leader, err := cluster.WaitLeader(timeout)
+    require.Nil(t, err)
+    joiner, err := cluster.AddNode()
+    require.Nil(t, err)
+    // the node checks whether it's fresh in its hsm, when it starts
+    // to join with the join request to itself
+    request := &ev.ClientJoinRequest{
+        Addr: cluster.Addr(joiner),
+    }
+    reqEvent := ev.NewClientJoinRequestEvent(request)
+    cluster.Node(joiner).Backend().Send(reqEvent)
+    respEvent := reqEvent.RecvResponse()
+    require.Equal(t, ev.EventClientResponse, respEvent.Type())
+    e, ok := respEvent.(*ev.ClientResponseEvent)
+    require.True(t, ok)
+    assert.True(t, e.Response.Success)
+    // it can't bootstrap once it starts to join
+    conf := &ps.Config{
+        Servers: &ps.ServerAddressSlice{
+            Addresses: []*ps.ServerAddress{cluster.Addr(joiner)},
+        },
+    }
+    assert.Equal(t, rafted.NodeNotFresh, cluster.Node(joiner).Bootstrap(conf))
+    // but it could try joining again
+    require.Nil(t, cluster.Node(joiner).Join(cluster.Addr(leader)))
+    // a member can't start to join
+    assert.Equal(t, rafted.NodeNotFresh,
+        cluster.Node(leader).Join(cluster.Addr(joiner)))
+}
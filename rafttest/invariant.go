@@ -0,0 +1,242 @@
+package rafttest
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    ps "github.com/hhkbp2/rafted/persist"
+    "strings"
+)
+
+// The invariants are checked on the logs of all the nodes, including
+// the stopped ones. Since the logs are read one by one, they should be
+// checked when no entry is being appended, e.g. after WaitIndex().
+
+// CheckElectionSafety checks that at most one leader is elected
+// in every term, as far as the cluster has seen.
+func (self *Cluster) CheckElectionSafety() error {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if len(self.violations) == 0 {
+        return nil
+    }
+    return errors.New(strings.Join(self.violations, "\n"))
+}
+
+// CheckLogMatching checks that if the logs of two nodes contain
+// an entry with the same index and term, the logs are identical
+// in all the entries up through that index.
+func (self *Cluster) CheckLogMatching() error {
+    logs, err := self.readLogs()
+    if err != nil {
+        return err
+    }
+    for i := 0; i < len(logs); i++ {
+        for j := i + 1; j < len(logs); j++ {
+            if err := checkLogMatching(logs[i], logs[j]); err != nil {
+                return errors.New(fmt.Sprintf(
+                    "node %d and node %d: %s", i, j, err.Error()))
+            }
+        }
+    }
+    return nil
+}
+
+// CheckLeaderCompleteness checks that the entries committed on any node
+// are present in the log of the leader with the highest term.
+func (self *Cluster) CheckLeaderCompleteness() error {
+    leader, _, ok := self.Leader()
+    if !ok {
+        return nil
+    }
+    logs, err := self.readLogs()
+    if err != nil {
+        return err
+    }
+    leaderLog := logs[leader]
+    for i, log := range logs {
+        if i == leader {
+            continue
+        }
+        for _, entry := range log.entries {
+            if entry.Index > log.committedIndex {
+                break
+            }
+            other, ok := leaderLog.get(entry.Index)
+            if !ok {
+                if entry.Index < leaderLog.firstIndex() {
+                    // compacted by snapshot
+                    continue
+                }
+                return errors.New(fmt.Sprintf(
+                    "entry %d committed on node %d is missing on leader %d",
+                    entry.Index, i, leader))
+            }
+            if !entryEqual(entry, other) {
+                return errors.New(fmt.Sprintf(
+                    "entry %d committed on node %d differs on leader %d",
+                    entry.Index, i, leader))
+            }
+        }
+    }
+    return nil
+}
+
+// CheckInvariants checks election safety, log matching and
+// leader completeness.
+func (self *Cluster) CheckInvariants() error {
+    if err := self.CheckElectionSafety(); err != nil {
+        return err
+    }
+    if err := self.CheckLogMatching(); err != nil {
+        return err
+    }
+    return self.CheckLeaderCompleteness()
+}
+
+// CheckStateMachines checks that the state machines of all the running
+// nodes which are not isolated are the same by equal. They should be
+// compared after the same entries are applied to them, e.g. after
+// WaitIndex().
+func (self *Cluster) CheckStateMachines(
+    equal func(stateMachine1, stateMachine2 ps.StateMachine) bool) error {
+
+    first := -1
+    for i, node := range self.nodes {
+        if node.node == nil || self.isIsolated(i) {
+            continue
+        }
+        if first < 0 {
+            first = i
+            continue
+        }
+        if !equal(self.nodes[first].stateMachine, node.stateMachine) {
+            return errors.New(fmt.Sprintf(
+                "state machines of node %d and node %d differ", first, i))
+        }
+    }
+    return nil
+}
+
+// MemoryStateMachineEqual compares two MemoryStateMachines by all
+// the data applied to them.
+func MemoryStateMachineEqual(
+    stateMachine1, stateMachine2 ps.StateMachine) bool {
+
+    sm1, ok1 := stateMachine1.(*ps.MemoryStateMachine)
+    sm2, ok2 := stateMachine2.(*ps.MemoryStateMachine)
+    if !(ok1 && ok2) {
+        return false
+    }
+    data1, data2 := sm1.Data(), sm2.Data()
+    if data1.Len() != data2.Len() {
+        return false
+    }
+    e2 := data2.Front()
+    for e1 := data1.Front(); e1 != nil; e1 = e1.Next() {
+        p1, _ := e1.Value.([]byte)
+        p2, _ := e2.Value.([]byte)
+        if !bytes.Equal(p1, p2) {
+            return false
+        }
+        e2 = e2.Next()
+    }
+    return true
+}
+
+// logSnapshot is a copy of all the entries in a log at some time.
+type logSnapshot struct {
+    entries        []*ps.LogEntry
+    committedIndex uint64
+}
+
+func (self *logSnapshot) firstIndex() uint64 {
+    if len(self.entries) == 0 {
+        return 0
+    }
+    return self.entries[0].Index
+}
+
+func (self *logSnapshot) get(index uint64) (*ps.LogEntry, bool) {
+    first := self.firstIndex()
+    if len(self.entries) == 0 || index < first ||
+        index-first >= uint64(len(self.entries)) {
+
+        return nil, false
+    }
+    return self.entries[index-first], true
+}
+
+func (self *Cluster) readLogs() ([]*logSnapshot, error) {
+    logs := make([]*logSnapshot, 0, len(self.nodes))
+    for _, node := range self.nodes {
+        log, err := readLog(node.log)
+        if err != nil {
+            return nil, err
+        }
+        logs = append(logs, log)
+    }
+    return logs, nil
+}
+
+func readLog(log ps.Log) (*logSnapshot, error) {
+    committedIndex, err := log.CommittedIndex()
+    if err != nil {
+        return nil, err
+    }
+    firstIndex, lastIndex := uint64(0), uint64(0)
+    if _, firstIndex, err = log.FirstEntryInfo(); err != nil {
+        return nil, err
+    }
+    if _, lastIndex, err = log.LastEntryInfo(); err != nil {
+        return nil, err
+    }
+    snapshot := &logSnapshot{
+        entries:        make([]*ps.LogEntry, 0),
+        committedIndex: committedIndex,
+    }
+    if lastIndex == 0 || lastIndex < firstIndex {
+        return snapshot, nil
+    }
+    entries, err := log.GetLogInRange(firstIndex, lastIndex)
+    if err != nil {
+        return nil, err
+    }
+    snapshot.entries = entries
+    return snapshot, nil
+}
+
+func entryEqual(entry1, entry2 *ps.LogEntry) bool {
+    return entry1.Term == entry2.Term &&
+        entry1.Index == entry2.Index &&
+        entry1.Type == entry2.Type &&
+        bytes.Equal(entry1.Data, entry2.Data)
+}
+
+// checkLogMatching finds the highest index where two logs have entries
+// with the same term, and compares all the entries up through it.
+func checkLogMatching(log1, log2 *logSnapshot) error {
+    for i := len(log1.entries) - 1; i >= 0; i-- {
+        entry1 := log1.entries[i]
+        entry2, ok := log2.get(entry1.Index)
+        if !ok || entry1.Term != entry2.Term {
+            continue
+        }
+        for j := i; j >= 0; j-- {
+            entry1 := log1.entries[j]
+            entry2, ok := log2.get(entry1.Index)
+            if !ok {
+                // compacted by snapshot
+                break
+            }
+            if !entryEqual(entry1, entry2) {
+                return errors.New(fmt.Sprintf(
+                    "entries %d differ, while entries %d match in term %d",
+                    entry1.Index, log1.entries[i].Index,
+                    log1.entries[i].Term))
+            }
+        }
+        return nil
+    }
+    return nil
+}
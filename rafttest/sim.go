@@ -0,0 +1,585 @@
+package rafttest
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "github.com/hhkbp2/rafted"
+    ck "github.com/hhkbp2/rafted/clock"
+    cm "github.com/hhkbp2/rafted/comm"
+    ev "github.com/hhkbp2/rafted/event"
+    logging "github.com/hhkbp2/rafted/logging"
+    ps "github.com/hhkbp2/rafted/persist"
+    rt "github.com/hhkbp2/rafted/retry"
+    "runtime"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+var (
+    SimTimeout = errors.New("simulation timeout")
+)
+
+// SimNode is a full node running inside a Simulation.
+type SimNode struct {
+    index         int
+    addr          *ps.ServerAddress
+    config        *rafted.Configuration
+    backend       *rafted.HSMBackend
+    logFaults     *ps.FaultLog
+    configManager ps.ConfigManager
+    stateMachine  ps.StateMachine
+    notifies      []ev.NotifyEvent
+    lock          sync.Mutex
+    closeChan     chan interface{}
+    group         *sync.WaitGroup
+    closed        bool
+}
+
+func (self *SimNode) collect() {
+    defer self.group.Done()
+    notifyChan := self.backend.GetNotifyChan()
+    for {
+        select {
+        case <-self.closeChan:
+            return
+        case event := <-notifyChan:
+            self.lock.Lock()
+            self.notifies = append(self.notifies, event)
+            self.lock.Unlock()
+        }
+    }
+}
+
+func (self *SimNode) takeNotifies() []ev.NotifyEvent {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    notifies := self.notifies
+    self.notifies = make([]ev.NotifyEvent, 0)
+    return notifies
+}
+
+func (self *SimNode) Addr() *ps.ServerAddress {
+    return self.addr
+}
+
+func (self *SimNode) Backend() *rafted.HSMBackend {
+    return self.backend
+}
+
+// LogFaults returns the faults injected into the log of the node.
+func (self *SimNode) LogFaults() *ps.FaultLog {
+    return self.logFaults
+}
+
+func (self *SimNode) stopCollect() {
+    close(self.closeChan)
+    self.group.Wait()
+}
+
+// Close shuts down the node, which is left closed when the simulation
+// closes. It could be called concurrently with the simulation running,
+// e.g. to shut down a node blocked by faults, but only once.
+func (self *SimNode) Close() error {
+    err := self.backend.Close()
+    self.stopCollect()
+    self.closed = true
+    return err
+}
+
+// Simulation runs a cluster of full nodes over the memory transport
+// in virtual time. All timers of the nodes and the transport are driven by
+// one virtual clock, and all timeout jitters are drawn from random sources
+// forked from the seed. Timers are fired one at a time and the cluster is
+// left to settle down after each one, so that running with the same seed
+// replays to the same sequence of events. A simulation should be the only
+// thing running in the process, since it takes the process as settled
+// only when all the other goroutines are blocked.
+type Simulation struct {
+    config          *rafted.Configuration
+    newStateMachine func(index int) ps.StateMachine
+    seed            int64
+    start           time.Time
+    clock           *ck.VirtualClock
+    register        *cm.MemoryTransportRegister
+    addrs           *ps.ServerAddressSlice
+    nodes           []*SimNode
+    trace           []string
+}
+
+func NewSimulation(
+    config *rafted.Configuration, size int, seed int64) (*Simulation, error) {
+
+    newStateMachine := func(_ int) ps.StateMachine {
+        return ps.NewMemoryStateMachine()
+    }
+    return NewSimulationWith(config, size, seed, newStateMachine)
+}
+
+// NewSimulationWith creates a simulation whose nodes run the state machines
+// created by newStateMachine with their indexes.
+func NewSimulationWith(
+    config *rafted.Configuration,
+    size int,
+    seed int64,
+    newStateMachine func(index int) ps.StateMachine) (*Simulation, error) {
+
+    start := time.Unix(0, 0)
+    clock := ck.NewVirtualClock(start)
+    register := cm.NewMemoryTransportRegister()
+    register.SetClock(clock.Fork("transport"))
+    random := rt.NewRandom(seed)
+    register.Faults().SetRandom(random.Fork("transport"))
+    object := &Simulation{
+        config:          config,
+        newStateMachine: newStateMachine,
+        seed:            seed,
+        start:           start,
+        clock:           clock,
+        register:        register,
+        addrs:           ps.SetupMemoryMultiAddrSlice(size),
+        nodes:           make([]*SimNode, 0, size),
+        trace:           make([]string, 0),
+    }
+    for i, addr := range object.addrs.Addresses {
+        addr.ID = fmt.Sprintf("node%d", i)
+    }
+    for i := 0; i < size; i++ {
+        nodeConfig := *config
+        name := fmt.Sprintf("node%d", i)
+        nodeConfig.Clock = clock.Fork(name)
+        nodeConfig.Random = random.Fork(name)
+        node, err := object.newNode(&nodeConfig, i)
+        if err != nil {
+            object.Close()
+            return nil, err
+        }
+        object.nodes = append(object.nodes, node)
+    }
+    return object, nil
+}
+
+func (self *Simulation) newNode(
+    config *rafted.Configuration, index int) (*SimNode, error) {
+
+    log := ps.NewFaultLog(ps.NewMemoryLog())
+    firstLogIndex, err := log.FirstIndex()
+    if err != nil {
+        return nil, err
+    }
+    conf := &ps.Config{
+        Servers:    self.addrs,
+        NewServers: nil,
+    }
+    configManager := ps.NewMemoryConfigManager(firstLogIndex, conf)
+    stateMachine := self.newStateMachine(index)
+    return self.startNode(config, index, log, configManager, stateMachine)
+}
+
+// startNode runs a node with the specified index on the stores given.
+func (self *Simulation) startNode(
+    config *rafted.Configuration,
+    index int,
+    log *ps.FaultLog,
+    configManager ps.ConfigManager,
+    stateMachine ps.StateMachine) (*SimNode, error) {
+
+    localAddr := self.addrs.Addresses[index]
+    name := fmt.Sprintf("node%d#%s", index, localAddr.String())
+    client := cm.NewMemoryClient(
+        config.CommPoolSize, config.CommClientTimeout, self.register)
+    client.SetLocalAddr(localAddr)
+    genServer := func(
+        handler cm.RequestEventHandler,
+        logger logging.Logger) (cm.Server, error) {
+
+        server := cm.NewMemoryServer(
+            localAddr, config.CommServerTimeout, handler, self.register,
+            logger)
+        return server, nil
+    }
+    backend, err := rafted.NewHSMBackendWith(
+        config,
+        localAddr,
+        configManager,
+        stateMachine,
+        log,
+        client,
+        genServer,
+        logging.GetLogger("backend"+"#"+name))
+    if err != nil {
+        return nil, err
+    }
+    node := &SimNode{
+        index:         index,
+        addr:          localAddr,
+        config:        config,
+        backend:       backend,
+        logFaults:     log,
+        configManager: configManager,
+        stateMachine:  stateMachine,
+        notifies:      make([]ev.NotifyEvent, 0),
+        closeChan:     make(chan interface{}),
+        group:         &sync.WaitGroup{},
+    }
+    node.group.Add(1)
+    go node.collect()
+    return node, nil
+}
+
+func (self *Simulation) Seed() int64 {
+    return self.seed
+}
+
+func (self *Simulation) Clock() *ck.VirtualClock {
+    return self.clock
+}
+
+func (self *Simulation) Register() *cm.MemoryTransportRegister {
+    return self.register
+}
+
+func (self *Simulation) Nodes() []*SimNode {
+    return self.nodes
+}
+
+// Faults returns the faults injected into the network of the simulation.
+func (self *Simulation) Faults() *cm.MemoryFaults {
+    return self.register.Faults()
+}
+
+// Addrs returns the addresses of the nodes with the specified indexes.
+func (self *Simulation) Addrs(indexes ...int) []ps.MultiAddr {
+    addrs := make([]ps.MultiAddr, 0, len(indexes))
+    for _, i := range indexes {
+        addrs = append(addrs, self.nodes[i].addr)
+    }
+    return addrs
+}
+
+// Elapsed returns the virtual time passed since the simulation started.
+func (self *Simulation) Elapsed() time.Duration {
+    return self.clock.Now().Sub(self.start)
+}
+
+// Trace returns the sequence of events happened so far.
+func (self *Simulation) Trace() []string {
+    trace := make([]string, len(self.trace))
+    copy(trace, self.trace)
+    return trace
+}
+
+func (self *Simulation) record(node string, message string) {
+    self.trace = append(self.trace, fmt.Sprintf(
+        "%v %s %s", self.Elapsed(), node, message))
+}
+
+// blockedStates are the states of the goroutines which are blocked until
+// other goroutines wake them up, as shown in the stack traces.
+var blockedStates = map[string]bool{
+    "chan receive":            true,
+    "chan receive (nil chan)": true,
+    "chan send":               true,
+    "chan send (nil chan)":    true,
+    "select":                  true,
+    "select (no cases)":       true,
+    "semacquire":              true,
+    "sync.Cond.Wait":          true,
+    "sync.Mutex.Lock":         true,
+    "sync.RWMutex.Lock":       true,
+    "sync.RWMutex.RLock":      true,
+    "sync.WaitGroup.Wait":     true,
+    "IO wait":                 true,
+    "sleep":                   true,
+    "finalizer wait":          true,
+    "force gc (idle)":         true,
+    "GC scavenge wait":        true,
+    "GC sweep wait":           true,
+}
+
+// idle returns whether all the goroutines except the calling one are
+// blocked. The stacks are taken with the world stopped, so none of them
+// is woken up in the meantime. Nothing changes any more until the clock
+// fires a timer, or the caller does something, if they're all blocked.
+func idle() bool {
+    buf := make([]byte, 1<<16)
+    for {
+        n := runtime.Stack(buf, true)
+        if n < len(buf) {
+            buf = buf[:n]
+            break
+        }
+        buf = make([]byte, len(buf)*2)
+    }
+    // the first stack is the calling goroutine
+    stacks := bytes.Split(buf, []byte("\n\n"))
+    for _, stack := range stacks[1:] {
+        header := string(stack)
+        if i := strings.IndexByte(header, '\n'); i >= 0 {
+            header = header[:i]
+        }
+        begin := strings.IndexByte(header, '[')
+        end := strings.LastIndexByte(header, ']')
+        if (begin < 0) || (end < begin) {
+            continue
+        }
+        state := header[begin+1 : end]
+        if i := strings.IndexByte(state, ','); i >= 0 {
+            state = state[:i]
+        }
+        if !blockedStates[state] {
+            return false
+        }
+    }
+    return true
+}
+
+// waitIdle yields to the other goroutines until they're all blocked.
+func waitIdle() {
+    for !idle() {
+        runtime.Gosched()
+    }
+}
+
+// settle waits until all the nodes become idle and records all
+// the notifies they emitted. The notifies are recorded in the order of
+// nodes, and grouped by type for every node, since the local hsm and
+// peer hsms of a node race to notify in the same virtual instant.
+// So concurrent notifies are always traced in the same order.
+func (self *Simulation) settle() {
+    waitIdle()
+    for _, node := range self.nodes {
+        notifies := node.takeNotifies()
+        sort.SliceStable(notifies, func(i, j int) bool {
+            return notifies[i].Type() < notifies[j].Type()
+        })
+        for _, event := range notifies {
+            self.record(
+                fmt.Sprintf("node%d", node.index), describeNotify(event))
+        }
+    }
+}
+
+// Step fires the next timer in virtual time. It returns false
+// if there is no timer left.
+func (self *Simulation) Step() bool {
+    self.settle()
+    name, ok := self.clock.Step()
+    if !ok {
+        return false
+    }
+    self.record(name, "timeout")
+    self.settle()
+    return true
+}
+
+// Run drives the cluster forward by d in virtual time.
+func (self *Simulation) Run(d time.Duration) {
+    end := self.clock.Now().Add(d)
+    self.RunUntil(func() bool { return false }, end)
+    self.settle()
+    self.clock.Advance(end.Sub(self.clock.Now()))
+}
+
+// RunUntil drives the cluster forward until cond is true or
+// the virtual time reaches the deadline. It returns the final value of cond.
+func (self *Simulation) RunUntil(cond func() bool, deadline time.Time) bool {
+    for !cond() {
+        next, _, ok := self.clock.Next()
+        if !ok || next.After(deadline) {
+            return false
+        }
+        self.Step()
+    }
+    return true
+}
+
+// Status returns the status of the node with the specified index.
+// The cluster keeps running while the node collects its status,
+// since it may wait on peers blocked in their rpcs.
+func (self *Simulation) Status(index int) *ev.QueryNodeStatusResponse {
+    reqEvent := ev.NewQueryNodeStatusRequestEvent(
+        &ev.QueryNodeStatusRequest{})
+    timeout := self.config.CommClientTimeout * 2
+    event, err := self.Request(index, reqEvent, timeout)
+    if err != nil {
+        return nil
+    }
+    e, ok := event.(*ev.QueryNodeStatusResponseEvent)
+    if !ok {
+        return nil
+    }
+    return e.Response
+}
+
+// State returns the raft state and the current term of the node with
+// the specified index. Unlike Status(), it only queries the local hsm,
+// so it never waits on the peers of a leader.
+func (self *Simulation) State(index int) (ev.RaftStateType, uint64) {
+    self.settle()
+    return self.nodes[index].backend.State()
+}
+
+// Leader returns the index of the leader with the highest term,
+// or false if there is no leader.
+func (self *Simulation) Leader() (int, bool) {
+    leader := -1
+    var term uint64 = 0
+    for i := range self.nodes {
+        state, currentTerm := self.State(i)
+        if state != ev.RaftStateLeader {
+            continue
+        }
+        if leader < 0 || currentTerm > term {
+            leader = i
+            term = currentTerm
+        }
+    }
+    return leader, leader >= 0
+}
+
+// WaitLeader runs the cluster until a leader is elected, or the timeout
+// passes in virtual time.
+func (self *Simulation) WaitLeader(timeout time.Duration) (int, bool) {
+    cond := func() bool {
+        _, ok := self.Leader()
+        return ok
+    }
+    if !self.RunUntil(cond, self.clock.Now().Add(timeout)) {
+        return -1, false
+    }
+    return self.Leader()
+}
+
+// Request sends the request to the node with the specified index, and
+// runs the cluster until the response arrives or the timeout passes
+// in virtual time.
+func (self *Simulation) Request(
+    index int,
+    reqEvent ev.RequestEvent,
+    timeout time.Duration) (ev.Event, error) {
+
+    self.nodes[index].backend.Send(reqEvent)
+    var response ev.Event
+    cond := func() bool {
+        select {
+        case response = <-reqEvent.GetResponseChan():
+            return true
+        default:
+            return false
+        }
+    }
+    self.settle()
+    if !self.RunUntil(cond, self.clock.Now().Add(timeout)) {
+        return nil, SimTimeout
+    }
+    return response, nil
+}
+
+// Append appends data to the cluster through the current leader.
+func (self *Simulation) Append(
+    data []byte, timeout time.Duration) ([]byte, error) {
+
+    leader, ok := self.Leader()
+    if !ok {
+        return nil, errors.New("no leader in simulation")
+    }
+    request := &ev.ClientAppendRequest{
+        Data: data,
+    }
+    reqEvent := ev.NewClientAppendRequestEvent(request)
+    event, err := self.Request(leader, reqEvent, timeout)
+    if err != nil {
+        return nil, err
+    }
+    if event.Type() != ev.EventClientResponse {
+        return nil, errors.New(fmt.Sprintf(
+            "unexpected response: %s", ev.EventTypeString(event.Type())))
+    }
+    e, ok := event.(*ev.ClientResponseEvent)
+    if !ok || !e.Response.Success {
+        return nil, errors.New("append fails")
+    }
+    return e.Response.Data, nil
+}
+
+// Restart crashes the node with the specified index, and starts it again
+// on the log, config manager and state machine it runs before, as
+// a process restarting on its disk. The virtual clock stays still during
+// the restart, so that it replays the same with the seed. The faults
+// injected into its log are kept, so they should be healed before that.
+func (self *Simulation) Restart(index int) error {
+    // record what it notifies before the crash
+    self.settle()
+    old := self.nodes[index]
+    old.Close()
+    node, err := self.startNode(old.config, index, old.logFaults,
+        old.configManager, old.stateMachine)
+    if err != nil {
+        return err
+    }
+    self.nodes[index] = node
+    self.settle()
+    return nil
+}
+
+// Close shuts down all the nodes. The virtual clock keeps going
+// during the shutdown, so that the rpcs blocked by faults could time out.
+func (self *Simulation) Close() error {
+    self.register.Faults().Reset()
+    stopChan := make(chan interface{})
+    group := &sync.WaitGroup{}
+    group.Add(1)
+    go func() {
+        defer group.Done()
+        for {
+            select {
+            case <-stopChan:
+                return
+            default:
+            }
+            waitIdle()
+            if _, ok := self.clock.Step(); !ok {
+                runtime.Gosched()
+            }
+        }
+    }()
+    nodes := make([]*SimNode, 0, len(self.nodes))
+    backends := make([]*rafted.HSMBackend, 0, len(self.nodes))
+    for _, node := range self.nodes {
+        if !node.closed {
+            nodes = append(nodes, node)
+            backends = append(backends, node.backend)
+        }
+    }
+    err := rafted.CloseHSMBackends(backends...)
+    for _, node := range nodes {
+        node.stopCollect()
+    }
+    close(stopChan)
+    group.Wait()
+    return err
+}
+
+func describeNotify(event ev.NotifyEvent) string {
+    name := ev.NotifyTypeString(event.Type())
+    switch e := event.(type) {
+    case *ev.NotifyStateChangeEvent:
+        return fmt.Sprintf("%s %s -> %s", name, e.OldState, e.NewState)
+    case *ev.NotifyLeaderChangeEvent:
+        if e.NewLeader == nil {
+            return fmt.Sprintf("%s none", name)
+        }
+        return fmt.Sprintf("%s %s", name, e.NewLeader.String())
+    case *ev.NotifyTermChangeEvent:
+        return fmt.Sprintf("%s %d -> %d", name, e.OldTerm, e.NewTerm)
+    case *ev.NotifyCommitEvent:
+        return fmt.Sprintf("%s term: %d, index: %d", name, e.Term, e.LogIndex)
+    case *ev.NotifyApplyEvent:
+        return fmt.Sprintf("%s term: %d, index: %d", name, e.Term, e.LogIndex)
+    default:
+        return name
+    }
+}
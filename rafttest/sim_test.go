@@ -0,0 +1,806 @@
+package rafttest
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "github.com/hhkbp2/rafted"
+    cm "github.com/hhkbp2/rafted/comm"
+    ev "github.com/hhkbp2/rafted/event"
+    logging "github.com/hhkbp2/rafted/logging"
+    ps "github.com/hhkbp2/rafted/persist"
+    rt "github.com/hhkbp2/rafted/retry"
+    "github.com/hhkbp2/testify/assert"
+    "github.com/hhkbp2/testify/require"
+    "strings"
+    "testing"
+    "time"
+)
+
+var (
+    testConfig = rafted.DefaultConfiguration()
+    testData   = []byte("simulation data")
+)
+
+// The seed of the simulation tests is fixed, so that their failures
+// reproduce. Other schedules could be explored with -sim.seed.
+var testSimulationSeed = flag.Int64(
+    "sim.seed", 20161018, "seed of the simulation tests")
+
+func getTestSimulationSeed(t *testing.T) int64 {
+    seed := *testSimulationSeed
+    t.Logf("simulation seed: %d", seed)
+    return seed
+}
+
+// simCase is a case of the simulation tests, which runs on a cluster
+// of 3 nodes with a leader elected. The config of the cluster is
+// testConfig changed by configure. If replay is set, the case is run twice
+// to check that it replays the same with the seed.
+type simCase struct {
+    name      string
+    configure func(config *rafted.Configuration)
+    replay    bool
+    run       func(st *simTest)
+}
+
+// simTest is the simulation a simCase runs on.
+type simTest struct {
+    t      *testing.T
+    sim    *Simulation
+    config *rafted.Configuration
+    leader int
+}
+
+func runSimCases(t *testing.T, cases []simCase) {
+    seed := getTestSimulationSeed(t)
+    for _, c := range cases {
+        c := c
+        t.Run(c.name, func(t *testing.T) {
+            config := *testConfig
+            if c.configure != nil {
+                c.configure(&config)
+            }
+            trace := runSimCase(t, &config, seed, c.run)
+            if !c.replay {
+                return
+            }
+            assert.NotEqual(t, 0, len(trace))
+            replay := runSimCase(t, &config, seed, c.run)
+            assert.Equal(t, trace, replay, "seed %d replays differently", seed)
+        })
+    }
+}
+
+func runSimCase(
+    t *testing.T,
+    config *rafted.Configuration,
+    seed int64,
+    run func(st *simTest)) []string {
+
+    sim, err := NewSimulation(config, 3, seed)
+    require.Nil(t, err)
+    defer sim.Close()
+    leader, ok := sim.WaitLeader(config.ElectionTimeout * 10)
+    require.True(t, ok, "no leader elected with seed: %d", seed)
+    st := &simTest{
+        t:      t,
+        sim:    sim,
+        config: config,
+        leader: leader,
+    }
+    run(st)
+    return sim.Trace()
+}
+
+// others returns the indexes of the nodes except the specified ones.
+func (self *simTest) others(excluded ...int) []int {
+    others := make([]int, 0, len(self.sim.Nodes()))
+    for i := range self.sim.Nodes() {
+        found := false
+        for _, j := range excluded {
+            if i == j {
+                found = true
+            }
+        }
+        if !found {
+            others = append(others, i)
+        }
+    }
+    return others
+}
+
+// isolate partitions the node with the specified index from the others,
+// and returns the indexes of the others.
+func (self *simTest) isolate(index int) []int {
+    others := self.others(index)
+    self.sim.Faults().Partition(
+        self.sim.Addrs(index), self.sim.Addrs(others...))
+    return others
+}
+
+// runUntil runs the simulation until cond is true, or the timeout passes
+// in virtual time. It returns the final value of cond.
+func (self *simTest) runUntil(cond func() bool, timeout time.Duration) bool {
+    deadline := self.sim.Clock().Now().Add(timeout)
+    return self.sim.RunUntil(cond, deadline)
+}
+
+// waitLeaderIn runs the simulation until one of the nodes with
+// the specified indexes becomes leader, and returns its index.
+func (self *simTest) waitLeaderIn(
+    timeout time.Duration, indexes ...int) (int, bool) {
+
+    leader := -1
+    cond := func() bool {
+        for _, i := range indexes {
+            if state, _ := self.sim.State(i); state == ev.RaftStateLeader {
+                leader = i
+                return true
+            }
+        }
+        return false
+    }
+    return leader, self.runUntil(cond, timeout)
+}
+
+// waitResponse runs the simulation until the response of reqEvent arrives,
+// or the timeout passes in virtual time, when it returns nil.
+func (self *simTest) waitResponse(
+    reqEvent ev.RequestEvent, timeout time.Duration) ev.Event {
+
+    var response ev.Event
+    cond := func() bool {
+        select {
+        case response = <-reqEvent.GetResponseChan():
+            return true
+        default:
+            return false
+        }
+    }
+    if !self.runUntil(cond, timeout) {
+        return nil
+    }
+    return response
+}
+
+// nextIndex returns the index of the next entry to append by the node
+// with the specified index.
+func (self *simTest) nextIndex(index int) uint64 {
+    status := self.sim.Status(index)
+    require.NotNil(self.t, status)
+    return status.LastLogIndex + 1
+}
+
+// failLeader fails the log of the leader, and makes it enter persist
+// error state with an append request. It returns the virtual time when
+// the log fails.
+func (self *simTest) failLeader() time.Time {
+    node := self.sim.Nodes()[self.leader]
+    node.LogFaults().Fail(nil)
+    failTime := self.sim.Clock().Now()
+    event, err := self.sim.Request(self.leader, newSimAppendEvent(),
+        self.config.CommClientTimeout)
+    require.Nil(self.t, err)
+    assert.Equal(self.t, ev.EventPersistErrorResponse, event.Type())
+    assert.Equal(self.t, rafted.StatePersistErrorID,
+        node.Backend().StateID())
+    return failTime
+}
+
+func (self *simTest) resume(index int) ev.Event {
+    reqEvent := ev.NewResumeRequestEvent(&ev.ResumeRequest{})
+    event, err := self.sim.Request(
+        index, reqEvent, self.config.CommClientTimeout)
+    if err != nil {
+        return nil
+    }
+    return event
+}
+
+// waitResume runs the simulation until the node with the specified index
+// leaves persist error state by itself.
+func (self *simTest) waitResume(index int, timeout time.Duration) bool {
+    backend := self.sim.Nodes()[index].Backend()
+    cond := func() bool {
+        self.sim.settle()
+        return backend.StateID() != rafted.StatePersistErrorID
+    }
+    return self.runUntil(cond, timeout)
+}
+
+func newSimAppendEvent() *ev.ClientAppendRequestEvent {
+    request := &ev.ClientAppendRequest{
+        Data: testData,
+    }
+    return ev.NewClientAppendRequestEvent(request)
+}
+
+func TestSimulationElection(t *testing.T) {
+    runSimCases(t, []simCase{
+        {
+            name:   "Stable",
+            replay: true,
+            run:    testSimStable,
+        },
+        {
+            name:   "Partition",
+            replay: true,
+            run:    testSimPartition,
+        },
+        {
+            name: "CheckQuorum",
+            configure: func(config *rafted.Configuration) {
+                config.CheckQuorum = true
+            },
+            run: testSimCheckQuorum,
+        },
+        {
+            name: "NoCheckQuorum",
+            configure: func(config *rafted.Configuration) {
+                config.CheckQuorum = false
+            },
+            run: testSimCheckQuorum,
+        },
+    })
+}
+
+func testSimStable(st *simTest) {
+    result, err := st.sim.Append(testData, st.config.ElectionTimeout)
+    require.Nil(st.t, err)
+    assert.Equal(st.t, testData, result)
+    st.sim.Run(st.config.ElectionTimeout * 2)
+    // the leader keeps its leadership with no fault injected
+    current, ok := st.sim.Leader()
+    assert.True(st.t, ok)
+    assert.Equal(st.t, st.leader, current)
+}
+
+func testSimPartition(st *simTest) {
+    others := st.isolate(st.leader)
+    _, ok := st.waitLeaderIn(st.config.CommClientTimeout*10, others...)
+    require.True(st.t, ok, "no new leader elected in majority")
+    // the old leader steps down after the partition heals
+    st.sim.Faults().Heal()
+    cond := func() bool {
+        state, _ := st.sim.State(st.leader)
+        return state != ev.RaftStateLeader
+    }
+    assert.True(st.t, st.runUntil(cond, st.config.CommClientTimeout*10),
+        "old leader doesn't step down")
+}
+
+func testSimCheckQuorum(st *simTest) {
+    st.isolate(st.leader)
+    // the partition is never healed, the isolated leader has to
+    // notice it by itself
+    cond := func() bool {
+        state, _ := st.sim.State(st.leader)
+        return state != ev.RaftStateLeader
+    }
+    steppedDown := st.runUntil(cond, st.config.ElectionTimeout*4)
+    if !st.config.CheckQuorum {
+        assert.False(st.t, steppedDown, "isolated leader steps down")
+        return
+    }
+    require.True(st.t, steppedDown, "isolated leader doesn't step down")
+    st.sim.settle()
+    stepdown := fmt.Sprintf("node%d %s %s -> %s", st.leader,
+        ev.NotifyTypeString(ev.EventNotifyStateChange),
+        ev.RaftStateLeader, ev.RaftStateFollower)
+    found := false
+    for _, line := range st.sim.Trace() {
+        if strings.HasSuffix(line, stepdown) {
+            found = true
+        }
+    }
+    assert.True(st.t, found, "no stepdown notify")
+}
+
+func TestSimulationLeaderChange(t *testing.T) {
+    runSimCases(t, []simCase{
+        {
+            name: "FailInflightOnStepdown",
+            run:  testSimFailInflightOnStepdown,
+        },
+        {
+            name: "LeaderWriteInParallel",
+            run:  testSimLeaderWriteInParallel,
+        },
+        {
+            name: "LeaderCrashBeforePersist",
+            run:  testSimLeaderCrashBeforePersist,
+        },
+    })
+}
+
+func testSimFailInflightOnStepdown(st *simTest) {
+    others := st.isolate(st.leader)
+    // the request to the isolated leader never commits
+    reqEvent := newSimAppendEvent()
+    st.sim.Nodes()[st.leader].Backend().Send(reqEvent)
+    newLeader, ok := st.waitLeaderIn(
+        st.config.CommClientTimeout*10, others...)
+    require.True(st.t, ok, "no new leader elected in majority")
+    // it fails as soon as the old leader steps down
+    st.sim.Faults().Heal()
+    response := st.waitResponse(reqEvent, st.config.CommClientTimeout*10)
+    require.NotNil(st.t, response, "inflight request not failed")
+    e, ok := response.(*ev.LeaderChangedResponseEvent)
+    require.True(st.t, ok,
+        "unexpected response: %s", ev.EventString(response))
+    if e.Response.Leader != nil {
+        assert.Equal(st.t, st.sim.Nodes()[newLeader].Addr(),
+            e.Response.Leader)
+    }
+}
+
+func testSimLeaderWriteInParallel(st *simTest) {
+    index := st.nextIndex(st.leader)
+    node := st.sim.Nodes()[st.leader]
+    node.LogFaults().Block()
+    defer node.LogFaults().Unblock()
+    reqEvent := newSimAppendEvent()
+    node.Backend().Send(reqEvent)
+    st.sim.Run(st.config.HeartbeatTimeout * 2)
+    // the entry is replicated to followers while the leader is
+    // still writing it, but not committed before the leader finishes
+    for _, i := range st.others(st.leader) {
+        lastIndex, err := st.sim.Nodes()[i].LogFaults().LastIndex()
+        require.Nil(st.t, err)
+        assert.Equal(st.t, index, lastIndex)
+    }
+    committedIndex, err := node.LogFaults().CommittedIndex()
+    require.Nil(st.t, err)
+    assert.True(st.t, committedIndex < index)
+    select {
+    case event := <-reqEvent.GetResponseChan():
+        assert.Fail(st.t, "unexpected response: %s", ev.EventString(event))
+    default:
+    }
+    node.LogFaults().Unblock()
+    response := st.waitResponse(reqEvent, st.config.CommClientTimeout)
+    require.NotNil(st.t, response, "request not committed")
+    e, ok := response.(*ev.ClientResponseEvent)
+    require.True(st.t, ok,
+        "unexpected response: %s", ev.EventString(response))
+    assert.True(st.t, e.Response.Success)
+    committedIndex, err = node.LogFaults().CommittedIndex()
+    require.Nil(st.t, err)
+    assert.Equal(st.t, index, committedIndex)
+}
+
+func testSimLeaderCrashBeforePersist(st *simTest) {
+    index := st.nextIndex(st.leader)
+    node := st.sim.Nodes()[st.leader]
+    node.LogFaults().Block()
+    defer node.LogFaults().Unblock()
+    node.Backend().Send(newSimAppendEvent())
+    st.sim.Run(st.config.HeartbeatTimeout * 2)
+    // the leader crashes after sending the entry but before storing it
+    node.LogFaults().Fail(nil)
+    node.LogFaults().Unblock()
+    others := st.others(st.leader)
+    newLeader, ok := st.waitLeaderIn(
+        st.config.ElectionTimeout*10, others...)
+    require.True(st.t, ok, "no new leader elected")
+    // the entry stored by the majority survives and commits
+    _, err := st.sim.Append(testData, st.config.ElectionTimeout)
+    require.Nil(st.t, err)
+    newLog := st.sim.Nodes()[newLeader].LogFaults()
+    committedIndex, err := newLog.CommittedIndex()
+    require.Nil(st.t, err)
+    assert.True(st.t, committedIndex > index)
+    for _, i := range others {
+        entry, err := st.sim.Nodes()[i].LogFaults().GetLog(index)
+        require.Nil(st.t, err)
+        assert.Equal(st.t, testData, entry.Data)
+    }
+    // the old leader restarts on its log without the entry, and converges
+    // with the new leader
+    node.LogFaults().Heal()
+    require.Nil(st.t, st.sim.Restart(st.leader))
+    oldLog := st.sim.Nodes()[st.leader].LogFaults()
+    converged := func() bool {
+        st.sim.settle()
+        lastIndex, err := newLog.LastIndex()
+        require.Nil(st.t, err)
+        committedIndex, err := newLog.CommittedIndex()
+        require.Nil(st.t, err)
+        oldLastIndex, err := oldLog.LastIndex()
+        require.Nil(st.t, err)
+        oldCommittedIndex, err := oldLog.CommittedIndex()
+        require.Nil(st.t, err)
+        return (oldLastIndex == lastIndex) &&
+            (oldCommittedIndex == committedIndex)
+    }
+    require.True(st.t, st.runUntil(converged, st.config.ElectionTimeout*10),
+        "old leader doesn't converge")
+    firstIndex, err := newLog.FirstIndex()
+    require.Nil(st.t, err)
+    lastIndex, err := newLog.LastIndex()
+    require.Nil(st.t, err)
+    require.True(st.t, lastIndex > index)
+    for i := firstIndex; i <= lastIndex; i++ {
+        expected, err := newLog.GetLog(i)
+        require.Nil(st.t, err)
+        entry, err := oldLog.GetLog(i)
+        require.Nil(st.t, err)
+        assert.Equal(st.t, expected.Term, entry.Term)
+        assert.Equal(st.t, expected.Data, entry.Data)
+    }
+}
+
+func TestSimulationPersistError(t *testing.T) {
+    runSimCases(t, []simCase{
+        {
+            name: "Resume",
+            run:  testSimPersistErrorResume,
+        },
+        {
+            name: "AutoRetry",
+            configure: func(config *rafted.Configuration) {
+                config.PersistErrorPolicy = rafted.PersistErrorAutoRetry
+                config.PersistErrorRetry = rt.NewErrorRetry().Delay(
+                    config.ElectionTimeout).Backoff(1)
+            },
+            run: testSimPersistErrorAutoRetry,
+        },
+        {
+            name: "AutoRetryGiveUp",
+            configure: func(config *rafted.Configuration) {
+                config.PersistErrorPolicy = rafted.PersistErrorAutoRetry
+                config.PersistErrorRetry = rt.NewErrorRetry().Delay(
+                    config.ElectionTimeout).Backoff(1).MaxTries(2)
+            },
+            run: testSimPersistErrorAutoRetryGiveUp,
+        },
+        {
+            name: "AutoRetryFailWrites",
+            configure: func(config *rafted.Configuration) {
+                config.PersistErrorPolicy = rafted.PersistErrorAutoRetry
+            },
+            run: testSimPersistErrorAutoRetryFailWrites,
+        },
+        {
+            name: "Evacuate",
+            configure: func(config *rafted.Configuration) {
+                config.PersistErrorPolicy = rafted.PersistErrorEvacuate
+            },
+            run: testSimPersistErrorEvacuate,
+        },
+    })
+}
+
+func testSimPersistErrorResume(st *simTest) {
+    st.failLeader()
+    node := st.sim.Nodes()[st.leader]
+    // it refuses to resume until the log works again
+    event := st.resume(st.leader)
+    require.NotNil(st.t, event)
+    assert.Equal(st.t, ev.EventPersistErrorResponse, event.Type())
+    st.sim.Run(st.config.ElectionTimeout * 2)
+    assert.Equal(st.t, rafted.StatePersistErrorID, node.Backend().StateID())
+    node.LogFaults().Heal()
+    event = st.resume(st.leader)
+    require.NotNil(st.t, event)
+    e, ok := event.(*ev.ClientResponseEvent)
+    require.True(st.t, ok, "unexpected response: %s", ev.EventString(event))
+    assert.True(st.t, e.Response.Success)
+    assert.NotEqual(st.t, rafted.StatePersistErrorID,
+        node.Backend().StateID())
+    // resuming it again is a no-op
+    event = st.resume(st.leader)
+    require.NotNil(st.t, event)
+    assert.Equal(st.t, ev.EventClientResponse, event.Type())
+    _, ok = st.sim.WaitLeader(st.config.ElectionTimeout * 10)
+    require.True(st.t, ok, "no leader elected")
+    _, err := st.sim.Append(testData, st.config.ElectionTimeout)
+    assert.Nil(st.t, err)
+}
+
+func testSimPersistErrorAutoRetry(st *simTest) {
+    st.failLeader()
+    node := st.sim.Nodes()[st.leader]
+    // it keeps retrying the check, and refuses client requests meanwhile
+    st.sim.Run(st.config.ElectionTimeout * 4)
+    assert.Equal(st.t, rafted.StatePersistErrorID, node.Backend().StateID())
+    event, err := st.sim.Request(st.leader, newSimAppendEvent(),
+        st.config.CommClientTimeout)
+    require.Nil(st.t, err)
+    assert.Equal(st.t, ev.EventPersistErrorResponse, event.Type())
+    // it resumes by itself at the next retry once the log works again
+    node.LogFaults().Heal()
+    healTime := st.sim.Clock().Now()
+    require.True(st.t,
+        st.waitResume(st.leader, st.config.ElectionTimeout*10),
+        "node doesn't resume")
+    // the delay is ElectionTimeout, with a jitter of 10% at most
+    elapsed := st.sim.Clock().Now().Sub(healTime)
+    maxDelay := st.config.ElectionTimeout + st.config.ElectionTimeout/10
+    assert.True(st.t, elapsed <= maxDelay, "resume takes %s", elapsed)
+}
+
+func testSimPersistErrorAutoRetryGiveUp(st *simTest) {
+    st.failLeader()
+    node := st.sim.Nodes()[st.leader]
+    // it stops retrying after the max tries, and doesn't resume by itself
+    // even though the log works again later
+    st.sim.Run(st.config.ElectionTimeout * 4)
+    node.LogFaults().Heal()
+    assert.False(st.t,
+        st.waitResume(st.leader, st.config.ElectionTimeout*10),
+        "node resumes after retries given up")
+    // it's left to the operator
+    event := st.resume(st.leader)
+    require.NotNil(st.t, event)
+    e, ok := event.(*ev.ClientResponseEvent)
+    require.True(st.t, ok, "unexpected response: %s", ev.EventString(event))
+    assert.True(st.t, e.Response.Success)
+    assert.NotEqual(st.t, rafted.StatePersistErrorID,
+        node.Backend().StateID())
+}
+
+func testSimPersistErrorAutoRetryFailWrites(st *simTest) {
+    st.failLeader()
+    node := st.sim.Nodes()[st.leader]
+    // the log is readable again but still fails writes, the node
+    // doesn't resume to fail again
+    node.LogFaults().FailWrites(nil)
+    st.sim.Run(st.config.ElectionTimeout * 4)
+    assert.Equal(st.t, rafted.StatePersistErrorID, node.Backend().StateID())
+    event := st.resume(st.leader)
+    require.NotNil(st.t, event)
+    assert.Equal(st.t, ev.EventPersistErrorResponse, event.Type())
+    node.LogFaults().Heal()
+    assert.True(st.t, st.waitResume(st.leader, st.config.ElectionTimeout*10),
+        "node doesn't resume")
+}
+
+func testSimPersistErrorEvacuate(st *simTest) {
+    failTime := st.failLeader()
+    // the leadership is transferred without waiting for election timeout
+    _, ok := st.waitLeaderIn(
+        st.config.ElectionTimeout*10, st.others(st.leader)...)
+    require.True(st.t, ok, "no new leader elected")
+    elapsed := st.sim.Clock().Now().Sub(failTime)
+    assert.True(st.t, elapsed < st.config.HeartbeatTimeout,
+        "leadership transfer takes %s", elapsed)
+    assert.Equal(st.t, rafted.StatePersistErrorID,
+        st.sim.Nodes()[st.leader].Backend().StateID())
+}
+
+func TestSimulationConfig(t *testing.T) {
+    runSimCases(t, []simCase{
+        {
+            name: "PreferredLeader",
+            run:  testSimPreferredLeader,
+        },
+        {
+            name: "UpdateAddr",
+            run:  testSimUpdateAddr,
+        },
+    })
+}
+
+func testSimPreferredLeader(st *simTest) {
+    preferred := (st.leader + 1) % 3
+    // raise the priority of a follower through the member change
+    servers := st.sim.addrs
+    request := &ev.ClientChangeConfigRequest{
+        Conf: &ps.Config{
+            Servers:    servers,
+            NewServers: servers,
+            Priorities: map[string]uint32{
+                ps.ServerKey(st.sim.Nodes()[preferred].Addr()): 1,
+            },
+        },
+    }
+    event, err := st.sim.Request(st.leader,
+        ev.NewClientChangeConfigRequestEvent(request),
+        st.config.CommClientTimeout)
+    require.Nil(st.t, err)
+    e, ok := event.(*ev.ClientResponseEvent)
+    require.True(st.t, ok, "unexpected response: %s", ev.EventString(event))
+    require.True(st.t, e.Response.Success)
+    _, ok = st.waitLeaderIn(st.config.ElectionTimeout*10, preferred)
+    require.True(st.t, ok, "leadership not transferred to preferred member")
+    // the others take over when it's away, and hand the leadership back
+    // once it returns
+    others := st.isolate(preferred)
+    _, ok = st.waitLeaderIn(st.config.ElectionTimeout*10, others...)
+    require.True(st.t, ok, "no leader elected in majority")
+    st.sim.Faults().Heal()
+    _, ok = st.waitLeaderIn(st.config.ElectionTimeout*20, preferred)
+    assert.True(st.t, ok, "leadership not transferred back")
+}
+
+func testSimUpdateAddr(st *simTest) {
+    moved := (st.leader + 1) % 3
+    node := st.sim.Nodes()[moved]
+    oldAddr := node.Addr()
+    // the follower moves to a new address, where it's served as well
+    newAddr := &ps.ServerAddress{
+        ID: oldAddr.ID,
+        Addresses: []*ps.Address{
+            &ps.Address{
+                Protocol: "memory",
+                IP:       "127.0.0.1",
+                Port:     7152,
+            },
+        },
+    }
+    eventHandler := func(event ev.RequestEvent) {
+        node.Backend().Send(event)
+    }
+    server := cm.NewMemoryServer(
+        newAddr,
+        st.config.CommServerTimeout,
+        eventHandler,
+        st.sim.Register(),
+        logging.GetLogger("server#moved"))
+    server.Serve()
+    defer server.Close()
+    first := st.nextIndex(st.leader)
+    request := &ev.ClientUpdateAddrRequest{
+        Addr: newAddr,
+    }
+    event, err := st.sim.Request(st.leader,
+        ev.NewClientUpdateAddrRequestEvent(request),
+        st.config.CommClientTimeout)
+    require.Nil(st.t, err)
+    e, ok := event.(*ev.ClientResponseEvent)
+    require.True(st.t, ok, "unexpected response: %s", ev.EventString(event))
+    require.True(st.t, e.Response.Success)
+    // the old address is unreachable from then on
+    for _, i := range st.others(moved) {
+        st.sim.Faults().Cut(st.sim.Nodes()[i].Addr(), oldAddr)
+    }
+    _, err = st.sim.Append(testData, st.config.CommClientTimeout)
+    require.Nil(st.t, err)
+    index := st.sim.Status(st.leader).CommittedIndex
+    cond := func() bool {
+        for i := 0; i < 3; i++ {
+            if st.sim.Status(i).CommittedIndex < index {
+                return false
+            }
+        }
+        return true
+    }
+    require.True(st.t, st.runUntil(cond, st.config.ElectionTimeout*10),
+        "members not caught up")
+    for i := 0; i < 3; i++ {
+        status := st.sim.Status(i)
+        require.NotNil(st.t, status)
+        assert.Nil(st.t, status.PendingConf)
+        assert.Equal(st.t, 3, status.Conf.Servers.Len())
+        server := status.Conf.Servers.Get(newAddr)
+        require.NotNil(st.t, server)
+        assert.True(st.t, ps.AddressesEqual(server, newAddr))
+    }
+    // it's replicated as a single entry of the new addresses rather than
+    // a member change procedure
+    for i, other := range st.sim.Nodes() {
+        log := other.LogFaults()
+        lastIndex, err := log.LastIndex()
+        require.Nil(st.t, err)
+        updates := 0
+        for j := first; j <= lastIndex; j++ {
+            entry, err := log.GetLog(j)
+            require.Nil(st.t, err)
+            assert.NotEqual(st.t, ps.LogMemberChange, entry.Type,
+                "member change entry at %d of node%d", j, i)
+            if entry.Type != ps.LogAddrUpdate {
+                continue
+            }
+            updates++
+            require.NotNil(st.t, entry.Conf)
+            assert.Nil(st.t, entry.Conf.NewServers)
+            assert.Equal(st.t, 3, entry.Conf.Servers.Len())
+            server := entry.Conf.Servers.Get(newAddr)
+            require.NotNil(st.t, server)
+            assert.True(st.t, ps.AddressesEqual(server, newAddr))
+        }
+        assert.Equal(st.t, 1, updates,
+            "%d address update entries in node%d", updates, i)
+    }
+}
+
+func TestSimulationShutdown(t *testing.T) {
+    runSimCases(t, []simCase{
+        {
+            name: "LeaderDrain",
+            run:  testSimLeaderDrain,
+        },
+        {
+            name: "FailQueuedOnTerminate",
+            run:  testSimFailQueuedOnTerminate,
+        },
+    })
+}
+
+func testSimLeaderDrain(st *simTest) {
+    _, err := st.sim.Append(testData, st.config.CommClientTimeout)
+    require.Nil(st.t, err)
+    index := st.sim.Status(st.leader).LastLogIndex
+    node := st.sim.Nodes()[st.leader]
+    drained := make(chan error, 1)
+    go func() {
+        drained <- node.Backend().Drain(context.Background())
+    }()
+    var drainErr error
+    cond := func() bool {
+        select {
+        case drainErr = <-drained:
+            return true
+        default:
+            return false
+        }
+    }
+    require.True(st.t, st.runUntil(cond, st.config.ElectionTimeout*10),
+        "drain not finished")
+    require.Nil(st.t, drainErr)
+    // the leadership is taken over after the entries are applied
+    status := st.sim.Status(st.leader)
+    require.NotNil(st.t, status)
+    assert.True(st.t, status.LastAppliedIndex >= index)
+    assert.NotEqual(st.t, ev.RaftStateLeader, status.State)
+    require.NotNil(st.t, status.Leader)
+    assert.True(st.t, ps.MultiAddrNotEqual(node.Addr(), status.Leader))
+    // the client requests are redirected to the new leader
+    event, err := st.sim.Request(st.leader, newSimAppendEvent(),
+        st.config.CommClientTimeout)
+    require.Nil(st.t, err)
+    e, ok := event.(*ev.LeaderRedirectResponseEvent)
+    require.True(st.t, ok, "unexpected response: %s", ev.EventString(event))
+    assert.True(st.t, ps.MultiAddrEqual(status.Leader, e.Response.Leader))
+}
+
+func testSimFailQueuedOnTerminate(st *simTest) {
+    follower := st.others(st.leader)[0]
+    node := st.sim.Nodes()[follower]
+    // the follower is held storing an entry, with the client requests
+    // sent to it queued behind
+    node.LogFaults().Block()
+    defer node.LogFaults().Unblock()
+    st.sim.Nodes()[st.leader].Backend().Send(newSimAppendEvent())
+    st.sim.Run(st.config.HeartbeatTimeout * 2)
+    reqEvents := make([]ev.RequestEvent, 0, 2)
+    for i := 0; i < 2; i++ {
+        reqEvent := newSimAppendEvent()
+        node.Backend().Send(reqEvent)
+        reqEvents = append(reqEvents, reqEvent)
+    }
+    st.sim.settle()
+    for _, reqEvent := range reqEvents {
+        select {
+        case event := <-reqEvent.GetResponseChan():
+            assert.Fail(st.t, "unexpected response: %s",
+                ev.EventString(event))
+        default:
+        }
+    }
+    // they're failed as if the leader is unknown once it's terminating,
+    // even though it's released after that
+    closed := make(chan error, 1)
+    go func() {
+        closed <- node.Close()
+    }()
+    st.sim.Run(st.config.HeartbeatTimeout)
+    node.LogFaults().Unblock()
+    cond := func() bool {
+        select {
+        case <-closed:
+            return true
+        default:
+            return false
+        }
+    }
+    require.True(st.t, st.runUntil(cond, st.config.CommClientTimeout*10),
+        "node not closed")
+    for _, reqEvent := range reqEvents {
+        event := reqEvent.RecvResponse()
+        assert.Equal(st.t, ev.EventLeaderUnknownResponse, event.Type(),
+            "unexpected response: %s", ev.EventString(event))
+    }
+}
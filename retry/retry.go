@@ -1,10 +1,13 @@
 package retry
 
 import (
+    "context"
     "errors"
     "github.com/deckarep/golang-set"
+    "hash/fnv"
     "math"
     "math/rand"
+    "sync"
     "time"
 )
 
@@ -18,8 +21,31 @@ var (
     RetryFailedError       = errors.New("retry failed")
 )
 
+// Retry calls a function until it succeeds or the retry policy gives up.
+// DoContext is the same as Do, except that it also gives up once ctx is
+// done, with the error of ctx if the function is never called, or
+// the error it gives up with otherwise. It never sleeps beyond
+// the deadline of ctx. A cancellation of ctx during a sleep is noticed
+// when the sleep ends.
 type Retry interface {
     Do(func() error) error
+    DoContext(ctx context.Context, fn func() error) error
+}
+
+// sleepContext sleeps for d with sleepFunc. It returns false if ctx is
+// done after the sleep, or without sleeping if ctx is done already or
+// its deadline comes before d passes.
+func sleepContext(
+    ctx context.Context, sleepFunc func(time.Duration), d time.Duration) bool {
+
+    if ctx.Err() != nil {
+        return false
+    }
+    if deadline, ok := ctx.Deadline(); ok && time.Now().Add(d).After(deadline) {
+        return false
+    }
+    sleepFunc(d)
+    return ctx.Err() == nil
 }
 
 type NTimesRetry struct {
@@ -41,10 +67,23 @@ func NewNTimesRetry(
 }
 
 func (self *NTimesRetry) Do(fn func() error) error {
+    return self.DoContext(context.Background(), fn)
+}
+
+func (self *NTimesRetry) DoContext(
+    ctx context.Context, fn func() error) error {
+
     var err error
+    if err = ctx.Err(); err != nil {
+        return err
+    }
     for i := uint32(0); i < self.maxTimes; i++ {
         if err = fn(); err != nil {
-            self.sleepFunc(self.sleepTimeBetweenRetries)
+            if !sleepContext(
+                ctx, self.sleepFunc, self.sleepTimeBetweenRetries) {
+
+                return err
+            }
             continue
         }
         return nil
@@ -84,10 +123,23 @@ func NewUntilElapsedRetry(
 }
 
 func (self *UntilElapsedRetry) Do(fn func() error) error {
+    return self.DoContext(context.Background(), fn)
+}
+
+func (self *UntilElapsedRetry) DoContext(
+    ctx context.Context, fn func() error) error {
+
+    if err := ctx.Err(); err != nil {
+        return err
+    }
     startTime := time.Now()
     for {
         if err := fn(); err != nil {
-            self.sleepFunc(self.sleepTimeBetweenRetries)
+            if !sleepContext(
+                ctx, self.sleepFunc, self.sleepTimeBetweenRetries) {
+
+                return err
+            }
             if time.Since(startTime) >= self.maxElapsedTime {
                 return err
             }
@@ -116,14 +168,25 @@ func NewExponentialBackoffRetry(
 }
 
 func (self *ExponentialBackoffRetry) Do(fn func() error) error {
+    return self.DoContext(context.Background(), fn)
+}
+
+func (self *ExponentialBackoffRetry) DoContext(
+    ctx context.Context, fn func() error) error {
+
     var err error
+    if err = ctx.Err(); err != nil {
+        return err
+    }
     sleepTime := self.baseSleepTime
     for {
         if err = fn(); err != nil {
             if sleepTime > self.maxSleepTime {
                 sleepTime = self.maxSleepTime
             }
-            self.sleepFunc(sleepTime)
+            if !sleepContext(ctx, self.sleepFunc, sleepTime) {
+                return err
+            }
             sleepTime = time.Duration(2 * int64(sleepTime))
             continue
         }
@@ -153,7 +216,16 @@ func NewBoundedExponentialBackoffRetry(
 }
 
 func (self *BoundedExponentialBackoffRetry) Do(fn func() error) error {
+    return self.DoContext(context.Background(), fn)
+}
+
+func (self *BoundedExponentialBackoffRetry) DoContext(
+    ctx context.Context, fn func() error) error {
+
     var err error
+    if err = ctx.Err(); err != nil {
+        return err
+    }
     sleepTime := self.baseSleepTime
     for i := uint32(0); i < self.maxTries; i++ {
         if err = fn(); err != nil {
@@ -161,7 +233,9 @@ func (self *BoundedExponentialBackoffRetry) Do(fn func() error) error {
             if sleepTime > self.maxSleepTime {
                 sleepTime = self.maxSleepTime
             }
-            self.sleepFunc(sleepTime)
+            if !sleepContext(ctx, self.sleepFunc, sleepTime) {
+                return err
+            }
             continue
         }
         return nil
@@ -253,6 +327,43 @@ func RandIntN(n int) int {
     return rand.Intn(n)
 }
 
+// Random is a source of pseudo random numbers. Forks of a Random seeded
+// with the same value always generate the same sequences, no matter in
+// which order they are created.
+type Random interface {
+    Intn(n int) int
+    Fork(name string) Random
+}
+
+type LockedRandom struct {
+    seed int64
+    rand *rand.Rand
+    lock sync.Mutex
+}
+
+func NewRandom(seed int64) *LockedRandom {
+    return &LockedRandom{
+        seed: seed,
+        rand: rand.New(rand.NewSource(seed)),
+    }
+}
+
+func (self *LockedRandom) Intn(n int) int {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.rand.Intn(n)
+}
+
+func (self *LockedRandom) Fork(name string) Random {
+    h := fnv.New64a()
+    h.Write([]byte(name))
+    return NewRandom(self.seed ^ int64(h.Sum64()))
+}
+
+var (
+    DefaultRandom Random = NewRandom(time.Now().UTC().UnixNano())
+)
+
 func (self *ErrorRetry) jitterDelay(delay time.Duration) time.Duration {
     jitter := float64(RandIntN(int(self.maxJitter*100))) / 100
     return time.Duration(int64(float64(int64(delay)) * (1 + jitter)))
@@ -271,6 +382,15 @@ func Min(a, b int64) int64 {
 }
 
 func (self *ErrorRetry) Do(fn func() error) error {
+    return self.DoContext(context.Background(), fn)
+}
+
+// DoContext gives up with the error of ctx once ctx is done, or with
+// context.DeadlineExceeded if the deadline of ctx comes before the next try.
+func (self *ErrorRetry) DoContext(ctx context.Context, fn func() error) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
     latestDelay := self.delay
     startTime := time.Now()
     for attempt := 0; attempt != self.maxTries; attempt++ {
@@ -282,7 +402,12 @@ func (self *ErrorRetry) Do(fn func() error) error {
                         return RetryFailedError
                     }
                 }
-                self.sleepFunc(sleepTime)
+                if !sleepContext(ctx, self.sleepFunc, sleepTime) {
+                    if err := ctx.Err(); err != nil {
+                        return err
+                    }
+                    return context.DeadlineExceeded
+                }
                 latestDelay = self.backoffDelay(latestDelay)
                 continue
             }
@@ -1,6 +1,7 @@
 package retry
 
 import (
+    "context"
     "errors"
     "github.com/hhkbp2/testify/assert"
     "testing"
@@ -305,3 +306,58 @@ func TestErrorRetryErrors(t *testing.T) {
     assert.Equal(t, sleepCount, triesBeforeSuccess)
     assert.Equal(t, fnCount, triesBeforeSuccess+1)
 }
+
+func TestRetryContext(t *testing.T) {
+    sleepCount := 0
+    sleepFunc := func(d time.Duration) {
+        sleepCount++
+        time.Sleep(d)
+    }
+    e := errors.New("test error")
+    fnCount := 0
+    fn := func() error {
+        fnCount++
+        return e
+    }
+    // a done ctx stops retry before any call
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    retry := NewNTimesRetry(sleepFunc, 3, time.Millisecond)
+    err := retry.DoContext(ctx, fn)
+    assert.Equal(t, context.Canceled, err)
+    assert.Equal(t, 0, fnCount)
+    // never sleep beyond the deadline of ctx
+    ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    retry = NewNTimesRetry(sleepFunc, 3, time.Second*10)
+    startTime := time.Now()
+    err = retry.DoContext(ctx, fn)
+    assert.Equal(t, e, err)
+    assert.Equal(t, 1, fnCount)
+    assert.Equal(t, 0, sleepCount)
+    assert.True(t, time.Since(startTime) < time.Second)
+    // keep retrying until the deadline of ctx
+    fnCount = 0
+    timeout := time.Millisecond * 100
+    ctx, cancel = context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    errorRetry := NewErrorRetry().
+        SleepFunc(sleepFunc).
+        Delay(time.Millisecond * 10).
+        Backoff(1).
+        OnError(e)
+    startTime = time.Now()
+    err = errorRetry.DoContext(ctx, fn)
+    assert.Equal(t, context.DeadlineExceeded, err)
+    assert.True(t, fnCount > 1)
+    assert.True(t, time.Since(startTime) < timeout+time.Millisecond*20)
+    // a cancellation during a sleep is returned
+    fnCount = 0
+    ctx, cancel = context.WithCancel(context.Background())
+    errorRetry.SleepFunc(func(d time.Duration) {
+        cancel()
+    })
+    err = errorRetry.DoContext(ctx, fn)
+    assert.Equal(t, context.Canceled, err)
+    assert.Equal(t, 1, fnCount)
+}
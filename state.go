@@ -2,6 +2,7 @@ package rafted
 
 import (
     hsm "github.com/hhkbp2/go-hsm"
+    ev "github.com/hhkbp2/rafted/event"
     logging "github.com/hhkbp2/rafted/logging"
 )
 
@@ -43,6 +44,35 @@ const (
     StateLeaderMemberChangePhase2ID      = "leader_member_change_phase2"
 )
 
+// RaftStateOf returns the raft state which the local state of
+// specified id belongs to.
+func RaftStateOf(stateID string) ev.RaftStateType {
+    switch stateID {
+    case StateFollowerID:
+        fallthrough
+    case StateSnapshotRecoveryID:
+        fallthrough
+    case StateFollowerMemberChangeID:
+        fallthrough
+    case StateFollowerOldNewConfigSeenID:
+        fallthrough
+    case StateFollowerOldNewConfigCommittedID:
+        fallthrough
+    case StateFollowerNewConfigSeenID:
+        return ev.RaftStateFollower
+    case StateCandidateID:
+        return ev.RaftStateCandidate
+    case StateLeaderID:
+        fallthrough
+    case StateUnsyncID:
+        fallthrough
+    case StateSyncID:
+        return ev.RaftStateLeader
+    default:
+        return ev.RaftStateUnknown
+    }
+}
+
 type LogState interface {
     hsm.State
     logging.Logger
@@ -3,8 +3,10 @@ package rafted
 import (
     "errors"
     hsm "github.com/hhkbp2/go-hsm"
+    ck "github.com/hhkbp2/rafted/clock"
     ev "github.com/hhkbp2/rafted/event"
     logging "github.com/hhkbp2/rafted/logging"
+    rt "github.com/hhkbp2/rafted/retry"
     "sync"
     "time"
 )
@@ -15,10 +17,11 @@ type CandidateState struct {
     // election timeout and its time ticker
     electionTimeout  time.Duration
     maxTimeoutJitter float32
-    ticker           Ticker
+    ticker           *RandomTicker
     // last time we have start election
     lastElectionTime     time.Time
     lastElectionTimeLock sync.RWMutex
+    clock                ck.Clock
     // vote
     condition CommitCondition
 }
@@ -27,13 +30,17 @@ func NewCandidateState(
     super hsm.State,
     electionTimeout time.Duration,
     maxTimeoutJitter float32,
+    clock ck.Clock,
+    random rt.Random,
     logger logging.Logger) *CandidateState {
 
     object := &CandidateState{
         LogStateHead:     NewLogStateHead(super, logger),
         electionTimeout:  electionTimeout,
         maxTimeoutJitter: maxTimeoutJitter,
-        ticker:           NewRandomTicker(electionTimeout, maxTimeoutJitter),
+        ticker: NewRandomTicker(
+            electionTimeout, maxTimeoutJitter, clock, random),
+        clock: clock,
     }
     super.AddChild(object)
     return object
@@ -87,10 +94,12 @@ func (self *CandidateState) Entry(
     // start election procedure
     self.StartElection(localHSM)
     // start election timeout ticker
+    scale := localHSM.ElectionTimeoutScale()
+    self.ticker.SetScale(scale)
     onTimeout := func() {
         timeout := &ev.Timeout{
             LastTime: self.LastElectionTime(),
-            Timeout:  self.electionTimeout,
+            Timeout:  self.electionTimeout * time.Duration(scale),
         }
         localHSM.SelfDispatch(ev.NewElectionTimeoutEvent(timeout))
     }
@@ -120,6 +129,11 @@ func (self *CandidateState) Handle(
     case event.Type() == ev.EventRequestVoteRequest:
         e, ok := event.(*ev.RequestVoteRequestEvent)
         hsm.AssertTrue(ok)
+        if RejectNonMemberVote(localHSM, e, false) {
+            self.Info("reject vote for non member candidate: %s",
+                e.Request.Candidate.String())
+            return nil
+        }
         term := localHSM.GetCurrentTerm()
         self.Debug("candidate receive RequestVoteRequest %#v, local term: %d",
             e.Request, term)
@@ -231,7 +245,7 @@ func (self *CandidateState) LastElectionTime() time.Time {
 func (self *CandidateState) UpdateLastElectionTime() {
     self.lastElectionTimeLock.Lock()
     defer self.lastElectionTimeLock.Unlock()
-    self.lastElectionTime = time.Now()
+    self.lastElectionTime = self.clock.Now()
 }
 
 func (self *CandidateState) StartElection(localHSM *LocalHSM) {
@@ -4,9 +4,12 @@ import (
     "errors"
     "fmt"
     hsm "github.com/hhkbp2/go-hsm"
+    ck "github.com/hhkbp2/rafted/clock"
     ev "github.com/hhkbp2/rafted/event"
     logging "github.com/hhkbp2/rafted/logging"
     ps "github.com/hhkbp2/rafted/persist"
+    rt "github.com/hhkbp2/rafted/retry"
+    "strings"
     "sync"
     "time"
 )
@@ -19,10 +22,13 @@ type FollowerState struct {
     electionTimeoutThresholdPersent float64
     electionTimeoutThreshold        time.Duration
     maxTimeoutJitter                float32
-    ticker                          Ticker
+    ticker                          *RandomTicker
     // last time we have contact from the leader
     lastContactTime     time.Time
     lastContactTimeLock sync.RWMutex
+    clock               ck.Clock
+    // whether local node starts to join a cluster
+    joining bool
 }
 
 func NewFollowerState(
@@ -30,6 +36,8 @@ func NewFollowerState(
     electionTimeout time.Duration,
     electionTimeoutThresholdPersent float64,
     maxTimeoutJitter float32,
+    clock ck.Clock,
+    random rt.Random,
     logger logging.Logger) *FollowerState {
 
     threshold := time.Duration(
@@ -39,7 +47,9 @@ func NewFollowerState(
         electionTimeout:                 electionTimeout,
         electionTimeoutThresholdPersent: electionTimeoutThresholdPersent,
         electionTimeoutThreshold:        threshold,
-        ticker: NewRandomTicker(electionTimeout, maxTimeoutJitter),
+        ticker: NewRandomTicker(
+            electionTimeout, maxTimeoutJitter, clock, random),
+        clock: clock,
     }
     super.AddChild(object)
     return object
@@ -60,10 +70,12 @@ func (self *FollowerState) Entry(
     // init status for this status
     self.UpdateLastContactTime()
     // start heartbeat timeout ticker
+    scale := localHSM.ElectionTimeoutScale()
+    self.ticker.SetScale(scale)
     onTimeout := func() {
         timeout := &ev.Timeout{
             LastTime: self.LastContactTime(),
-            Timeout:  self.electionTimeout,
+            Timeout:  self.electionTimeout * time.Duration(scale),
         }
         localHSM.SelfDispatch(ev.NewElectionTimeoutEvent(timeout))
     }
@@ -71,6 +83,24 @@ func (self *FollowerState) Entry(
     return nil
 }
 
+func (self *FollowerState) Init(
+    sm hsm.HSM, event hsm.Event) (state hsm.State) {
+
+    self.Debug("STATE: %s, -> Init", self.ID())
+    localHSM, ok := sm.(*LocalHSM)
+    hsm.AssertTrue(ok)
+    // resume the member change in progress, e.g. on a stepdown leader
+    switch localHSM.GetMemberChangeStatus() {
+    case OldNewConfigSeen:
+        sm.QInit(StateFollowerOldNewConfigSeenID)
+    case OldNewConfigCommitted:
+        sm.QInit(StateFollowerOldNewConfigCommittedID)
+    case NewConfigSeen:
+        sm.QInit(StateFollowerNewConfigSeenID)
+    }
+    return nil
+}
+
 func (self *FollowerState) Exit(
     sm hsm.HSM, event hsm.Event) (state hsm.State) {
 
@@ -98,6 +128,11 @@ func (self *FollowerState) Handle(
         self.Debug(
             "follower receive RequestVoteRequestEvent %#v, local term: %d",
             e.Request, localHSM.GetCurrentTerm())
+        if RejectNonMemberVote(localHSM, e, self.LeaderInContact(localHSM)) {
+            self.Info("reject vote for non member candidate: %s",
+                e.Request.Candidate.String())
+            return nil
+        }
         self.UpdateLastContact(localHSM)
         // Update to latest term if we see newer term
         if e.Request.Term > localHSM.GetCurrentTerm() {
@@ -169,6 +204,14 @@ func (self *FollowerState) Handle(
             return nil
         }
         return nil
+    case IsLocalJoin(localHSM, event):
+        e, ok := event.(*ev.ClientJoinRequestEvent)
+        hsm.AssertTrue(ok)
+        response := &ev.ClientResponse{
+            Success: self.StartJoin(localHSM),
+        }
+        e.SendResponse(ev.NewClientResponseEvent(response))
+        return nil
     case ev.IsClientRequestEvent(event.Type()):
         e, ok := event.(ev.RequestEvent)
         hsm.AssertTrue(ok)
@@ -184,6 +227,12 @@ func (self *FollowerState) Handle(
     case event.Type() == ev.EventTimeoutElection:
         e, ok := event.(*ev.ElectionTimeoutEvent)
         hsm.AssertTrue(ok)
+        if !localHSM.IsMember(localHSM.GetLocalAddr()) {
+            // not bootstrapped or joined yet, or removed from cluster,
+            // there is no one to vote for us
+            self.Debug("ignore election timeout of non member")
+            return nil
+        }
         localHSM.Notifier().Notify(ev.NewNotifyElectionTimeoutEvent(
             e.Message.LastTime, e.Message.Timeout))
         localHSM.Notifier().Notify(ev.NewNotifyStateChangeEvent(
@@ -199,27 +248,116 @@ func (self *FollowerState) Handle(
             DispatchInconsistantError(localHSM)
             return nil
         }
-
-        lastLogIndex, err := localHSM.Log().LastIndex()
-        if err != nil {
-            message := fmt.Sprintf(
-                "fail to read last index of log, error: %#v", err)
-            localHSM.SelfDispatch(ev.NewPersistErrorEvent(errors.New(message)))
+        if FollowerSeeOldNewConfig(localHSM, e.Message.Index, conf) {
+            localHSM.QTran(StateFollowerOldNewConfigSeenID)
+        }
+        return nil
+    case event.Type() == ev.EventBootstrapRequest:
+        e, ok := event.(*ev.BootstrapRequestEvent)
+        hsm.AssertTrue(ok)
+        response := &ev.ClientResponse{
+            Success: self.Bootstrap(localHSM, e.Request.Conf),
         }
+        e.SendResponse(ev.NewClientResponseEvent(response))
+        return nil
+    case event.Type() == ev.EventTimeoutNowRequest:
+        // the leader transfers its leadership to us, start an election
+        // without waiting for the election timeout
+        e, ok := event.(*ev.TimeoutNowRequestEvent)
+        hsm.AssertTrue(ok)
+        term := localHSM.GetCurrentTerm()
+        response := &ev.TimeoutNowResponse{
+            Term:    term,
+            Success: false,
+        }
+        if (e.Request.Term != term) ||
+            !localHSM.IsMember(localHSM.GetLocalAddr()) {
 
-        nextLogIndex := lastLogIndex + 1
-        err = localHSM.ConfigManager().Push(nextLogIndex, conf)
-        if err != nil {
-            DispatchPushConfigError(localHSM, nextLogIndex)
+            self.Info("refuse TimeoutNowRequest of term: %d, local term: %d",
+                e.Request.Term, term)
+            e.SendResponse(ev.NewTimeoutNowResponseEvent(response))
             return nil
         }
-        localHSM.SetMemberChangeStatus(OldNewConfigSeen)
-        sm.QTran(StateFollowerOldNewConfigSeenID)
+        response.Success = true
+        e.SendResponse(ev.NewTimeoutNowResponseEvent(response))
+        localHSM.Notifier().Notify(ev.NewNotifyStateChangeEvent(
+            ev.RaftStateFollower, ev.RaftStateCandidate))
+        localHSM.QTran(StateCandidateID)
         return nil
     }
     return self.Super()
 }
 
+// Bootstrap sets up conf as the initial config on a fresh node, which
+// has neither log nor config. It returns whether it succeeds.
+// Since it runs in the hsm goroutine, only one of the concurrent
+// bootstraps on the same node could succeed.
+func (self *FollowerState) Bootstrap(
+    localHSM *LocalHSM, conf *ps.Config) bool {
+
+    if conf == nil || !conf.IsNormalConfig() ||
+        !conf.Servers.Contains(localHSM.GetLocalAddr()) {
+
+        self.Warning("refuse to bootstrap with invalid config: %#v", conf)
+        return false
+    }
+    if self.joining || !self.IsFresh(localHSM) {
+        self.Warning("refuse to bootstrap a node with log or config, " +
+            "or joining a cluster")
+        return false
+    }
+    firstLogIndex, err := localHSM.Log().FirstIndex()
+    if err != nil {
+        localHSM.SelfDispatch(ev.NewPersistErrorEvent(
+            errors.New("fail to read first index of log")))
+        return false
+    }
+    if err = localHSM.ConfigManager().Push(firstLogIndex, conf); err != nil {
+        DispatchPushConfigError(localHSM, firstLogIndex)
+        return false
+    }
+    self.Info("bootstrap with config: %s",
+        strings.Join(AddrsString(conf.Servers.Addresses), " "))
+    return true
+}
+
+// StartJoin marks local node joining a cluster if it's fresh. It returns
+// whether it's fresh. The node can't bootstrap any more after that,
+// since the leader of the cluster may add it anytime, while it could
+// start to join again, e.g. after the former try times out.
+func (self *FollowerState) StartJoin(localHSM *LocalHSM) bool {
+    if !self.IsFresh(localHSM) {
+        self.Warning("refuse to join from a node with log or config")
+        return false
+    }
+    self.joining = true
+    self.Info("start to join as: %s", localHSM.GetLocalAddr().String())
+    return true
+}
+
+// IsFresh returns whether local node has neither log nor config.
+func (self *FollowerState) IsFresh(localHSM *LocalHSM) bool {
+    lastLogIndex, err := localHSM.Log().LastIndex()
+    if err != nil {
+        localHSM.SelfDispatch(ev.NewPersistErrorEvent(
+            errors.New("fail to read last index of log")))
+        return false
+    }
+    _, err = localHSM.ConfigManager().RNth(0)
+    return (lastLogIndex == 0) && (err == ps.ErrorNoConfig)
+}
+
+// IsLocalJoin returns whether event is the join request of local node
+// itself, which is sent to local node first by RaftNode.Join().
+func IsLocalJoin(localHSM *LocalHSM, event hsm.Event) bool {
+    if event.Type() != ev.EventClientJoinRequest {
+        return false
+    }
+    e, ok := event.(*ev.ClientJoinRequestEvent)
+    hsm.AssertTrue(ok)
+    return ps.MultiAddrEqual(e.Request.Addr, localHSM.GetLocalAddr())
+}
+
 func (self *FollowerState) HandleRequestVoteRequest(
     localHSM *LocalHSM,
     request *ev.RequestVoteRequest) *ev.RequestVoteResponse {
@@ -305,7 +443,7 @@ func (self *FollowerState) HandleAppendEntriesRequest(
     }
 
     if !self.checkPrevIndex(
-        localHSM, request.PrevLogIndex, request.PrevLogTerm) {
+        localHSM, request.PrevLogIndex, request.PrevLogTerm, response) {
         return response
     }
     if !checkIndexesForEntries(&request.Entries) {
@@ -314,9 +452,18 @@ func (self *FollowerState) HandleAppendEntriesRequest(
     }
 
     log := localHSM.Log()
+    // skip the entries we already have, e.g. in a resent request
+    entries := request.Entries
+    for len(entries) > 0 && entries[0].Index <= lastLogIndex {
+        entry, err := log.GetLog(entries[0].Index)
+        if err != nil || entry.Term != entries[0].Term {
+            break
+        }
+        entries = entries[1:]
+    }
     // store any new entries
-    if n := len(request.Entries); n > 0 {
-        first := request.Entries[0]
+    if n := len(entries); n > 0 {
+        first := entries[0]
         // delete any conflicting entries
         if first.Index <= lastLogIndex {
             self.Info("AppendEntriesRequest log entry start from "+
@@ -332,13 +479,21 @@ func (self *FollowerState) HandleAppendEntriesRequest(
             }
         }
 
-        if err := log.StoreLogs(request.Entries); err != nil {
+        if err := log.StoreLogs(entries); err != nil {
             message := fmt.Sprintf(
                 "fail to store logs from index: %d to index: %d",
-                first.Index, request.Entries[n-1].Index)
+                first.Index, entries[n-1].Index)
             localHSM.SelfDispatch(ev.NewPersistErrorEvent(errors.New(message)))
             return response
         }
+        for _, entry := range entries {
+            if entry.Type != ps.LogAddrUpdate {
+                continue
+            }
+            if !FollowerSeeAddrUpdate(localHSM, entry.Index, entry.Conf) {
+                return response
+            }
+        }
 
         newLastIndex, err := log.LastIndex()
         if err != nil {
@@ -356,9 +511,11 @@ func (self *FollowerState) HandleAppendEntriesRequest(
             "fail to read committed index of log")))
         return response
     }
-    if (request.LeaderCommitIndex > 0) &&
-        (request.LeaderCommitIndex > committedIndex) {
-        index := Min(request.LeaderCommitIndex, lastLogIndex)
+    // commit up to the last entry in this request at most, since the ones
+    // after it in local log are not confirmed to be the same as leader's.
+    lastNewIndex := request.PrevLogIndex + uint64(len(request.Entries))
+    index := Min(request.LeaderCommitIndex, lastNewIndex)
+    if index > committedIndex {
         if err = localHSM.CommitLogsUpTo(index); err != nil {
             message := fmt.Sprintf(
                 "fail to commit log up to index: %d, error: %s", index, err)
@@ -396,15 +553,24 @@ func (self *FollowerState) LastContactTime() time.Time {
     return self.lastContactTime
 }
 
+// LeaderInContact returns whether the follower has heard from its leader
+// within the election timeout.
+func (self *FollowerState) LeaderInContact(localHSM *LocalHSM) bool {
+    if localHSM.GetLeader() == nil {
+        return false
+    }
+    return !TimeExpire(self.clock, self.LastContactTime(), self.electionTimeout)
+}
+
 func (self *FollowerState) UpdateLastContactTime() {
     self.lastContactTimeLock.Lock()
     defer self.lastContactTimeLock.Unlock()
-    self.lastContactTime = time.Now()
+    self.lastContactTime = self.clock.Now()
 }
 
 func (self *FollowerState) UpdateLastContact(localHSM *LocalHSM) {
     lastContactTime := self.LastContactTime()
-    if TimeExpire(lastContactTime, self.electionTimeoutThreshold) {
+    if TimeExpire(self.clock, lastContactTime, self.electionTimeoutThreshold) {
         localHSM.Notifier().Notify(ev.NewNotifyElectionTimeoutThresholdEvent(
             lastContactTime, self.electionTimeout))
     }
@@ -413,8 +579,11 @@ func (self *FollowerState) UpdateLastContact(localHSM *LocalHSM) {
 }
 
 // check PrevLogIndex, PrevLogTerm in AppendEntriesRequest with local log.
+// The conflict hints are filled in response if they don't match.
 func (self *FollowerState) checkPrevIndex(
-    localHSM *LocalHSM, prevLogIndex, prevLogTerm uint64) bool {
+    localHSM *LocalHSM,
+    prevLogIndex, prevLogTerm uint64,
+    response *ev.AppendEntriesResponse) bool {
 
     var logTerm uint64 = 0
     lastTerm, lastIndex, err := localHSM.Log().LastEntryInfo()
@@ -424,6 +593,14 @@ func (self *FollowerState) checkPrevIndex(
         localHSM.SelfDispatch(ev.NewPersistErrorEvent(errors.New(message)))
         return false
     }
+    if prevLogIndex > lastIndex {
+        self.Info("missing log in append entries request, "+
+            "index: %d, term: %d, while local last index: %d",
+            prevLogIndex, prevLogTerm, lastIndex)
+        response.ConflictTerm = 0
+        response.ConflictIndex = lastIndex + 1
+        return false
+    }
     if prevLogIndex == lastIndex {
         logTerm = lastTerm
     } else {
@@ -439,6 +616,16 @@ func (self *FollowerState) checkPrevIndex(
         self.Info("inconsistant log in append entries request, "+
             "index: %d, term: %d, while local index: %d, term: %d",
             prevLogIndex, prevLogTerm, prevLogIndex, logTerm)
+        // skip all the entries of the conflicting term
+        conflictIndex, err := FirstIndexOfTerm(
+            localHSM.Log(), logTerm, prevLogIndex)
+        if err != nil {
+            self.Warning("fail to find first index of term: %d, error: %s",
+                logTerm, err)
+            conflictIndex = prevLogIndex
+        }
+        response.ConflictTerm = logTerm
+        response.ConflictIndex = conflictIndex
         return false
     }
     return true
@@ -493,7 +680,10 @@ func (self *FollowerState) dispatchMemberChangeEvents(
         for i := committedIndex + 1; i <= newCommittedIndex; i++ {
             entry := logEntries[i-(committedIndex+1)]
             if entry.Type == ps.LogMemberChange {
-                message := &ev.MemberChangeNewConf{entry.Conf}
+                message := &ev.MemberChangeNewConf{
+                    Index: entry.Index,
+                    Conf:  entry.Conf,
+                }
                 localHSM.SelfDispatch(ev.NewMemberChangeLogEntryCommitEvent(message))
             }
         }
@@ -502,7 +692,10 @@ func (self *FollowerState) dispatchMemberChangeEvents(
         for i := lastLogIndex + 1; i <= newLastLogIndex; i++ {
             entry := logEntries[i-(committedIndex+1)]
             if entry.Type == ps.LogMemberChange {
-                message := &ev.MemberChangeNewConf{entry.Conf}
+                message := &ev.MemberChangeNewConf{
+                    Index: entry.Index,
+                    Conf:  entry.Conf,
+                }
                 localHSM.SelfDispatch(ev.NewMemberChangeNextStepEvent(message))
             }
         }
@@ -512,7 +705,10 @@ func (self *FollowerState) dispatchMemberChangeEvents(
         for i := committedIndex + 1; i <= lastLogIndex; i++ {
             entry := logEntries[i-(committedIndex+1)]
             if entry.Type == ps.LogMemberChange {
-                message := &ev.MemberChangeNewConf{entry.Conf}
+                message := &ev.MemberChangeNewConf{
+                    Index: entry.Index,
+                    Conf:  entry.Conf,
+                }
                 localHSM.SelfDispatch(ev.NewMemberChangeLogEntryCommitEvent(message))
             }
         }
@@ -521,7 +717,10 @@ func (self *FollowerState) dispatchMemberChangeEvents(
         for i := lastLogIndex + 1; i <= newCommittedIndex; i++ {
             entry := logEntries[i-(committedIndex+1)]
             if entry.Type == ps.LogMemberChange {
-                message := &ev.MemberChangeNewConf{entry.Conf}
+                message := &ev.MemberChangeNewConf{
+                    Index: entry.Index,
+                    Conf:  entry.Conf,
+                }
                 localHSM.SelfDispatch(ev.NewMemberChangeNextStepEvent(message))
                 localHSM.SelfDispatch(ev.NewMemberChangeLogEntryCommitEvent(message))
             }
@@ -531,7 +730,10 @@ func (self *FollowerState) dispatchMemberChangeEvents(
         for i := newCommittedIndex + 1; i <= newLastLogIndex; i++ {
             entry := logEntries[i-(committedIndex+1)]
             if entry.Type == ps.LogMemberChange {
-                message := &ev.MemberChangeNewConf{entry.Conf}
+                message := &ev.MemberChangeNewConf{
+                    Index: entry.Index,
+                    Conf:  entry.Conf,
+                }
                 localHSM.SelfDispatch(ev.NewMemberChangeNextStepEvent(message))
             }
         }
@@ -539,6 +741,36 @@ func (self *FollowerState) dispatchMemberChangeEvents(
     return true
 }
 
+// RejectNonMemberVote rejects the RequestVoteRequest from a candidate
+// not in the latest config, and returns whether it does. A node not
+// bootstrapped or joined yet never votes. Otherwise such request is
+// rejected if its term is stale, or while leaderInContact, without taking
+// its term, so that neither the servers removed from cluster nor the ones
+// in another cluster bootstrapped separately could disrupt a working
+// cluster. Without a leader in contact, the local config may lag behind
+// a member change, and the request is handled as usual.
+func RejectNonMemberVote(
+    localHSM *LocalHSM,
+    e *ev.RequestVoteRequestEvent,
+    leaderInContact bool) bool {
+
+    if localHSM.IsMember(e.Request.Candidate) {
+        return false
+    }
+    term := localHSM.GetCurrentTerm()
+    if localHSM.IsMember(localHSM.GetLocalAddr()) && !leaderInContact &&
+        (e.Request.Term >= term) {
+
+        return false
+    }
+    response := &ev.RequestVoteResponse{
+        Term:    term,
+        Granted: false,
+    }
+    e.SendResponse(ev.NewRequestVoteResponseEvent(response))
+    return true
+}
+
 func DispatchInconsistantError(localHSM *LocalHSM) error {
     message := "config and member change status inconsistant"
     e := errors.New(message)
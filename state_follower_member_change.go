@@ -91,9 +91,13 @@ func (self *FollowerOldNewConfigSeenState) Handle(
         hsm.AssertTrue(ok)
         localHSM, ok := sm.(*LocalHSM)
         hsm.AssertTrue(ok)
-        if !(e.Message.Conf.IsOldNewConfig() &&
-            localHSM.GetMemberChangeStatus() == OldNewConfigSeen) {
-
+        if !IsLatestConfig(localHSM, e.Message.Conf) {
+            // a stale commit of the entries of former member changes,
+            // which are replayed to a newly joined server
+            self.Debug("ignore commit of stale config")
+            return nil
+        }
+        if !e.Message.Conf.IsOldNewConfig() {
             DispatchInconsistantError(localHSM)
             return nil
         }
@@ -101,6 +105,23 @@ func (self *FollowerOldNewConfigSeenState) Handle(
         localHSM.SetMemberChangeStatus(OldNewConfigCommitted)
         sm.QTran(StateFollowerOldNewConfigCommittedID)
         return nil
+    case ev.EventMemberChangeNextStep:
+        e, ok := event.(*ev.MemberChangeNextStepEvent)
+        hsm.AssertTrue(ok)
+        localHSM, ok := sm.(*LocalHSM)
+        hsm.AssertTrue(ok)
+        if !e.Message.Conf.IsNewConfig() {
+            DispatchInconsistantError(localHSM)
+            return nil
+        }
+        // The leader only appends the new config after the old/new config
+        // is committed. Seeing the new config before the commit index
+        // catches up means the old/new config is already committed.
+        localHSM.SetMemberChangeStatus(OldNewConfigCommitted)
+        if FollowerSeeNewConfig(localHSM, e.Message.Index, e.Message.Conf) {
+            sm.QTran(StateFollowerNewConfigSeenID)
+        }
+        return nil
     }
     return self.Super()
 }
@@ -157,21 +178,9 @@ func (self *FollowerOldNewConfigCommittedState) Handle(
             return nil
         }
 
-        lastLogIndex, err := localHSM.Log().LastIndex()
-        if err != nil {
-            localHSM.SelfDispatch(ev.NewPersistErrorEvent(errors.New(
-                "fail to read last log index of log")))
-            return nil
-        }
-
-        nextLogIndex := lastLogIndex + 1
-        err = localHSM.ConfigManager().Push(nextLogIndex, conf)
-        if err != nil {
-            DispatchPushConfigError(localHSM, nextLogIndex)
-            return nil
+        if FollowerSeeNewConfig(localHSM, e.Message.Index, conf) {
+            sm.QTran(StateFollowerNewConfigSeenID)
         }
-        localHSM.SetMemberChangeStatus(NewConfigSeen)
-        sm.QTran(StateFollowerNewConfigSeenID)
         return nil
     }
     return self.Super()
@@ -220,41 +229,126 @@ func (self *FollowerNewConfigSeenState) Handle(
         hsm.AssertTrue(ok)
         localHSM, ok := sm.(*LocalHSM)
         hsm.AssertTrue(ok)
+        if !IsLatestConfig(localHSM, e.Message.Conf) {
+            self.Debug("ignore commit of stale config")
+            return nil
+        }
         if !(e.Message.Conf.IsNewConfig() &&
-            localHSM.GetMemberChangeStatus() == OldNewConfigCommitted) {
+            localHSM.GetMemberChangeStatus() == NewConfigSeen) {
 
             DispatchInconsistantError(localHSM)
             return nil
         }
 
-        newConf := &ps.Config{
-            Servers:    e.Message.Conf.NewServers,
-            NewServers: nil,
-        }
+        if FollowerCommitNewConfig(
+            localHSM, e.Message.Index+1, e.Message.Conf) {
 
-        lastLogIndex, err := localHSM.Log().LastIndex()
-        if err != nil {
-            localHSM.SelfDispatch(ev.NewPersistErrorEvent(errors.New(
-                "fail to read last log index of log")))
+            sm.QTran(StateFollowerID)
+        }
+        return nil
+    case ev.EventMemberChangeNextStep:
+        e, ok := event.(*ev.MemberChangeNextStepEvent)
+        hsm.AssertTrue(ok)
+        localHSM, ok := sm.(*LocalHSM)
+        hsm.AssertTrue(ok)
+        if !e.Message.Conf.IsOldNewConfig() {
+            DispatchInconsistantError(localHSM)
             return nil
         }
-
-        nextLogIndex := lastLogIndex + 1
-        err = localHSM.ConfigManager().Push(nextLogIndex, newConf)
+        // A next member change begins only after the current one completes.
+        // Seeing it before the commit index catches up means the new config
+        // is already committed.
+        conf, err := localHSM.ConfigManager().RNth(0)
         if err != nil {
-            DispatchPushConfigError(localHSM, nextLogIndex)
+            localHSM.SelfDispatch(ev.NewPersistErrorEvent(errors.New(
+                "fail to read config")))
             return nil
         }
-        localHSM.SetMemberChangeStatus(NotInMemeberChange)
+        index := e.Message.Index
+        if FollowerCommitNewConfig(localHSM, index, conf) &&
+            FollowerSeeOldNewConfig(localHSM, index, e.Message.Conf) {
 
-        if err = localHSM.SendMemberChangeNotify(); err != nil {
-            message := fmt.Sprintf(
-                "fail to send member change notify, error: %s", err)
-            localHSM.SelfDispatch(ev.NewPersistErrorEvent(errors.New(message)))
+            sm.QTran(StateFollowerOldNewConfigSeenID)
         }
-
-        sm.QTran(StateFollowerID)
         return nil
     }
     return self.Super()
 }
+
+// IsLatestConfig returns whether conf is the same as the latest config
+// in config manager.
+func IsLatestConfig(localHSM *LocalHSM, conf *ps.Config) bool {
+    latest, err := localHSM.ConfigManager().RNth(0)
+    if err != nil {
+        return false
+    }
+    return ps.ConfigEqual(latest, conf)
+}
+
+// FollowerSeeOldNewConfig records the old/new config conf of
+// the member change log entry at index. It returns whether it succeeds.
+func FollowerSeeOldNewConfig(
+    localHSM *LocalHSM, index uint64, conf *ps.Config) bool {
+
+    if err := localHSM.ConfigManager().Push(index, conf); err != nil {
+        DispatchPushConfigError(localHSM, index)
+        return false
+    }
+    localHSM.SetMemberChangeStatus(OldNewConfigSeen)
+    return true
+}
+
+// FollowerSeeNewConfig records the new config conf of
+// the member change log entry at index. It returns whether it succeeds.
+func FollowerSeeNewConfig(
+    localHSM *LocalHSM, index uint64, conf *ps.Config) bool {
+
+    if err := localHSM.ConfigManager().Push(index, conf); err != nil {
+        DispatchPushConfigError(localHSM, index)
+        return false
+    }
+    localHSM.SetMemberChangeStatus(NewConfigSeen)
+    return true
+}
+
+// FollowerSeeAddrUpdate records the normal config conf of the address
+// update log entry at index, and replaces the peer to the old addresses.
+// It returns whether it succeeds.
+func FollowerSeeAddrUpdate(
+    localHSM *LocalHSM, index uint64, conf *ps.Config) bool {
+
+    if err := localHSM.ConfigManager().Push(index, conf); err != nil {
+        DispatchPushConfigError(localHSM, index)
+        return false
+    }
+    localHSM.Peers().AddPeers(GetPeers(localHSM.GetLocalAddr(), conf))
+    return true
+}
+
+// FollowerCommitNewConfig finishes the member change after the new config
+// conf is committed. The normal config of the new servers takes effect
+// since index. It returns whether it succeeds.
+func FollowerCommitNewConfig(
+    localHSM *LocalHSM, index uint64, conf *ps.Config) bool {
+
+    newConf := &ps.Config{
+        Servers:    conf.NewServers,
+        NewServers: nil,
+        Priorities: conf.Priorities,
+    }
+    if err := localHSM.ConfigManager().Push(index, newConf); err != nil {
+        DispatchPushConfigError(localHSM, index)
+        return false
+    }
+    localHSM.SetMemberChangeStatus(NotInMemeberChange)
+    localHSM.Peers().RemovePeers(
+        GetPeers(localHSM.GetLocalAddr(), newConf))
+
+    if err := localHSM.SendMemberChangeNotify(); err != nil {
+        message := fmt.Sprintf(
+            "fail to send member change notify, error: %s", err)
+        localHSM.SelfDispatch(ev.NewPersistErrorEvent(errors.New(message)))
+        return false
+    }
+    return true
+}
@@ -84,6 +84,61 @@ func TestFollowerHandleRequestVoteRequest(t *testing.T) {
     local.Close()
 }
 
+func TestFollowerHandleNonMemberRequestVoteRequest(t *testing.T) {
+    require.Nil(t, assert.SetCallerInfoLevelNumber(2))
+    local := getTestLocalSafe(t)
+    defer local.Close()
+    // without a leader, the local config may lag behind, and the term
+    // of a non member candidate is taken
+    newTerm := testTerm + 1
+    request := &ev.RequestVoteRequest{
+        Term:         newTerm,
+        Candidate:    ps.RandomMemoryMultiAddr(),
+        LastLogIndex: testIndex,
+        LastLogTerm:  testTerm,
+    }
+    reqEvent := ev.NewRequestVoteRequestEvent(request)
+    local.Send(reqEvent)
+    assertGetRequestVoteResponseEvent(t, reqEvent, true, newTerm)
+    assert.Equal(t, newTerm, local.GetCurrentTerm())
+    // a stale one is rejected
+    request = &ev.RequestVoteRequest{
+        Term:         testTerm,
+        Candidate:    ps.RandomMemoryMultiAddr(),
+        LastLogIndex: testIndex,
+        LastLogTerm:  testTerm,
+    }
+    reqEvent = ev.NewRequestVoteRequestEvent(request)
+    local.Send(reqEvent)
+    assertGetRequestVoteResponseEvent(t, reqEvent, false, newTerm)
+    // with a leader in contact, a higher term doesn't disrupt the cluster
+    leader := testServers.Addresses[1]
+    appendRequest := &ev.AppendEntriesRequest{
+        Term:              newTerm,
+        Leader:            leader,
+        PrevLogIndex:      testIndex,
+        PrevLogTerm:       testTerm,
+        Entries:           make([]*ps.LogEntry, 0),
+        LeaderCommitIndex: testIndex,
+    }
+    appendEvent := ev.NewAppendEntriesRequestEvent(appendRequest)
+    local.Send(appendEvent)
+    assertGetAppendEntriesResponseEvent(
+        t, appendEvent, true, newTerm, testIndex)
+    request = &ev.RequestVoteRequest{
+        Term:         newTerm + 5,
+        Candidate:    ps.RandomMemoryMultiAddr(),
+        LastLogIndex: testIndex,
+        LastLogTerm:  testTerm,
+    }
+    reqEvent = ev.NewRequestVoteRequestEvent(request)
+    local.Send(reqEvent)
+    assertGetRequestVoteResponseEvent(t, reqEvent, false, newTerm)
+    assert.Equal(t, newTerm, local.GetCurrentTerm())
+    assert.Equal(t, leader, local.GetLeader())
+    assert.Equal(t, StateFollowerID, local.QueryState())
+}
+
 func TestFollowerHandleAppendEntriesRequest(t *testing.T) {
     require.Nil(t, assert.SetCallerInfoLevelNumber(2))
     local := getTestLocalSafe(t)
@@ -162,3 +217,220 @@ func TestFollowerHandleAppendEntriesRequest(t *testing.T) {
         BeforeTimeout(testConfig.ElectionTimeout, startTime))
     local.Close()
 }
+
+func TestFollowerHandleResentAppendEntriesRequest(t *testing.T) {
+    require.Nil(t, assert.SetCallerInfoLevelNumber(2))
+    local := getTestLocalSafe(t)
+    defer local.Close()
+    nextTerm := testTerm + 1
+    nextIndex := testIndex + 1
+    entries := []*ps.LogEntry{
+        &ps.LogEntry{
+            Term:  nextTerm,
+            Index: nextIndex,
+            Type:  ps.LogCommand,
+            Data:  testData,
+        },
+    }
+    request := &ev.AppendEntriesRequest{
+        Term:              nextTerm,
+        Leader:            testServers.Addresses[1],
+        PrevLogIndex:      testIndex,
+        PrevLogTerm:       testTerm,
+        Entries:           entries,
+        LeaderCommitIndex: nextIndex,
+    }
+    reqEvent := ev.NewAppendEntriesRequestEvent(request)
+    local.Send(reqEvent)
+    assertGetAppendEntriesResponseEvent(t, reqEvent, true, nextTerm, nextIndex)
+    // the entry is committed by the next request
+    reqEvent = ev.NewAppendEntriesRequestEvent(request)
+    local.Send(reqEvent)
+    assertGetAppendEntriesResponseEvent(t, reqEvent, true, nextTerm, nextIndex)
+    assertLogCommittedIndex(t, local.Log(), nextIndex)
+    // a resent request with the committed entry is accepted as is
+    reqEvent = ev.NewAppendEntriesRequestEvent(request)
+    local.Send(reqEvent)
+    assertGetAppendEntriesResponseEvent(t, reqEvent, true, nextTerm, nextIndex)
+    assert.Equal(t, StateFollowerID, local.QueryState())
+    assertLogLastIndex(t, local.Log(), nextIndex)
+    assertLogCommittedIndex(t, local.Log(), nextIndex)
+}
+
+func TestFollowerHandleAppendEntriesRequestConflict(t *testing.T) {
+    require.Nil(t, assert.SetCallerInfoLevelNumber(2))
+    local := getTestLocalSafe(t)
+    defer local.Close()
+    leader := testServers.Addresses[1]
+    nextTerm := testTerm + 1
+    entries := []*ps.LogEntry{
+        &ps.LogEntry{
+            Term:  nextTerm,
+            Index: testIndex + 1,
+            Type:  ps.LogCommand,
+            Data:  testData,
+        },
+        &ps.LogEntry{
+            Term:  nextTerm,
+            Index: testIndex + 2,
+            Type:  ps.LogCommand,
+            Data:  testData,
+        },
+    }
+    request := &ev.AppendEntriesRequest{
+        Term:              nextTerm,
+        Leader:            leader,
+        PrevLogIndex:      testIndex,
+        PrevLogTerm:       testTerm,
+        Entries:           entries,
+        LeaderCommitIndex: testIndex,
+    }
+    reqEvent := ev.NewAppendEntriesRequestEvent(request)
+    local.Send(reqEvent)
+    assertGetAppendEntriesResponseEvent(
+        t, reqEvent, true, nextTerm, testIndex+2)
+    assertConflict := func(
+        prevLogIndex, prevLogTerm, conflictTerm, conflictIndex uint64) {
+
+        request := &ev.AppendEntriesRequest{
+            Term:              nextTerm,
+            Leader:            leader,
+            PrevLogIndex:      prevLogIndex,
+            PrevLogTerm:       prevLogTerm,
+            Entries:           make([]*ps.LogEntry, 0),
+            LeaderCommitIndex: testIndex,
+        }
+        reqEvent := ev.NewAppendEntriesRequestEvent(request)
+        local.Send(reqEvent)
+        respEvent := reqEvent.RecvResponse()
+        e, ok := respEvent.(*ev.AppendEntriesResponseEvent)
+        require.True(t, ok)
+        assert.False(t, e.Response.Success)
+        assert.Equal(t, testIndex+2, e.Response.LastLogIndex)
+        assert.Equal(t, conflictTerm, e.Response.ConflictTerm)
+        assert.Equal(t, conflictIndex, e.Response.ConflictIndex)
+    }
+    // the index after the local last one is hinted for a missing index
+    assertConflict(testIndex+5, nextTerm, 0, testIndex+3)
+    // the first index of the conflicting term is hinted for a term mismatch
+    assertConflict(testIndex+2, testTerm, nextTerm, testIndex+1)
+    // the log is left as is
+    assertLogLastIndex(t, local.Log(), testIndex+2)
+    assertLogLastTerm(t, local.Log(), nextTerm)
+}
+
+func TestFollowerQueryStatus(t *testing.T) {
+    require.Nil(t, assert.SetCallerInfoLevelNumber(2))
+    local := getTestLocalSafe(t)
+    status := local.QueryStatus()
+    require.NotNil(t, status)
+    assert.Equal(t, testTerm, status.Term)
+    assert.Equal(t, ev.RaftStateFollower, status.State)
+    assert.Equal(t, StateFollowerID, status.StateID)
+    assert.Equal(t, local.GetLocalAddr(), status.LocalAddr)
+    assert.Equal(t, ps.ServerAddressNil, status.Leader)
+    assert.Equal(t, ps.ServerAddressNil, status.VotedFor)
+    assert.Equal(t, testIndex, status.FirstLogIndex)
+    assert.Equal(t, testIndex, status.LastLogIndex)
+    assert.Equal(t, testIndex, status.CommittedIndex)
+    assert.Equal(t, testIndex, status.LastAppliedIndex)
+    assert.Nil(t, status.LastSnapshot)
+    assert.True(t, ps.MultiAddrSliceEqual(testServers, status.Conf.Servers))
+    assert.Nil(t, status.PendingConf)
+    assert.Equal(t, NotInMemeberChange.String(), status.MemberChangeStatus)
+    assert.Equal(t, 0, len(status.Peers))
+    local.Close()
+}
+
+func waitMemberChangeStatus(
+    t *testing.T, local Local, status MemberChangeStatusType) {
+
+    deadline := time.Now().Add(time.Second)
+    for {
+        current := local.QueryStatus()
+        require.NotNil(t, current)
+        if current.MemberChangeStatus == status.String() {
+            return
+        }
+        if time.Now().After(deadline) {
+            assert.Fail(t, "member change status mismatch",
+                "expected: %s, actual: %s", status, current.MemberChangeStatus)
+            return
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+func TestFollowerMemberChangeCommitLagging(t *testing.T) {
+    require.Nil(t, assert.SetCallerInfoLevelNumber(2))
+    local, peers := getTestLocalAndPeers(t)
+    defer local.Close()
+    peers.On("RemovePeers", mock.Anything).Return()
+    leader := testServers.Addresses[1]
+    nextTerm := testTerm + 1
+    addresses := make([]*ps.ServerAddress, 0, testServers.Len()+1)
+    addresses = append(addresses, testServers.Addresses...)
+    addresses = append(addresses, ps.RandomMemoryMultiAddr())
+    newServers := &ps.ServerAddressSlice{
+        Addresses: addresses,
+    }
+    entries := []*ps.LogEntry{
+        &ps.LogEntry{
+            Term:  nextTerm,
+            Index: testIndex + 1,
+            Type:  ps.LogMemberChange,
+            Data:  make([]byte, 0),
+            Conf: &ps.Config{
+                Servers:    testServers,
+                NewServers: newServers,
+            },
+        },
+        &ps.LogEntry{
+            Term:  nextTerm,
+            Index: testIndex + 2,
+            Type:  ps.LogMemberChange,
+            Data:  make([]byte, 0),
+            Conf: &ps.Config{
+                Servers:    nil,
+                NewServers: newServers,
+            },
+        },
+    }
+    // the entries of a whole member change are replicated before
+    // any of them commits, e.g. replayed to a server just joined
+    request := &ev.AppendEntriesRequest{
+        Term:              nextTerm,
+        Leader:            leader,
+        PrevLogIndex:      testIndex,
+        PrevLogTerm:       testTerm,
+        Entries:           entries,
+        LeaderCommitIndex: testIndex,
+    }
+    reqEvent := ev.NewAppendEntriesRequestEvent(request)
+    local.Send(reqEvent)
+    assertGetAppendEntriesResponseEvent(
+        t, reqEvent, true, nextTerm, testIndex+2)
+    // seeing the new config means the old/new config is committed
+    waitMemberChangeStatus(t, local, NewConfigSeen)
+    assert.Equal(t, StateFollowerNewConfigSeenID, local.QueryState())
+    // the commit of the old/new config lags behind, and is ignored
+    request = &ev.AppendEntriesRequest{
+        Term:              nextTerm,
+        Leader:            leader,
+        PrevLogIndex:      testIndex + 2,
+        PrevLogTerm:       nextTerm,
+        Entries:           make([]*ps.LogEntry, 0),
+        LeaderCommitIndex: testIndex + 2,
+    }
+    reqEvent = ev.NewAppendEntriesRequestEvent(request)
+    local.Send(reqEvent)
+    assertGetAppendEntriesResponseEvent(
+        t, reqEvent, true, nextTerm, testIndex+2)
+    waitMemberChangeStatus(t, local, NotInMemeberChange)
+    assert.Equal(t, StateFollowerID, local.QueryState())
+    status := local.QueryStatus()
+    require.NotNil(t, status)
+    assert.True(t, ps.MultiAddrSliceEqual(newServers, status.Conf.Servers))
+    assert.Nil(t, status.PendingConf)
+    assertLogCommittedIndex(t, local.Log(), testIndex+2)
+}
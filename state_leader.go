@@ -4,25 +4,55 @@ import (
     "errors"
     "fmt"
     hsm "github.com/hhkbp2/go-hsm"
+    ck "github.com/hhkbp2/rafted/clock"
     ev "github.com/hhkbp2/rafted/event"
     logging "github.com/hhkbp2/rafted/logging"
     ps "github.com/hhkbp2/rafted/persist"
     "strings"
+    "time"
 )
 
 type LeaderState struct {
     *LogStateHead
 
-    MemberChangeHSM *LeaderMemberChangeHSM
-    Inflight        *Inflight
-    listener        *ClientEventListener
+    MemberChangeHSM    *LeaderMemberChangeHSM
+    Inflight           *Inflight
+    listener           *ClientEventListener
+    persistErrorPolicy PersistErrorPolicy
+    // election timeout and the ticker to check quorum on it
+    electionTimeout time.Duration
+    checkQuorum     bool
+    ticker          Ticker
+    clock           ck.Clock
+    // the writer to store log entries in parallel with replicating them
+    writer *LogWriter
+    // the last log entry started, and the last index persisted in local log
+    lastLogTerm    uint64
+    lastLogIndex   uint64
+    persistedIndex uint64
+    // the entries committed by peers but not persisted in local log yet
+    pendingCommits []*InflightEntry
+    // the last time to transfer leadership to the preferred member
+    transferTime time.Time
 }
 
-func NewLeaderState(super hsm.State, logger logging.Logger) *LeaderState {
+func NewLeaderState(
+    super hsm.State,
+    electionTimeout time.Duration,
+    checkQuorum bool,
+    persistErrorPolicy PersistErrorPolicy,
+    clock ck.Clock,
+    logger logging.Logger) *LeaderState {
+
     object := &LeaderState{
-        LogStateHead:    NewLogStateHead(super, logger),
-        MemberChangeHSM: SetupLeaderMemberChangeHSM(logger),
-        listener:        NewClientEventListener(),
+        LogStateHead:       NewLogStateHead(super, logger),
+        MemberChangeHSM:    SetupLeaderMemberChangeHSM(logger),
+        listener:           NewClientEventListener(),
+        persistErrorPolicy: persistErrorPolicy,
+        electionTimeout:    electionTimeout,
+        checkQuorum:        checkQuorum,
+        ticker:             NewSimpleTicker(electionTimeout, clock),
+        clock:              clock,
     }
     object.MemberChangeHSM.SetLeaderState(object)
     super.AddChild(object)
@@ -41,17 +71,38 @@ func (self *LeaderState) Entry(
     hsm.AssertTrue(ok)
     // init global status
     localHSM.SetLeaderWithNotify(localHSM.GetLocalAddr())
+    // don't take the contact times of the former term for this one
+    localHSM.Peers().ResetLastContactTimes()
     // coordinate peer into LeaderPeerState
     localHSM.Peers().Broadcast(ev.NewPeerEnterLeaderEvent())
     // activate member change hsm
     self.MemberChangeHSM.SetLocalHSM(localHSM)
     self.MemberChangeHSM.Dispatch(ev.NewLeaderMemberChangeActivateEvent())
     ignoreResponse := func(event ev.Event) {
-        e, ok := event.(*ev.ClientResponseEvent)
-        hsm.AssertTrue(ok)
-        self.Info("orphan client response: %t", e.Response.Success)
+        if e, ok := event.(*ev.ClientResponseEvent); ok {
+            self.Info("orphan client response: %t", e.Response.Success)
+            return
+        }
+        self.Info("orphan client response: %s", ev.EventString(event))
     }
     self.listener.Start(ignoreResponse)
+    // start check quorum ticker
+    if self.checkQuorum {
+        onTimeout := func() {
+            timeout := &ev.Timeout{
+                LastTime: self.clock.Now(),
+                Timeout:  self.electionTimeout,
+            }
+            localHSM.SelfDispatch(ev.NewCheckQuorumTimeoutEvent(timeout))
+        }
+        self.ticker.Start(onTimeout)
+    }
+    // start log writer
+    dispatcher := func(event hsm.Event) {
+        localHSM.SelfDispatch(event)
+    }
+    self.writer = NewLogWriter(
+        localHSM.Log(), dispatcher, self.electionTimeout, self.Logger)
     // init status for this state
     conf, err := localHSM.ConfigManager().RNth(0)
     if err != nil {
@@ -66,11 +117,16 @@ func (self *LeaderState) Entry(
             "fail to read committed index of log")))
         return nil
     }
-    lastLogIndex, err := localHSM.Log().LastIndex()
+    lastLogTerm, lastLogIndex, err := localHSM.Log().LastEntryInfo()
     if err != nil {
         localHSM.SelfDispatch(ev.NewPersistErrorEvent(errors.New(
-            "fail to read last log index of log")))
+            "fail to read last entry info of log")))
     }
+    self.lastLogTerm = lastLogTerm
+    self.lastLogIndex = lastLogIndex
+    self.persistedIndex = lastLogIndex
+    self.pendingCommits = make([]*InflightEntry, 0)
+    self.transferTime = time.Time{}
     if committedIndex < lastLogIndex {
         inflightEntries := make([]*InflightEntry, 0, lastLogIndex-committedIndex)
         for i := committedIndex + 1; i <= lastLogIndex; i++ {
@@ -107,8 +163,17 @@ func (self *LeaderState) Exit(
     self.Debug("STATE: %s, -> Exit", self.ID())
     localHSM, ok := sm.(*LocalHSM)
     hsm.AssertTrue(ok)
+    // stop check quorum ticker
+    if self.checkQuorum {
+        self.ticker.Stop()
+    }
+    // stop log writer after the entries started are stored, since
+    // they may be replicated to peers already
+    self.writer.Close()
+    self.writer = nil
     // cleanup status for this state
     self.Inflight.Init()
+    self.pendingCommits = nil
     self.listener.Stop()
     // deactivate member change hsm
     self.MemberChangeHSM.Dispatch(ev.NewLeaderMemberChangeDeactivateEvent())
@@ -129,6 +194,14 @@ func (self *LeaderState) Handle(
         e, ok := event.(*ev.AppendEntriesResponseEvent)
         hsm.AssertTrue(ok)
         self.Debug("leader receive AppendEntriesResponse: %#v", e.Response)
+        // it's sent by log writer after the entry is stored in local log
+        if e.Response.LastLogIndex > self.persistedIndex {
+            self.persistedIndex = e.Response.LastLogIndex
+            if err := self.CommitPendingEntries(localHSM); err != nil {
+                localHSM.SelfDispatch(ev.NewPersistErrorEvent(err))
+                return nil
+            }
+        }
         peerUpdate := &ev.PeerReplicateLog{
             Peer:       localHSM.GetLocalAddr(),
             MatchIndex: e.Response.LastLogIndex,
@@ -144,7 +217,8 @@ func (self *LeaderState) Handle(
         // step down to follower state if local term is not greater than
         // the remote one
         if e.Request.Term > localHSM.GetCurrentTerm() {
-            localHSM.SelfDispatch(ev.NewStepdownEvent())
+            localHSM.SelfDispatch(
+                ev.NewStepdownEventWithLeader(e.Request.Leader))
             localHSM.SelfDispatch(event)
             return nil
         }
@@ -164,6 +238,11 @@ func (self *LeaderState) Handle(
     case ev.EventRequestVoteRequest:
         e, ok := event.(*ev.RequestVoteRequestEvent)
         hsm.AssertTrue(ok)
+        if RejectNonMemberVote(localHSM, e, true) {
+            self.Info("reject vote for non member candidate: %s",
+                e.Request.Candidate.String())
+            return nil
+        }
         self.Debug(
             "leader receive RequestVoteRequest: %#v from: %s, local term: %d",
             e.Request, e.Request.Candidate.String(), localHSM.GetCurrentTerm())
@@ -195,12 +274,22 @@ func (self *LeaderState) Handle(
     case ev.EventClientReadOnlyRequest:
         e, ok := event.(*ev.ClientReadOnlyRequestEvent)
         hsm.AssertTrue(ok)
+        if DeadlineExpire(self.clock, e.Deadline) {
+            self.Debug("drop expired ClientReadOnlyRequestEvent")
+            e.SendResponse(ev.NewDeadlineExceededResponseEvent())
+            return nil
+        }
         self.HandleClientRequest(localHSM, e.Request.Data, e.ResultChan)
         return nil
     case ev.EventClientAppendRequest:
         self.Debug("receive ClientAppendRequestEvent")
         e, ok := event.(*ev.ClientAppendRequestEvent)
         hsm.AssertTrue(ok)
+        if DeadlineExpire(self.clock, e.Deadline) {
+            self.Debug("drop expired ClientAppendRequestEvent")
+            e.SendResponse(ev.NewDeadlineExceededResponseEvent())
+            return nil
+        }
         self.HandleClientRequest(localHSM, e.Request.Data, e.ResultChan)
         return nil
     case ev.EventPeerReplicateLog:
@@ -226,14 +315,86 @@ func (self *LeaderState) Handle(
                 allCommitted[0].Request.LogEntry.Index,
                 allCommitted[len(allCommitted)-1].Request.LogEntry.Index)
         }
+        self.TransferToPreferred(localHSM)
+        return nil
+    case ev.EventQueryNodeStatusRequest:
+        e, ok := event.(*ev.QueryNodeStatusRequestEvent)
+        hsm.AssertTrue(ok)
+        response, err := localHSM.QueryNodeStatus()
+        if err != nil {
+            e.SendResponse(ev.NewPersistErrorResponseEvent(err))
+            localHSM.SelfDispatch(ev.NewPersistErrorEvent(err))
+            return nil
+        }
+        response.StartedIndex = self.LastLogIndex()
+        // querying peers may block for a while when peers are busy
+        // on rpc, so don't do it in the hsm goroutine
+        peers := localHSM.Peers()
+        go func() {
+            response.Peers = peers.QueryStatus()
+            e.SendResponse(ev.NewQueryNodeStatusResponseEvent(response))
+        }()
+        return nil
+    case ev.EventTimeoutCheckQuorum:
+        e, ok := event.(*ev.CheckQuorumTimeoutEvent)
+        hsm.AssertTrue(ok)
+        if !self.QuorumContacted(localHSM, e.Message.LastTime) {
+            self.Warning("lose contact with a majority within %s, "+
+                "about to stepdown", self.electionTimeout)
+            localHSM.SelfDispatch(ev.NewStepdownEvent())
+            return nil
+        }
+        self.TransferToPreferred(localHSM)
+        return nil
+    case ev.EventTransferLeadershipRequest:
+        e, ok := event.(*ev.TransferLeadershipRequestEvent)
+        hsm.AssertTrue(ok)
+        // hold off the transfer to preferred member for a while
+        self.transferTime = self.clock.Now()
+        var target *ps.ServerAddress
+        if e.Request.Target == nil {
+            target = self.TransferLeadership(localHSM)
+        } else {
+            target = self.TransferLeadershipToPeer(localHSM, e.Request.Target)
+        }
+        response := &ev.ClientResponse{
+            Success: target != nil,
+        }
+        e.SendResponse(ev.NewClientResponseEvent(response))
         return nil
     case ev.EventStepdown:
+        e, ok := event.(*ev.StepdownEvent)
+        hsm.AssertTrue(ok)
+        self.FailInflightRequests(localHSM, e.Leader)
         localHSM.Notifier().Notify(ev.NewNotifyStateChangeEvent(
             ev.RaftStateLeader, ev.RaftStateFollower))
         sm.QTran(StateFollowerID)
         return nil
+    case ev.EventPersistError:
+        // leave the transition to persist error state to super state
+        var leader *ps.ServerAddress
+        if self.persistErrorPolicy == PersistErrorEvacuate {
+            leader = self.TransferLeadership(localHSM)
+        }
+        self.FailInflightRequests(localHSM, leader)
+        return self.Super()
+    case ev.EventClientJoinRequest:
+        if IsLocalJoin(localHSM, event) {
+            // leader is a member already
+            e, ok := event.(*ev.ClientJoinRequestEvent)
+            hsm.AssertTrue(ok)
+            response := &ev.ClientResponse{
+                Success: false,
+            }
+            e.SendResponse(ev.NewClientResponseEvent(response))
+            return nil
+        }
+        self.MemberChangeHSM.Dispatch(event)
+        return nil
     case ev.EventClientChangeConfigRequest:
         fallthrough
+    case ev.EventClientUpdateAddrRequest:
+        fallthrough
     case ev.EventLeaderReenterMemberChangeState:
         fallthrough
     case ev.EventLeaderForwardMemberChangePhase:
@@ -243,6 +404,188 @@ func (self *LeaderState) Handle(
     return self.Super()
 }
 
+// FailInflightRequests responses all the client requests not committed
+// yet with LeaderChangedResponseEvent, since their outcome is unknown
+// after stepping down. The no-op and recovered entries are left out,
+// they are waited by the leader itself rather than any client. So are
+// the ones committed already, which are responsed by applier.
+func (self *LeaderState) FailInflightRequests(
+    localHSM *LocalHSM, leader *ps.ServerAddress) {
+
+    committedIndex, err := localHSM.Log().CommittedIndex()
+    if err != nil {
+        self.Error("fail to read committed index of log, error: %s", err)
+        committedIndex = 0
+    }
+    toCommit := self.Inflight.GetToCommit()
+    entries := make([]*InflightEntry, 0, len(self.pendingCommits)+len(toCommit))
+    entries = append(entries, self.pendingCommits...)
+    entries = append(entries, toCommit...)
+    self.pendingCommits = make([]*InflightEntry, 0)
+    for _, entry := range entries {
+        request := entry.Request
+        if (request.LogEntry.Index <= committedIndex) ||
+            (request.LogEntry.Type == ps.LogNoop) ||
+            (request.ResultChan == self.listener.GetChan()) {
+            continue
+        }
+        SendLeaderChangedResponse(request.ResultChan, leader)
+    }
+}
+
+// QuorumContacted returns whether the leader has contact from a majority
+// of the current config within an election timeout before now. During
+// member change, it needs a majority in both the old and new servers.
+func (self *LeaderState) QuorumContacted(
+    localHSM *LocalHSM, now time.Time) bool {
+
+    conf, err := localHSM.ConfigManager().RNth(0)
+    if err != nil {
+        self.Error("fail to read last config for check quorum")
+        // leave it to the persist error handling
+        return true
+    }
+    return IsQuorumContacted(localHSM.GetLocalAddr(), conf,
+        localHSM.Peers().LastContactTimes(), now.Add(-self.electionTimeout))
+}
+
+// IsQuorumContacted returns whether local and the servers contacted
+// no earlier than since, according to contactTimes keyed by the string
+// form of their addresses, make up a majority of conf.
+func IsQuorumContacted(
+    local *ps.ServerAddress,
+    conf *ps.Config,
+    contactTimes map[string]time.Time,
+    since time.Time) bool {
+
+    condition := NewConfigCommitCondition(conf)
+    // the leader is always in contact with itself, while it may be
+    // not in the new config during member change
+    condition.AddVote(local)
+    for _, addr := range GetPeers(local, conf).Addresses {
+        contactTime, ok := contactTimes[ps.ServerKey(addr)]
+        if ok && !contactTime.Before(since) {
+            condition.AddVote(addr)
+        }
+    }
+    return condition.IsCommitted()
+}
+
+// TransferLeadership asks the peer with the most log replicated to start
+// an election right away, so that a new leader is elected without waiting
+// for the election timeout. It returns the peer chosen, nil if there is
+// no peer at all.
+func (self *LeaderState) TransferLeadership(
+    localHSM *LocalHSM) *ps.ServerAddress {
+
+    conf, err := localHSM.ConfigManager().RNth(0)
+    if err != nil {
+        self.Error("fail to read last config for leadership transfer")
+        return nil
+    }
+    var target *ps.ServerAddress
+    var targetMatchIndex uint64
+    for _, addr := range GetPeers(localHSM.GetLocalAddr(), conf).Addresses {
+        matchIndex := self.Inflight.MatchIndex(addr)
+        if (target == nil) || (matchIndex > targetMatchIndex) {
+            target = addr
+            targetMatchIndex = matchIndex
+        }
+    }
+    if target == nil {
+        self.Warning("no peer to transfer leadership to")
+        return nil
+    }
+    self.Info("transfer leadership to: %s, match index: %d",
+        target.String(), targetMatchIndex)
+    self.TransferLeadershipTo(localHSM, target)
+    return target
+}
+
+// TransferLeadershipToPeer asks the peer addr to start an election right
+// away. It returns the peer in the last config, nil if addr is not a peer.
+func (self *LeaderState) TransferLeadershipToPeer(
+    localHSM *LocalHSM, addr *ps.ServerAddress) *ps.ServerAddress {
+
+    conf, err := localHSM.ConfigManager().RNth(0)
+    if err != nil {
+        self.Error("fail to read last config for leadership transfer")
+        return nil
+    }
+    for _, peer := range GetPeers(localHSM.GetLocalAddr(), conf).Addresses {
+        if ps.MultiAddrEqual(peer, addr) {
+            self.Info("transfer leadership to: %s, match index: %d",
+                peer.String(), self.Inflight.MatchIndex(peer))
+            self.TransferLeadershipTo(localHSM, peer)
+            return peer
+        }
+    }
+    self.Warning("no peer %s to transfer leadership to", addr.String())
+    return nil
+}
+
+// TransferLeadershipTo asks target to start an election right away.
+func (self *LeaderState) TransferLeadershipTo(
+    localHSM *LocalHSM, target *ps.ServerAddress) {
+
+    request := &ev.TimeoutNowRequest{
+        Term:   localHSM.GetCurrentTerm(),
+        Leader: localHSM.GetLocalAddr(),
+    }
+    localHSM.Peers().SendTimeoutNow(target, request)
+}
+
+// TransferToPreferred transfers the leadership to the member of the highest
+// priority, if it's higher than the local one and the member has caught up
+// with leader log. It's skipped when the leader is not healthy or in
+// member change, and not retried within an election timeout.
+func (self *LeaderState) TransferToPreferred(localHSM *LocalHSM) {
+    if localHSM.GetMemberChangeStatus() != NotInMemeberChange {
+        return
+    }
+    if !self.transferTime.IsZero() &&
+        !TimeExpire(self.clock, self.transferTime, self.electionTimeout) {
+        return
+    }
+    conf, err := localHSM.ConfigManager().RNth(0)
+    if err != nil {
+        localHSM.SelfDispatch(ev.NewPersistErrorEvent(errors.New(
+            "fail to read last config")))
+        return
+    }
+    target := PreferredLeader(localHSM.GetLocalAddr(), conf)
+    if target == nil {
+        return
+    }
+    matchIndex := self.Inflight.MatchIndex(target)
+    if (matchIndex < self.lastLogIndex) ||
+        (self.persistedIndex < self.lastLogIndex) ||
+        !self.QuorumContacted(localHSM, self.clock.Now()) {
+        return
+    }
+    self.Info("transfer leadership to preferred member: %s, "+
+        "priority: %d, local priority: %d", target.String(),
+        conf.Priority(target), conf.Priority(localHSM.GetLocalAddr()))
+    self.transferTime = self.clock.Now()
+    self.TransferLeadershipTo(localHSM, target)
+}
+
+// PreferredLeader returns the first member of the highest priority in conf,
+// or nil if its priority is not higher than the one of local.
+func PreferredLeader(
+    local *ps.ServerAddress, conf *ps.Config) *ps.ServerAddress {
+
+    var target *ps.ServerAddress
+    priority := conf.Priority(local)
+    for _, addr := range GetPeers(local, conf).Addresses {
+        if p := conf.Priority(addr); p > priority {
+            target = addr
+            priority = p
+        }
+    }
+    return target
+}
+
 func (self *LeaderState) HandleClientRequest(
     localHSM *LocalHSM, requestData []byte, resultChan chan ev.Event) {
 
@@ -261,12 +604,8 @@ func (self *LeaderState) StartFlight(
 
     term := localHSM.GetCurrentTerm()
     log := localHSM.Log()
-    lastLogTerm, lastLogIndex, err := log.LastEntryInfo()
-    if err != nil {
-        message := fmt.Sprintf(
-            "fail to read last entry info of log, error: %s", err)
-        return errors.New(message)
-    }
+    // the previous entries may be not stored in local log yet
+    lastLogTerm, lastLogIndex := self.lastLogTerm, self.lastLogIndex
     committedIndex, err := log.CommittedIndex()
     if err != nil {
         return errors.New("fail to read committed index of log")
@@ -287,14 +626,13 @@ func (self *LeaderState) StartFlight(
         Conf:  conf,
     }
 
-    // persist log locally
-    if err := log.StoreLog(logEntry); err != nil {
-        message := fmt.Sprintf("fail to store log, error: %s", err)
-        return errors.New(message)
-    }
-
     if conf.IsInMemeberChange() {
-        localHSM.Peers().AddPeers(GetPeers(localHSM.GetLocalAddr(), conf))
+        peers := localHSM.Peers()
+        peers.AddPeers(GetPeers(localHSM.GetLocalAddr(), conf))
+        // the newly added peers start deactivated, bring them to leader
+        // peer state. Others already there would ignore these events.
+        peers.Broadcast(ev.NewPeerActivateEvent())
+        peers.Broadcast(ev.NewPeerEnterLeaderEvent())
         self.Inflight.ChangeMember(conf)
     }
 
@@ -303,8 +641,10 @@ func (self *LeaderState) StartFlight(
         LogEntry:   logEntry,
         ResultChan: resultChan,
     }
-    self.Inflight.Add(inflightRequest)
-    // TODO add check for Add()
+    if err := self.Inflight.Add(inflightRequest); err != nil {
+        return err
+    }
+    self.lastLogTerm, self.lastLogIndex = term, logIndex
 
     // send AppendEntriesReqeust to all peer
     request := &ev.AppendEntriesRequest{
@@ -321,31 +661,47 @@ func (self *LeaderState) StartFlight(
         len(request.Entries), request.LeaderCommitIndex,
         "["+strings.Join(EntriesInfo(request.Entries), ",")+"]")
     event := ev.NewAppendEntriesRequestEvent(request)
-
-    selfResponse := &ev.AppendEntriesResponse{
-        Term:         term,
-        LastLogIndex: logIndex,
-        Success:      true,
-    }
-    localHSM.SelfDispatch(ev.NewAppendEntriesResponseEvent(selfResponse))
+    // replicate to peers and persist locally in parallel, the local
+    // log writer responses to leader itself after the entry is stored
     localHSM.Peers().Broadcast(event)
+    self.writer.Write(logEntry)
     return nil
 }
 
+// CommitInflightEntries commits the entries replicated to a majority.
+// Since the entries are stored in local log in parallel with replicating,
+// the ones not persisted locally yet are pending until they are.
 func (self *LeaderState) CommitInflightEntries(
     localHSM *LocalHSM, entries []*InflightEntry) error {
 
-    for _, entry := range entries {
+    self.pendingCommits = append(self.pendingCommits, entries...)
+    return self.CommitPendingEntries(localHSM)
+}
+
+// CommitPendingEntries commits the pending entries persisted in local log.
+func (self *LeaderState) CommitPendingEntries(localHSM *LocalHSM) error {
+    for len(self.pendingCommits) > 0 {
+        entry := self.pendingCommits[0]
+        if entry.Request.LogEntry.Index > self.persistedIndex {
+            break
+        }
         err := localHSM.CommitInflightLog(entry)
         if err != nil {
             return err
         }
+        self.pendingCommits = self.pendingCommits[1:]
         localHSM.Notifier().Notify(ev.NewNotifyCommitEvent(
             entry.Request.LogEntry.Term, entry.Request.LogEntry.Index))
     }
     return nil
 }
 
+// LastLogIndex returns the index of the last entry started by leader,
+// which may be not stored in local log yet.
+func (self *LeaderState) LastLogIndex() uint64 {
+    return self.lastLogIndex
+}
+
 type UnsyncState struct {
     *LogStateHead
 
@@ -480,3 +836,18 @@ func (self *SyncState) Handle(
         ev.EventString(event))
     return self.Super()
 }
+
+// SendLeaderChangedResponse tells the client waiting on resultChan that
+// its leader has stepped down, with leader as the hint of the new one.
+// It never blocks, since the chan may be one of a stopped listener.
+func SendLeaderChangedResponse(
+    resultChan chan ev.Event, leader *ps.ServerAddress) {
+
+    response := &ev.LeaderChangedResponse{
+        Leader: leader,
+    }
+    select {
+    case resultChan <- ev.NewLeaderChangedResponseEvent(response):
+    default:
+    }
+}
@@ -280,3 +280,105 @@ func TestLeaderSyncHandleClientAppendRequest(t *testing.T) {
     assertGetClientResponseEvent(t, reqEvent, true, testData)
     local.Close()
 }
+
+func TestLeaderSyncHandleExpiredClientRequest(t *testing.T) {
+    local, _ := getLocalAndPeersForSync(t)
+    // the timeouts pass before the requests are handled
+    timeout := time.Nanosecond
+    appendEvent := ev.NewClientAppendRequestEvent(&ev.ClientAppendRequest{
+        Data:    testData,
+        Timeout: timeout,
+    })
+    local.Send(appendEvent)
+    assertGetDeadlineExceededResponseEvent(t, appendEvent)
+    readEvent := ev.NewClientReadOnlyRequestEvent(&ev.ClientReadOnlyRequest{
+        Data:    testData,
+        Timeout: timeout,
+    })
+    local.Send(readEvent)
+    assertGetDeadlineExceededResponseEvent(t, readEvent)
+    local.Close()
+}
+
+func TestLeaderQueryStatus(t *testing.T) {
+    local, peers := getLocalAndPeersForSync(t)
+    follower := testServers.Addresses[1]
+    peerStatus := []*ev.PeerStatus{
+        &ev.PeerStatus{
+            Addr:            follower,
+            StateID:         StateLeaderPeerID,
+            MatchIndex:      testIndex + 1,
+            NextIndex:       testIndex + 2,
+            LastContactTime: time.Now(),
+        },
+    }
+    peers.On("QueryStatus").Return(peerStatus).Once()
+    status := local.QueryStatus()
+    require.NotNil(t, status)
+    assert.Equal(t, testTerm+1, status.Term)
+    assert.Equal(t, ev.RaftStateLeader, status.State)
+    assert.Equal(t, StateSyncID, status.StateID)
+    assert.Equal(t, local.GetLocalAddr(), status.Leader)
+    assert.Equal(t, testIndex+1, status.CommittedIndex)
+    assert.Equal(t, peerStatus, status.Peers)
+    peers.Mock.AssertExpectations(t)
+    local.Close()
+}
+
+func TestIsQuorumContacted(t *testing.T) {
+    servers := ps.SetupMemoryMultiAddrSlice(5)
+    addrs := servers.Addresses
+    local := addrs[0]
+    now := time.Now()
+    since := now.Add(-testConfig.ElectionTimeout)
+    stale := since.Add(-time.Millisecond)
+    conf := &ps.Config{
+        Servers:    servers,
+        NewServers: nil,
+    }
+    contactTimes := map[string]time.Time{
+        addrs[1].String(): now,
+        addrs[2].String(): stale,
+    }
+    assert.False(t, IsQuorumContacted(local, conf, contactTimes, since))
+    contactTimes[addrs[2].String()] = since
+    assert.True(t, IsQuorumContacted(local, conf, contactTimes, since))
+    // it needs a majority in both the old and new servers
+    // during member change
+    conf = &ps.Config{
+        Servers: &ps.ServerAddressSlice{
+            Addresses: addrs[:3],
+        },
+        NewServers: &ps.ServerAddressSlice{
+            Addresses: addrs[2:],
+        },
+    }
+    contactTimes = map[string]time.Time{
+        addrs[1].String(): now,
+        addrs[3].String(): now,
+    }
+    assert.False(t, IsQuorumContacted(local, conf, contactTimes, since))
+    contactTimes[addrs[4].String()] = now
+    assert.True(t, IsQuorumContacted(local, conf, contactTimes, since))
+}
+
+func TestPreferredLeader(t *testing.T) {
+    servers := ps.SetupMemoryMultiAddrSlice(4)
+    addrs := servers.Addresses
+    local := addrs[0]
+    conf := &ps.Config{
+        Servers:    servers,
+        NewServers: nil,
+    }
+    assert.Nil(t, PreferredLeader(local, conf))
+    conf.Priorities = map[string]uint32{
+        local.String():    1,
+        addrs[1].String(): 1,
+    }
+    assert.Nil(t, PreferredLeader(local, conf))
+    conf.Priorities[addrs[2].String()] = 3
+    conf.Priorities[addrs[3].String()] = 2
+    assert.Equal(t, addrs[2], PreferredLeader(local, conf))
+    // no transfer from a member of the highest priority
+    assert.Nil(t, PreferredLeader(addrs[2], conf))
+}
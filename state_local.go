@@ -1,10 +1,15 @@
 package rafted
 
 import (
+    "context"
     "errors"
     hsm "github.com/hhkbp2/go-hsm"
+    ck "github.com/hhkbp2/rafted/clock"
     ev "github.com/hhkbp2/rafted/event"
     logging "github.com/hhkbp2/rafted/logging"
+    ps "github.com/hhkbp2/rafted/persist"
+    rt "github.com/hhkbp2/rafted/retry"
+    "sync"
     "time"
 )
 
@@ -54,6 +59,74 @@ func (self *LocalState) Handle(sm hsm.HSM, event hsm.Event) (state hsm.State) {
         }
         e.SendResponse(ev.NewQueryStateResponseEvent(response))
         return nil
+    case ev.EventQueryNodeStatusRequest:
+        localHSM, ok := sm.(*LocalHSM)
+        hsm.AssertTrue(ok)
+        e, ok := event.(*ev.QueryNodeStatusRequestEvent)
+        hsm.AssertTrue(ok)
+        response, err := localHSM.QueryNodeStatus()
+        if err != nil {
+            e.SendResponse(ev.NewPersistErrorResponseEvent(err))
+            localHSM.SelfDispatch(ev.NewPersistErrorEvent(err))
+            return nil
+        }
+        e.SendResponse(ev.NewQueryNodeStatusResponseEvent(response))
+        return nil
+    case ev.EventBootstrapRequest:
+        // only a follower which has never been configured could bootstrap
+        e, ok := event.(*ev.BootstrapRequestEvent)
+        hsm.AssertTrue(ok)
+        response := &ev.ClientResponse{
+            Success: false,
+        }
+        e.SendResponse(ev.NewClientResponseEvent(response))
+        return nil
+    case ev.EventLeaderForwardMemberChangePhase:
+        // the leader steps down before forwarding the member change
+        localHSM, ok := sm.(*LocalHSM)
+        hsm.AssertTrue(ok)
+        e, ok := event.(*ev.LeaderForwardMemberChangePhaseEvent)
+        hsm.AssertTrue(ok)
+        SendLeaderChangedResponse(e.Message.ResultChan, localHSM.GetLeader())
+        return nil
+    case ev.EventResumeRequest:
+        // not in persist error state, nothing to resume
+        e, ok := event.(*ev.ResumeRequestEvent)
+        hsm.AssertTrue(ok)
+        response := &ev.ClientResponse{
+            Success: true,
+        }
+        e.SendResponse(ev.NewClientResponseEvent(response))
+        return nil
+    case ev.EventSnapshotRequest:
+        // the snapshot is taken by applier, in between the applications
+        localHSM, ok := sm.(*LocalHSM)
+        hsm.AssertTrue(ok)
+        e, ok := event.(*ev.SnapshotRequestEvent)
+        hsm.AssertTrue(ok)
+        localHSM.Applier().Snapshot(e)
+        return nil
+    case ev.EventTransferLeadershipRequest:
+        // only a leader has leadership to transfer
+        e, ok := event.(*ev.TransferLeadershipRequestEvent)
+        hsm.AssertTrue(ok)
+        response := &ev.ClientResponse{
+            Success: false,
+        }
+        e.SendResponse(ev.NewClientResponseEvent(response))
+        return nil
+    case ev.EventTimeoutNowRequest:
+        // only a follower could start an election for the leader
+        localHSM, ok := sm.(*LocalHSM)
+        hsm.AssertTrue(ok)
+        e, ok := event.(*ev.TimeoutNowRequestEvent)
+        hsm.AssertTrue(ok)
+        response := &ev.TimeoutNowResponse{
+            Term:    localHSM.GetCurrentTerm(),
+            Success: false,
+        }
+        e.SendResponse(ev.NewTimeoutNowResponseEvent(response))
+        return nil
     case ev.EventPersistError:
         sm.QTranOnEvent(StatePersistErrorID, event)
         return nil
@@ -107,6 +180,7 @@ func (self *NeedPeersState) Entry(
         if err != nil {
             localHSM.SelfDispatch(ev.NewPersistErrorEvent(errors.New(
                 "fail to read last config")))
+            return nil
         }
         localHSM.Peers().AddPeers(GetPeers(localHSM.GetLocalAddr(), conf))
     }
@@ -133,23 +207,40 @@ func (self *NeedPeersState) Handle(
     return self.Super()
 }
 
+// PersistErrorState is the state a node stays in after any persist error,
+// where it serves no request except ResumeRequest. A ResumeRequest brings
+// the node back to follower once the log and config work again,
+// as CheckPersist() tells.
+// With PersistErrorAutoRetry policy, the node checks them with the backoff
+// of retry by itself, and resumes once the check passes.
 type PersistErrorState struct {
     *LogStateHead
 
     err           error
     notifyTimeout time.Duration
     ticker        Ticker
+    policy        PersistErrorPolicy
+    retry         *rt.ErrorRetry
+    clock         ck.Clock
+    cancel        context.CancelFunc
+    group         sync.WaitGroup
 }
 
 func NewPersistErrorState(
     super hsm.State,
     persistErrorNotifyTimeout time.Duration,
+    policy PersistErrorPolicy,
+    retry *rt.ErrorRetry,
+    clock ck.Clock,
     logger logging.Logger) *PersistErrorState {
 
     object := &PersistErrorState{
         LogStateHead:  NewLogStateHead(super, logger),
         notifyTimeout: persistErrorNotifyTimeout,
-        ticker:        NewSimpleTicker(persistErrorNotifyTimeout),
+        ticker:        NewSimpleTicker(persistErrorNotifyTimeout, clock),
+        policy:        policy,
+        retry:         retry,
+        clock:         clock,
     }
     super.AddChild(object)
     return object
@@ -174,6 +265,12 @@ func (self *PersistErrorState) Entry(
         localHSM.Notifier().Notify(ev.NewNotifyPersistErrorEvent(self.err))
     }
     self.ticker.Start(dispatchTimeout)
+    if (self.policy == PersistErrorAutoRetry) && (self.retry != nil) {
+        ctx, cancel := context.WithCancel(context.Background())
+        self.cancel = cancel
+        self.group.Add(1)
+        go self.retryResume(ctx, localHSM)
+    }
     return nil
 }
 
@@ -182,9 +279,41 @@ func (self *PersistErrorState) Exit(
 
     self.Debug("STATE: %s, -> Exit", self.ID())
     self.ticker.Stop()
+    if self.cancel != nil {
+        self.cancel()
+        self.group.Wait()
+        self.cancel = nil
+    }
     return nil
 }
 
+func (self *PersistErrorState) retryResume(
+    ctx context.Context, localHSM *LocalHSM) {
+
+    defer self.group.Done()
+    sleep := func(d time.Duration) {
+        select {
+        case <-self.clock.After(d):
+        case <-ctx.Done():
+        }
+    }
+    check := func() error {
+        if err := CheckPersist(localHSM); err != nil {
+            self.Warning("persist check fails: %s", err)
+            return rt.ForceRetryError
+        }
+        return nil
+    }
+    if err := self.retry.Copy().SleepFunc(sleep).DoContext(
+        ctx, check); err != nil {
+
+        self.Warning("stop retrying persist check: %s", err)
+        return
+    }
+    self.Info("persist check passes, resume")
+    localHSM.SelfDispatch(ev.NewResumeRequestEvent(&ev.ResumeRequest{}))
+}
+
 func (self *PersistErrorState) Handle(
     sm hsm.HSM, event hsm.Event) (state hsm.State) {
 
@@ -195,11 +324,63 @@ func (self *PersistErrorState) Handle(
         self.Error("already in state: %s, ignore event: %s", self.ID(),
             ev.EventString(event))
         return nil
-    case ev.IsClientRequestEvent(event.Type()):
+    case ev.IsClientRequestEvent(event.Type()) ||
+        event.Type() == ev.EventSnapshotRequest:
+
         e, ok := event.(ev.RequestEvent)
         hsm.AssertTrue(ok)
         e.SendResponse(ev.NewPersistErrorResponseEvent(self.err))
         return nil
+    case event.Type() == ev.EventResumeRequest:
+        localHSM, ok := sm.(*LocalHSM)
+        hsm.AssertTrue(ok)
+        e, ok := event.(*ev.ResumeRequestEvent)
+        hsm.AssertTrue(ok)
+        if err := CheckPersist(localHSM); err != nil {
+            self.Warning("refuse to resume: %s", err)
+            e.SendResponse(ev.NewPersistErrorResponseEvent(err))
+            return nil
+        }
+        self.Info("resume from persist error: %s", self.err)
+        response := &ev.ClientResponse{
+            Success: true,
+        }
+        e.SendResponse(ev.NewClientResponseEvent(response))
+        sm.QTran(StateFollowerID)
+        return nil
     }
     return self.Super()
 }
+
+// CheckPersist reads the log and config of localHSM, and probes writing
+// them if they implement ps.Prober, to tell whether they work again after
+// a persist error.
+func CheckPersist(localHSM *LocalHSM) error {
+    log := localHSM.Log()
+    if _, _, err := log.LastEntryInfo(); err != nil {
+        return err
+    }
+    if _, err := log.CommittedIndex(); err != nil {
+        return err
+    }
+    if _, err := log.LastAppliedIndex(); err != nil {
+        return err
+    }
+    configManager := localHSM.ConfigManager()
+    _, err := configManager.RNth(0)
+    if (err != nil) && (err != ps.ErrorNoConfig) {
+        return err
+    }
+    // a disk failing writes could be still readable
+    if prober, ok := log.(ps.Prober); ok {
+        if err := prober.Probe(); err != nil {
+            return err
+        }
+    }
+    if prober, ok := configManager.(ps.Prober); ok {
+        if err := prober.Probe(); err != nil {
+            return err
+        }
+    }
+    return nil
+}
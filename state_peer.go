@@ -4,9 +4,11 @@ import (
     "errors"
     "fmt"
     hsm "github.com/hhkbp2/go-hsm"
+    ck "github.com/hhkbp2/rafted/clock"
     ev "github.com/hhkbp2/rafted/event"
     logging "github.com/hhkbp2/rafted/logging"
     ps "github.com/hhkbp2/rafted/persist"
+    rt "github.com/hhkbp2/rafted/retry"
     "io"
     "strings"
     "sync"
@@ -284,19 +286,24 @@ type LeaderPeerState struct {
     // last time we have contact from the peer
     lastContactTime     time.Time
     lastContactTimeLock sync.RWMutex
+    clock               ck.Clock
 }
 
 func NewLeaderPeerState(
     super hsm.State,
     heartbeatTimeout time.Duration,
     maxTimeoutJitter float32,
+    clock ck.Clock,
+    random rt.Random,
     logger logging.Logger) *LeaderPeerState {
 
     object := &LeaderPeerState{
         LogStateHead:     NewLogStateHead(super, logger),
         heartbeatTimeout: heartbeatTimeout,
         maxTimeoutJitter: maxTimeoutJitter,
-        ticker:           NewRandomTicker(heartbeatTimeout, maxTimeoutJitter),
+        ticker: NewRandomTicker(
+            heartbeatTimeout, maxTimeoutJitter, clock, random),
+        clock: clock,
     }
     super.AddChild(object)
     return object
@@ -502,7 +509,7 @@ func (self *LeaderPeerState) LastContactTime() time.Time {
 func (self *LeaderPeerState) UpdateLastContactTime() {
     self.lastContactTimeLock.Lock()
     defer self.lastContactTimeLock.Unlock()
-    self.lastContactTime = time.Now()
+    self.lastContactTime = self.clock.Now()
 }
 
 func (self *LeaderPeerState) UpdateLastContact() {
@@ -519,6 +526,20 @@ func (self *LeaderPeerState) HandleAppendEntriesResponse(local Local, peerHSM *P
     }
     matchIndex, _ := self.GetIndexInfo()
     peerAddr := peerHSM.Addr()
+    if !response.Success && (response.ConflictIndex > 0) {
+        // nothing is replicated, backtrack to skip the conflict
+        nextIndex, err := self.BacktrackIndex(local, response)
+        if err != nil {
+            local.SendPrior(ev.NewPersistErrorEvent(err))
+            return
+        }
+        self.Debug("the log of peer %s conflicts at term: %d, index: %d, "+
+            "backtrack next index to %d", peerAddr.String(),
+            response.ConflictTerm, response.ConflictIndex, nextIndex)
+        self.SetMatchIndex(nextIndex - 1)
+        self.SetMatchIndexUpdated(true)
+        return
+    }
     if response.LastLogIndex > matchIndex {
         self.Debug("the LastLogIndex of peer %s updates from %d to %d",
             peerAddr.String(), matchIndex, response.LastLogIndex)
@@ -539,6 +560,35 @@ func (self *LeaderPeerState) HandleAppendEntriesResponse(local Local, peerHSM *P
     self.SetMatchIndexUpdated(true)
 }
 
+// BacktrackIndex returns the next index to replicate to the peer
+// according to the conflict hints in response. It skips to the one after
+// the last entry of the conflicting term in local log, or to the first
+// index of that term in the peer log if local log has no such term.
+func (self *LeaderPeerState) BacktrackIndex(
+    local Local, response *ev.AppendEntriesResponse) (uint64, error) {
+
+    if response.ConflictTerm == 0 {
+        // the peer log is shorter than the index checked
+        return response.ConflictIndex, nil
+    }
+    lastLogIndex, err := local.Log().LastIndex()
+    if err != nil {
+        return 0, errors.New("fail to read last log index of log")
+    }
+    index, err := LastIndexOfTerm(
+        local.Log(), response.ConflictTerm, lastLogIndex)
+    if err != nil {
+        message := fmt.Sprintf(
+            "fail to find last index of term: %d, error: %s",
+            response.ConflictTerm, err)
+        return 0, errors.New(message)
+    }
+    if index == 0 {
+        return response.ConflictIndex, nil
+    }
+    return index + 1, nil
+}
+
 type StandardModePeerState struct {
     *LogStateHead
 
@@ -600,7 +650,8 @@ func (self *StandardModePeerState) Handle(
                 "fail to read last log index of log")))
             return nil
         }
-        if e.Response.LastLogIndex < lastLogIndex {
+        matchIndex, _ := leaderPeerState.GetIndexInfo()
+        if matchIndex < lastLogIndex {
             // peer log has not caught up with us leader yet
             event := self.SetupReplicating(peerHSM)
             peerHSM.SelfDispatch(event)
@@ -709,6 +760,10 @@ func (self *StandardModePeerState) SetupReplicating(
     case matchIndex == 0:
         event = self.SetupNextAppendEntriesRequestEvent(
             local, uint64(0), uint64(0), nextIndex)
+    case matchIndex == lastSnapshotIndex:
+        // the entry at matchIndex may be compacted into the snapshot
+        event = self.SetupNextAppendEntriesRequestEvent(
+            local, lastSnapshotTerm, lastSnapshotIndex, nextIndex)
     default:
         log, err := local.Log().GetLog(matchIndex)
         if err != nil {
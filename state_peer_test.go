@@ -7,7 +7,9 @@ import (
     "github.com/hhkbp2/testify/assert"
     "github.com/hhkbp2/testify/mock"
     "github.com/hhkbp2/testify/require"
+    "sync/atomic"
     "testing"
+    "time"
 )
 
 func TestPeerHeartbeatTimeout(t *testing.T) {
@@ -232,3 +234,121 @@ func TestPeerStandardModeCatchingUp(t *testing.T) {
     peer.Close()
     assert.Nil(t, server.Close())
 }
+
+// runTestPeerDivergence replicates to a peer whose log has a long divergent
+// suffix, and returns the number of AE rpc until their logs are the same.
+// The peer responds with conflict term hints if hint is true, otherwise
+// it only hints one index back.
+func runTestPeerDivergence(t *testing.T, hint bool) int32 {
+    conf := &ps.Config{
+        Servers:    testServers,
+        NewServers: nil,
+    }
+    newEntries := func(term, from uint64, count int) []*ps.LogEntry {
+        entries := make([]*ps.LogEntry, 0, count)
+        for i := 0; i < count; i++ {
+            entries = append(entries, &ps.LogEntry{
+                Term:  term,
+                Index: from + uint64(i),
+                Type:  ps.LogCommand,
+                Data:  testData,
+                Conf:  conf,
+            })
+        }
+        return entries
+    }
+    // the peer has the same two entries with leader, followed by
+    // the divergent entries of a term never seen by leader
+    peerLog, err := getTestLog(testIndex, testIndex,
+        newEntries(testTerm, testIndex-1, 2))
+    require.Nil(t, err)
+    require.Nil(t, peerLog.StoreLogs(newEntries(testTerm+1, testIndex+1, 20)))
+    aheadCount := 10
+    leaderLastIndex := testIndex + uint64(aheadCount)
+    var requestCount int32
+    var syncedCount int32
+    synced := make(chan interface{})
+    // a simple simulation for a follower which checks the prev log and
+    // stores the entries in AE rpc
+    requestHandler := func(event ev.RequestEvent) {
+        e, ok := event.(*ev.AppendEntriesRequestEvent)
+        if !assert.True(t, ok) {
+            return
+        }
+        count := atomic.AddInt32(&requestCount, 1)
+        request := e.Request
+        response := &ev.AppendEntriesResponse{
+            Term:    request.Term,
+            Success: false,
+        }
+        lastIndex, err := peerLog.LastIndex()
+        assert.Nil(t, err)
+        prevLog, err := peerLog.GetLog(request.PrevLogIndex)
+        switch {
+        case request.PrevLogIndex > lastIndex:
+            response.ConflictIndex = lastIndex + 1
+        case err != nil:
+            assert.Nil(t, err)
+        case prevLog.Term != request.PrevLogTerm:
+            if hint {
+                response.ConflictTerm = prevLog.Term
+                response.ConflictIndex, err = FirstIndexOfTerm(
+                    peerLog, prevLog.Term, request.PrevLogIndex)
+                assert.Nil(t, err)
+            } else {
+                response.ConflictIndex = request.PrevLogIndex
+            }
+        default:
+            if len(request.Entries) > 0 {
+                first := request.Entries[0].Index
+                if first <= lastIndex {
+                    assert.Nil(t, peerLog.TruncateAfter(first))
+                }
+                assert.Nil(t, peerLog.StoreLogs(request.Entries))
+            }
+            response.Success = true
+        }
+        response.LastLogIndex, err = peerLog.LastIndex()
+        assert.Nil(t, err)
+        if response.Success && (response.LastLogIndex == leaderLastIndex) &&
+            atomic.CompareAndSwapInt32(&syncedCount, 0, count) {
+
+            close(synced)
+        }
+        event.SendResponse(ev.NewAppendEntriesResponseEvent(response))
+    }
+    leaderAddr := testServers.Addresses[0]
+    peerAddr := testServers.Addresses[1]
+    server := getTestMemoryServer(peerAddr, requestHandler)
+    defer server.Close()
+    peer, mockLocal := getTestPeerAndLocalSafe(t)
+    defer peer.Close()
+    require.Nil(t, mockLocal.Log().StoreLogs(
+        newEntries(testTerm+2, testIndex+1, aheadCount)))
+    peer.Send(ev.NewPeerActivateEvent())
+    mockLocal.On("GetCurrentTerm").Return(testTerm + 2)
+    mockLocal.On("GetLocalAddr").Return(leaderAddr)
+    mockLocal.On("SendPrior", mock.Anything).Return()
+    peer.Send(ev.NewPeerEnterLeaderEvent())
+    select {
+    case <-synced:
+    case <-time.After(time.Second):
+        require.True(t, false, "peer log not synced")
+    }
+    for i := testIndex + 1; i <= leaderLastIndex; i++ {
+        entry, err := peerLog.GetLog(i)
+        require.Nil(t, err)
+        assert.Equal(t, testTerm+2, entry.Term)
+    }
+    return atomic.LoadInt32(&syncedCount)
+}
+
+func TestPeerStandardModeDivergence(t *testing.T) {
+    require.Nil(t, assert.SetCallerInfoLevelNumber(3))
+    stepCount := runTestPeerDivergence(t, false)
+    hintCount := runTestPeerDivergence(t, true)
+    // one for the conflict, and another for the entries after it
+    assert.Equal(t, int32(2), hintCount)
+    assert.True(t, hintCount < stepCount,
+        "round trips with hints: %d, without: %d", hintCount, stepCount)
+}
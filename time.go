@@ -1,116 +1,237 @@
 package rafted
 
 import (
+    "context"
+    hsm "github.com/hhkbp2/go-hsm"
+    ck "github.com/hhkbp2/rafted/clock"
+    ev "github.com/hhkbp2/rafted/event"
     rt "github.com/hhkbp2/rafted/retry"
+    "math"
     "sync"
+    "sync/atomic"
     "time"
 )
 
-func RandomLessDuration(d time.Duration, maxJitter float32) time.Duration {
-    jitter := float64(rt.RandIntN(int(maxJitter*100))+1) / 100
+func RandomLessDuration(
+    random rt.Random, d time.Duration, maxJitter float32) time.Duration {
+
+    return lessDuration(d, random.Intn(int(maxJitter*100)))
+}
+
+// lessDuration shortens d by (n+1) percent.
+func lessDuration(d time.Duration, n int) time.Duration {
+    jitter := float64(n+1) / 100
     return time.Duration(int64(float64(int64(d)) * (1 - jitter)))
 }
 
-func TimeExpire(lastTime time.Time, timeout time.Duration) bool {
-    if time.Now().Sub(lastTime) < timeout {
+// mix64 scrambles x into an evenly distributed number, with the finalizer
+// of splitmix64.
+func mix64(x uint64) uint64 {
+    x ^= x >> 30
+    x *= 0xbf58476d1ce4e5b9
+    x ^= x >> 27
+    x *= 0x94d049bb133111eb
+    x ^= x >> 31
+    return x
+}
+
+func TimeExpire(
+    clock ck.Clock, lastTime time.Time, timeout time.Duration) bool {
+
+    if clock.Now().Sub(lastTime) < timeout {
         return false
     }
     return true
 }
 
+// TimeoutOf returns the time left before the deadline of ctx, which
+// travels in client requests, so that the clocks of client and node
+// needn't agree. It's zero if ctx has no deadline, and no less than
+// a nanosecond otherwise, since zero means no timeout.
+func TimeoutOf(ctx context.Context) time.Duration {
+    deadline, ok := ctx.Deadline()
+    if !ok {
+        return 0
+    }
+    if timeout := deadline.Sub(time.Now()); timeout > 0 {
+        return timeout
+    }
+    return time.Nanosecond
+}
+
+// SetRequestDeadline sets the deadline of a client request event from
+// the timeout in its request, counted from now on the clock of local node.
+// It's called on the request arriving.
+func SetRequestDeadline(event hsm.Event, now time.Time) {
+    switch e := event.(type) {
+    case *ev.ClientAppendRequestEvent:
+        e.Deadline = deadlineAfter(now, e.Request.Timeout)
+    case *ev.ClientReadOnlyRequestEvent:
+        e.Deadline = deadlineAfter(now, e.Request.Timeout)
+    }
+}
+
+func deadlineAfter(now time.Time, timeout time.Duration) time.Time {
+    if timeout == 0 {
+        return time.Time{}
+    }
+    return now.Add(timeout)
+}
+
+// DeadlineExpire returns whether the deadline of a client request
+// has passed on clock. A zero deadline never expires.
+func DeadlineExpire(clock ck.Clock, deadline time.Time) bool {
+    return !deadline.IsZero() && clock.Now().After(deadline)
+}
+
 type Ticker interface {
     Start(fn func())
     Reset()
     Stop()
 }
 
-type SimpleTicker struct {
-    timeout   time.Duration
+// ClockTicker calls back on every timeout of timers created by its clock.
+// The timeout of every timer is decided by the time it's armed.
+// When periodic is set, the next deadline is counted from the last one
+// rather than the time the callback is triggered, so that ticks don't drift.
+type ClockTicker struct {
+    clock     ck.Clock
+    timeout   func(from time.Time) time.Duration
+    periodic  bool
+    timer     ck.Timer
+    deadline  time.Time
+    timerLock sync.Mutex
     stopChan  chan interface{}
     resetChan chan interface{}
     group     *sync.WaitGroup
 }
 
-func NewSimpleTicker(timeout time.Duration) *SimpleTicker {
-    return &SimpleTicker{
+func NewClockTicker(
+    clock ck.Clock,
+    timeout func(from time.Time) time.Duration,
+    periodic bool) *ClockTicker {
+
+    return &ClockTicker{
+        clock:     clock,
         timeout:   timeout,
+        periodic:  periodic,
         stopChan:  make(chan interface{}),
         resetChan: make(chan interface{}),
         group:     &sync.WaitGroup{},
     }
 }
 
-func (self *SimpleTicker) Start(fn func()) {
+// arm starts a new timer which fires at one timeout later than from.
+// It should be called with timerLock held.
+func (self *ClockTicker) arm(from time.Time) {
+    if self.timer != nil {
+        self.timer.Stop()
+    }
+    self.deadline = from.Add(self.timeout(from))
+    self.timer = self.clock.NewTimer(self.deadline.Sub(self.clock.Now()))
+}
+
+func (self *ClockTicker) Start(fn func()) {
+    self.timerLock.Lock()
+    self.arm(self.clock.Now())
+    self.timerLock.Unlock()
     routine := func() {
         defer self.group.Done()
-        ticker := time.NewTicker(self.timeout)
         for {
+            self.timerLock.Lock()
+            timer := self.timer
+            self.timerLock.Unlock()
             select {
             case <-self.stopChan:
+                self.timerLock.Lock()
+                self.timer.Stop()
+                self.timerLock.Unlock()
                 return
             case <-self.resetChan:
-                ticker = time.NewTicker(self.timeout)
-            case <-ticker.C:
+            case <-timer.Chan():
+                self.timerLock.Lock()
+                if self.timer != timer {
+                    // reset during the firing of this timer
+                    self.timerLock.Unlock()
+                    continue
+                }
+                if self.periodic {
+                    self.arm(self.deadline)
+                } else {
+                    self.arm(self.clock.Now())
+                }
+                self.timerLock.Unlock()
                 fn()
             }
         }
-
     }
     self.group.Add(1)
     go routine()
 }
 
-func (self *SimpleTicker) Reset() {
+func (self *ClockTicker) Reset() {
+    self.timerLock.Lock()
+    self.arm(self.clock.Now())
+    self.timerLock.Unlock()
     self.resetChan <- self
 }
 
-func (self *SimpleTicker) Stop() {
+func (self *ClockTicker) Stop() {
     self.stopChan <- self
     self.group.Wait()
 }
 
-type RandomTicker struct {
-    timeout   time.Duration
-    maxJitter float32
-    stopChan  chan interface{}
-    resetChan chan interface{}
-    group     *sync.WaitGroup
+type SimpleTicker struct {
+    *ClockTicker
 }
 
-func NewRandomTicker(timeout time.Duration, maxJitter float32) *RandomTicker {
-    return &RandomTicker{
-        timeout:   timeout,
-        maxJitter: maxJitter,
-        stopChan:  make(chan interface{}),
-        resetChan: make(chan interface{}),
-        group:     &sync.WaitGroup{},
+func NewSimpleTicker(timeout time.Duration, clock ck.Clock) *SimpleTicker {
+    fn := func(_ time.Time) time.Duration {
+        return timeout
+    }
+    return &SimpleTicker{
+        ClockTicker: NewClockTicker(clock, fn, true),
     }
 }
 
-func (self *RandomTicker) Start(fn func()) {
-    routine := func() {
-        defer self.group.Done()
-        for {
-            timeChan := time.After(
-                RandomLessDuration(self.timeout, self.maxJitter))
-            select {
-            case <-self.stopChan:
-                return
-            case <-self.resetChan:
-            case <-timeChan:
-                fn()
-            }
-        }
+// RandomTicker ticks with a random jitter for every timeout.
+// The jitter is a hash of the time the timer is armed and a seed drawn
+// from random once, rather than the next number of random. So it only
+// depends on the time line of clock, not on how many times the ticker
+// is reset, and it's cheap to arm the timer.
+// The timeout could be scaled, e.g. to delay the election of
+// low priority members.
+type RandomTicker struct {
+    *ClockTicker
+    scale int64
+}
+
+func NewRandomTicker(
+    timeout time.Duration,
+    maxJitter float32,
+    clock ck.Clock,
+    random rt.Random) *RandomTicker {
+
+    object := &RandomTicker{
+        scale: 1,
     }
-    self.group.Add(1)
-    go routine()
+    seed := uint64(random.Intn(math.MaxInt32))
+    percent := uint64(maxJitter * 100)
+    fn := func(from time.Time) time.Duration {
+        n := mix64(seed^uint64(from.UnixNano())) % percent
+        scaled := timeout * time.Duration(atomic.LoadInt64(&object.scale))
+        return lessDuration(scaled, int(n))
+    }
+    object.ClockTicker = NewClockTicker(clock, fn, false)
+    return object
 }
 
-func (self *RandomTicker) Reset() {
-    self.resetChan <- self
+// SetScale makes the timeouts armed afterwards scale times long.
+func (self *RandomTicker) SetScale(scale int) {
+    atomic.StoreInt64(&self.scale, int64(scale))
 }
 
-func (self *RandomTicker) Stop() {
-    self.stopChan <- self
-    self.group.Wait()
+// Scale returns the scale of timeout.
+func (self *RandomTicker) Scale() int {
+    return int(atomic.LoadInt64(&self.scale))
 }
@@ -1,6 +1,10 @@
 package rafted
 
 import (
+    "context"
+    ck "github.com/hhkbp2/rafted/clock"
+    ev "github.com/hhkbp2/rafted/event"
+    rt "github.com/hhkbp2/rafted/retry"
     "github.com/hhkbp2/testify/assert"
     "testing"
     "time"
@@ -9,16 +13,50 @@ import (
 func TestRandomLessDuration(t *testing.T) {
     timeout := testConfig.HeartbeatTimeout
     var maxJitter float32 = 0.1
-    rtimeout := RandomLessDuration(timeout, maxJitter)
+    rtimeout := RandomLessDuration(rt.DefaultRandom, timeout, maxJitter)
     assert.True(t, timeout > rtimeout)
     timeoutLowerBound := time.Duration(int64(float64(int64(timeout)) * (1 - 0.1)))
     assert.True(t, rtimeout >= timeoutLowerBound)
 }
 
+func TestRequestDeadline(t *testing.T) {
+    // the timeout travels rather than the deadline of client
+    assert.Equal(t, time.Duration(0), TimeoutOf(context.Background()))
+    ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+    defer cancel()
+    timeout := TimeoutOf(ctx)
+    assert.True(t, (timeout > 0) && (timeout <= time.Minute))
+    expired, cancel := context.WithDeadline(
+        context.Background(), time.Now().Add(-time.Minute))
+    defer cancel()
+    assert.Equal(t, time.Nanosecond, TimeoutOf(expired))
+    // the deadline is counted on the clock of node from arrival
+    clock := ck.NewVirtualClock(time.Unix(0, 0))
+    request := &ev.ClientAppendRequest{
+        Data:    testData,
+        Timeout: time.Second,
+    }
+    event := ev.NewClientAppendRequestEvent(request)
+    SetRequestDeadline(event, clock.Now())
+    assert.Equal(t, time.Unix(1, 0), event.Deadline)
+    assert.False(t, DeadlineExpire(clock, event.Deadline))
+    clock.Advance(time.Second)
+    assert.False(t, DeadlineExpire(clock, event.Deadline))
+    clock.Advance(time.Nanosecond)
+    assert.True(t, DeadlineExpire(clock, event.Deadline))
+    // requests without timeout never expire
+    readEvent := ev.NewClientReadOnlyRequestEvent(&ev.ClientReadOnlyRequest{
+        Data: testData,
+    })
+    SetRequestDeadline(readEvent, clock.Now())
+    assert.True(t, readEvent.Deadline.IsZero())
+    assert.False(t, DeadlineExpire(clock, readEvent.Deadline))
+}
+
 func TestSimpleTicker(t *testing.T) {
     timeout := time.Millisecond * 50
     totalTime := time.Second * 1
-    ticker := NewSimpleTicker(timeout)
+    ticker := NewSimpleTicker(timeout, ck.DefaultClock)
     timeoutCount := 0
     onTimeout := func() {
         timeoutCount++
@@ -47,7 +85,8 @@ func TestRandomTicker(t *testing.T) {
     timeout := time.Millisecond * 50
     totalTime := time.Second * 1
     maxJitter := float32(0.2)
-    ticker := NewRandomTicker(timeout, maxJitter)
+    ticker := NewRandomTicker(
+        timeout, maxJitter, ck.DefaultClock, rt.DefaultRandom)
     timeoutCount := 0
     onTimeout := func() {
         timeoutCount++
@@ -69,3 +108,88 @@ func TestRandomTicker(t *testing.T) {
     assert.Equal(t, 0, timeoutCount)
     ticker.Stop()
 }
+
+func waitTimerArmed(clock *ck.VirtualClock, count int) {
+    for clock.Pending() < count {
+        time.Sleep(time.Millisecond)
+    }
+}
+
+func TestSimpleTickerVirtualClock(t *testing.T) {
+    clock := ck.NewVirtualClock(time.Unix(0, 0))
+    timeout := time.Millisecond * 50
+    ticker := NewSimpleTicker(timeout, clock)
+    tickChan := make(chan time.Time, 1)
+    onTimeout := func() {
+        tickChan <- clock.Now()
+    }
+    ticker.Start(onTimeout)
+    // ticks should happen exactly at every timeout in virtual time
+    for i := 1; i <= 10; i++ {
+        _, ok := clock.Step()
+        assert.True(t, ok)
+        now := <-tickChan
+        assert.Equal(t, time.Unix(0, 0).Add(timeout*time.Duration(i)), now)
+        waitTimerArmed(clock, 1)
+    }
+    // test Reset()
+    clock.Advance(timeout / 2)
+    ticker.Reset()
+    assert.Equal(t, 1, clock.Pending())
+    clock.Advance(timeout / 2)
+    assert.Equal(t, 0, len(tickChan))
+    clock.Advance(timeout / 2)
+    <-tickChan
+    // test Stop()
+    waitTimerArmed(clock, 1)
+    ticker.Stop()
+    assert.Equal(t, 0, clock.Pending())
+}
+
+func TestRandomTickerReplay(t *testing.T) {
+    timeout := time.Millisecond * 50
+    maxJitter := float32(0.2)
+    run := func(seed int64) []time.Time {
+        clock := ck.NewVirtualClock(time.Unix(0, 0))
+        ticker := NewRandomTicker(timeout, maxJitter, clock, rt.NewRandom(seed))
+        tickChan := make(chan time.Time, 1)
+        ticker.Start(func() {
+            tickChan <- clock.Now()
+        })
+        ticks := make([]time.Time, 0, 10)
+        for i := 0; i < 10; i++ {
+            clock.Step()
+            ticks = append(ticks, <-tickChan)
+            waitTimerArmed(clock, 1)
+        }
+        ticker.Stop()
+        return ticks
+    }
+    ticks := run(1)
+    for i := 1; i < len(ticks); i++ {
+        d := ticks[i].Sub(ticks[i-1])
+        assert.True(t, d < timeout)
+        assert.True(t, d >= time.Duration(float64(timeout)*(1-0.2)))
+    }
+    // the same seed should replay to the same ticks
+    assert.Equal(t, ticks, run(1))
+}
+
+func TestRandomTickerScale(t *testing.T) {
+    clock := ck.NewVirtualClock(time.Unix(0, 0))
+    timeout := time.Millisecond * 50
+    ticker := NewRandomTicker(timeout, float32(0.1), clock, rt.NewRandom(0))
+    ticker.SetScale(3)
+    assert.Equal(t, 3, ticker.Scale())
+    tickChan := make(chan time.Time, 1)
+    ticker.Start(func() {
+        tickChan <- clock.Now()
+    })
+    _, ok := clock.Step()
+    assert.True(t, ok)
+    elapsed := (<-tickChan).Sub(time.Unix(0, 0))
+    assert.True(t, elapsed > timeout*2, "elapsed: %s", elapsed)
+    assert.True(t, elapsed <= timeout*3, "elapsed: %s", elapsed)
+    waitTimerArmed(clock, 1)
+    ticker.Stop()
+}
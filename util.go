@@ -10,6 +10,8 @@ import (
     ps "github.com/hhkbp2/rafted/persist"
     "io"
     "sync"
+    "sync/atomic"
+    "time"
 )
 
 // The general interface of event channel.
@@ -19,9 +21,106 @@ type EventChannel interface {
     Close()
 }
 
-// ReliableEventChannel is an unlimited size channel for
-// non-blocking event sending/receiving.
+// OverflowPolicy is what a bounded channel does with a new item
+// when it's full.
+type OverflowPolicy uint8
+
+const (
+    // OverflowBlock blocks the sender until there is room.
+    OverflowBlock OverflowPolicy = iota
+    // OverflowReject drops the new item.
+    OverflowReject
+    // OverflowDropOldest drops the oldest item queued to make room for
+    // the new one, which fits the items whose latest ones matter most,
+    // e.g. notifications.
+    OverflowDropOldest
+)
+
+// channelBound keeps the queue of a reliable channel within capacity
+// according to policy. A capacity of 0 means unlimited. The items sent
+// through GetInChan() directly are not counted for OverflowBlock and
+// OverflowReject.
+type channelBound struct {
+    capacity int
+    policy   OverflowPolicy
+    slots    chan struct{}
+    length   int64
+    dropped  uint64
+}
+
+func newChannelBound(capacity int, policy OverflowPolicy) *channelBound {
+    object := &channelBound{
+        capacity: capacity,
+        policy:   policy,
+    }
+    if (capacity > 0) && (policy != OverflowDropOldest) {
+        object.slots = make(chan struct{}, capacity)
+    }
+    return object
+}
+
+// acquire takes the room for a new item. It waits for the room only if
+// block is true and the policy is OverflowBlock.
+func (self *channelBound) acquire(block bool) bool {
+    if self.slots == nil {
+        return true
+    }
+    if block && (self.policy == OverflowBlock) {
+        self.slots <- struct{}{}
+        return true
+    }
+    select {
+    case self.slots <- struct{}{}:
+        return true
+    default:
+        return false
+    }
+}
+
+// reject counts a new item dropped for overflow.
+func (self *channelBound) reject() {
+    atomic.AddUint64(&self.dropped, 1)
+}
+
+// push queues item, and drops the oldest item if it overflows with
+// OverflowDropOldest policy.
+func (self *channelBound) push(queue *list.List, item interface{}) {
+    queue.PushBack(item)
+    atomic.AddInt64(&self.length, 1)
+    if (self.policy == OverflowDropOldest) && (self.capacity > 0) &&
+        (queue.Len() > self.capacity) {
+
+        queue.Remove(queue.Front())
+        atomic.AddInt64(&self.length, -1)
+        atomic.AddUint64(&self.dropped, 1)
+    }
+}
+
+// pop removes e from queue after it's received, and releases its room.
+func (self *channelBound) pop(queue *list.List, e *list.Element) {
+    queue.Remove(e)
+    select {
+    case <-self.slots:
+    default:
+    }
+    atomic.AddInt64(&self.length, -1)
+}
+
+// Len returns the number of items queued.
+func (self *channelBound) Len() int {
+    return int(atomic.LoadInt64(&self.length))
+}
+
+// Dropped returns the number of items dropped for overflow.
+func (self *channelBound) Dropped() uint64 {
+    return atomic.LoadUint64(&self.dropped)
+}
+
+// ReliableEventChannel is a channel for non-blocking event
+// sending/receiving. It's unlimited in size unless it's bounded
+// on creation.
 type ReliableEventChannel struct {
+    *channelBound
     inChan    chan hsm.Event
     outChan   chan hsm.Event
     closeChan chan interface{}
@@ -30,13 +129,22 @@ type ReliableEventChannel struct {
 }
 
 func NewReliableEventChannel() *ReliableEventChannel {
+    return NewBoundedEventChannel(0, OverflowBlock)
+}
+
+// NewBoundedEventChannel creates a channel which queues at most
+// capacity events, and handles the overflow with policy.
+func NewBoundedEventChannel(
+    capacity int, policy OverflowPolicy) *ReliableEventChannel {
+
     object := &ReliableEventChannel{
+        channelBound: newChannelBound(capacity, policy),
         // all underlaid channals should not buffer.
-        inChan:    make(chan hsm.Event, 0),
-        outChan:   make(chan hsm.Event, 0),
-        closeChan: make(chan interface{}, 0),
-        queue:     list.New(),
-        group:     &sync.WaitGroup{},
+        inChan:       make(chan hsm.Event, 0),
+        outChan:      make(chan hsm.Event, 0),
+        closeChan:    make(chan interface{}, 0),
+        queue:        list.New(),
+        group:        &sync.WaitGroup{},
     }
     object.Start()
     return object
@@ -53,16 +161,16 @@ func (self *ReliableEventChannel) Start() {
                 case <-self.closeChan:
                     return
                 case inEvent := <-self.inChan:
-                    self.queue.PushBack(inEvent)
+                    self.push(self.queue, inEvent)
                 case self.outChan <- outEvent:
-                    self.queue.Remove(e)
+                    self.pop(self.queue, e)
                 }
             } else {
                 select {
                 case <-self.closeChan:
                     return
                 case event := <-self.inChan:
-                    self.queue.PushBack(event)
+                    self.push(self.queue, event)
                 }
             }
         }
@@ -71,8 +179,24 @@ func (self *ReliableEventChannel) Start() {
     go routine()
 }
 
+// Send queues event. It's dropped if it overflows with OverflowReject
+// policy, use TrySend() to know about that.
 func (self *ReliableEventChannel) Send(event hsm.Event) {
+    if !self.acquire(true) {
+        self.reject()
+        return
+    }
+    self.inChan <- event
+}
+
+// TrySend queues event if there is room, without blocking.
+// It returns false if event is not queued.
+func (self *ReliableEventChannel) TrySend(event hsm.Event) bool {
+    if !self.acquire(false) {
+        return false
+    }
     self.inChan <- event
+    return true
 }
 
 func (self *ReliableEventChannel) Recv() hsm.Event {
@@ -93,9 +217,22 @@ func (self *ReliableEventChannel) Close() {
     self.group.Wait()
 }
 
-// ReliableUint64Channel is an unlimited size channel for
-// non-blocking sending/receiving
+// CloseAndDrain closes the channel, and returns the events queued
+// but never received, in the order they're sent.
+func (self *ReliableEventChannel) CloseAndDrain() []hsm.Event {
+    self.Close()
+    events := make([]hsm.Event, 0, self.queue.Len())
+    for e := self.queue.Front(); e != nil; e = e.Next() {
+        event, _ := e.Value.(hsm.Event)
+        events = append(events, event)
+    }
+    return events
+}
+
+// ReliableUint64Channel is a channel for non-blocking sending/receiving.
+// It's unlimited in size unless it's bounded on creation.
 type ReliableUint64Channel struct {
+    *channelBound
     inChan    chan uint64
     outChan   chan uint64
     closeChan chan interface{}
@@ -104,12 +241,21 @@ type ReliableUint64Channel struct {
 }
 
 func NewReliableUint64Channel() *ReliableUint64Channel {
+    return NewBoundedUint64Channel(0, OverflowBlock)
+}
+
+// NewBoundedUint64Channel creates a channel which queues at most
+// capacity values, and handles the overflow with policy.
+func NewBoundedUint64Channel(
+    capacity int, policy OverflowPolicy) *ReliableUint64Channel {
+
     object := &ReliableUint64Channel{
-        inChan:    make(chan uint64, 0),
-        outChan:   make(chan uint64, 0),
-        closeChan: make(chan interface{}, 0),
-        queue:     list.New(),
-        group:     &sync.WaitGroup{},
+        channelBound: newChannelBound(capacity, policy),
+        inChan:       make(chan uint64, 0),
+        outChan:      make(chan uint64, 0),
+        closeChan:    make(chan interface{}, 0),
+        queue:        list.New(),
+        group:        &sync.WaitGroup{},
     }
     object.Start()
     return object
@@ -126,16 +272,16 @@ func (self *ReliableUint64Channel) Start() {
                 case <-self.closeChan:
                     return
                 case in := <-self.inChan:
-                    self.queue.PushBack(in)
+                    self.push(self.queue, in)
                 case self.outChan <- out:
-                    self.queue.Remove(e)
+                    self.pop(self.queue, e)
                 }
             } else {
                 select {
                 case <-self.closeChan:
                     return
                 case in := <-self.inChan:
-                    self.queue.PushBack(in)
+                    self.push(self.queue, in)
                 }
             }
         }
@@ -144,10 +290,26 @@ func (self *ReliableUint64Channel) Start() {
     go routine()
 }
 
+// Send queues in. It's dropped if it overflows with OverflowReject
+// policy, use TrySend() to know about that.
 func (self *ReliableUint64Channel) Send(in uint64) {
+    if !self.acquire(true) {
+        self.reject()
+        return
+    }
     self.inChan <- in
 }
 
+// TrySend queues in if there is room, without blocking.
+// It returns false if in is not queued.
+func (self *ReliableUint64Channel) TrySend(in uint64) bool {
+    if !self.acquire(false) {
+        return false
+    }
+    self.inChan <- in
+    return true
+}
+
 func (self *ReliableUint64Channel) Recv() uint64 {
     out := <-self.outChan
     return out
@@ -166,7 +328,11 @@ func (self *ReliableUint64Channel) Close() {
     self.group.Wait()
 }
 
+// ReliableInflightEntryChannel is a channel for non-blocking inflight
+// entry sending/receiving. It's unlimited in size unless it's bounded
+// on creation.
 type ReliableInflightEntryChannel struct {
+    *channelBound
     inChan    chan *InflightEntry
     outChan   chan *InflightEntry
     closeChan chan interface{}
@@ -175,12 +341,21 @@ type ReliableInflightEntryChannel struct {
 }
 
 func NewReliableInflightEntryChannel() *ReliableInflightEntryChannel {
+    return NewBoundedInflightEntryChannel(0, OverflowBlock)
+}
+
+// NewBoundedInflightEntryChannel creates a channel which queues at most
+// capacity entries, and handles the overflow with policy.
+func NewBoundedInflightEntryChannel(
+    capacity int, policy OverflowPolicy) *ReliableInflightEntryChannel {
+
     object := &ReliableInflightEntryChannel{
-        inChan:    make(chan *InflightEntry, 0),
-        outChan:   make(chan *InflightEntry, 0),
-        closeChan: make(chan interface{}, 0),
-        queue:     list.New(),
-        group:     &sync.WaitGroup{},
+        channelBound: newChannelBound(capacity, policy),
+        inChan:       make(chan *InflightEntry, 0),
+        outChan:      make(chan *InflightEntry, 0),
+        closeChan:    make(chan interface{}, 0),
+        queue:        list.New(),
+        group:        &sync.WaitGroup{},
     }
     object.Start()
     return object
@@ -197,16 +372,16 @@ func (self *ReliableInflightEntryChannel) Start() {
                 case <-self.closeChan:
                     return
                 case in := <-self.inChan:
-                    self.queue.PushBack(in)
+                    self.push(self.queue, in)
                 case self.outChan <- out:
-                    self.queue.Remove(e)
+                    self.pop(self.queue, e)
                 }
             } else {
                 select {
                 case <-self.closeChan:
                     return
                 case in := <-self.inChan:
-                    self.queue.PushBack(in)
+                    self.push(self.queue, in)
                 }
             }
         }
@@ -215,10 +390,28 @@ func (self *ReliableInflightEntryChannel) Start() {
     go routine()
 }
 
+// Send queues entry. It's dropped if it overflows with OverflowReject
+// policy, use TrySend() to know about that.
 func (self *ReliableInflightEntryChannel) Send(entry *InflightEntry) {
+    if !self.acquire(true) {
+        self.reject()
+        return
+    }
     self.inChan <- entry
 }
 
+// TrySend queues entry if there is room, without blocking.
+// It returns false if entry is not queued.
+func (self *ReliableInflightEntryChannel) TrySend(
+    entry *InflightEntry) bool {
+
+    if !self.acquire(false) {
+        return false
+    }
+    self.inChan <- entry
+    return true
+}
+
 func (self *ReliableInflightEntryChannel) Recv() *InflightEntry {
     out := <-self.outChan
     return out
@@ -237,31 +430,76 @@ func (self *ReliableInflightEntryChannel) Close() {
     self.group.Wait()
 }
 
-// Notifier is use to signal notify to the outside of this module.
-type Notifier struct {
+// CloseAndDrain closes the channel, and returns the entries queued
+// but never received, in the order they're sent.
+func (self *ReliableInflightEntryChannel) CloseAndDrain() []*InflightEntry {
+    self.Close()
+    entries := make([]*InflightEntry, 0, self.queue.Len())
+    for e := self.queue.Front(); e != nil; e = e.Next() {
+        entry, _ := e.Value.(*InflightEntry)
+        entries = append(entries, entry)
+    }
+    return entries
+}
+
+// seqNotifyEvent is a notify along with its seq in the notifier.
+type seqNotifyEvent struct {
+    ev.NotifyEvent
+    Seq uint64
+}
+
+// Subscription receives the notifies of the types it subscribes to from
+// a Notifier, independent of the other subscriptions. It keeps at most
+// capacity notifies not received yet, and drops the oldest ones beyond that.
+// A subscription made by SubscribeFrom() delivers the notifies as messages
+// with their seqs, through the channel returned by GetMessageChan().
+type Subscription struct {
+    types     map[hsm.EventType]bool
     inChan    *ReliableEventChannel
     outChan   chan ev.NotifyEvent
+    msgChan   chan *ev.NotifyMessage
     closeChan chan interface{}
     group     *sync.WaitGroup
 }
 
-func NewNotifier() *Notifier {
-    object := &Notifier{
-        inChan:    NewReliableEventChannel(),
+func NewSubscription(capacity int, types ...hsm.EventType) *Subscription {
+    object := newSubscription(capacity, types...)
+    object.Start()
+    return object
+}
+
+func newSubscription(capacity int, types ...hsm.EventType) *Subscription {
+    typeSet := make(map[hsm.EventType]bool)
+    for _, eventType := range types {
+        typeSet[eventType] = true
+    }
+    return &Subscription{
+        types:     typeSet,
+        inChan:    NewBoundedEventChannel(capacity, OverflowDropOldest),
         outChan:   make(chan ev.NotifyEvent, 0),
         closeChan: make(chan interface{}, 1),
         group:     &sync.WaitGroup{},
     }
+}
+
+func newMessageSubscription(
+    capacity int, types ...hsm.EventType) *Subscription {
+
+    object := newSubscription(capacity, types...)
+    object.msgChan = make(chan *ev.NotifyMessage, 0)
     object.Start()
     return object
 }
 
-func (self *Notifier) Start() {
+func (self *Subscription) Start() {
     self.group.Add(1)
     go func() {
         defer self.group.Done()
+        if self.msgChan != nil {
+            defer close(self.msgChan)
+        }
         inChan := self.inChan.GetOutChan()
-        var event ev.NotifyEvent
+        var event hsm.Event
         for {
             select {
             case <-self.closeChan:
@@ -269,30 +507,230 @@ func (self *Notifier) Start() {
             case event = <-inChan:
             }
 
-            ne, _ := event.(ev.NotifyEvent)
+            e, _ := event.(*seqNotifyEvent)
+            if self.msgChan != nil {
+                select {
+                case <-self.closeChan:
+                    return
+                case self.msgChan <- ev.NewNotifyMessage(e.Seq, e.NotifyEvent):
+                }
+                continue
+            }
             select {
             case <-self.closeChan:
                 return
-            case self.outChan <- ne:
+            case self.outChan <- e.NotifyEvent:
             }
         }
     }()
 }
 
-func (self *Notifier) Notify(event ev.NotifyEvent) {
-    self.inChan.Send(event)
+// Accepts returns whether the notifies of eventType are subscribed.
+// All types are subscribed if none is specified.
+func (self *Subscription) Accepts(eventType hsm.EventType) bool {
+    return (len(self.types) == 0) || self.types[eventType]
 }
 
-func (self *Notifier) GetNotifyChan() <-chan ev.NotifyEvent {
+func (self *Subscription) notify(event *seqNotifyEvent) {
+    if self.Accepts(event.Type()) {
+        self.inChan.Send(event)
+    }
+}
+
+func (self *Subscription) GetNotifyChan() <-chan ev.NotifyEvent {
     return self.outChan
 }
 
-func (self *Notifier) Close() {
+// GetMessageChan returns the channel of the notify messages, which is
+// closed once the subscription is closed. It's nil for the subscriptions
+// not made by SubscribeFrom().
+func (self *Subscription) GetMessageChan() <-chan *ev.NotifyMessage {
+    return self.msgChan
+}
+
+// Pending returns the number of notifies not received yet.
+func (self *Subscription) Pending() int {
+    return self.inChan.Len()
+}
+
+// Dropped returns the number of notifies dropped for overflow.
+func (self *Subscription) Dropped() uint64 {
+    return self.inChan.Dropped()
+}
+
+// Close stops the delivery of notifies. The notify channel is left open,
+// so the receivers should stop on their own. The message channel is
+// closed though.
+func (self *Subscription) Close() {
     self.closeChan <- self
     self.group.Wait()
     self.inChan.Close()
 }
 
+// Notifier is use to signal notify to the outside of this module.
+// Every notify is delivered to all the subscriptions accepting it.
+// There is always a default subscription to all types, whose channel is
+// returned by GetNotifyChan().
+// The notifies are numbered by seq from 1, and the latest historySize
+// ones are kept in history, for the subscriptions resuming after them.
+// The epoch of a notifier tells it from the ones before a restart.
+type Notifier struct {
+    capacity      int
+    historySize   int
+    epoch         uint64
+    seq           uint64
+    history       []*seqNotifyEvent
+    defaultSub    *Subscription
+    subscriptions map[*Subscription]bool
+    lock          sync.RWMutex
+}
+
+func NewNotifier() *Notifier {
+    return NewBoundedNotifier(0)
+}
+
+// NewBoundedNotifier creates a notifier whose default subscription keeps
+// at most capacity notifies not received yet.
+func NewBoundedNotifier(capacity int) *Notifier {
+    return NewHistoryNotifier(capacity, 0)
+}
+
+// NewHistoryNotifier creates a notifier like NewBoundedNotifier(), which
+// also keeps the latest historySize notifies in history.
+func NewHistoryNotifier(capacity int, historySize int) *Notifier {
+    defaultSub := NewSubscription(capacity)
+    return &Notifier{
+        capacity:    capacity,
+        historySize: historySize,
+        epoch:       uint64(time.Now().UnixNano()),
+        history:     make([]*seqNotifyEvent, 0, historySize),
+        defaultSub:  defaultSub,
+        subscriptions: map[*Subscription]bool{
+            defaultSub: true,
+        },
+    }
+}
+
+func (self *Notifier) Notify(event ev.NotifyEvent) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.seq++
+    e := &seqNotifyEvent{
+        NotifyEvent: event,
+        Seq:         self.seq,
+    }
+    if self.historySize > 0 {
+        if len(self.history) == self.historySize {
+            copy(self.history, self.history[1:])
+            self.history = self.history[:len(self.history)-1]
+        }
+        self.history = append(self.history, e)
+    }
+    for subscription, _ := range self.subscriptions {
+        subscription.notify(e)
+    }
+}
+
+// Subscribe creates a subscription to the notifies of types, or all
+// the notifies if no type is specified. The subscription keeps at most
+// capacity notifies not received yet, zero for the same capacity of
+// the default one.
+func (self *Notifier) Subscribe(
+    capacity int, types ...hsm.EventType) *Subscription {
+
+    if capacity <= 0 {
+        capacity = self.capacity
+    }
+    subscription := NewSubscription(capacity, types...)
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.subscriptions[subscription] = true
+    return subscription
+}
+
+// SubscribeFrom creates a subscription like Subscribe(), which delivers
+// the notifies as messages. A zero epoch makes a new subscription.
+// Otherwise it resumes the one of epoch after the notify of seq after,
+// and the notifies after that in history are delivered first.
+// All the history is delivered if epoch isn't the one of this notifier,
+// for it's from the notifier before a restart.
+func (self *Notifier) SubscribeFrom(
+    epoch uint64,
+    after uint64,
+    capacity int,
+    types ...hsm.EventType) (*Subscription, *ev.SubscribeResponse) {
+
+    if capacity <= 0 {
+        capacity = self.capacity
+    }
+    subscription := newMessageSubscription(capacity, types...)
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    response := &ev.SubscribeResponse{
+        Epoch: self.epoch,
+        Seq:   self.seq,
+    }
+    if epoch != 0 {
+        if epoch != self.epoch {
+            after = 0
+            response.Missed = true
+        }
+        // the seq of the oldest notify in history
+        first := self.seq + 1 - uint64(len(self.history))
+        if after+1 < first {
+            response.Missed = true
+        }
+        for _, e := range self.history {
+            if e.Seq > after {
+                subscription.notify(e)
+            }
+        }
+    }
+    self.subscriptions[subscription] = true
+    return subscription, response
+}
+
+// Unsubscribe stops the delivery of notifies to subscription.
+// The default subscription couldn't be unsubscribed.
+func (self *Notifier) Unsubscribe(subscription *Subscription) {
+    if subscription == self.defaultSub {
+        return
+    }
+    self.lock.Lock()
+    _, ok := self.subscriptions[subscription]
+    delete(self.subscriptions, subscription)
+    self.lock.Unlock()
+    if ok {
+        subscription.Close()
+    }
+}
+
+func (self *Notifier) GetNotifyChan() <-chan ev.NotifyEvent {
+    return self.defaultSub.GetNotifyChan()
+}
+
+// Pending returns the number of notifies not received yet
+// by the default subscription.
+func (self *Notifier) Pending() int {
+    return self.defaultSub.Pending()
+}
+
+// Dropped returns the number of notifies dropped for overflow
+// by the default subscription.
+func (self *Notifier) Dropped() uint64 {
+    return self.defaultSub.Dropped()
+}
+
+func (self *Notifier) Close() {
+    self.lock.Lock()
+    subscriptions := self.subscriptions
+    self.subscriptions = make(map[*Subscription]bool)
+    self.lock.Unlock()
+    for subscription, _ := range subscriptions {
+        subscription.Close()
+    }
+}
+
 // ClientEventListener is a a helper class for listening client response
 // in independent go routine.
 type ClientEventListener struct {
@@ -335,13 +773,15 @@ func (self *ClientEventListener) Stop() {
 }
 
 type Applier struct {
-    log          ps.Log
-    stateMachine ps.StateMachine
-    dispatcher   func(event hsm.Event)
-    notifier     *Notifier
+    log           ps.Log
+    configManager ps.ConfigManager
+    stateMachine  ps.StateMachine
+    dispatcher    func(event hsm.Event)
+    notifier      *Notifier
 
     followerCommitChan *ReliableUint64Channel
     leaderCommitChan   *ReliableInflightEntryChannel
+    snapshotChan       *ReliableEventChannel
     closeChan          chan interface{}
     group              *sync.WaitGroup
 
@@ -350,18 +790,39 @@ type Applier struct {
 
 func NewApplier(
     log ps.Log,
+    configManager ps.ConfigManager,
+    stateMachine ps.StateMachine,
+    dispatcher func(event hsm.Event),
+    notifier *Notifier,
+    logger logging.Logger) *Applier {
+
+    return NewBoundedApplier(
+        log, configManager, stateMachine, dispatcher, notifier, 0, logger)
+}
+
+// NewBoundedApplier creates an applier which queues at most capacity
+// commits of each kind to apply. Committing more blocks until the queued
+// ones are applied, which slows down the hsm committing them.
+func NewBoundedApplier(
+    log ps.Log,
+    configManager ps.ConfigManager,
     stateMachine ps.StateMachine,
     dispatcher func(event hsm.Event),
     notifier *Notifier,
+    capacity int,
     logger logging.Logger) *Applier {
 
     object := &Applier{
-        log:                log,
-        stateMachine:       stateMachine,
-        dispatcher:         dispatcher,
-        notifier:           notifier,
-        followerCommitChan: NewReliableUint64Channel(),
-        leaderCommitChan:   NewReliableInflightEntryChannel(),
+        log:           log,
+        configManager: configManager,
+        stateMachine:  stateMachine,
+        dispatcher:    dispatcher,
+        notifier:      notifier,
+        followerCommitChan: NewBoundedUint64Channel(
+            capacity, OverflowBlock),
+        leaderCommitChan: NewBoundedInflightEntryChannel(
+            capacity, OverflowBlock),
+        snapshotChan:       NewReliableEventChannel(),
         closeChan:          make(chan interface{}, 1),
         group:              &sync.WaitGroup{},
         logger:             logger,
@@ -376,6 +837,7 @@ func (self *Applier) Start() {
         self.ApplyCommitted()
         followerChan := self.followerCommitChan.GetOutChan()
         leaderChan := self.leaderCommitChan.GetOutChan()
+        snapshotChan := self.snapshotChan.GetOutChan()
         for {
             select {
             case <-self.closeChan:
@@ -384,6 +846,10 @@ func (self *Applier) Start() {
                 self.ApplyLogsUpto(logIndex)
             case inflightEntry := <-leaderChan:
                 self.ApplyInflightLog(inflightEntry)
+            case event := <-snapshotChan:
+                e, ok := event.(*ev.SnapshotRequestEvent)
+                hsm.AssertTrue(ok)
+                self.MakeSnapshot(e)
             }
         }
     }
@@ -401,6 +867,18 @@ func (self *Applier) LeaderCommit(entry *InflightEntry) {
     self.leaderCommitChan.Send(entry)
 }
 
+// Snapshot queues the request to take a snapshot of the state machine.
+// It's taken in between the applications of log entries, so that
+// the snapshot covers exactly the entries applied so far.
+func (self *Applier) Snapshot(e *ev.SnapshotRequestEvent) {
+    self.snapshotChan.Send(e)
+}
+
+// Pending returns the number of commits queued to apply.
+func (self *Applier) Pending() int {
+    return self.followerCommitChan.Len() + self.leaderCommitChan.Len()
+}
+
 func (self *Applier) ApplyCommitted() {
     // apply log up to this index if necessary
     committedIndex, err := self.log.CommittedIndex()
@@ -439,6 +917,7 @@ func (self *Applier) ApplyLogsUpto(index uint64) {
         entry, err := self.log.GetLog(i)
         if err != nil {
             self.handleLogError("applier: fail to read log at index: %d", i)
+            return
         }
 
         if _, err = self.ApplyLogEntry(entry); err != nil {
@@ -460,6 +939,8 @@ func (self *Applier) ApplyLogEntry(
         // nothing to do
     case ps.LogMemberChange:
         // nothing to do here
+    case ps.LogAddrUpdate:
+        // nothing to do, the config takes effect once it's appended
     default:
         self.logger.Error(
             "unknown log entry type: %d, index: %s", entry.Type, entry.Index)
@@ -531,6 +1012,68 @@ func (self *Applier) ApplyInflightLog(entry *InflightEntry) {
         ev.NewNotifyApplyEvent(entry.Request.LogEntry.Term, logIndex))
 }
 
+// MakeSnapshot takes a snapshot of the state machine up through the last
+// applied log entry, and responds e with the id of the snapshot. If the
+// latest snapshot already covers that entry, it's responded instead.
+func (self *Applier) MakeSnapshot(e *ev.SnapshotRequestEvent) {
+    lastAppliedIndex, err := self.log.LastAppliedIndex()
+    if err != nil {
+        message := fmt.Sprintf(
+            "fail to read last applied index of log, error: %s", err)
+        e.SendResponse(ev.NewPersistErrorResponseEvent(errors.New(message)))
+        return
+    }
+    if lastAppliedIndex == 0 {
+        // nothing applied to take a snapshot of
+        e.SendResponse(ev.NewClientResponseEvent(&ev.ClientResponse{
+            Success: false,
+        }))
+        return
+    }
+    meta, err := self.stateMachine.LastSnapshotInfo()
+    if err != nil && err != ps.ErrorNoSnapshot {
+        message := fmt.Sprintf(
+            "fail to read last snapshot info, error: %s", err)
+        e.SendResponse(ev.NewPersistErrorResponseEvent(errors.New(message)))
+        return
+    }
+    if meta == nil || meta.LastIncludedIndex < lastAppliedIndex {
+        id, err := self.takeSnapshot(lastAppliedIndex)
+        if err != nil {
+            self.logger.Error(err.Error())
+            e.SendResponse(ev.NewPersistErrorResponseEvent(err))
+            return
+        }
+        self.logger.Info("take snapshot: %s", id)
+        meta = &ps.SnapshotMeta{ID: id}
+    }
+    response := &ev.ClientResponse{
+        Success: true,
+        Data:    []byte(meta.ID),
+    }
+    e.SendResponse(ev.NewClientResponseEvent(response))
+}
+
+func (self *Applier) takeSnapshot(index uint64) (string, error) {
+    entry, err := self.log.GetLog(index)
+    if err != nil {
+        return "", errors.New(fmt.Sprintf(
+            "fail to read log at index: %d, error: %s", index, err))
+    }
+    metas, err := ListConfigsAfter(self.configManager, index)
+    if err != nil || len(metas) == 0 {
+        return "", errors.New(fmt.Sprintf(
+            "fail to read config at index: %d, error: %s", index, err))
+    }
+    id, err := self.stateMachine.MakeSnapshot(
+        entry.Term, index, metas[0].Conf)
+    if err != nil {
+        return "", errors.New(fmt.Sprintf(
+            "fail to make snapshot at index: %d, error: %s", index, err))
+    }
+    return id, nil
+}
+
 func (self *Applier) handleLogError(format string, args ...interface{}) {
     errorMessage := fmt.Sprintf(format, args...)
     self.logger.Error(errorMessage)
@@ -541,6 +1084,159 @@ func (self *Applier) handleLogError(format string, args ...interface{}) {
 func (self *Applier) Close() {
     self.closeChan <- self
     self.group.Wait()
+    // the snapshot requests never handled are failed rather than
+    // left waiting for ever
+    for _, event := range self.snapshotChan.CloseAndDrain() {
+        if e, ok := event.(ev.RequestEvent); ok {
+            e.SendResponse(ev.NewClientResponseEvent(&ev.ClientResponse{
+                Success: false,
+            }))
+        }
+    }
+}
+
+// LogWriter stores the log entries started by leader in its own goroutine,
+// in the order they're written, so that leader could replicate them to
+// peers in the meantime. The AppendEntriesResponseEvent for leader itself
+// is dispatched after every entry is stored.
+type LogWriter struct {
+    log        ps.Log
+    dispatcher func(event hsm.Event)
+    entryChan  *ReliableInflightEntryChannel
+    closeChan  chan interface{}
+    // the max time to wait for the queued entries to be stored on close
+    closeTimeout time.Duration
+    aborted      int32
+    group        *sync.WaitGroup
+    logger       logging.Logger
+}
+
+func NewLogWriter(
+    log ps.Log,
+    dispatcher func(event hsm.Event),
+    closeTimeout time.Duration,
+    logger logging.Logger) *LogWriter {
+
+    object := &LogWriter{
+        log:          log,
+        dispatcher:   dispatcher,
+        entryChan:    NewReliableInflightEntryChannel(),
+        closeChan:    make(chan interface{}, 1),
+        closeTimeout: closeTimeout,
+        group:        &sync.WaitGroup{},
+        logger:       logger,
+    }
+    object.Start()
+    return object
+}
+
+func (self *LogWriter) Start() {
+    routine := func() {
+        defer self.group.Done()
+        entryChan := self.entryChan.GetOutChan()
+        for {
+            select {
+            case <-self.closeChan:
+                self.Flush()
+                return
+            case entry := <-entryChan:
+                if !self.StoreLog(entry.Request.LogEntry) ||
+                    self.Aborted() {
+                    // the entries after it are not stored to
+                    // leave no hole in log, or since Close() gives
+                    // up on them
+                    <-self.closeChan
+                    self.Drop(self.entryChan.CloseAndDrain())
+                    return
+                }
+            }
+        }
+    }
+    self.group.Add(1)
+    go routine()
+}
+
+// Write queues log entry to store.
+func (self *LogWriter) Write(logEntry *ps.LogEntry) {
+    entry := &InflightEntry{
+        Request: &InflightRequest{
+            LogEntry: logEntry,
+        },
+    }
+    self.entryChan.Send(entry)
+}
+
+func (self *LogWriter) StoreLog(logEntry *ps.LogEntry) bool {
+    if err := self.log.StoreLog(logEntry); err != nil {
+        message := fmt.Sprintf("fail to store log at index: %d, error: %s",
+            logEntry.Index, err)
+        self.logger.Error(message)
+        self.dispatcher(ev.NewPersistErrorEvent(errors.New(message)))
+        return false
+    }
+    if self.Aborted() {
+        // the leader which waits for it is gone
+        return true
+    }
+    response := &ev.AppendEntriesResponse{
+        Term:         logEntry.Term,
+        LastLogIndex: logEntry.Index,
+        Success:      true,
+    }
+    self.dispatcher(ev.NewAppendEntriesResponseEvent(response))
+    return true
+}
+
+// Flush stores the entries queued before closing, until one of them
+// fails or Close() gives up waiting.
+func (self *LogWriter) Flush() {
+    entries := self.entryChan.CloseAndDrain()
+    for i, entry := range entries {
+        if self.Aborted() {
+            self.Drop(entries[i:])
+            return
+        }
+        if !self.StoreLog(entry.Request.LogEntry) {
+            self.Drop(entries[i+1:])
+            return
+        }
+    }
+}
+
+// Aborted returns whether Close() gives up waiting for storing.
+func (self *LogWriter) Aborted() bool {
+    return atomic.LoadInt32(&self.aborted) != 0
+}
+
+// Drop reports the entries never stored, which are left out of log
+// for good, as the leader which writes them is gone.
+func (self *LogWriter) Drop(entries []*InflightEntry) {
+    if len(entries) == 0 {
+        return
+    }
+    self.logger.Error("drop %d queued log entries from index: %d to %d",
+        len(entries), entries[0].Request.LogEntry.Index,
+        entries[len(entries)-1].Request.LogEntry.Index)
+}
+
+// Close stops writing after the queued entries are stored. It waits
+// at most closeTimeout for that, so that a blocked log doesn't hold
+// the caller forever. When it gives up, the entry being stored is the
+// last one, and the rest are dropped.
+func (self *LogWriter) Close() {
+    self.closeChan <- self
+    done := make(chan interface{})
+    go func() {
+        self.group.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(self.closeTimeout):
+        atomic.StoreInt32(&self.aborted, 1)
+        self.logger.Error("log writer doesn't finish storing in %s",
+            self.closeTimeout)
+    }
 }
 
 // Min returns the minimum.
@@ -627,6 +1323,51 @@ func EntriesInfo(entries []*ps.LogEntry) []string {
     return result
 }
 
+// FirstIndexOfTerm returns the index of the first entry in log of term,
+// looking backward from index, which should be an entry of term.
+func FirstIndexOfTerm(log ps.Log, term, index uint64) (uint64, error) {
+    firstIndex, err := log.FirstIndex()
+    if err != nil {
+        return 0, err
+    }
+    for ; index > firstIndex; index-- {
+        entry, err := log.GetLog(index - 1)
+        if err != nil {
+            return 0, err
+        }
+        if entry.Term != term {
+            break
+        }
+    }
+    return index, nil
+}
+
+// LastIndexOfTerm returns the index of the last entry in log of term,
+// looking backward from index. It's 0 if there is no entry of term.
+func LastIndexOfTerm(log ps.Log, term, index uint64) (uint64, error) {
+    firstIndex, err := log.FirstIndex()
+    if err != nil {
+        return 0, err
+    }
+    if firstIndex == 0 {
+        return 0, nil
+    }
+    for ; index >= firstIndex; index-- {
+        entry, err := log.GetLog(index)
+        if err != nil {
+            return 0, err
+        }
+        if entry.Term == term {
+            return index, nil
+        }
+        if entry.Term < term {
+            // the terms only increase along the log
+            break
+        }
+    }
+    return 0, nil
+}
+
 func ParallelDo(todo []func()) {
     todoGroup := sync.WaitGroup{}
     for _, f1 := range todo {
@@ -9,6 +9,7 @@ import (
     "github.com/hhkbp2/rafted/str"
     "github.com/hhkbp2/testify/assert"
     "github.com/hhkbp2/testify/mock"
+    "github.com/hhkbp2/testify/require"
     "io"
     "sync"
     "testing"
@@ -40,6 +41,85 @@ func TestReliableEventChannel(t *testing.T) {
     ch.Close()
 }
 
+func TestReliableEventChannelCloseAndDrain(t *testing.T) {
+    ch := NewReliableEventChannel()
+    event1 := ev.NewStepdownEvent()
+    event2 := ev.NewLeaderMemberChangeActivateEvent()
+    event3 := ev.NewStepdownEvent()
+    ch.Send(event1)
+    ch.Send(event2)
+    ch.Send(event3)
+    assert.Equal(t, event1, ch.Recv())
+    // the events never received are returned in order
+    events := ch.CloseAndDrain()
+    require.Equal(t, 2, len(events))
+    assert.Equal(t, event2, events[0])
+    assert.Equal(t, event3, events[1])
+}
+
+func waitChannelLen(ch interface {
+    Len() int
+}, length int) bool {
+
+    deadline := time.Now().Add(time.Second)
+    for time.Now().Before(deadline) {
+        if ch.Len() == length {
+            return true
+        }
+        time.Sleep(time.Millisecond)
+    }
+    return false
+}
+
+func TestBoundedEventChannel(t *testing.T) {
+    event1 := ev.NewStepdownEvent()
+    event2 := ev.NewLeaderMemberChangeActivateEvent()
+    event3 := ev.NewLeaderMemberChangeDeactivateEvent()
+    // the new events are rejected when it's full
+    ch := NewBoundedEventChannel(2, OverflowReject)
+    ch.Send(event1)
+    assert.True(t, ch.TrySend(event2))
+    ch.Send(event3)
+    assert.False(t, ch.TrySend(event3))
+    assert.True(t, waitChannelLen(ch, 2))
+    assert.Equal(t, uint64(1), ch.Dropped())
+    assert.Equal(t, event1, ch.Recv())
+    assert.True(t, waitChannelLen(ch, 1))
+    assert.True(t, ch.TrySend(event3))
+    assert.Equal(t, event2, ch.Recv())
+    assert.Equal(t, event3, ch.Recv())
+    assert.True(t, waitChannelLen(ch, 0))
+    ch.Close()
+    // the sender waits for the room when it's full
+    ch = NewBoundedEventChannel(1, OverflowBlock)
+    ch.Send(event1)
+    assert.False(t, ch.TrySend(event2))
+    sent := make(chan bool, 1)
+    go func() {
+        ch.Send(event2)
+        sent <- true
+    }()
+    select {
+    case <-sent:
+        assert.True(t, false, "send not blocked")
+    case <-time.After(time.Millisecond * 10):
+    }
+    assert.Equal(t, event1, ch.Recv())
+    assert.True(t, <-sent)
+    assert.Equal(t, event2, ch.Recv())
+    assert.Equal(t, uint64(0), ch.Dropped())
+    ch.Close()
+    // the oldest events are dropped for the new ones when it's full
+    ch = NewBoundedEventChannel(2, OverflowDropOldest)
+    for _, event := range []hsm.Event{event1, event2, event3} {
+        ch.Send(event)
+    }
+    assert.Equal(t, event2, ch.Recv())
+    assert.Equal(t, event3, ch.Recv())
+    assert.Equal(t, uint64(1), ch.Dropped())
+    ch.Close()
+}
+
 func TestReliableUint64Channel(t *testing.T) {
     ch := NewReliableUint64Channel()
     // test Send()
@@ -130,6 +210,118 @@ func TestNotifier(t *testing.T) {
     notifier.Close()
 }
 
+func TestNotifierSubscribe(t *testing.T) {
+    notifier := NewNotifier()
+    defer notifier.Close()
+    applySub := notifier.Subscribe(0, ev.EventNotifyApply)
+    commitSub := notifier.Subscribe(1, ev.EventNotifyCommit)
+    assert.True(t, applySub.Accepts(ev.EventNotifyApply))
+    assert.False(t, applySub.Accepts(ev.EventNotifyCommit))
+    count := 5
+    for i := 1; i <= count; i++ {
+        notifier.Notify(ev.NewNotifyApplyEvent(testTerm, uint64(i)))
+        notifier.Notify(ev.NewNotifyCommitEvent(testTerm, uint64(i)))
+    }
+    // every subscription receives the notifies of its types on its own
+    for i := 1; i <= count; i++ {
+        select {
+        case notify := <-applySub.GetNotifyChan():
+            e, ok := notify.(*ev.NotifyApplyEvent)
+            require.True(t, ok)
+            assert.Equal(t, uint64(i), e.LogIndex)
+        case <-time.After(time.Second):
+            require.True(t, false, "apply notify not received")
+        }
+    }
+    assert.Equal(t, uint64(0), applySub.Dropped())
+    // the bounded one drops the oldest notifies and keeps the latest
+    received := 0
+    for {
+        select {
+        case notify := <-commitSub.GetNotifyChan():
+            e, ok := notify.(*ev.NotifyCommitEvent)
+            require.True(t, ok)
+            received++
+            if e.LogIndex < uint64(count) {
+                continue
+            }
+        case <-time.After(time.Second):
+            require.True(t, false, "commit notify not received")
+        }
+        break
+    }
+    assert.True(t, commitSub.Dropped() >= uint64(count-2))
+    assert.Equal(t, uint64(count), uint64(received)+commitSub.Dropped())
+    // the default subscription receives all notifies, one of which may
+    // be taken out of the queue for delivery
+    assert.True(t, notifier.Pending() >= count*2-1)
+    // no notify after unsubscribe
+    notifier.Unsubscribe(applySub)
+    notifier.Notify(ev.NewNotifyApplyEvent(testTerm, testIndex))
+    select {
+    case <-applySub.GetNotifyChan():
+        assert.True(t, false, "notify received after unsubscribe")
+    case <-time.After(time.Millisecond * 10):
+    }
+    notifier.Unsubscribe(commitSub)
+}
+
+func TestNotifierSubscribeFrom(t *testing.T) {
+    notifier := NewHistoryNotifier(0, 2)
+    defer notifier.Close()
+    recvSeqs := func(subscription *Subscription, count int) []uint64 {
+        seqs := make([]uint64, 0, count)
+        for i := 0; i < count; i++ {
+            select {
+            case message := <-subscription.GetMessageChan():
+                seqs = append(seqs, message.Seq)
+            case <-time.After(time.Second):
+                require.True(t, false, "notify message not received")
+            }
+        }
+        return seqs
+    }
+    for i := 1; i <= 3; i++ {
+        notifier.Notify(ev.NewNotifyCommitEvent(testTerm, uint64(i)))
+    }
+    // a new subscription receives only the notifies after it
+    subscription, response := notifier.SubscribeFrom(0, 0, 0)
+    assert.Equal(t, uint64(3), response.Seq)
+    assert.False(t, response.Missed)
+    notifier.Notify(ev.NewNotifyCommitEvent(testTerm, uint64(4)))
+    select {
+    case message := <-subscription.GetMessageChan():
+        assert.Equal(t, uint64(4), message.Seq)
+        e, ok := message.Event().(*ev.NotifyCommitEvent)
+        require.True(t, ok)
+        assert.Equal(t, testTerm, e.Term)
+        assert.Equal(t, uint64(4), e.LogIndex)
+    case <-time.After(time.Second):
+        require.True(t, false, "notify message not received")
+    }
+    // the message channel is closed after unsubscribe
+    notifier.Unsubscribe(subscription)
+    _, ok := <-subscription.GetMessageChan()
+    assert.False(t, ok)
+    epoch := response.Epoch
+    // resume with the notifies in history
+    subscription, response = notifier.SubscribeFrom(epoch, 2, 0)
+    assert.False(t, response.Missed)
+    assert.Equal(t, []uint64{3, 4}, recvSeqs(subscription, 2))
+    notifier.Unsubscribe(subscription)
+    // the ones out of history are missed
+    subscription, response = notifier.SubscribeFrom(epoch, 1, 0)
+    assert.True(t, response.Missed)
+    assert.Equal(t, []uint64{3, 4}, recvSeqs(subscription, 2))
+    notifier.Unsubscribe(subscription)
+    // all the history is sent for a subscription before a restart
+    subscription, response = notifier.SubscribeFrom(
+        epoch+1, 4, 0, ev.EventNotifyCommit)
+    assert.True(t, response.Missed)
+    assert.Equal(t, []uint64{3, 4}, recvSeqs(subscription, 2))
+    notifier.Unsubscribe(subscription)
+}
+
 func TestClientEventListener(t *testing.T) {
     listener := NewClientEventListener()
     fnCount := 0
@@ -382,6 +574,7 @@ func TestApplierConstruction(t *testing.T) {
         log.On("GetLog", i).Return(entry, nil).Once()
         log.On("StoreLastAppliedIndex", i).Return(nil).Once()
     }
+    configManager := ps.NewMemoryConfigManager(0, nil)
     stateMachine := NewMockStateMachine()
     stateMachine.On("Apply", mock.AnythingOfType("[]uint8")).Return(
         []byte(""), nil).Times(number)
@@ -414,7 +607,8 @@ func TestApplierConstruction(t *testing.T) {
             }
         }
     }()
-    applier := NewApplier(log, stateMachine, dispatcher, notifier, logger)
+    applier := NewApplier(
+        log, configManager, stateMachine, dispatcher, notifier, logger)
     <-waitChan
     stopChan <- 0
     assert.Equal(t, 0, dispatchCount)
@@ -430,6 +624,7 @@ func TestApplierFollowerCommit(t *testing.T) {
     log := NewMockLog()
     log.On("CommittedIndex").Return(committedIndex, nil).Twice()
     log.On("LastAppliedIndex").Return(lastAppliedIndex, nil).Once()
+    configManager := ps.NewMemoryConfigManager(0, nil)
     stateMachine := NewMockStateMachine()
     dispatchCount := 0
     dispatcher := func(_ hsm.Event) {
@@ -457,7 +652,8 @@ func TestApplierFollowerCommit(t *testing.T) {
             }
         }
     }()
-    applier := NewApplier(log, stateMachine, dispatcher, notifier, logger)
+    applier := NewApplier(
+        log, configManager, stateMachine, dispatcher, notifier, logger)
     nextIndex := committedIndex + uint64(number)
     log.On("CommittedIndex").Return(nextIndex, nil).Twice()
     log.On("LastAppliedIndex").Return(lastAppliedIndex, nil).Once()
@@ -492,6 +688,7 @@ func TestApplierLeaderCommit(t *testing.T) {
     log := NewMockLog()
     log.On("CommittedIndex").Return(committedIndex, nil).Twice()
     log.On("LastAppliedIndex").Return(lastAppliedIndex, nil).Once()
+    configManager := ps.NewMemoryConfigManager(0, nil)
     stateMachine := NewMockStateMachine()
     dispatchCount := 0
     dispatcher := func(event hsm.Event) {
@@ -526,7 +723,8 @@ func TestApplierLeaderCommit(t *testing.T) {
             }
         }
     }()
-    applier := NewApplier(log, stateMachine, dispatcher, notifier, logger)
+    applier := NewApplier(
+        log, configManager, stateMachine, dispatcher, notifier, logger)
     log.On("CommittedIndex").Return(nextIndex, nil).Once()
     log.On("LastAppliedIndex").Return(lastAppliedIndex, nil).Once()
     log.On("StoreLastAppliedIndex", nextIndex).Return(nil).Once()
@@ -563,6 +761,142 @@ func TestApplierLeaderCommit(t *testing.T) {
     notifier.Close()
 }
 
+func TestApplierSnapshot(t *testing.T) {
+    term := testTerm
+    conf := &ps.Config{
+        Servers:    testServers,
+        NewServers: nil,
+    }
+    entries := make([]*ps.LogEntry, 0, 3)
+    for i := uint64(1); i <= 3; i++ {
+        entries = append(entries, &ps.LogEntry{
+            Term:  term,
+            Index: i,
+            Type:  ps.LogCommand,
+            Data:  testData,
+            Conf:  conf,
+        })
+    }
+    committedIndex := uint64(2)
+    log, err := getTestLog(committedIndex, 0, entries)
+    require.Nil(t, err)
+    configManager := ps.NewMemoryConfigManager(1, conf)
+    stateMachine := ps.NewMemoryStateMachine()
+    dispatcher := func(_ hsm.Event) {}
+    notifier := NewNotifier()
+    logger := logging.GetLogger("test")
+    applier := NewApplier(
+        log, configManager, stateMachine, dispatcher, notifier, logger)
+    // the snapshot covers the committed entries applied on start
+    reqEvent := ev.NewSnapshotRequestEvent(&ev.SnapshotRequest{})
+    applier.Snapshot(reqEvent)
+    event := reqEvent.RecvResponse()
+    require.Equal(t, ev.EventClientResponse, event.Type())
+    e, ok := event.(*ev.ClientResponseEvent)
+    require.True(t, ok)
+    require.True(t, e.Response.Success)
+    meta, err := stateMachine.LastSnapshotInfo()
+    require.Nil(t, err)
+    assert.Equal(t, string(e.Response.Data), meta.ID)
+    assert.Equal(t, term, meta.LastIncludedTerm)
+    assert.Equal(t, committedIndex, meta.LastIncludedIndex)
+    assert.Equal(t, committedIndex, meta.Size)
+    assert.Equal(t, conf, meta.Conf)
+    // nothing applied since then, the same snapshot is responded
+    reqEvent = ev.NewSnapshotRequestEvent(&ev.SnapshotRequest{})
+    applier.Snapshot(reqEvent)
+    event = reqEvent.RecvResponse()
+    e, ok = event.(*ev.ClientResponseEvent)
+    require.True(t, ok)
+    assert.True(t, e.Response.Success)
+    assert.Equal(t, meta.ID, string(e.Response.Data))
+    metas, err := stateMachine.AllSnapshotInfo()
+    assert.Nil(t, err)
+    assert.Equal(t, 1, len(metas))
+    applier.Close()
+    notifier.Close()
+}
+
+// blockingLog blocks storing log entries until it's released.
+type blockingLog struct {
+    ps.Log
+    releaseChan chan interface{}
+}
+
+func (self *blockingLog) StoreLog(log *ps.LogEntry) error {
+    <-self.releaseChan
+    return self.Log.StoreLog(log)
+}
+
+func getTestLogWriterEntries(n int) []*ps.LogEntry {
+    entries := make([]*ps.LogEntry, 0, n)
+    for i := 1; i <= n; i++ {
+        entries = append(entries, &ps.LogEntry{
+            Term:  testTerm,
+            Index: uint64(i),
+            Type:  ps.LogCommand,
+            Data:  testData,
+        })
+    }
+    return entries
+}
+
+func TestLogWriterFlushOnClose(t *testing.T) {
+    log := ps.NewMemoryLog()
+    eventChan := NewReliableEventChannel()
+    dispatcher := func(event hsm.Event) {
+        eventChan.Send(event)
+    }
+    logger := logging.GetLogger("test")
+    writer := NewLogWriter(log, dispatcher, time.Second, logger)
+    entries := getTestLogWriterEntries(3)
+    for _, entry := range entries {
+        writer.Write(entry)
+    }
+    // the queued entries are stored rather than dropped on close
+    writer.Close()
+    lastIndex, err := log.LastIndex()
+    require.Nil(t, err)
+    assert.Equal(t, uint64(len(entries)), lastIndex)
+    for _, entry := range entries {
+        event := eventChan.Recv()
+        require.Equal(t, ev.EventAppendEntriesResponse, event.Type())
+        e, ok := event.(*ev.AppendEntriesResponseEvent)
+        require.True(t, ok)
+        assert.Equal(t, entry.Index, e.Response.LastLogIndex)
+    }
+    eventChan.Close()
+}
+
+func TestLogWriterCloseTimeout(t *testing.T) {
+    log := &blockingLog{
+        Log:         ps.NewMemoryLog(),
+        releaseChan: make(chan interface{}),
+    }
+    eventChan := NewReliableEventChannel()
+    dispatcher := func(event hsm.Event) {
+        eventChan.Send(event)
+    }
+    logger := logging.GetLogger("test")
+    timeout := time.Millisecond * 50
+    writer := NewLogWriter(log, dispatcher, timeout, logger)
+    for _, entry := range getTestLogWriterEntries(3) {
+        writer.Write(entry)
+    }
+    // it gives up waiting for the blocked log
+    startTime := time.Now()
+    writer.Close()
+    assert.True(t, time.Now().Sub(startTime) < timeout*10)
+    // the entry being stored is the last one
+    close(log.releaseChan)
+    writer.group.Wait()
+    lastIndex, err := log.LastIndex()
+    require.Nil(t, err)
+    assert.Equal(t, uint64(1), lastIndex)
+    assert.Equal(t, 0, eventChan.Len())
+    eventChan.Close()
+}
+
 func TestMin(t *testing.T) {
     v1 := uint64(5)
     v2 := uint64(6)